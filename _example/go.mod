@@ -4,4 +4,7 @@ go 1.12
 
 replace github.com/zorion79/ksmglog => ../
 
-require github.com/zorion79/ksmglog v0.0.0-00010101000000-000000000000 // indirect
+require (
+	github.com/go-pkgz/lgr v0.6.3
+	github.com/zorion79/ksmglog v0.0.0-00010101000000-000000000000
+)
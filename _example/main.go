@@ -9,6 +9,7 @@ import (
 
 	log "github.com/go-pkgz/lgr"
 	"github.com/zorion79/ksmglog"
+	"github.com/zorion79/ksmglog/console"
 )
 
 func main() {
@@ -23,6 +24,7 @@ func main() {
 		URL:      ksmgUrl,
 		User:     os.Getenv("EXMPL_KSMG_USER"),
 		Password: os.Getenv("EXMPL_KSMG_PASS"),
+		Logger:   ksmglog.NewLgrLogger(log.Default()),
 	}
 
 	service := ksmglog.NewService(options)
@@ -32,7 +34,12 @@ func main() {
 	}
 
 	log.Printf("count of record=%d", len(records))
-	log.Printf("first record\n%+v", records[0])
+	printer := console.NewPrinter(os.Stdout, console.Opts{Color: true})
+	for _, r := range records {
+		if err = printer.Print(*r); err != nil {
+			log.Fatalf("could not print record: %v", err)
+		}
+	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	go func() { // catch signal and invoke graceful termination
@@ -44,20 +51,10 @@ func main() {
 	}()
 	go service.Run(ctx)
 
-	newLogChan := service.Channel()
-	count := 0
-	for {
-		select {
-		case record, ok := <-newLogChan:
-			if !ok {
-				log.Printf("[WARN] channel closed")
-				return
-			}
-			count++
-			if record.HashString == "" {
-				log.Printf("%d new %+v", count, record)
-			}
-			log.Printf("%d\t%+v", count, record)
+	for record := range service.Channel() {
+		if err = printer.Print(record); err != nil {
+			log.Printf("[WARN] %v", err)
 		}
 	}
+	log.Printf("[WARN] channel closed")
 }
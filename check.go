@@ -0,0 +1,202 @@
+package ksmglog
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Check is diagnostic of one server made by Service.Check. Steps run in order of Check* stages
+// and stop at the first failed one, Stage and Err are set then.
+type Check struct {
+	URL    string `json:"url"`
+	Server string `json:"server"`
+
+	Addresses   []string      `json:"addresses"`     // resolved addresses of server host
+	DNSTime     time.Duration `json:"dnsTime"`       // resolve time
+	TCPTime     time.Duration `json:"tcpTime"`       // connect time to the first address
+	TLS         *CertInfo     `json:"tls,omitempty"` // certificate of https server, nil for http
+	HTTPStatus  string        `json:"httpStatus"`    // status of plain GET of url
+	UserType    int           `json:"userType"`      // user type returned by login
+	TimeZone    string        `json:"timeZone"`      // server time zone
+	ServerTime  time.Time     `json:"serverTime"`    // server clock
+	ClockSkew   time.Duration `json:"clockSkew"`     // server clock minus local clock
+	JournalTime time.Duration `json:"journalTime"`   // time of journal query requests, without waiting for results
+	Records     int           `json:"records"`       // records returned by journal query
+
+	Stage string `json:"stage,omitempty"` // failed stage, empty if all passed
+	Err   error  `json:"-"`
+}
+
+// CertInfo describes server certificate
+type CertInfo struct {
+	Subject     string    `json:"subject"`
+	Issuer      string    `json:"issuer"`
+	DNSNames    []string  `json:"dnsNames"`
+	NotBefore   time.Time `json:"notBefore"`
+	NotAfter    time.Time `json:"notAfter"`
+	Version     string    `json:"version"`               // negotiated tls version
+	VerifyError string    `json:"verifyError,omitempty"` // empty if chain and host name verified with system roots
+}
+
+// Check stages
+const (
+	CheckDNS           = "dns"
+	CheckTCP           = "tcp"
+	CheckTLS           = "tls"
+	CheckHTTP          = "http"
+	CheckLogin         = "login"
+	CheckCurrentTime   = "current_time"
+	CheckJournalQuery  = "journal_query"
+	CheckJournalResult = "journal_result"
+)
+
+var tlsVersions = map[uint16]string{
+	tls.VersionTLS10: "TLS 1.0",
+	tls.VersionTLS11: "TLS 1.1",
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+// Check diagnoses connectivity and permissions of ksmg url step by step:
+// dns, tcp, tls certificate, http status, login, server clock and journal query
+func (s *Service) Check(ksmgURL string) (res Check) {
+	srv := s.server(ksmgURL)
+	res = Check{URL: ksmgURL, Server: srv.Name}
+	fail := func(stage string, err error) Check {
+		res.Stage, res.Err = stage, err
+		return res
+	}
+
+	u, err := url.Parse(ksmgURL)
+	if err != nil || u.Hostname() == "" {
+		return fail(CheckDNS, errors.Errorf("invalid url %q", ksmgURL))
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), srv.Timeout)
+	defer cancel()
+	start := time.Now()
+	if res.Addresses, err = net.DefaultResolver.LookupHost(ctx, u.Hostname()); err != nil {
+		return fail(CheckDNS, errors.Wrap(err, "could not resolve"))
+	}
+	res.DNSTime = time.Since(start)
+
+	start = time.Now()
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(res.Addresses[0], port), srv.Timeout)
+	if err != nil {
+		return fail(CheckTCP, errors.Wrap(err, "could not connect"))
+	}
+	res.TCPTime = time.Since(start)
+
+	if u.Scheme == "https" {
+		host := u.Hostname()
+		if srv.TLS.ServerName != "" {
+			host = srv.TLS.ServerName
+		}
+		res.TLS, err = certInfo(conn, host, srv.Timeout)
+		if err != nil {
+			return fail(CheckTLS, err)
+		}
+	} else if err = conn.Close(); err != nil {
+		return fail(CheckTCP, errors.Wrap(err, "could not close connection"))
+	}
+
+	req, _ := http.NewRequest("GET", ksmgURL, nil)
+	resp, err := srv.client.Do(req)
+	if err != nil {
+		return fail(CheckHTTP, errors.Wrap(err, "could not request"))
+	}
+	res.HTTPStatus = resp.Status
+	if err = resp.Body.Close(); err != nil {
+		return fail(CheckHTTP, errors.Wrap(err, "could not close body"))
+	}
+
+	userType, c2htoken, cookies, err := s.userLogin(ksmgURL)
+	if err != nil {
+		return fail(CheckLogin, errors.Wrap(err, "could not login"))
+	}
+	if c2htoken == "" {
+		return fail(CheckLogin, errors.New("no session token returned, check user and password"))
+	}
+	res.UserType = userType
+
+	_, actionID, cookies, err := s.getCurrentTime(ksmgURL, c2htoken, cookies)
+	if err != nil {
+		return fail(CheckCurrentTime, errors.Wrap(err, "could not get current time"))
+	}
+	time.Sleep(300 * time.Millisecond)
+	tz, serverTime, cookies, err := s.getCurrentTimeWithActionID(ksmgURL, c2htoken, actionID, cookies)
+	if err != nil {
+		return fail(CheckCurrentTime, errors.Wrap(err, "could not get current time for action id"))
+	}
+	res.TimeZone, res.ServerTime = tz, time.Unix(int64(serverTime), 0)
+	res.ClockSkew = time.Until(res.ServerTime).Round(time.Second)
+
+	start = time.Now()
+	actionID, err = s.eventLoggerJournalQuery(ksmgURL, c2htoken, srv.Filters, cookies)
+	if err != nil {
+		return fail(CheckJournalQuery, errors.Wrap(err, "could not get event logger action id"))
+	}
+	res.JournalTime = time.Since(start)
+
+	time.Sleep(2500 * time.Millisecond)
+
+	start = time.Now()
+	recs, err := s.eventLoggerJournalQueryWithActionID(ksmgURL, c2htoken, srv.Filters, actionID, cookies)
+	if err != nil {
+		return fail(CheckJournalResult, errors.Wrap(err, "could not get records"))
+	}
+	res.JournalTime += time.Since(start)
+	res.Records = len(recs)
+
+	return res
+}
+
+// certInfo makes tls handshake over conn and verifies server certificate, failed verification
+// is reported in CertInfo only, as service verifies certificates of servers with TLSOpts.Verify only
+func certInfo(conn net.Conn, host string, timeout time.Duration) (*CertInfo, error) {
+	tc := tls.Client(conn, &tls.Config{ServerName: host, InsecureSkipVerify: true}) //nolint:gosec
+	defer tc.Close()                                                                //nolint:errcheck
+	if err := tc.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, errors.Wrap(err, "could not set deadline")
+	}
+	if err := tc.Handshake(); err != nil {
+		return nil, errors.Wrap(err, "could not make tls handshake")
+	}
+
+	state := tc.ConnectionState()
+	if len(state.PeerCertificates) == 0 {
+		return nil, errors.New("no server certificate")
+	}
+	cert := state.PeerCertificates[0]
+	res := &CertInfo{
+		Subject:   cert.Subject.String(),
+		Issuer:    cert.Issuer.String(),
+		DNSNames:  cert.DNSNames,
+		NotBefore: cert.NotBefore,
+		NotAfter:  cert.NotAfter,
+		Version:   tlsVersions[state.Version],
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, c := range state.PeerCertificates[1:] {
+		intermediates.AddCert(c)
+	}
+	if _, err := cert.Verify(x509.VerifyOptions{DNSName: host, Intermediates: intermediates}); err != nil {
+		res.VerifyError = err.Error()
+	}
+	return res, nil
+}
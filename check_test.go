@@ -0,0 +1,56 @@
+package ksmglog
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestService_Check(t *testing.T) {
+	ht := httptest.NewTLSServer(journalHandler(t, []Record{{ID: 1}, {ID: 2}}, nil))
+	defer ht.Close()
+
+	svc := NewService(Opts{URL: []string{ht.URL}, Timeout: time.Second})
+	res := svc.Check(ht.URL)
+	assert.NoError(t, res.Err)
+	assert.Equal(t, "", res.Stage)
+	assert.Equal(t, "127.0.0.1", res.Server)
+	assert.Equal(t, []string{"127.0.0.1"}, res.Addresses)
+	assert.Equal(t, "200 OK", res.HTTPStatus)
+	if assert.NotNil(t, res.TLS) {
+		assert.Equal(t, "O=Acme Co", res.TLS.Subject)
+		assert.NotEmpty(t, res.TLS.VerifyError, "test certificate is not trusted")
+		assert.True(t, res.TLS.NotAfter.After(time.Now()))
+	}
+	assert.Equal(t, 1, res.UserType)
+	assert.Equal(t, "Europe/Moscow", res.TimeZone)
+	assert.True(t, res.ClockSkew < 2*time.Second && res.ClockSkew > -2*time.Second, "skew %v", res.ClockSkew)
+	assert.Equal(t, 2, res.Records)
+	assert.True(t, res.JournalTime > 0)
+}
+
+func TestService_CheckFailed(t *testing.T) {
+	ht := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer ht.Close()
+
+	svc := NewService(Opts{Timeout: time.Second})
+	res := svc.Check(ht.URL)
+	assert.Equal(t, CheckLogin, res.Stage)
+	assert.EqualError(t, res.Err, "could not login: could not request: 403 Forbidden")
+	assert.Equal(t, "403 Forbidden", res.HTTPStatus)
+	assert.Nil(t, res.TLS)
+
+	res = svc.Check(strings.Replace(ht.URL, "127.0.0.1", "ksmg.invalid", 1))
+	assert.Equal(t, CheckDNS, res.Stage)
+
+	addr := ht.Listener.Addr().String()
+	ht.Close()
+	res = svc.Check("http://" + addr)
+	assert.Equal(t, CheckTCP, res.Stage)
+}
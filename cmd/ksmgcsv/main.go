@@ -0,0 +1,107 @@
+// ksmgcsv converts newline-delimited json records, like written by sink/file, to csv
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/pkg/errors"
+
+	"github.com/zorion79/ksmglog"
+	"github.com/zorion79/ksmglog/csvexport"
+)
+
+var opts struct {
+	csvexport.Opts
+	Output string `short:"o" long:"output" description:"output file, stdout if empty"`
+	Args   struct {
+		Files []string `positional-arg-name:"FILE" description:"ndjson files, gzipped if ends with .gz, stdin if none"`
+	} `positional-args:"yes"`
+}
+
+func main() {
+	if _, err := flags.Parse(&opts); err != nil {
+		if flagsErr, ok := err.(*flags.Error); ok && flagsErr.Type == flags.ErrHelp {
+			os.Exit(0)
+		}
+		os.Exit(2)
+	}
+
+	if err := run(); err != nil {
+		_, _ = os.Stderr.WriteString("ksmgcsv: " + err.Error() + "\n")
+		os.Exit(1)
+	}
+}
+
+func run() (err error) {
+	out := io.Writer(os.Stdout)
+	if opts.Output != "" {
+		f, e := os.Create(opts.Output)
+		if e != nil {
+			return errors.Wrap(e, "could not create output")
+		}
+		defer func() {
+			if e := f.Close(); err == nil {
+				err = e
+			}
+		}()
+		out = f
+	}
+
+	w, err := csvexport.NewWriter(out, opts.Opts)
+	if err != nil {
+		return err
+	}
+
+	files := opts.Args.Files
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	for _, name := range files {
+		if err = convert(w, name); err != nil {
+			return errors.Wrapf(err, "could not convert %s", name)
+		}
+	}
+	return w.Flush()
+}
+
+func convert(w *csvexport.Writer, name string) error {
+	in := io.Reader(os.Stdin)
+	if name != "-" {
+		f, err := os.Open(name) //nolint:gosec
+		if err != nil {
+			return err
+		}
+		defer f.Close() //nolint:errcheck
+		in = f
+	}
+	if strings.HasSuffix(name, ".gz") {
+		zr, err := gzip.NewReader(in)
+		if err != nil {
+			return err
+		}
+		defer zr.Close() //nolint:errcheck
+		in = zr
+	}
+
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(strings.TrimSpace(scanner.Text())) == 0 {
+			continue
+		}
+		r := ksmglog.Record{}
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return errors.Wrapf(err, "line %d", line)
+		}
+		if err := w.Write(r); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/zorion79/ksmglog"
+)
+
+// checkCommand diagnoses connectivity and permissions of all servers,
+// exit code follows monitoring plugins convention
+type checkCommand struct {
+	CertWarn time.Duration `long:"cert-warn" default:"720h" description:"warn if certificate expires within this time"`
+	MaxSkew  time.Duration `long:"max-skew" default:"1m" description:"warn if server clock differs more than this"`
+	JSON     bool          `long:"json" description:"print results as json"`
+
+	ksmg *ksmglog.Opts
+	out  io.Writer
+}
+
+// check statuses, used as exit codes
+const (
+	statusOK = iota
+	statusWarning
+	statusCritical
+	statusUnknown
+)
+
+var statusNames = []string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+// exitError terminates command with exit code
+type exitError struct {
+	code int
+	msg  string
+}
+
+func (e exitError) Error() string { return e.msg }
+
+// checkReport is result of one server
+type checkReport struct {
+	ksmglog.Check
+	Status   string   `json:"status"`
+	Problems []string `json:"problems,omitempty"`
+	Error    string   `json:"error,omitempty"`
+
+	status int
+}
+
+// Execute checks all servers in parallel and prints reports in order of urls
+func (c *checkCommand) Execute(_ []string) error {
+	service := ksmglog.NewService(*c.ksmg)
+	servers := service.Servers()
+	if len(servers) == 0 {
+		return exitError{code: statusUnknown, msg: "no ksmg urls"}
+	}
+
+	reports := make([]checkReport, len(servers))
+	wg := sync.WaitGroup{}
+	for i, srv := range servers {
+		wg.Add(1)
+		go func(i int, u string) {
+			defer wg.Done()
+			reports[i] = c.evaluate(service.Check(u), time.Now())
+		}(i, srv.URL)
+	}
+	wg.Wait()
+
+	status := statusOK
+	for _, r := range reports {
+		if r.status > status {
+			status = r.status
+		}
+	}
+
+	if err := c.print(reports); err != nil {
+		return exitError{code: statusUnknown, msg: err.Error()}
+	}
+	if status != statusOK {
+		return exitError{code: status, msg: fmt.Sprintf("check %s", statusNames[status])}
+	}
+	return nil
+}
+
+// evaluate sets status of check, failed stage is critical, expiring certificate and clock skew are warnings
+func (c *checkCommand) evaluate(ch ksmglog.Check, now time.Time) checkReport {
+	res := checkReport{Check: ch}
+	if ch.Err != nil {
+		res.status, res.Error = statusCritical, ch.Err.Error()
+		res.Problems = append(res.Problems, ch.Stage+": "+ch.Err.Error())
+	}
+
+	if ch.TLS != nil {
+		if left := ch.TLS.NotAfter.Sub(now); left < c.CertWarn {
+			res.Problems = append(res.Problems, fmt.Sprintf("certificate expires in %s", days(left)))
+			if res.status < statusWarning {
+				res.status = statusWarning
+			}
+		}
+	}
+
+	skew := ch.ClockSkew
+	if skew < 0 {
+		skew = -skew
+	}
+	if !ch.ServerTime.IsZero() && skew > c.MaxSkew {
+		res.Problems = append(res.Problems, fmt.Sprintf("clock skew %v", ch.ClockSkew))
+		if res.status < statusWarning {
+			res.status = statusWarning
+		}
+	}
+
+	res.Status = statusNames[res.status]
+	return res
+}
+
+func (c *checkCommand) print(reports []checkReport) error {
+	if c.JSON {
+		enc := json.NewEncoder(c.out)
+		enc.SetIndent("", "  ")
+		return errors.Wrap(enc.Encode(reports), "could not encode reports")
+	}
+
+	buf := strings.Builder{}
+	for _, r := range reports {
+		fmt.Fprintf(&buf, "%s %s %s\n", r.Status, r.Server, r.URL)
+		line := func(stage, format string, args ...interface{}) {
+			fmt.Fprintf(&buf, "  %-8s %s\n", stage, fmt.Sprintf(format, args...))
+		}
+		if len(r.Addresses) > 0 {
+			line("dns", "%s in %v", strings.Join(r.Addresses, ", "), r.DNSTime.Round(time.Millisecond))
+		}
+		if r.TCPTime > 0 {
+			line("tcp", "connected in %v", r.TCPTime.Round(time.Millisecond))
+		}
+		if t := r.TLS; t != nil {
+			verified := "verified"
+			if t.VerifyError != "" {
+				verified = "not verified: " + t.VerifyError
+			}
+			line("tls", "%s, subject %s, issuer %s, expires %s, %s", t.Version, t.Subject, t.Issuer,
+				t.NotAfter.Format("2006-01-02"), verified)
+		}
+		if r.HTTPStatus != "" {
+			line("http", "%s", r.HTTPStatus)
+		}
+		if passed(r.Check, ksmglog.CheckLogin) {
+			line("login", "user type %d", r.UserType)
+		}
+		if !r.ServerTime.IsZero() {
+			line("clock", "%s %s, skew %v", r.ServerTime.Format("2006-01-02 15:04:05"), r.TimeZone, r.ClockSkew)
+		}
+		if r.Stage == "" {
+			line("journal", "%d records in %v", r.Records, r.JournalTime.Round(time.Millisecond))
+		}
+		for _, p := range r.Problems {
+			line("problem", "%s", p)
+		}
+	}
+	_, err := io.WriteString(c.out, buf.String())
+	return errors.Wrap(err, "could not print reports")
+}
+
+// checkStages lists stages in order of Service.Check
+var checkStages = []string{ksmglog.CheckDNS, ksmglog.CheckTCP, ksmglog.CheckTLS, ksmglog.CheckHTTP, ksmglog.CheckLogin,
+	ksmglog.CheckCurrentTime, ksmglog.CheckJournalQuery, ksmglog.CheckJournalResult}
+
+// passed checks if stage was done before failed one
+func passed(ch ksmglog.Check, stage string) bool {
+	if ch.Stage == "" {
+		return true
+	}
+	for _, s := range checkStages {
+		switch s {
+		case ch.Stage:
+			return false
+		case stage:
+			return true
+		}
+	}
+	return false
+}
+
+// days formats duration as number of days
+func days(d time.Duration) string {
+	return fmt.Sprintf("%d days", int(d.Hours()/24))
+}
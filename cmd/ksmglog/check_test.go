@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/zorion79/ksmglog"
+)
+
+func TestCheckCommand_Evaluate(t *testing.T) {
+	now := time.Date(2019, 6, 10, 12, 0, 0, 0, time.UTC)
+	c := checkCommand{CertWarn: 30 * 24 * time.Hour, MaxSkew: time.Minute}
+	ok := ksmglog.Check{
+		Server:     "ksmg01",
+		TLS:        &ksmglog.CertInfo{NotAfter: now.AddDate(1, 0, 0)},
+		ServerTime: now,
+		ClockSkew:  time.Second,
+	}
+
+	r := c.evaluate(ok, now)
+	assert.Equal(t, statusOK, r.status)
+	assert.Equal(t, "OK", r.Status)
+	assert.Empty(t, r.Problems)
+
+	warn := ok
+	warn.TLS = &ksmglog.CertInfo{NotAfter: now.AddDate(0, 0, 10)}
+	warn.ClockSkew = -2 * time.Minute
+	r = c.evaluate(warn, now)
+	assert.Equal(t, statusWarning, r.status)
+	assert.Equal(t, []string{"certificate expires in 10 days", "clock skew -2m0s"}, r.Problems)
+
+	failed := warn
+	failed.Stage, failed.Err = ksmglog.CheckLogin, errors.New("could not login")
+	r = c.evaluate(failed, now)
+	assert.Equal(t, statusCritical, r.status)
+	assert.Equal(t, "CRITICAL", r.Status)
+	assert.Equal(t, "login: could not login", r.Problems[0])
+}
+
+func TestCheckCommand_Print(t *testing.T) {
+	now := time.Date(2019, 6, 10, 12, 0, 0, 0, time.UTC)
+	buf := bytes.Buffer{}
+	c := checkCommand{CertWarn: time.Hour, MaxSkew: time.Minute, out: &buf}
+
+	ch := ksmglog.Check{Server: "ksmg01", URL: "https://ksmg01/klwi", Addresses: []string{"10.0.0.1"},
+		DNSTime: time.Millisecond, TCPTime: 2 * time.Millisecond, HTTPStatus: "200 OK", UserType: 1,
+		TLS:   &ksmglog.CertInfo{Version: "TLS 1.2", Subject: "CN=ksmg01", Issuer: "CN=ca", NotAfter: now.AddDate(1, 0, 0)},
+		Stage: ksmglog.CheckJournalQuery, Err: errors.New("timeout"),
+	}
+	require.NoError(t, c.print([]checkReport{c.evaluate(ch, now)}))
+	assert.Equal(t, "CRITICAL ksmg01 https://ksmg01/klwi\n"+
+		"  dns      10.0.0.1 in 1ms\n"+
+		"  tcp      connected in 2ms\n"+
+		"  tls      TLS 1.2, subject CN=ksmg01, issuer CN=ca, expires 2020-06-10, verified\n"+
+		"  http     200 OK\n"+
+		"  login    user type 1\n"+
+		"  problem  journal_query: timeout\n", buf.String())
+
+	buf.Reset()
+	c.JSON = true
+	require.NoError(t, c.print([]checkReport{c.evaluate(ch, now)}))
+	assert.Contains(t, buf.String(), `"status": "CRITICAL"`)
+	assert.Contains(t, buf.String(), `"error": "timeout"`)
+}
+
+func TestPassed(t *testing.T) {
+	assert.True(t, passed(ksmglog.Check{}, ksmglog.CheckLogin))
+	assert.True(t, passed(ksmglog.Check{Stage: ksmglog.CheckJournalQuery}, ksmglog.CheckLogin))
+	assert.False(t, passed(ksmglog.Check{Stage: ksmglog.CheckLogin}, ksmglog.CheckLogin))
+	assert.False(t, passed(ksmglog.Check{Stage: ksmglog.CheckTCP}, ksmglog.CheckLogin))
+}
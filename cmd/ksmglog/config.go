@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+
+	"github.com/zorion79/ksmglog"
+)
+
+// config is yaml configuration file. Keys are long names of command line options nested by namespace,
+// like `loki: {url: http://loki:3100}`, besides servers and routes sections. Values of options become
+// their defaults, so environment variables and command line flags override the file.
+type config struct {
+	file    string
+	parser  *flags.Parser
+	values  []configValue
+	servers []ksmglog.Server
+	routes  []routeConfig
+}
+
+// configValue is value of command line option set in file
+type configValue struct {
+	name   string // long name with namespace
+	values []string
+	line   int
+}
+
+// serverConfig is item of servers section
+type serverConfig struct {
+	Name         string        `yaml:"name"`
+	URL          string        `yaml:"url"`
+	User         string        `yaml:"user"`
+	Password     string        `yaml:"password"`
+	Timeout      time.Duration `yaml:"timeout"`
+	PollInterval time.Duration `yaml:"poll-interval"`
+	Filters      string        `yaml:"filters"`
+	TLS          struct {
+		Verify     bool   `yaml:"verify"`
+		CACert     string `yaml:"ca-cert"`
+		ServerName string `yaml:"server-name"`
+	} `yaml:"tls"`
+}
+
+// routeConfig is item of routes section, it sends records matched by all filters to one of enabled sinks
+type routeConfig struct {
+	Name          string        `yaml:"name"`
+	Sink          string        `yaml:"sink"`
+	Match         []string      `yaml:"match"` // filters like tail --filter
+	BatchSize     int           `yaml:"batch-size"`
+	FlushInterval time.Duration `yaml:"flush-interval"`
+	QueueSize     int           `yaml:"queue-size"`
+
+	pos string // file and line of route
+}
+
+// configFile finds config file name in args or environment before options are parsed
+func configFile(args []string) string {
+	var pre struct {
+		Config string `short:"c" long:"config" env:"CONFIG"`
+	}
+	_, _ = flags.NewParser(&pre, flags.IgnoreUnknown).ParseArgs(args)
+	return pre.Config
+}
+
+// loadConfig reads and validates config file, options are looked up in parser
+func loadConfig(file string, p *flags.Parser) (*config, error) {
+	data, err := ioutil.ReadFile(file) //nolint:gosec
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read config")
+	}
+
+	doc := yaml.Node{}
+	if err = yaml.Unmarshal(data, &doc); err != nil {
+		return nil, errors.Wrapf(err, "could not parse config %s", file)
+	}
+
+	res := &config{file: file, parser: p}
+	if len(doc.Content) == 0 {
+		return res, nil
+	}
+	if err = res.walk(doc.Content[0], ""); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+// apply sets values from file as defaults of parser options
+func (c *config) apply() {
+	for _, v := range c.values {
+		if opt := c.parser.FindOptionByLongName(v.name); opt != nil {
+			opt.Default = v.values
+		}
+	}
+}
+
+// explain adds file and line to error of option value set in file
+func (c *config) explain(err error) error {
+	flagsErr, ok := err.(*flags.Error)
+	if !ok || (flagsErr.Type != flags.ErrMarshal && flagsErr.Type != flags.ErrInvalidChoice) {
+		return err
+	}
+	for _, v := range c.values {
+		if !strings.Contains(flagsErr.Message, "`--"+v.name+"'") {
+			continue
+		}
+		if opt := c.parser.FindOptionByLongName(v.name); opt != nil {
+			if _, ok := os.LookupEnv(opt.EnvKeyWithNamespace()); ok {
+				return err // value of environment is wrong
+			}
+		}
+		return c.errorf(v.line, "%s", flagsErr.Message)
+	}
+	return err
+}
+
+func (c *config) errorf(line int, format string, args ...interface{}) error {
+	return errors.Errorf("%s:%d: %s", c.file, line, fmt.Sprintf(format, args...))
+}
+
+// walk collects option values of mapping node, nested mappings are namespaces
+func (c *config) walk(node *yaml.Node, prefix string) error {
+	if node.Kind != yaml.MappingNode {
+		return c.errorf(node.Line, "mapping expected")
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		name := prefix + key.Value
+
+		switch name {
+		case "servers":
+			if err := c.parseServers(value); err != nil {
+				return err
+			}
+			continue
+		case "routes":
+			if err := c.parseRoutes(value); err != nil {
+				return err
+			}
+			continue
+		case "config":
+			return c.errorf(key.Line, "config can't be set in config file")
+		}
+
+		opt := c.parser.FindOptionByLongName(name)
+		if opt == nil {
+			if value.Kind == yaml.MappingNode {
+				if err := c.walk(value, name+"."); err != nil {
+					return err
+				}
+				continue
+			}
+			return c.errorf(key.Line, "unknown option %s", name)
+		}
+
+		values, err := c.optionValues(value, reflect.TypeOf(opt.Value()).Kind() == reflect.Map)
+		if err != nil {
+			return c.errorf(value.Line, "option %s: %v", name, err)
+		}
+		c.values = append(c.values, configValue{name: name, values: values, line: value.Line})
+	}
+	return nil
+}
+
+// optionValues converts scalar, list of scalars or mapping for map option to option values
+func (c *config) optionValues(node *yaml.Node, isMap bool) ([]string, error) {
+	switch {
+	case node.Kind == yaml.ScalarNode:
+		return []string{node.Value}, nil
+	case node.Kind == yaml.SequenceNode:
+		res := []string{}
+		for _, item := range node.Content {
+			if item.Kind != yaml.ScalarNode {
+				return nil, errors.New("list of values expected")
+			}
+			res = append(res, item.Value)
+		}
+		return res, nil
+	case node.Kind == yaml.MappingNode && isMap:
+		res := []string{}
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			if node.Content[i+1].Kind != yaml.ScalarNode {
+				return nil, errors.New("mapping of values expected")
+			}
+			res = append(res, node.Content[i].Value+":"+node.Content[i+1].Value)
+		}
+		return res, nil
+	}
+	return nil, errors.New("value or list of values expected")
+}
+
+func (c *config) parseServers(node *yaml.Node) error {
+	if node.Kind != yaml.SequenceNode {
+		return c.errorf(node.Line, "servers must be a list")
+	}
+
+	names, urls := map[string]bool{}, map[string]bool{}
+	for _, item := range node.Content {
+		if err := c.checkKeys(item, serverConfig{}); err != nil {
+			return err
+		}
+		if tls := mappingValue(item, "tls"); tls != nil {
+			if err := c.checkKeys(tls, serverConfig{}.TLS); err != nil {
+				return err
+			}
+		}
+
+		sc := serverConfig{}
+		if err := item.Decode(&sc); err != nil {
+			return c.errorf(item.Line, "invalid server: %v", err)
+		}
+
+		u, err := url.Parse(sc.URL)
+		if sc.URL == "" || err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return c.errorf(item.Line, "server must have http or https url, got %q", sc.URL)
+		}
+		srv := ksmglog.Server{Name: sc.Name, URL: sc.URL, User: sc.User, Password: sc.Password, Timeout: sc.Timeout,
+			PollInterval: sc.PollInterval, Filters: sc.Filters,
+			TLS: ksmglog.TLSOpts{Verify: sc.TLS.Verify, CACert: sc.TLS.CACert, ServerName: sc.TLS.ServerName}}
+		if srv.Name == "" {
+			srv.Name = u.Hostname()
+		}
+
+		if names[srv.Name] {
+			return c.errorf(item.Line, "duplicate server name %s", srv.Name)
+		}
+		if urls[srv.URL] {
+			return c.errorf(item.Line, "duplicate server url %s", srv.URL)
+		}
+		names[srv.Name], urls[srv.URL] = true, true
+
+		if srv.Filters != "" && !json.Valid([]byte(srv.Filters)) {
+			return c.errorf(item.Line, "server %s has invalid filters json", srv.Name)
+		}
+		if srv.TLS.CACert != "" {
+			if _, err := os.Stat(srv.TLS.CACert); err != nil {
+				return c.errorf(item.Line, "server %s: %v", srv.Name, err)
+			}
+		}
+		c.servers = append(c.servers, srv)
+	}
+	return nil
+}
+
+func (c *config) parseRoutes(node *yaml.Node) error {
+	if node.Kind != yaml.SequenceNode {
+		return c.errorf(node.Line, "routes must be a list")
+	}
+
+	names := map[string]bool{}
+	for _, item := range node.Content {
+		if err := c.checkKeys(item, routeConfig{}); err != nil {
+			return err
+		}
+		rc := routeConfig{pos: fmt.Sprintf("%s:%d", c.file, item.Line)}
+		if err := item.Decode(&rc); err != nil {
+			return c.errorf(item.Line, "invalid route: %v", err)
+		}
+
+		if rc.Name == "" || rc.Sink == "" {
+			return c.errorf(item.Line, "route must have name and sink")
+		}
+		if names[rc.Name] {
+			return c.errorf(item.Line, "duplicate route %s", rc.Name)
+		}
+		names[rc.Name] = true
+
+		for _, m := range rc.Match {
+			cond, err := parseFilter(m)
+			if err != nil {
+				return c.errorf(item.Line, "route %s: %v", rc.Name, err)
+			}
+			if cond.Op == ksmglog.OpRegex {
+				if _, err = regexp.Compile(cond.Value); err != nil {
+					return c.errorf(item.Line, "route %s: %v", rc.Name, err)
+				}
+			}
+		}
+		c.routes = append(c.routes, rc)
+	}
+	return nil
+}
+
+// checkKeys reports keys of mapping node not known as yaml tags of struct v
+func (c *config) checkKeys(node *yaml.Node, v interface{}) error {
+	if node.Kind != yaml.MappingNode {
+		return c.errorf(node.Line, "mapping expected")
+	}
+
+	known := map[string]bool{}
+	t := reflect.TypeOf(v)
+	for i := 0; i < t.NumField(); i++ {
+		if tag := t.Field(i).Tag.Get("yaml"); tag != "" {
+			known[tag] = true
+		}
+	}
+	for i := 0; i < len(node.Content); i += 2 {
+		if key := node.Content[i]; !known[key.Value] {
+			return c.errorf(key.Line, "unknown key %s", key.Value)
+		}
+	}
+	return nil
+}
+
+// mappingValue returns value node of key, nil if not found
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
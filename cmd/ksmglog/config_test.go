@@ -0,0 +1,129 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jessevdk/go-flags"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/zorion79/ksmglog"
+)
+
+func TestLoadConfig(t *testing.T) {
+	file := writeConfig(t, `
+ksmg:
+  admin-user: admin
+  sleep-time: 30s
+sink: [file, loki]
+file:
+  dir: /var/lib/ksmglog
+  max-files: 10
+loki:
+  url: http://loki:3100
+  label: {env: prod}
+servers:
+  - name: ksmg01
+    url: https://ksmg01/ksmg/en-US/cgi-bin/klwi
+    password: secret
+    poll-interval: 1m
+    tls:
+      verify: true
+  - url: https://ksmg02/ksmg/en-US/cgi-bin/klwi
+routes:
+  - name: alerts
+    sink: loki
+    match: ["result=Infected,Spam"]
+    batch-size: 1
+`)
+	defer os.RemoveAll(filepath.Dir(file))
+	require.NoError(t, os.Setenv("FILE_MAX_FILES", "5"))
+	defer os.Unsetenv("FILE_MAX_FILES")
+
+	var opts options
+	p := flags.NewParser(&opts, flags.HelpFlag)
+	cfg, err := loadConfig(file, p)
+	require.NoError(t, err)
+	cfg.apply()
+	_, err = p.ParseArgs([]string{"--file.dir=/tmp"})
+	require.NoError(t, err)
+
+	assert.Equal(t, "admin", opts.KSMG.User)
+	assert.Equal(t, 30*time.Second, opts.KSMG.SleepTime)
+	assert.Equal(t, []string{"file", "loki"}, opts.Sinks)
+	assert.Equal(t, "/tmp", opts.File.Dir, "flag overrides config")
+	assert.Equal(t, 5, opts.File.MaxFiles, "env overrides config")
+	assert.Equal(t, "http://loki:3100", opts.Loki.URL)
+	assert.Equal(t, map[string]string{"env": "prod"}, opts.Loki.Labels)
+	assert.Equal(t, 5*time.Second, opts.KSMG.Timeout, "default kept")
+
+	assert.Equal(t, []ksmglog.Server{
+		{Name: "ksmg01", URL: "https://ksmg01/ksmg/en-US/cgi-bin/klwi", Password: "secret", PollInterval: time.Minute,
+			TLS: ksmglog.TLSOpts{Verify: true}},
+		{Name: "ksmg02", URL: "https://ksmg02/ksmg/en-US/cgi-bin/klwi"},
+	}, cfg.servers)
+	require.Equal(t, 1, len(cfg.routes))
+	assert.Equal(t, "loki", cfg.routes[0].Sink)
+	assert.Equal(t, []string{"result=Infected,Spam"}, cfg.routes[0].Match)
+	assert.Equal(t, file+":21", cfg.routes[0].pos)
+}
+
+func TestLoadConfig_Errors(t *testing.T) {
+	tbl := []struct {
+		yml string
+		err string
+	}{
+		{"loki:\n  bogus: 1\n", ":2: unknown option loki.bogus"},
+		{"sink:\n  a: b\n", ":2: option sink: value or list of values expected"},
+		{"servers:\n  - name: a\n", ":2: server must have http or https url, got \"\""},
+		{"servers:\n  - url: http://a\n  - url: http://a\n", ":3: duplicate server name a"},
+		{"servers:\n  - url: http://a\n    pass: x\n", ":3: unknown key pass"},
+		{"servers:\n  - url: http://a\n    filters: '{bad'\n", ":2: server a has invalid filters json"},
+		{"routes:\n  - name: r\n", ":2: route must have name and sink"},
+		{"routes:\n  - name: r\n    sink: file\n    match: [result]\n", `:2: route r: invalid filter "result", expected field, operator and value`},
+		{"routes:\n  - name: r\n    sink: file\n    match: ['subject=~(']\n", ":2: route r: error parsing regexp"},
+		{"config: x.yml\n", ":1: config can't be set in config file"},
+	}
+
+	for _, tt := range tbl {
+		file := writeConfig(t, tt.yml)
+		var opts options
+		_, err := loadConfig(file, flags.NewParser(&opts, flags.HelpFlag))
+		require.Error(t, err, tt.yml)
+		assert.Contains(t, err.Error(), file+tt.err)
+		os.RemoveAll(filepath.Dir(file))
+	}
+}
+
+func TestConfig_Explain(t *testing.T) {
+	file := writeConfig(t, "loki:\n  max-retries: many\n")
+	defer os.RemoveAll(filepath.Dir(file))
+
+	var opts options
+	p := flags.NewParser(&opts, flags.HelpFlag)
+	cfg, err := loadConfig(file, p)
+	require.NoError(t, err)
+	cfg.apply()
+	_, err = p.ParseArgs(nil)
+	require.Error(t, err)
+	assert.EqualError(t, cfg.explain(err), file+":2: invalid argument for flag `--loki.max-retries' (expected int): "+
+		`strconv.ParseInt: parsing "many": invalid syntax`)
+}
+
+func TestConfigFile(t *testing.T) {
+	assert.Equal(t, "a.yml", configFile([]string{"--sink=file", "-c", "a.yml", "tail", "--no-color"}))
+	assert.Equal(t, "b.yml", configFile([]string{"--config=b.yml"}))
+	assert.Equal(t, "", configFile([]string{"query"}))
+}
+
+func writeConfig(t *testing.T, yml string) string {
+	dir, err := ioutil.TempDir("", "ksmglog-config")
+	require.NoError(t, err)
+	file := filepath.Join(dir, "ksmglog.yml")
+	require.NoError(t, ioutil.WriteFile(file, []byte(yml), 0600))
+	return file
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/zorion79/ksmglog"
+	"github.com/zorion79/ksmglog/secret"
+)
+
+// keystoreCommand manages encrypted keystore of passwords referenced as keystore:name
+type keystoreCommand struct {
+	Args struct {
+		Action string `positional-arg-name:"action" choice:"set" choice:"delete" choice:"list" required:"true"`
+		Name   string `positional-arg-name:"name" description:"secret name, value of set is read from stdin"`
+	} `positional-args:"true"`
+
+	ksmg *ksmglog.Opts
+	in   io.Reader
+	out  io.Writer
+}
+
+// Execute runs action on keystore of ksmg options
+func (c *keystoreCommand) Execute(_ []string) error {
+	if c.ksmg.Keystore == "" {
+		return errors.New("keystore is not set, use --ksmg.keystore")
+	}
+	ks := secret.Keystore{Path: c.ksmg.Keystore, Passphrase: secret.Parse(c.ksmg.KeystorePass, secret.Keystore{})}
+
+	if c.Args.Action == "list" {
+		names, err := ks.Names()
+		if err != nil {
+			return err
+		}
+		for _, name := range names {
+			if _, err = fmt.Fprintln(c.out, name); err != nil {
+				return errors.Wrap(err, "could not print")
+			}
+		}
+		return nil
+	}
+
+	if c.Args.Name == "" {
+		return errors.Errorf("name of secret required for %s", c.Args.Action)
+	}
+	if c.Args.Action == "delete" {
+		return ks.Delete(c.Args.Name)
+	}
+
+	value, err := bufio.NewReader(c.in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return errors.Wrap(err, "could not read secret")
+	}
+	if value = strings.TrimRight(value, "\r\n"); value == "" {
+		return errors.New("empty secret")
+	}
+	return ks.Set(c.Args.Name, value)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/zorion79/ksmglog"
+	"github.com/zorion79/ksmglog/secret"
+)
+
+func TestKeystoreCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ksmglog-cmd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := ksmglog.Opts{Keystore: filepath.Join(dir, "keystore"), KeystorePass: "master"}
+	run := func(action, name, in string) (string, error) {
+		out := bytes.Buffer{}
+		c := keystoreCommand{ksmg: &opts, in: strings.NewReader(in), out: &out}
+		c.Args.Action, c.Args.Name = action, name
+		err := c.Execute(nil)
+		return out.String(), err
+	}
+
+	_, err = run("set", "admin", "passw0rd\n")
+	require.NoError(t, err)
+	_, err = run("set", "collector", "other")
+	require.NoError(t, err)
+	out, err := run("list", "", "")
+	require.NoError(t, err)
+	assert.Equal(t, "admin\ncollector\n", out)
+
+	v, err := secret.Parse("keystore:admin", secret.Keystore{Path: opts.Keystore, Passphrase: secret.Static("master")}).Secret()
+	require.NoError(t, err)
+	assert.Equal(t, "passw0rd", v)
+
+	_, err = run("delete", "collector", "")
+	require.NoError(t, err)
+	out, err = run("list", "", "")
+	require.NoError(t, err)
+	assert.Equal(t, "admin\n", out)
+
+	_, err = run("set", "admin", "\n")
+	assert.EqualError(t, err, "empty secret")
+	_, err = run("delete", "", "")
+	assert.EqualError(t, err, "name of secret required for delete")
+	opts.Keystore = ""
+	_, err = run("list", "", "")
+	assert.EqualError(t, err, "keystore is not set, use --ksmg.keystore")
+}
@@ -0,0 +1,266 @@
+// ksmglog collects mail journal of KSMG servers and delivers new records to configured sinks
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/jessevdk/go-flags"
+	_ "github.com/lib/pq" // postgres driver of sqldb sink
+	"github.com/pkg/errors"
+	_ "modernc.org/sqlite" // sqlite driver of sqldb sink, pure go
+
+	"github.com/zorion79/ksmglog"
+	"github.com/zorion79/ksmglog/notify/chat"
+	"github.com/zorion79/ksmglog/notify/digest"
+	"github.com/zorion79/ksmglog/sink/file"
+	"github.com/zorion79/ksmglog/sink/kafka"
+	"github.com/zorion79/ksmglog/sink/loki"
+	"github.com/zorion79/ksmglog/sink/otlp"
+	"github.com/zorion79/ksmglog/sink/parquet"
+	"github.com/zorion79/ksmglog/sink/splunk"
+	"github.com/zorion79/ksmglog/sink/sqldb"
+	"github.com/zorion79/ksmglog/sink/webhook"
+	"github.com/zorion79/ksmglog/spool"
+)
+
+type options struct {
+	Config          string        `short:"c" long:"config" env:"CONFIG" description:"yaml config file, environment and flags override it"`
+	ConfigWatch     time.Duration `long:"config-watch" env:"CONFIG_WATCH" default:"10s" description:"interval of config file change check, disabled if 0"`
+	KSMG            ksmglog.Opts  `group:"ksmg" namespace:"ksmg" env-namespace:"KSMG"`
+	Sinks           []string      `long:"sink" env:"SINKS" env-delim:"," description:"enabled sinks: splunk, loki, kafka, otlp, file, webhook, parquet, sqldb, chat, digest"`
+	Listen          string        `long:"listen" env:"LISTEN" description:"address of /metrics endpoint like :8080, disabled if empty"`
+	ShutdownTimeout time.Duration `long:"shutdown-timeout" env:"SHUTDOWN_TIMEOUT" default:"10s" description:"max time to flush sinks on termination"`
+	Spool           spool.Opts    `group:"spool" namespace:"spool" env-namespace:"SPOOL" description:"on-disk buffer per route, enabled with dir"`
+
+	Splunk  splunk.Opts  `group:"splunk" namespace:"splunk" env-namespace:"SPLUNK"`
+	Loki    loki.Opts    `group:"loki" namespace:"loki" env-namespace:"LOKI"`
+	Kafka   kafka.Opts   `group:"kafka" namespace:"kafka" env-namespace:"KAFKA"`
+	OTLP    otlp.Opts    `group:"otlp" namespace:"otlp" env-namespace:"OTLP"`
+	File    file.Opts    `group:"file" namespace:"file" env-namespace:"FILE"`
+	Webhook webhook.Opts `group:"webhook" namespace:"webhook" env-namespace:"WEBHOOK"`
+	Parquet parquet.Opts `group:"parquet" namespace:"parquet" env-namespace:"PARQUET"`
+	SQLDB   sqldb.Opts   `group:"sqldb" namespace:"sqldb" env-namespace:"SQLDB"`
+	Chat    chat.Opts    `group:"chat" namespace:"chat" env-namespace:"CHAT"`
+	Digest  digest.Opts  `group:"digest" namespace:"digest" env-namespace:"DIGEST"`
+
+	Dbg     bool `long:"dbg" env:"DEBUG" description:"debug mode"`
+	Version bool `short:"V" long:"version" description:"show version and exit"`
+
+	routes    []routeConfig               // from config file, route per sink if empty
+	delivered func(ksmglog.Record, error) // delivery reports of sinks supporting them, set by run
+}
+
+var revision = "unknown"
+
+func main() {
+	err := parseOptions(os.Args[1:], func(opts options, cmd flags.Commander, args []string) error {
+		if opts.Version {
+			fmt.Printf("ksmglog %s\n", revision)
+			return nil
+		}
+		if cmd != nil { // commands print results to stdout, so logs go to stderr
+			setupLog(opts.Dbg, log.Out(os.Stderr), log.Err(os.Stderr))
+			return cmd.Execute(args)
+		}
+
+		setupLog(opts.Dbg)
+		log.Printf("[INFO] ksmglog %s", revision)
+		return run(signalContext(), opts, func() (options, error) { return loadOptions(os.Args[1:]) })
+	})
+
+	if err != nil {
+		if flagsErr, ok := err.(*flags.Error); ok {
+			if flagsErr.Type == flags.ErrHelp {
+				fmt.Println(err)
+				os.Exit(0)
+			}
+			_, _ = os.Stderr.WriteString(err.Error() + "\n")
+			os.Exit(2)
+		}
+		_, _ = os.Stderr.WriteString("ksmglog: " + err.Error() + "\n")
+		if exitErr, ok := err.(exitError); ok {
+			os.Exit(exitErr.code)
+		}
+		os.Exit(1)
+	}
+}
+
+// parseOptions parses args over environment and config file, handler is called with options and command to run
+func parseOptions(args []string, handler func(opts options, cmd flags.Commander, args []string) error) error {
+	var opts options
+	p := flags.NewParser(&opts, flags.HelpFlag|flags.PassDoubleDash)
+	p.SubcommandsOptional = true
+	if _, err := p.AddCommand("query", "search journal", "Search journal of all servers and print merged records.",
+		&queryCommand{ksmg: &opts.KSMG, out: os.Stdout}); err != nil {
+		panic(err)
+	}
+	if _, err := p.AddCommand("check", "diagnose servers", "Check dns, tcp, tls, login, clock and journal of all servers. "+
+		"Exit code is 0 if all is ok, 1 on warnings, 2 on failures and 3 if check can't be done.",
+		&checkCommand{ksmg: &opts.KSMG, out: os.Stdout}); err != nil {
+		panic(err)
+	}
+	if _, err := p.AddCommand("tail", "follow new records", "Print new records of all servers as they arrive.",
+		&tailCommand{ksmg: &opts.KSMG, out: os.Stdout}); err != nil {
+		panic(err)
+	}
+	if _, err := p.AddCommand("keystore", "manage keystore", "Set, delete or list passwords of encrypted keystore "+
+		"referenced as keystore:name, value of set is read from stdin.",
+		&keystoreCommand{ksmg: &opts.KSMG, in: os.Stdin, out: os.Stdout}); err != nil {
+		panic(err)
+	}
+
+	var cfg *config
+	if file := configFile(args); file != "" {
+		var err error
+		if cfg, err = loadConfig(file, p); err != nil {
+			return err
+		}
+		cfg.apply()
+	}
+
+	p.CommandHandler = func(cmd flags.Commander, args []string) error {
+		opts.KSMG.Logger = ksmglog.NewLgrLogger(log.Func(log.Printf))
+		if cfg != nil {
+			opts.KSMG.Servers, opts.routes = cfg.servers, cfg.routes
+		}
+		return handler(opts, cmd, args)
+	}
+
+	_, err := p.ParseArgs(args)
+	if err != nil && cfg != nil {
+		err = cfg.explain(err)
+	}
+	return err
+}
+
+// loadOptions parses options of daemon again, used on reload
+func loadOptions(args []string) (res options, err error) {
+	err = parseOptions(args, func(opts options, cmd flags.Commander, _ []string) error {
+		res = opts
+		return nil
+	})
+	return res, err
+}
+
+// run collects records until ctx done, then gives sinks ShutdownTimeout to deliver what is already collected.
+// Options made by load are applied on SIGHUP and on change of config file.
+func run(ctx context.Context, opts options, load func() (options, error)) error {
+	service := ksmglog.NewService(opts.KSMG)
+	if len(service.Servers()) == 0 {
+		return errors.New("no ksmg urls")
+	}
+
+	if opts.Spool.Dir == "" {
+		opts.delivered = service.Delivered // spool retries failed records itself
+	}
+	routes, sinks, err := makeRoutes(opts, nil)
+	if err != nil {
+		return err
+	}
+	pl := newPipeline(opts, service, routes, sinks)
+	defer pl.close()
+
+	if err = pl.newRouter(routes); err != nil {
+		return err
+	}
+	pl.router.Logger = opts.KSMG.Logger
+
+	if opts.Listen != "" {
+		srv := &http.Server{Addr: opts.Listen, Handler: metricsHandler(service), ReadHeaderTimeout: 5 * time.Second}
+		go func() {
+			if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				log.Printf("[WARN] metrics server terminated: %v", err)
+			}
+		}()
+		defer srv.Close() //nolint:errcheck
+	}
+
+	// delivery continues after termination signal until records collected before it are flushed
+	deliveryCtx, cancelDelivery := context.WithCancel(context.Background())
+	defer cancelDelivery()
+	go func() {
+		<-ctx.Done()
+		select {
+		case <-deliveryCtx.Done():
+		case <-time.After(opts.ShutdownTimeout):
+			log.Printf("[WARN] sinks not flushed in %v", opts.ShutdownTimeout)
+			cancelDelivery()
+		}
+	}()
+
+	pl.start(deliveryCtx)
+	go pl.watch(ctx, load)
+
+	go service.Run(ctx)
+	records := forward(ctx, deliveryCtx, service.Channel())
+
+	log.Printf("[INFO] collect %d servers to %d routes", len(service.Servers()), len(routes))
+	pl.router.Run(deliveryCtx, records)
+	pl.finish(deliveryCtx)
+	log.Printf("[INFO] terminated")
+	return nil
+}
+
+// forward passes records from service channel until ctx done, returned channel is closed then.
+// Service closes its channel only after sleep between polls, so termination doesn't wait for it.
+// Record received when ctx is done has passed dedup already, it is handed over until delivery is done.
+func forward(ctx, delivery context.Context, in <-chan ksmglog.Record) <-chan ksmglog.Record {
+	out := make(chan ksmglog.Record)
+	go func() {
+		defer close(out)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case r, ok := <-in:
+				if !ok {
+					return
+				}
+				select {
+				case out <- r:
+				case <-ctx.Done():
+					select {
+					case out <- r:
+					case <-delivery.Done():
+					}
+					return
+				}
+			}
+		}
+	}()
+	return out
+}
+
+// signalContext returns context canceled on SIGINT or SIGTERM
+func signalContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() { // catch signal and invoke graceful termination
+		stop := make(chan os.Signal, 1)
+		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+		<-stop
+		log.Printf("[WARN] interrupt signal")
+		cancel()
+	}()
+	return ctx
+}
+
+func metricsHandler(service *ksmglog.Service) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", service.Metrics())
+	return mux
+}
+
+func setupLog(dbg bool, options ...log.Option) {
+	options = append(options, log.Msec, log.LevelBraces)
+	if dbg {
+		options = append(options, log.Debug, log.CallerFile, log.CallerFunc)
+	}
+	log.Setup(options...)
+}
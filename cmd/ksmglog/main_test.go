@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/zorion79/ksmglog"
+)
+
+func TestForward(t *testing.T) {
+	in := make(chan ksmglog.Record)
+	ctx, cancel := context.WithCancel(context.Background())
+	out := forward(ctx, context.Background(), in)
+
+	in <- ksmglog.Record{ID: 1}
+	cancel()
+	time.Sleep(10 * time.Millisecond)
+
+	r, ok := <-out
+	require.True(t, ok, "record received before termination is not dropped")
+	assert.Equal(t, 1, r.ID)
+	_, ok = <-out
+	assert.False(t, ok)
+}
+
+func TestForward_DeliveryDone(t *testing.T) {
+	in := make(chan ksmglog.Record)
+	ctx, cancel := context.WithCancel(context.Background())
+	delivery, cancelDelivery := context.WithCancel(context.Background())
+	out := forward(ctx, delivery, in)
+
+	in <- ksmglog.Record{ID: 1}
+	cancel()
+	cancelDelivery()
+	time.Sleep(10 * time.Millisecond)
+
+	_, ok := <-out
+	assert.False(t, ok, "not blocked after delivery is done")
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/zorion79/ksmglog"
+	"github.com/zorion79/ksmglog/csvexport"
+)
+
+// queryCommand searches journal of all servers
+type queryCommand struct {
+	From      string   `long:"from" description:"records since time, RFC3339, date or duration ago like 2h"`
+	To        string   `long:"to" description:"records before time, RFC3339, date or duration ago like 30m"`
+	Sender    string   `long:"sender" description:"sender address substring"`
+	Recipient string   `long:"recipient" description:"recipient address substring"`
+	Result    []string `long:"result" description:"record result like Clean or Infected, repeat for many"`
+	Filters   string   `long:"filters" description:"raw journal filters json sent to servers instead of ones built from other options"`
+	Format    string   `short:"f" long:"format" choice:"table" choice:"json" choice:"csv" default:"table" description:"output format"`
+
+	ksmg *ksmglog.Opts
+	out  io.Writer
+}
+
+// Execute runs query and prints records
+func (c *queryCommand) Execute(_ []string) error {
+	service := ksmglog.NewService(*c.ksmg)
+	if len(service.Servers()) == 0 {
+		return errors.New("no ksmg urls")
+	}
+
+	q, err := c.query(time.Now())
+	if err != nil {
+		return err
+	}
+	records, err := service.Query(q)
+	if err != nil {
+		return err
+	}
+	return c.print(records)
+}
+
+// print writes records in selected format
+func (c *queryCommand) print(records []*ksmglog.Record) error {
+	switch c.Format {
+	case "json":
+		enc := json.NewEncoder(c.out)
+		enc.SetIndent("", "  ")
+		return errors.Wrap(enc.Encode(records), "could not encode records")
+	case "csv":
+		w, err := csvexport.NewWriter(c.out, csvexport.Opts{TimeFormat: time.RFC3339, NoCRLF: true})
+		if err != nil {
+			return err
+		}
+		for _, r := range records {
+			if err = w.Write(*r); err != nil {
+				return err
+			}
+		}
+		return w.Flush()
+	}
+	return c.table(records)
+}
+
+func (c *queryCommand) query(now time.Time) (res ksmglog.Query, err error) {
+	res = ksmglog.Query{Filters: c.Filters, Sender: c.Sender, Recipient: c.Recipient, Result: c.Result}
+	if res.From, err = parseTime(c.From, now); err != nil {
+		return res, errors.Wrap(err, "invalid from")
+	}
+	if res.To, err = parseTime(c.To, now); err != nil {
+		return res, errors.Wrap(err, "invalid to")
+	}
+	return res, nil
+}
+
+func (c *queryCommand) table(records []*ksmglog.Record) error {
+	tw := tabwriter.NewWriter(c.out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "TIME\tSERVER\tRESULT\tFROM\tTO\tSUBJECT")
+	for _, r := range records {
+		info := r.Details.MessageInfo
+		recipients := info.AllRecipients()
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", time.Unix(int64(r.Time), 0).Format("2006-01-02 15:04:05"),
+			r.Server, r.Result, info.From, strings.Join(recipients, ", "), info.Subject)
+	}
+	return errors.Wrap(tw.Flush(), "could not write table")
+}
+
+// parseTime parses RFC3339 time, local date with optional time or duration before now, zero time if empty
+func parseTime(s string, now time.Time) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02 15:04:05", "2006-01-02 15:04", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.Errorf("can't parse time %q", s)
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/zorion79/ksmglog"
+)
+
+func TestQueryCommand_Print(t *testing.T) {
+	r := &ksmglog.Record{ID: 1, Time: int(time.Date(2019, 6, 10, 12, 0, 0, 0, time.Local).Unix()), Result: "Infected", Server: "ksmg01"}
+	r.Details.MessageInfo.From = "spam@evil.com"
+	r.Details.MessageInfo.To = []string{"bob@corp.local"}
+	r.Details.MessageInfo.Cc = []string{"carol@corp.local"}
+	r.Details.MessageInfo.Subject = "invoice"
+
+	buf := bytes.Buffer{}
+	c := queryCommand{Format: "table", out: &buf}
+	require.NoError(t, c.print([]*ksmglog.Record{r}))
+	assert.Equal(t, "TIME                 SERVER  RESULT    FROM           TO                                SUBJECT\n"+
+		"2019-06-10 12:00:00  ksmg01  Infected  spam@evil.com  bob@corp.local, carol@corp.local  invoice\n", buf.String())
+
+	buf.Reset()
+	c.Format = "csv"
+	require.NoError(t, c.print([]*ksmglog.Record{r}))
+	assert.Contains(t, buf.String(), "ksmg01,1,,Infected,spam@evil.com,bob@corp.local; carol@corp.local,invoice")
+
+	buf.Reset()
+	c.Format = "json"
+	require.NoError(t, c.print([]*ksmglog.Record{r}))
+	assert.Contains(t, buf.String(), `"server": "ksmg01"`)
+}
+
+func TestParseTime(t *testing.T) {
+	now := time.Date(2019, 6, 10, 12, 0, 0, 0, time.Local)
+	tbl := []struct {
+		in   string
+		want time.Time
+	}{
+		{"", time.Time{}},
+		{"2h", now.Add(-2 * time.Hour)},
+		{"2019-06-09T10:00:00Z", time.Date(2019, 6, 9, 10, 0, 0, 0, time.UTC)},
+		{"2019-06-09 10:30", time.Date(2019, 6, 9, 10, 30, 0, 0, time.Local)},
+		{"2019-06-09", time.Date(2019, 6, 9, 0, 0, 0, 0, time.Local)},
+	}
+	for _, tt := range tbl {
+		got, err := parseTime(tt.in, now)
+		require.NoError(t, err, tt.in)
+		assert.True(t, tt.want.Equal(got), "%s: %v", tt.in, got)
+	}
+
+	_, err := parseTime("yesterday", now)
+	assert.EqualError(t, err, `can't parse time "yesterday"`)
+}
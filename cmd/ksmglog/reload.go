@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"reflect"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/pkg/errors"
+
+	"github.com/zorion79/ksmglog"
+	"github.com/zorion79/ksmglog/spool"
+)
+
+// pipeline is running service, sinks and routes of daemon. Reload replaces only changed parts of it,
+// so unchanged servers keep dedup state and connections and unchanged routes keep their queues.
+// With spool every route appends records to own spool and they are drained to its sink from there.
+type pipeline struct {
+	router *ksmglog.Router
+
+	lock      sync.Mutex
+	opts      options
+	service   *ksmglog.Service
+	ctx       context.Context // sinks run and flush with it
+	sinks     map[string]ksmglog.Sink
+	routes    map[string]ksmglog.Route      // as configured, without spool
+	stop      map[string]context.CancelFunc // stops Run of sink by name
+	spoolOpts spool.Opts                    // of start, spool is not reloaded
+	drain     spool.DrainOpts               // of route spools
+	spools    map[string]*routeSpool        // by route name
+}
+
+func newPipeline(opts options, service *ksmglog.Service, routes []ksmglog.Route, sinks map[string]ksmglog.Sink) *pipeline {
+	res := &pipeline{opts: opts, service: service, sinks: sinks, ctx: context.Background(),
+		routes: map[string]ksmglog.Route{}, stop: map[string]context.CancelFunc{},
+		spoolOpts: opts.Spool, spools: map[string]*routeSpool{}}
+	res.spoolOpts.Logger = opts.KSMG.Logger
+	for _, rt := range routes {
+		res.routes[rt.Name] = rt
+	}
+	return res
+}
+
+// newRouter makes router of routes, every route gets spool in front of its sink if spool is enabled
+func (p *pipeline) newRouter(routes []ksmglog.Route) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	spooled := make([]ksmglog.Route, 0, len(routes))
+	for _, rt := range routes {
+		srt, err := p.spooled(rt)
+		if err != nil {
+			return err
+		}
+		spooled = append(spooled, srt)
+	}
+	router, err := ksmglog.NewRouter(spooled, p.service.Metrics())
+	if err != nil {
+		return errors.Wrap(err, "could not make router")
+	}
+	p.router = router
+	return nil
+}
+
+// start runs sinks with Run method and drains spools until ctx done
+func (p *pipeline) start(ctx context.Context) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.ctx = ctx
+	for name, sink := range p.sinks {
+		p.startSink(name, sink)
+	}
+	for _, sp := range p.spools {
+		sp.run(ctx)
+	}
+}
+
+// finish waits until spools delivered records to sinks or ctx done, router must be stopped before
+func (p *pipeline) finish(ctx context.Context) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, sp := range p.spools {
+		if err := sp.flush(ctx); err != nil {
+			log.Printf("[WARN] spool not delivered, it is kept for the next start: %v", err)
+		}
+	}
+}
+
+// close closes spools and all sinks, router must be stopped before
+func (p *pipeline) close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for name := range p.spools {
+		p.closeSpool(name)
+	}
+	for name, sink := range p.sinks {
+		if stop, ok := p.stop[name]; ok {
+			stop()
+		}
+		closeSinks([]ksmglog.Sink{sink})
+	}
+}
+
+// watch applies options made by load on SIGHUP and on change of config file until ctx done,
+// invalid options are reported and running ones kept
+func (p *pipeline) watch(ctx context.Context, load func() (options, error)) {
+	for range reloads(ctx, p.opts.Config, p.opts.ConfigWatch) {
+		log.Printf("[INFO] reload configuration")
+		next, err := load()
+		if err != nil {
+			log.Printf("[WARN] could not reload configuration, running one kept: %v", err)
+			continue
+		}
+		if err = p.reload(next); err != nil {
+			log.Printf("[WARN] could not reload configuration, running one kept: %v", err)
+		}
+	}
+}
+
+// reload applies options to running pipeline. Sinks with changed options are made again and routes
+// to them restarted after their queues are delivered, servers are reloaded by service.
+func (p *pipeline) reload(next options) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+
+	next.delivered = p.opts.delivered
+	reuse := map[string]ksmglog.Sink{}
+	for name, sink := range p.sinks {
+		if reflect.DeepEqual(sinkOptions(name, p.opts), sinkOptions(name, next)) {
+			reuse[name] = sink
+		}
+	}
+	routes, sinks, err := makeRoutes(next, reuse)
+	if err != nil {
+		return err
+	}
+	if len(next.KSMG.URL) == 0 && len(next.KSMG.Servers) == 0 {
+		p.closeMade(sinks)
+		return errors.New("no ksmg urls")
+	}
+	if _, err = ksmglog.NewRouter(routes, nil); err != nil {
+		p.closeMade(sinks)
+		return errors.Wrap(err, "invalid routes")
+	}
+
+	byName := map[string]ksmglog.Route{}
+	for _, rt := range routes {
+		byName[rt.Name] = rt
+	}
+
+	for name, rt := range p.routes {
+		if sameRoute(rt, byName[name]) {
+			continue
+		}
+		if err = p.router.RemoveRoute(name); err != nil {
+			log.Printf("[WARN] could not remove route %s: %v", name, err)
+		}
+		p.closeSpool(name) // spooled records are drained to the route added with the same name
+		log.Printf("[INFO] route %s removed", name)
+	}
+	for name, sink := range p.sinks {
+		if sinks[name] != sink {
+			p.stopSink(name, sink)
+			log.Printf("[INFO] sink %s stopped", name)
+		}
+	}
+	for name, sink := range sinks {
+		if p.sinks[name] != sink {
+			p.startSink(name, sink)
+			log.Printf("[INFO] sink %s started", name)
+		}
+	}
+	for _, rt := range routes {
+		if sameRoute(p.routes[rt.Name], rt) {
+			continue
+		}
+		srt, err := p.spooled(rt)
+		if err != nil {
+			log.Printf("[WARN] could not add route %s: %v", rt.Name, err)
+			continue
+		}
+		if err = p.router.AddRoute(srt); err != nil {
+			p.closeSpool(rt.Name)
+			log.Printf("[WARN] could not add route %s: %v", rt.Name, err)
+			continue
+		}
+		if sp, ok := p.spools[rt.Name]; ok {
+			sp.run(p.ctx)
+		}
+		log.Printf("[INFO] route %s added", rt.Name)
+	}
+
+	p.service.Reload(next.KSMG)
+
+	if next.Listen != p.opts.Listen || next.ShutdownTimeout != p.opts.ShutdownTimeout || next.Spool != p.opts.Spool {
+		log.Printf("[WARN] listen, shutdown-timeout and spool options are applied on restart")
+	}
+	p.opts, p.sinks, p.routes = next, sinks, byName
+	return nil
+}
+
+// spooled returns route sending records to spool drained to route sink, route is returned as is without spool.
+// Called with lock held, drain of spool is not started.
+func (p *pipeline) spooled(rt ksmglog.Route) (ksmglog.Route, error) {
+	if p.spoolOpts.Dir == "" {
+		return rt, nil
+	}
+	sp, err := newRouteSpool(p.spoolOpts, p.drain, rt)
+	if err != nil {
+		return rt, err
+	}
+	p.spools[rt.Name] = sp
+	rt.Sink, rt.Block = sp, true
+	return rt, nil
+}
+
+// closeSpool stops drain of route spool and closes it, called with lock held
+func (p *pipeline) closeSpool(name string) {
+	sp, ok := p.spools[name]
+	if !ok {
+		return
+	}
+	delete(p.spools, name)
+	if err := sp.close(); err != nil {
+		log.Printf("[WARN] could not close spool of route %s: %v", name, err)
+	}
+}
+
+// startSink runs sink with Run method, called with lock held
+func (p *pipeline) startSink(name string, sink ksmglog.Sink) {
+	runner, ok := sink.(interface{ Run(context.Context) })
+	if !ok {
+		return
+	}
+	ctx, cancel := context.WithCancel(p.ctx)
+	p.stop[name] = cancel
+	go runner.Run(ctx)
+}
+
+// stopSink stops Run of sink, sends what it accumulated and closes it, called with lock held
+func (p *pipeline) stopSink(name string, sink ksmglog.Sink) {
+	if stop, ok := p.stop[name]; ok {
+		stop()
+		delete(p.stop, name)
+	}
+	if flusher, ok := sink.(interface{ Flush(context.Context) error }); ok {
+		if err := flusher.Flush(p.ctx); err != nil {
+			log.Printf("[WARN] could not flush sink %s: %v", name, err)
+		}
+	}
+	closeSinks([]ksmglog.Sink{sink})
+}
+
+// closeMade closes sinks made for reload which is not applied
+func (p *pipeline) closeMade(sinks map[string]ksmglog.Sink) {
+	for name, sink := range sinks {
+		if p.sinks[name] != sink {
+			closeSinks([]ksmglog.Sink{sink})
+		}
+	}
+}
+
+// sameRoute checks if route is not changed, including instance of its sink
+func sameRoute(a, b ksmglog.Route) bool {
+	return a.Sink != nil && a.Sink == b.Sink && reflect.DeepEqual(a, b)
+}
+
+// reloads returns channel signaled on SIGHUP and on change of file checked every interval,
+// file is not watched if empty or interval is 0. Channel is closed when ctx done.
+func reloads(ctx context.Context, file string, interval time.Duration) <-chan struct{} {
+	res := make(chan struct{}, 1)
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	notify := func() {
+		select {
+		case res <- struct{}{}:
+		default: // reload is pending already
+		}
+	}
+
+	var last os.FileInfo
+	var ticker *time.Ticker
+	var tick <-chan time.Time
+	if file != "" && interval > 0 {
+		last, _ = os.Stat(file)
+		ticker = time.NewTicker(interval)
+		tick = ticker.C
+	}
+
+	go func() {
+		defer close(res)
+		defer signal.Stop(hup)
+		if ticker != nil {
+			defer ticker.Stop()
+		}
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				log.Printf("[INFO] hangup signal")
+				notify()
+			case <-tick:
+				fi, err := os.Stat(file)
+				if err != nil {
+					continue // file is being replaced or removed, running configuration kept
+				}
+				if last == nil || !fi.ModTime().Equal(last.ModTime()) || fi.Size() != last.Size() {
+					log.Printf("[INFO] config file %s changed", file)
+					notify()
+				}
+				last = fi
+			}
+		}
+	}()
+	return res
+}
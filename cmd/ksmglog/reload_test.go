@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/zorion79/ksmglog"
+)
+
+func TestPipeline_Reload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ksmglog-cmd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := options{Sinks: []string{"file", "parquet"}}
+	opts.KSMG.URL = []string{"https://ksmg01/klwi"}
+	opts.File.Dir = filepath.Join(dir, "file")
+	opts.Parquet.Dir = filepath.Join(dir, "parquet")
+
+	service := ksmglog.NewService(opts.KSMG)
+	routes, sinks, err := makeRoutes(opts, nil)
+	require.NoError(t, err)
+	pl := newPipeline(opts, service, routes, sinks)
+	defer pl.close()
+	pl.router, err = ksmglog.NewRouter(routes, nil)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ch := make(chan ksmglog.Record)
+	go pl.router.Run(ctx, ch)
+	pl.start(ctx)
+	fileSink := pl.sinks["file"]
+
+	next := opts
+	next.Sinks = []string{"file"}
+	next.KSMG.URL = []string{"https://ksmg01/klwi", "https://ksmg02/klwi"}
+	require.NoError(t, pl.reload(next))
+	assert.True(t, fileSink == pl.sinks["file"], "unchanged sink kept")
+	assert.Equal(t, []string{"file"}, routeNames(pl.router))
+	assert.Equal(t, 2, len(service.Servers()))
+
+	next.File.Dir = filepath.Join(dir, "other")
+	require.NoError(t, pl.reload(next))
+	assert.False(t, fileSink == pl.sinks["file"], "sink with changed options made again")
+	require.Equal(t, 1, len(pl.router.Routes()))
+	assert.True(t, pl.router.Routes()[0].Sink == pl.sinks["file"], "route to new sink")
+
+	bad := next
+	bad.Sinks = []string{"file", "foo"}
+	assert.EqualError(t, pl.reload(bad), "could not make sink foo: unknown sink")
+	bad = next
+	bad.KSMG.URL = nil
+	assert.EqualError(t, pl.reload(bad), "no ksmg urls")
+	assert.Equal(t, next.File.Dir, pl.opts.File.Dir, "running options kept")
+	assert.Equal(t, 2, len(service.Servers()))
+}
+
+func TestReloads(t *testing.T) {
+	file := writeConfig(t, "sink: [file]\n")
+	defer os.RemoveAll(filepath.Dir(file))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := reloads(ctx, file, 10*time.Millisecond)
+
+	require.NoError(t, ioutil.WriteFile(file, []byte("sink: [file, loki]\n"), 0600))
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		t.Fatal("file change not detected")
+	}
+
+	require.NoError(t, syscall.Kill(os.Getpid(), syscall.SIGHUP))
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		t.Fatal("hangup signal not detected")
+	}
+
+	cancel()
+	_, ok := <-ch
+	assert.False(t, ok, "closed on ctx done")
+}
+
+func TestLoadOptions(t *testing.T) {
+	file := writeConfig(t, `
+sink: [file]
+servers:
+  - url: https://ksmg01/klwi
+    user: collector
+`)
+	defer os.RemoveAll(filepath.Dir(file))
+
+	opts, err := loadOptions([]string{"-c", file, "--shutdown-timeout=1s"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"file"}, opts.Sinks)
+	assert.Equal(t, time.Second, opts.ShutdownTimeout)
+	require.Equal(t, 1, len(opts.KSMG.Servers))
+	assert.Equal(t, "collector", opts.KSMG.Servers[0].User)
+
+	_, err = loadOptions([]string{"-c", file, "--shutdown-timeout=soon"})
+	assert.Error(t, err)
+}
+
+func routeNames(router *ksmglog.Router) []string {
+	res := []string{}
+	for _, rt := range router.Routes() {
+		res = append(res, rt.Name)
+	}
+	return res
+}
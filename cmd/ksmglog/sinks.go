@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"io"
+	"strings"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/pkg/errors"
+
+	"github.com/zorion79/ksmglog"
+	"github.com/zorion79/ksmglog/notify/chat"
+	"github.com/zorion79/ksmglog/notify/digest"
+	"github.com/zorion79/ksmglog/sink/file"
+	"github.com/zorion79/ksmglog/sink/kafka"
+	"github.com/zorion79/ksmglog/sink/loki"
+	"github.com/zorion79/ksmglog/sink/otlp"
+	"github.com/zorion79/ksmglog/sink/parquet"
+	"github.com/zorion79/ksmglog/sink/splunk"
+	"github.com/zorion79/ksmglog/sink/sqldb"
+	"github.com/zorion79/ksmglog/sink/webhook"
+)
+
+// makeRoutes makes enabled sinks and routes of config to them,
+// without configured routes every sink gets all records by route named after it.
+// Sinks found in reuse by name are taken instead of making new ones, all sinks are returned by name.
+func makeRoutes(opts options, reuse map[string]ksmglog.Sink) ([]ksmglog.Route, map[string]ksmglog.Sink, error) {
+	if len(opts.Sinks) == 0 {
+		return nil, nil, errors.New("no sinks enabled")
+	}
+
+	res := []ksmglog.Route{}
+	sinks := map[string]ksmglog.Sink{}
+	made := []ksmglog.Sink{}
+	fail := func(err error) ([]ksmglog.Route, map[string]ksmglog.Sink, error) {
+		closeSinks(made)
+		return nil, nil, err
+	}
+
+	for _, name := range opts.Sinks {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if _, ok := sinks[name]; ok {
+			return fail(errors.Errorf("sink %s enabled twice", name))
+		}
+
+		sink, ok := reuse[name]
+		if !ok {
+			var err error
+			if sink, err = makeSink(name, opts); err != nil {
+				return fail(errors.Wrapf(err, "could not make sink %s", name))
+			}
+			made = append(made, sink)
+		}
+		sinks[name] = sink
+		res = append(res, ksmglog.Route{Name: name, Sink: sink})
+	}
+	if len(opts.routes) == 0 {
+		return res, sinks, nil
+	}
+
+	routes := []ksmglog.Route{}
+	used := map[string]bool{}
+	for _, rc := range opts.routes {
+		sink, ok := sinks[strings.ToLower(rc.Sink)]
+		if !ok {
+			return fail(errors.Errorf("%s: route %s: sink %s is not enabled", rc.pos, rc.Name, rc.Sink))
+		}
+		used[strings.ToLower(rc.Sink)] = true
+
+		route := ksmglog.Route{Name: rc.Name, Sink: sink, QueueSize: rc.QueueSize,
+			Batch: ksmglog.BatchOpts{Size: rc.BatchSize, FlushInterval: rc.FlushInterval}}
+		for _, m := range rc.Match {
+			cond, err := parseFilter(m)
+			if err != nil {
+				return fail(errors.Wrapf(err, "%s: route %s", rc.pos, rc.Name))
+			}
+			route.Match = append(route.Match, cond)
+		}
+		routes = append(routes, route)
+	}
+
+	for name := range sinks {
+		if !used[name] {
+			log.Printf("[WARN] sink %s has no routes", name)
+		}
+	}
+	return routes, sinks, nil
+}
+
+// makeSink makes sink of options group, sink logs with logger of service
+func makeSink(name string, opts options) (ksmglog.Sink, error) {
+	l := opts.KSMG.Logger
+	opts.Splunk.Logger, opts.Loki.Logger, opts.Kafka.Logger, opts.OTLP.Logger = l, l, l, l
+	opts.File.Logger, opts.Webhook.Logger, opts.Parquet.Logger, opts.SQLDB.Logger = l, l, l, l
+	opts.Chat.Logger, opts.Digest.Logger = l, l
+
+	switch name {
+	case "splunk":
+		if opts.Splunk.URL == "" || opts.Splunk.Token == "" {
+			return nil, errors.New("url and token required")
+		}
+		return splunk.NewSink(opts.Splunk), nil
+	case "loki":
+		if opts.Loki.URL == "" {
+			return nil, errors.New("url required")
+		}
+		return loki.NewSink(opts.Loki), nil
+	case "kafka":
+		if len(opts.Kafka.Brokers) == 0 {
+			return nil, errors.New("brokers required")
+		}
+		ko := opts.Kafka
+		ko.OnDelivery = opts.delivered
+		return kafka.NewSink(ko), nil
+	case "otlp":
+		if opts.OTLP.URL == "" {
+			return nil, errors.New("url required")
+		}
+		return otlp.NewSink(opts.OTLP), nil
+	case "file":
+		return file.NewSink(opts.File), nil
+	case "webhook":
+		if opts.Webhook.URL == "" {
+			return nil, errors.New("url required")
+		}
+		return webhook.NewSink(opts.Webhook)
+	case "parquet":
+		return parquet.NewSink(opts.Parquet), nil
+	case "sqldb":
+		if opts.SQLDB.DSN == "" {
+			return nil, errors.New("dsn required")
+		}
+		return sqldb.NewSink(context.Background(), opts.SQLDB)
+	case "chat":
+		if opts.Chat.URL == "" {
+			return nil, errors.New("url required")
+		}
+		return chat.NewAlerter(opts.Chat), nil
+	case "digest":
+		if opts.Digest.Host == "" || opts.Digest.From == "" || len(opts.Digest.To) == 0 {
+			return nil, errors.New("host, from and to required")
+		}
+		return digest.NewNotifier(opts.Digest), nil
+	}
+	return nil, errors.New("unknown sink")
+}
+
+// sinkOptions returns options group of sink, sink is made again on reload if they changed
+func sinkOptions(name string, opts options) interface{} {
+	switch name {
+	case "splunk":
+		return opts.Splunk
+	case "loki":
+		return opts.Loki
+	case "kafka":
+		return opts.Kafka
+	case "otlp":
+		return opts.OTLP
+	case "file":
+		return opts.File
+	case "webhook":
+		return opts.Webhook
+	case "parquet":
+		return opts.Parquet
+	case "sqldb":
+		return opts.SQLDB
+	case "chat":
+		return opts.Chat
+	case "digest":
+		return opts.Digest
+	}
+	return nil
+}
+
+// closeSinks closes sinks holding files or connections
+func closeSinks(sinks []ksmglog.Sink) {
+	for _, sink := range sinks {
+		if c, ok := sink.(io.Closer); ok {
+			if err := c.Close(); err != nil {
+				log.Printf("[WARN] could not close sink %T: %v", sink, err)
+			}
+		}
+	}
+}
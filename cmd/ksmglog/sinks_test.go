@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/zorion79/ksmglog"
+	"github.com/zorion79/ksmglog/sink/file"
+	"github.com/zorion79/ksmglog/sink/kafka"
+	"github.com/zorion79/ksmglog/sink/loki"
+	"github.com/zorion79/ksmglog/sink/sqldb"
+)
+
+func TestMakeRoutes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ksmglog-cmd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := options{Sinks: []string{"file", " Loki"}}
+	opts.File.Dir = dir
+	opts.Loki.URL = "http://loki:3100"
+
+	routes, sinks, err := makeRoutes(opts, nil)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(routes))
+	assert.Equal(t, "file", routes[0].Name)
+	assert.IsType(t, &file.Sink{}, routes[0].Sink)
+	assert.Equal(t, "loki", routes[1].Name)
+	assert.IsType(t, &loki.Sink{}, routes[1].Sink)
+	assert.Equal(t, map[string]ksmglog.Sink{"file": routes[0].Sink, "loki": routes[1].Sink}, sinks)
+
+	reused, _, err := makeRoutes(opts, map[string]ksmglog.Sink{"loki": sinks["loki"]})
+	require.NoError(t, err)
+	assert.True(t, reused[1].Sink == sinks["loki"], "sink reused")
+	assert.False(t, reused[0].Sink == sinks["file"], "sink made")
+	closeSinks([]ksmglog.Sink{sinks["file"], sinks["loki"], reused[0].Sink})
+}
+
+func TestMakeRoutes_Delivered(t *testing.T) {
+	reports := 0
+	opts := options{Sinks: []string{"kafka"}, delivered: func(ksmglog.Record, error) { reports++ }}
+	opts.Kafka.Brokers = []string{"kafka01:9092"}
+
+	_, sinks, err := makeRoutes(opts, nil)
+	require.NoError(t, err)
+	ks := sinks["kafka"].(*kafka.Sink)
+	require.NotNil(t, ks.OnDelivery)
+	ks.OnDelivery(ksmglog.Record{ID: 1}, nil)
+	assert.Equal(t, 1, reports)
+	assert.Nil(t, opts.Kafka.OnDelivery, "options compared on reload are not changed")
+	closeSinks([]ksmglog.Sink{ks})
+}
+
+func TestMakeRoutes_Logger(t *testing.T) {
+	logged := []string{}
+	opts := options{Sinks: []string{"file"}}
+	opts.File.Dir = "."
+	opts.KSMG.Logger = ksmglog.LoggerFunc(func(_, msg string, _ ...interface{}) { logged = append(logged, msg) })
+
+	_, sinks, err := makeRoutes(opts, nil)
+	require.NoError(t, err)
+	fs := sinks["file"].(*file.Sink)
+	fs.Logger.Log(ksmglog.LevelWarn, "could not rotate file")
+	assert.Equal(t, []string{"could not rotate file"}, logged, "sink logs with logger of service")
+	assert.Nil(t, opts.File.Logger, "options compared on reload are not changed")
+	closeSinks([]ksmglog.Sink{fs})
+}
+
+func TestMakeRoutes_Errors(t *testing.T) {
+	tbl := []struct {
+		sinks []string
+		err   string
+	}{
+		{nil, "no sinks enabled"},
+		{[]string{"foo"}, "could not make sink foo: unknown sink"},
+		{[]string{"splunk"}, "could not make sink splunk: url and token required"},
+		{[]string{"kafka"}, "could not make sink kafka: brokers required"},
+		{[]string{"digest"}, "could not make sink digest: host, from and to required"},
+		{[]string{"sqldb"}, "could not make sink sqldb: dsn required"},
+		{[]string{"parquet", "parquet"}, "sink parquet enabled twice"},
+	}
+
+	for _, tt := range tbl {
+		_, _, err := makeRoutes(options{Sinks: tt.sinks}, nil)
+		require.Error(t, err, tt.sinks)
+		assert.EqualError(t, err, tt.err)
+	}
+}
+
+func TestMakeRoutes_SQLDB(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ksmglog-cmd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := options{Sinks: []string{"sqldb"}}
+	opts.SQLDB = sqldb.Opts{Driver: "sqlite", DSN: filepath.Join(dir, "ksmg.db")}
+	routes, sinks, err := makeRoutes(opts, nil)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(routes))
+	require.NoError(t, routes[0].Sink.Send(context.Background(), []ksmglog.Record{{ID: 1, Server: "ksmg01"}}))
+	closeSinks([]ksmglog.Sink{sinks["sqldb"]})
+
+	assert.Subset(t, sql.Drivers(), []string{"sqlite", "postgres"}, "drivers registered without cgo")
+}
+
+func TestMakeRoutes_Config(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ksmglog-cmd")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := options{Sinks: []string{"file"}, routes: []routeConfig{
+		{Name: "infected", Sink: "file", Match: []string{"result=Infected"}, BatchSize: 1},
+		{Name: "spam", Sink: "FILE", Match: []string{"result=Spam"}},
+	}}
+	opts.File.Dir = dir
+
+	routes, sinks, err := makeRoutes(opts, nil)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(routes))
+	assert.Equal(t, "infected", routes[0].Name)
+	assert.Equal(t, []ksmglog.Condition{{Field: "result", Op: ksmglog.OpEq, Value: "Infected"}}, routes[0].Match)
+	assert.Equal(t, 1, routes[0].Batch.Size)
+	assert.True(t, routes[0].Sink == routes[1].Sink, "sink shared by routes")
+	assert.Equal(t, 1, len(sinks))
+	closeSinks([]ksmglog.Sink{sinks["file"]})
+
+	opts.routes = []routeConfig{{Name: "alerts", Sink: "chat", pos: "ksmglog.yml:3"}}
+	_, _, err = makeRoutes(opts, nil)
+	assert.EqualError(t, err, "ksmglog.yml:3: route alerts: sink chat is not enabled")
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/pkg/errors"
+
+	"github.com/zorion79/ksmglog"
+	"github.com/zorion79/ksmglog/spool"
+)
+
+// routeSpool is sink of route appending records to spool of the route. Drain delivers spooled records
+// to route sink and moves spool cursor only after the sink accepted them, so records survive outage
+// of the sink and restart of daemon.
+type routeSpool struct {
+	name   string
+	spool  *spool.Spool
+	sink   ksmglog.Sink
+	drain  spool.DrainOpts
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+const flushCheck = 100 * time.Millisecond
+
+// newRouteSpool opens spool of route in subdirectory of opts.Dir named after route,
+// batch size of drain is taken from route if not set
+func newRouteSpool(opts spool.Opts, drain spool.DrainOpts, rt ksmglog.Route) (*routeSpool, error) {
+	opts.Dir = filepath.Join(opts.Dir, strings.NewReplacer("/", "_", "\\", "_", ":", "_", "..", "_").Replace(rt.Name))
+	sp, err := spool.New(opts)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not open spool of route %s", rt.Name)
+	}
+	if drain.BatchSize <= 0 {
+		drain.BatchSize = rt.Batch.Size
+	}
+	return &routeSpool{name: rt.Name, spool: sp, sink: rt.Sink, drain: drain}, nil
+}
+
+// Send appends records to spool
+func (s *routeSpool) Send(_ context.Context, records []ksmglog.Record) error {
+	return s.spool.Append(records)
+}
+
+// run drains spool to route sink until ctx done or close
+func (s *routeSpool) run(ctx context.Context) {
+	ctx, s.cancel = context.WithCancel(ctx)
+	s.done = make(chan struct{})
+	go func() {
+		defer close(s.done)
+		if err := s.spool.Drain(ctx, s.sink, s.drain); err != nil && err != context.Canceled {
+			log.Printf("[WARN] spool drain of route %s terminated: %v", s.name, err)
+		}
+	}()
+}
+
+// flush waits until all spooled records are delivered or ctx done
+func (s *routeSpool) flush(ctx context.Context) error {
+	ticker := time.NewTicker(flushCheck)
+	defer ticker.Stop()
+	for s.spool.Pending() > 0 {
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "%d bytes of route %s left in spool", s.spool.Pending(), s.name)
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// close stops drain and closes spool, records not delivered are kept for the next start
+func (s *routeSpool) close() error {
+	if s.cancel != nil {
+		s.cancel()
+		<-s.done
+	}
+	return s.spool.Close()
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/zorion79/ksmglog"
+)
+
+// flakySink fails first sends and accepts records after
+type flakySink struct {
+	lock  sync.Mutex
+	fails int
+	ids   []int
+}
+
+func (f *flakySink) Send(_ context.Context, records []ksmglog.Record) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.fails != 0 {
+		f.fails--
+		return errors.New("sink is down")
+	}
+	for _, r := range records {
+		f.ids = append(f.ids, r.ID)
+	}
+	return nil
+}
+
+func (f *flakySink) delivered() []int {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return append([]int{}, f.ids...)
+}
+
+func TestPipeline_Spool(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ksmglog-spool")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := options{}
+	opts.Spool.Dir = dir
+	sink := &flakySink{fails: 3}
+	pl := runSpooled(t, opts, sink, 1, 50, time.Second)
+	pl.close()
+
+	assert.Equal(t, ids(1, 50), sink.delivered(), "records spooled while sink was down are delivered once in order")
+}
+
+func TestPipeline_SpoolRestart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ksmglog-spool")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	opts := options{}
+	opts.Spool.Dir = dir
+	down := &flakySink{fails: -1}
+	pl := runSpooled(t, opts, down, 1, 20, 50*time.Millisecond)
+	pl.close()
+	assert.Empty(t, down.delivered())
+
+	// records left in spool of the route are delivered after restart
+	up := &flakySink{}
+	pl = runSpooled(t, opts, up, 21, 30, time.Second)
+	pl.close()
+	assert.Equal(t, ids(1, 30), up.delivered())
+}
+
+// runSpooled routes records from..to through spooled route to sink and waits for delivery up to timeout
+func runSpooled(t *testing.T, opts options, sink ksmglog.Sink, from, to int, timeout time.Duration) *pipeline {
+	routes := []ksmglog.Route{{Name: "siem", Sink: sink, QueueSize: 1, Batch: ksmglog.BatchOpts{Size: 5, FlushInterval: time.Millisecond}}}
+	pl := newPipeline(opts, ksmglog.NewService(opts.KSMG), routes, map[string]ksmglog.Sink{"siem": sink})
+	pl.drain.RetryDelay = time.Millisecond
+	require.NoError(t, pl.newRouter(routes))
+	pl.start(context.Background())
+
+	ch := make(chan ksmglog.Record)
+	done := make(chan struct{})
+	go func() {
+		pl.router.Run(context.Background(), ch)
+		close(done)
+	}()
+	for i := from; i <= to; i++ {
+		ch <- ksmglog.Record{ID: i, Server: "ksmg01"}
+	}
+	close(ch)
+	<-done
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	pl.finish(ctx)
+	return pl
+}
+
+func ids(from, to int) []int {
+	res := []int{}
+	for i := from; i <= to; i++ {
+		res = append(res, i)
+	}
+	return res
+}
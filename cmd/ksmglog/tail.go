@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+
+	"github.com/zorion79/ksmglog"
+	"github.com/zorion79/ksmglog/console"
+)
+
+// tailCommand follows new records of all servers and prints them as they arrive
+type tailCommand struct {
+	Fields     []string `short:"F" long:"field" description:"print json paths like details.messageInfo.from instead of default line, repeat for many"`
+	Filters    []string `long:"filter" description:"condition like result=Infected or details.messageInfo.from~evil.com, repeat for many"`
+	NoColor    bool     `long:"no-color" env:"NO_COLOR" description:"don't color lines by result"`
+	TimeFormat string   `long:"time-format" default:"2006-01-02 15:04:05" description:"layout of record time"`
+
+	ksmg *ksmglog.Opts
+	out  io.Writer
+}
+
+// filter operators, two character ones checked first
+var filterOps = []struct{ token, op string }{
+	{"!=", ksmglog.OpNe},
+	{"=~", ksmglog.OpRegex},
+	{"^=", ksmglog.OpPrefix},
+	{"$=", ksmglog.OpSuffix},
+	{"=", ksmglog.OpEq},
+	{"~", ksmglog.OpContains},
+	{"?", ksmglog.OpExists},
+}
+
+// Execute prints records until interrupted
+func (c *tailCommand) Execute(_ []string) error {
+	service := ksmglog.NewService(*c.ksmg)
+	if len(service.Servers()) == 0 {
+		return errors.New("no ksmg urls")
+	}
+
+	conditions := []ksmglog.Condition{}
+	for _, f := range c.Filters {
+		cond, err := parseFilter(f)
+		if err != nil {
+			return err
+		}
+		conditions = append(conditions, cond)
+	}
+
+	printer := console.NewPrinter(c.out, console.Opts{
+		Fields:     c.Fields,
+		Color:      !c.NoColor && isTerminal(c.out),
+		TimeFormat: c.TimeFormat,
+	})
+
+	router, err := ksmglog.NewRouter([]ksmglog.Route{
+		{Name: "tail", Sink: printer, Match: conditions, Batch: ksmglog.BatchOpts{Size: 1}},
+	}, service.Metrics())
+	if err != nil {
+		return errors.Wrap(err, "invalid filter")
+	}
+	router.Logger = c.ksmg.Logger
+
+	ctx := signalContext()
+	go service.Run(ctx)
+	router.Run(ctx, service.Channel())
+	return nil
+}
+
+// parseFilter makes condition from expression like field=value. Operators are = (equal), != (not equal),
+// ~ (contains), ^= (prefix), $= (suffix), =~ (regex) and ? after field for non-empty value.
+// Comma separated value of = matches any of values.
+func parseFilter(expr string) (ksmglog.Condition, error) {
+	i := strings.IndexAny(expr, "=!~^$?")
+	if i <= 0 {
+		return ksmglog.Condition{}, errors.Errorf("invalid filter %q, expected field, operator and value", expr)
+	}
+
+	field, rest := strings.TrimSpace(expr[:i]), expr[i:]
+	for _, o := range filterOps {
+		if !strings.HasPrefix(rest, o.token) {
+			continue
+		}
+		value := strings.TrimSpace(strings.TrimPrefix(rest, o.token))
+		switch {
+		case o.op == ksmglog.OpExists && value != "":
+			return ksmglog.Condition{}, errors.Errorf("invalid filter %q, no value expected after ?", expr)
+		case o.op == ksmglog.OpEq && strings.Contains(value, ","):
+			return ksmglog.Condition{Field: field, Op: ksmglog.OpIn, Values: strings.Split(value, ",")}, nil
+		}
+		return ksmglog.Condition{Field: field, Op: o.op, Value: value}, nil
+	}
+	return ksmglog.Condition{}, errors.Errorf("invalid filter %q, unknown operator", expr)
+}
+
+// isTerminal checks if w is character device, so colors are printed only to terminal
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
+}
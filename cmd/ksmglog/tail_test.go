@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/zorion79/ksmglog"
+)
+
+func TestParseFilter(t *testing.T) {
+	tbl := []struct {
+		expr string
+		want ksmglog.Condition
+	}{
+		{"result=Infected", ksmglog.Condition{Field: "result", Op: ksmglog.OpEq, Value: "Infected"}},
+		{"result = Spam,Infected", ksmglog.Condition{Field: "result", Op: ksmglog.OpIn, Values: []string{"Spam", "Infected"}}},
+		{"result!=Clean", ksmglog.Condition{Field: "result", Op: ksmglog.OpNe, Value: "Clean"}},
+		{"details.messageInfo.from~evil.com", ksmglog.Condition{Field: "details.messageInfo.from", Op: ksmglog.OpContains, Value: "evil.com"}},
+		{"details.messageInfo.subject=~^(?i)invoice", ksmglog.Condition{Field: "details.messageInfo.subject", Op: ksmglog.OpRegex, Value: "^(?i)invoice"}},
+		{"server^=ksmg", ksmglog.Condition{Field: "server", Op: ksmglog.OpPrefix, Value: "ksmg"}},
+		{"details.messageInfo.to$=@corp.local", ksmglog.Condition{Field: "details.messageInfo.to", Op: ksmglog.OpSuffix, Value: "@corp.local"}},
+		{"details.partResults.avInfo.threats?", ksmglog.Condition{Field: "details.partResults.avInfo.threats", Op: ksmglog.OpExists}},
+	}
+	for _, tt := range tbl {
+		got, err := parseFilter(tt.expr)
+		require.NoError(t, err, tt.expr)
+		assert.Equal(t, tt.want, got, tt.expr)
+	}
+
+	for _, expr := range []string{"result", "=Clean", "result!Clean", "threats?x"} {
+		_, err := parseFilter(expr)
+		assert.Error(t, err, expr)
+	}
+}
@@ -0,0 +1,138 @@
+// Package console prints records as compact human readable lines, colored by result
+package console
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/zorion79/ksmglog"
+)
+
+// Printer writes one line per record, it is ksmglog.Sink as well
+type Printer struct {
+	Opts
+
+	lock sync.Mutex
+	out  io.Writer
+}
+
+// Opts collects parameters to initialize Printer
+type Opts struct {
+	// Fields replace default line with tab separated values of json paths, see ksmglog.Record.Field
+	Fields     []string `long:"field" description:"print json paths instead of default line, repeat for many"`
+	Color      bool     `long:"color" description:"color lines by result"`
+	TimeFormat string   `long:"time-format" default:"2006-01-02 15:04:05" description:"layout of record time"`
+}
+
+// ANSI colors of results
+const (
+	colorReset  = "\x1b[0m"
+	colorRed    = "\x1b[31m"
+	colorGreen  = "\x1b[32m"
+	colorYellow = "\x1b[33m"
+
+	timeFormat = "2006-01-02 15:04:05"
+)
+
+// resultColors maps lower case results to colors, unknown results are yellow
+var resultColors = map[string]string{
+	"clean":    colorGreen,
+	"infected": colorRed,
+	"spam":     colorRed,
+	"phishing": colorRed,
+	"blocked":  colorRed,
+	"rejected": colorRed,
+	"deleted":  colorRed,
+}
+
+// NewPrinter makes Printer writing to out
+func NewPrinter(out io.Writer, opts Opts) *Printer {
+	res := &Printer{Opts: opts, out: out}
+	if res.TimeFormat == "" {
+		res.TimeFormat = timeFormat
+	}
+	return res
+}
+
+// Send prints records
+func (p *Printer) Send(_ context.Context, records []ksmglog.Record) error {
+	for _, r := range records {
+		if err := p.Print(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Print writes line of record
+func (p *Printer) Print(r ksmglog.Record) error {
+	line, err := p.Line(r)
+	if err != nil {
+		return err
+	}
+	if p.Color {
+		color, ok := resultColors[strings.ToLower(string(r.Result))]
+		if !ok {
+			color = colorYellow
+		}
+		line = color + line + colorReset
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	_, err = io.WriteString(p.out, line+"\n")
+	return errors.Wrap(err, "could not print record")
+}
+
+// Line renders record without color, like
+// 2019-06-10 12:00:00 ksmg01 Infected spam@evil.com → bob@corp.local "invoice" av:Infected threats:EICAR
+func (p *Printer) Line(r ksmglog.Record) (string, error) {
+	if len(p.Fields) > 0 {
+		values := make([]string, 0, len(p.Fields))
+		for _, f := range p.Fields {
+			v, err := r.Field(f)
+			if err != nil {
+				return "", errors.Wrapf(err, "could not get field %s", f)
+			}
+			values = append(values, strings.Join(v, ","))
+		}
+		return strings.Join(values, "\t"), nil
+	}
+
+	d := r.Details
+	info := d.MessageInfo
+	recipients := info.AllRecipients()
+	parts := []string{
+		time.Unix(int64(r.Time), 0).Format(p.TimeFormat),
+		r.Server,
+		string(r.Result),
+		fmt.Sprintf("%s → %s", info.From, strings.Join(recipients, ",")),
+		fmt.Sprintf("%q", info.Subject),
+	}
+
+	verdicts := []struct{ name, value string }{
+		{"av", string(d.AvStatus)}, {"as", string(d.AsStatus)}, {"ap", string(d.ApStatus)}, {"cf", string(d.CfStatus)}, {"dmarc", d.MaInfo.DmarcVerdict},
+	}
+	for _, v := range verdicts {
+		if v.value != "" {
+			parts = append(parts, v.name+":"+v.value)
+		}
+	}
+	threats := []string{}
+	for _, part := range d.PartResults {
+		threats = append(threats, part.AvInfo.Threats...)
+	}
+	if len(threats) > 0 {
+		parts = append(parts, "threats:"+strings.Join(threats, ","))
+	}
+	if d.DocWithMacroDetected {
+		parts = append(parts, "macro")
+	}
+	return strings.Join(parts, " "), nil
+}
@@ -0,0 +1,39 @@
+package console
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/zorion79/ksmglog"
+)
+
+func TestPrinter_Send(t *testing.T) {
+	r := ksmglog.Record{ID: 1, Time: int(time.Date(2019, 6, 10, 12, 0, 0, 0, time.Local).Unix()), Result: ksmglog.ResultInfected, Server: "ksmg01",
+		Details: ksmglog.Details{
+			MessageInfo: ksmglog.MessageInfo{From: "spam@evil.com", To: []string{"bob@corp.local"}, Subject: "invoice"},
+			AvStatus:    ksmglog.StatusInfected,
+			MaInfo:      ksmglog.MaInfo{DmarcVerdict: "reject"},
+			PartResults: []ksmglog.PartResult{{AvInfo: ksmglog.AvInfo{Threats: []string{"EICAR-Test-File"}}}},
+		},
+	}
+
+	clean := ksmglog.Record{ID: 2, Time: r.Time, Result: "Clean", Server: "ksmg02"}
+
+	buf := bytes.Buffer{}
+	p := NewPrinter(&buf, Opts{})
+	require.NoError(t, p.Send(context.Background(), []ksmglog.Record{r, clean}))
+	assert.Equal(t, "2019-06-10 12:00:00 ksmg01 Infected spam@evil.com → bob@corp.local \"invoice\" av:Infected dmarc:reject threats:EICAR-Test-File\n"+
+		"2019-06-10 12:00:00 ksmg02 Clean  →  \"\"\n", buf.String())
+
+	buf.Reset()
+	p = NewPrinter(&buf, Opts{Color: true, Fields: []string{"server", "details.messageInfo.to", "result"}})
+	require.NoError(t, p.Send(context.Background(), []ksmglog.Record{r, clean, {Result: "Unknown"}}))
+	assert.Equal(t, colorRed+"ksmg01\tbob@corp.local\tInfected"+colorReset+"\n"+
+		colorGreen+"ksmg02\t\tClean"+colorReset+"\n"+
+		colorYellow+"\t\tUnknown"+colorReset+"\n", buf.String())
+}
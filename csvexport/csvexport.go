@@ -0,0 +1,232 @@
+// Package csvexport writes records as RFC 4180 csv with configurable columns
+package csvexport
+
+import (
+	"context"
+	"encoding/csv"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/zorion79/ksmglog"
+)
+
+// Writer renders records to csv rows, it is ksmglog.Sink as well
+type Writer struct {
+	Opts
+
+	lock          sync.Mutex
+	out           io.Writer
+	csv           *csv.Writer
+	columns       []Column
+	headerWritten bool
+	written       map[rowKey]struct{} // rows of recipients written in PerRecipient mode
+}
+
+// rowKey identifies row of recipient, service sends copy of record per recipient and they give the same rows
+type rowKey struct {
+	server string
+	id     int
+	rcpt   string
+}
+
+// Opts collects parameters to initialize Writer
+type Opts struct {
+	// Columns like "details.messageInfo.from" or "Sender=details.messageInfo.from", see ksmglog.Record.Field for paths,
+	// pseudo columns "recipient" and "recipientType" are available as well
+	Columns      []string `long:"column" env:"COLUMNS" env-delim:"," description:"columns as [header=]json.path"`
+	PerRecipient bool     `long:"per-recipient" env:"PER_RECIPIENT" description:"row per to, cc and bcc recipient, once per record id"`
+	Separator    string   `long:"separator" env:"SEPARATOR" default:"; " description:"joins many values of one field"`
+	Comma        string   `long:"comma" env:"COMMA" default:"," description:"field delimiter"`
+	TimeFormat   string   `long:"time-format" env:"TIME_FORMAT" default:"2006-01-02T15:04:05Z07:00" description:"layout of time column, unix seconds if empty"`
+	BOM          bool     `long:"bom" env:"BOM" description:"start output with utf-8 byte order mark"`
+	NoCRLF       bool     `long:"no-crlf" env:"NO_CRLF" description:"end lines with LF instead of CRLF"`
+	NoHeader     bool     `long:"no-header" env:"NO_HEADER" description:"skip header row"`
+}
+
+// Column maps header to record field path
+type Column struct {
+	Header string
+	Path   string
+}
+
+// pseudo columns of recipient
+const (
+	ColRecipient     = "recipient"
+	ColRecipientType = "recipientType"
+)
+
+// DefaultColumns used if Opts.Columns is empty
+var DefaultColumns = []string{
+	"time", "server", "id", "type", "result",
+	"details.messageInfo.from", ColRecipient, "details.messageInfo.subject",
+	"details.avStatus", "details.asStatus", "details.partResults.avInfo.threats",
+}
+
+const (
+	separator = "; "
+	bom       = "\ufeff"
+)
+
+// NewWriter makes Writer writing to out
+func NewWriter(out io.Writer, opts Opts) (*Writer, error) {
+	res := &Writer{Opts: opts, out: out, written: map[rowKey]struct{}{}}
+
+	if res.Separator == "" {
+		res.Separator = separator
+	}
+	specs := res.Columns
+	if len(specs) == 0 {
+		specs = DefaultColumns
+	}
+	for _, spec := range specs {
+		res.columns = append(res.columns, ParseColumn(spec))
+	}
+
+	res.csv = csv.NewWriter(out)
+	res.csv.UseCRLF = !res.NoCRLF
+	if res.Comma != "" {
+		comma := []rune(res.Comma)
+		if len(comma) != 1 || comma[0] == '"' || comma[0] == '\r' || comma[0] == '\n' {
+			return nil, errors.Errorf("invalid field delimiter %q", res.Comma)
+		}
+		res.csv.Comma = comma[0]
+	}
+
+	return res, nil
+}
+
+// ParseColumn parses "header=path" or "path" column spec
+func ParseColumn(spec string) Column {
+	spec = strings.TrimSpace(spec)
+	if i := strings.Index(spec, "="); i >= 0 {
+		return Column{Header: strings.TrimSpace(spec[:i]), Path: strings.TrimSpace(spec[i+1:])}
+	}
+	return Column{Header: spec, Path: spec}
+}
+
+// Write writes record as one row or row per recipient. Row of recipient is written once for server and id of record,
+// so per recipient copies of record sent by service don't repeat rows, copy of cc or bcc recipient has it in To.
+func (w *Writer) Write(r ksmglog.Record) error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if err := w.header(); err != nil {
+		return err
+	}
+
+	info := r.Details.MessageInfo
+	if !w.PerRecipient {
+		return w.row(r, info.AllRecipients(), nil)
+	}
+
+	kinds := map[string]string{}
+	for _, rcpt := range info.To {
+		kinds[rcpt] = "to"
+	}
+	for _, rcpt := range info.Cc {
+		kinds[rcpt] = "cc"
+	}
+	for _, rcpt := range info.Bcc {
+		kinds[rcpt] = "bcc"
+	}
+
+	rcpts := info.AllRecipients()
+	if len(rcpts) == 0 {
+		return w.row(r, nil, nil)
+	}
+	for _, rcpt := range rcpts {
+		key := rowKey{server: r.Server, id: r.ID, rcpt: rcpt}
+		if _, ok := w.written[key]; ok {
+			continue
+		}
+		w.written[key] = struct{}{}
+
+		rec := r
+		rec.Details.MessageInfo.To = []string{rcpt}
+		rec.Details.MessageInfo.Cc = nil
+		rec.Details.MessageInfo.Bcc = nil
+		if err := w.row(rec, []string{rcpt}, []string{kinds[rcpt]}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Send writes records and flushes output, makes Writer usable as ksmglog.Sink
+func (w *Writer) Send(_ context.Context, records []ksmglog.Record) error {
+	for _, r := range records {
+		if err := w.Write(r); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// Flush writes header if nothing written yet and flushes buffered rows
+func (w *Writer) Flush() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if err := w.header(); err != nil {
+		return err
+	}
+	w.csv.Flush()
+	return errors.Wrap(w.csv.Error(), "could not write csv")
+}
+
+func (w *Writer) header() error {
+	if w.headerWritten {
+		return nil
+	}
+	w.headerWritten = true
+
+	if w.BOM {
+		w.csv.Flush()
+		if _, err := io.WriteString(w.out, bom); err != nil {
+			return errors.Wrap(err, "could not write bom")
+		}
+	}
+	if w.NoHeader {
+		return nil
+	}
+
+	header := make([]string, 0, len(w.columns))
+	for _, c := range w.columns {
+		header = append(header, c.Header)
+	}
+	return errors.Wrap(w.csv.Write(header), "could not write header")
+}
+
+func (w *Writer) row(r ksmglog.Record, rcpts, kinds []string) error {
+	row := make([]string, 0, len(w.columns))
+	for _, c := range w.columns {
+		var values []string
+		switch c.Path {
+		case ColRecipient:
+			values = rcpts
+		case ColRecipientType:
+			values = kinds
+		case "time":
+			values = []string{w.formatTime(r.Time)}
+		default:
+			var err error
+			if values, err = r.Field(c.Path); err != nil {
+				return errors.Wrapf(err, "could not get %s of record %d", c.Path, r.ID)
+			}
+		}
+		row = append(row, strings.Join(values, w.Separator))
+	}
+	return errors.Wrap(w.csv.Write(row), "could not write row")
+}
+
+func (w *Writer) formatTime(sec int) string {
+	if w.TimeFormat == "" {
+		return strconv.Itoa(sec)
+	}
+	return time.Unix(int64(sec), 0).Format(w.TimeFormat)
+}
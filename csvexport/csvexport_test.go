@@ -0,0 +1,104 @@
+package csvexport
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/zorion79/ksmglog"
+)
+
+func testRecord(t *testing.T) ksmglog.Record {
+	r := ksmglog.Record{}
+	require.NoError(t, json.Unmarshal([]byte(`{"id":1,"time":1560000000,"result":"Infected","details":{
+		"messageInfo":{"from":"a@example.com","to":["b@example.com","c@example.com"],"bcc":["d@example.com"],"subject":"Hello, \"world\""},
+		"partResults":[{"fileName":"a.doc","avInfo":{"threats":["T1","T2"]}}]}}`), &r))
+	r.Server = "ksmg01"
+	return r
+}
+
+func TestWriter_Write(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w, err := NewWriter(buf, Opts{
+		Columns: []string{"time", "server", "Sender=details.messageInfo.from", ColRecipient, "details.messageInfo.subject",
+			"Threats=details.partResults.avInfo.threats"},
+		TimeFormat: time.RFC3339,
+		BOM:        true,
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, w.Send(context.Background(), []ksmglog.Record{testRecord(t)}))
+
+	ts := time.Unix(1560000000, 0).Format(time.RFC3339)
+	assert.Equal(t, "\ufefftime,server,Sender,recipient,details.messageInfo.subject,Threats\r\n"+
+		ts+`,ksmg01,a@example.com,b@example.com; c@example.com; d@example.com,"Hello, ""world""",T1; T2`+"\r\n", buf.String())
+}
+
+func TestWriter_WritePerRecipient(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w, err := NewWriter(buf, Opts{
+		Columns:      []string{"id", ColRecipient, ColRecipientType, "details.messageInfo.to"},
+		PerRecipient: true,
+		NoCRLF:       true,
+		Comma:        ";",
+	})
+	require.NoError(t, err)
+
+	require.NoError(t, w.Write(testRecord(t)))
+	require.NoError(t, w.Write(ksmglog.Record{ID: 2}))
+	require.NoError(t, w.Flush())
+
+	assert.Equal(t, "id;recipient;recipientType;details.messageInfo.to\n"+
+		"1;b@example.com;to;b@example.com\n"+
+		"1;c@example.com;to;c@example.com\n"+
+		"1;d@example.com;bcc;d@example.com\n"+
+		"2;;;\n", buf.String())
+}
+
+func TestWriter_WritePerRecipientCopies(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w, err := NewWriter(buf, Opts{Columns: []string{"server", "id", ColRecipient, ColRecipientType}, PerRecipient: true, NoCRLF: true})
+	require.NoError(t, err)
+
+	// copies made by service per recipient, every one has its recipient in To
+	r := testRecord(t)
+	for _, rcpt := range r.Details.MessageInfo.AllRecipients() {
+		c := r
+		c.Details.MessageInfo.To = []string{rcpt}
+		require.NoError(t, w.Write(c))
+	}
+	other := testRecord(t)
+	other.Server = "ksmg02"
+	other.Details.MessageInfo.To = []string{"b@example.com"}
+	require.NoError(t, w.Write(other))
+	require.NoError(t, w.Flush())
+
+	assert.Equal(t, "server,id,recipient,recipientType\n"+
+		"ksmg01,1,b@example.com,to\n"+
+		"ksmg01,1,d@example.com,bcc\n"+
+		"ksmg01,1,c@example.com,to\n"+
+		"ksmg02,1,b@example.com,to\n"+
+		"ksmg02,1,d@example.com,bcc\n", buf.String())
+}
+
+func TestWriter_Flush(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w, err := NewWriter(buf, Opts{Columns: []string{"id"}, NoHeader: true, TimeFormat: ""})
+	require.NoError(t, err)
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "", buf.String())
+
+	w, err = NewWriter(buf, Opts{Columns: []string{"id", "time"}})
+	require.NoError(t, err)
+	require.NoError(t, w.Write(ksmglog.Record{ID: 5, Time: 10}))
+	require.NoError(t, w.Flush())
+	assert.Equal(t, "id,time\r\n5,10\r\n", buf.String())
+
+	_, err = NewWriter(buf, Opts{Comma: "ab"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,247 @@
+package ksmglog
+
+import (
+	"sort"
+	"strings"
+)
+
+// Result is verdict of KSMG for message, like Clean or Infected
+type Result string
+
+// Known results
+const (
+	ResultClean        Result = "Clean"
+	ResultInfected     Result = "Infected"
+	ResultSpam         Result = "Spam"
+	ResultProbableSpam Result = "ProbableSpam"
+	ResultPhishing     Result = "Phishing"
+	ResultBlacklisted  Result = "Blacklisted"
+	ResultRejected     Result = "Rejected"
+	ResultNotScanned   Result = "NotScanned"
+	ResultError        Result = "Error"
+)
+
+var resultDescriptions = map[string]string{
+	string(ResultClean):        "no threats found",
+	string(ResultInfected):     "malware found",
+	string(ResultSpam):         "spam",
+	string(ResultProbableSpam): "probable spam",
+	string(ResultPhishing):     "phishing",
+	string(ResultBlacklisted):  "sender or server in deny list",
+	string(ResultRejected):     "rejected by policy",
+	string(ResultNotScanned):   "not scanned",
+	string(ResultError):        "scan error",
+}
+
+// String returns raw value
+func (r Result) String() string { return string(r) }
+
+// IsKnown checks if value is one of known results, case insensitive
+func (r Result) IsKnown() bool { return isKnown(resultDescriptions, string(r)) }
+
+// Description returns human readable result, raw value if unknown
+func (r Result) Description() string { return describe(resultDescriptions, string(r)) }
+
+// RecordType is type of journal record
+type RecordType string
+
+// Known record types
+const (
+	TypeMail RecordType = "mail"
+)
+
+var typeDescriptions = map[string]string{
+	string(TypeMail): "mail message",
+}
+
+// String returns raw value
+func (t RecordType) String() string { return string(t) }
+
+// IsKnown checks if value is one of known record types, case insensitive
+func (t RecordType) IsKnown() bool { return isKnown(typeDescriptions, string(t)) }
+
+// Description returns human readable record type, raw value if unknown
+func (t RecordType) Description() string { return describe(typeDescriptions, string(t)) }
+
+// ScanStatus is status of scan engine for message or part, like AvStatus or AsStatus
+type ScanStatus string
+
+// Known scan statuses
+const (
+	StatusClean        ScanStatus = "Clean"
+	StatusInfected     ScanStatus = "Infected"
+	StatusDisinfected  ScanStatus = "Disinfected"
+	StatusDeleted      ScanStatus = "Deleted"
+	StatusProtected    ScanStatus = "Protected"
+	StatusCorrupted    ScanStatus = "Corrupted"
+	StatusSpam         ScanStatus = "Spam"
+	StatusProbableSpam ScanStatus = "ProbableSpam"
+	StatusPhishing     ScanStatus = "Phishing"
+	StatusBlacklisted  ScanStatus = "Blacklisted"
+	StatusBanned       ScanStatus = "Banned"
+	StatusSkipped      ScanStatus = "Skipped"
+	StatusNotScanned   ScanStatus = "NotScanned"
+	StatusError        ScanStatus = "Error"
+)
+
+var statusDescriptions = map[string]string{
+	string(StatusClean):        "clean",
+	string(StatusInfected):     "infected",
+	string(StatusDisinfected):  "disinfected",
+	string(StatusDeleted):      "deleted",
+	string(StatusProtected):    "password protected, can't be scanned",
+	string(StatusCorrupted):    "corrupted",
+	string(StatusSpam):         "spam",
+	string(StatusProbableSpam): "probable spam",
+	string(StatusPhishing):     "phishing",
+	string(StatusBlacklisted):  "in deny list",
+	string(StatusBanned):       "banned by content filter",
+	string(StatusSkipped):      "skipped by rule",
+	string(StatusNotScanned):   "not scanned",
+	string(StatusError):        "scan error",
+}
+
+// String returns raw value
+func (s ScanStatus) String() string { return string(s) }
+
+// IsKnown checks if value is one of known scan statuses, case insensitive
+func (s ScanStatus) IsKnown() bool { return isKnown(statusDescriptions, string(s)) }
+
+// Description returns human readable scan status, raw value if unknown
+func (s ScanStatus) Description() string { return describe(statusDescriptions, string(s)) }
+
+// NotScannedReason tells why scan engine skipped message
+type NotScannedReason string
+
+// Known reasons of not scanned messages
+const (
+	ReasonDisabled      NotScannedReason = "Disabled"
+	ReasonSizeLimit     NotScannedReason = "SizeLimit"
+	ReasonTimeout       NotScannedReason = "Timeout"
+	ReasonEncrypted     NotScannedReason = "Encrypted"
+	ReasonCorrupted     NotScannedReason = "Corrupted"
+	ReasonNoLicense     NotScannedReason = "NoLicense"
+	ReasonTrustedSender NotScannedReason = "TrustedSender"
+	ReasonError         NotScannedReason = "Error"
+)
+
+var reasonDescriptions = map[string]string{
+	string(ReasonDisabled):      "engine disabled",
+	string(ReasonSizeLimit):     "message size limit exceeded",
+	string(ReasonTimeout):       "scan timed out",
+	string(ReasonEncrypted):     "message encrypted",
+	string(ReasonCorrupted):     "message corrupted",
+	string(ReasonNoLicense):     "no valid license",
+	string(ReasonTrustedSender): "trusted sender",
+	string(ReasonError):         "engine error",
+}
+
+// String returns raw value
+func (r NotScannedReason) String() string { return string(r) }
+
+// IsKnown checks if value is one of known reasons, case insensitive
+func (r NotScannedReason) IsKnown() bool { return isKnown(reasonDescriptions, string(r)) }
+
+// Description returns human readable reason, raw value if unknown
+func (r NotScannedReason) Description() string { return describe(reasonDescriptions, string(r)) }
+
+func isKnown(descriptions map[string]string, v string) bool {
+	_, ok := lookup(descriptions, v)
+	return ok
+}
+
+func describe(descriptions map[string]string, v string) string {
+	if res, ok := lookup(descriptions, v); ok {
+		return res
+	}
+	return v
+}
+
+func lookup(descriptions map[string]string, v string) (string, bool) {
+	if res, ok := descriptions[v]; ok {
+		return res, true
+	}
+	for k, res := range descriptions {
+		if strings.EqualFold(k, v) {
+			return res, true
+		}
+	}
+	return "", false
+}
+
+// UnknownValue is value of enumerated record field not known to package, it is a sign of new KSMG version
+type UnknownValue struct {
+	Field string // json path like details.avStatus
+	Value string
+}
+
+// UnknownValues returns set fields of record with unknown values, empty fields are not reported
+func (o *Record) UnknownValues() []UnknownValue {
+	type enum interface {
+		IsKnown() bool
+		String() string
+	}
+	res := []UnknownValue{}
+	check := func(field string, v enum) {
+		if v.String() != "" && !v.IsKnown() {
+			res = append(res, UnknownValue{Field: field, Value: v.String()})
+		}
+	}
+
+	d := o.Details
+	check("type", o.Type)
+	check("result", o.Result)
+	check("details.avStatus", d.AvStatus)
+	check("details.avNotScannedReason", d.AvNotScannedReason)
+	check("details.asStatus", d.AsStatus)
+	check("details.asNotScannedReason", d.AsNotScannedReason)
+	check("details.maStatus", d.MaStatus)
+	check("details.maNotScannedReason", d.MaNotScannedReason)
+	check("details.apStatus", d.ApStatus)
+	check("details.apNotScannedReason", d.ApNotScannedReason)
+	check("details.cfStatus", d.CfStatus)
+	check("details.cfNotScannedReason", d.CfNotScannedReason)
+	check("details.ktStatus", d.KtStatus)
+	check("details.ktNotScannedReason", d.KtNotScannedReason)
+	for _, p := range d.PartResults {
+		for _, st := range p.AvInfo.Statuses {
+			check("details.partResults.avInfo.statuses.avStatus", st.AvStatus)
+		}
+		for _, st := range p.CfInfo.Statuses {
+			check("details.partResults.cfInfo.statuses", st)
+		}
+	}
+	return res
+}
+
+// UnknownValues returns unknown values of enumerated fields seen in new records since start, sorted by field and value
+func (s *Service) UnknownValues() []UnknownValue {
+	s.unknownLock.Lock()
+	defer s.unknownLock.Unlock()
+	res := make([]UnknownValue, 0, len(s.unknown))
+	for v := range s.unknown {
+		res = append(res, v)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Field != res[j].Field {
+			return res[i].Field < res[j].Field
+		}
+		return res[i].Value < res[j].Value
+	})
+	return res
+}
+
+// reportUnknown counts unknown values of record and warns once about every new one
+func (s *Service) reportUnknown(l *Record) {
+	for _, v := range l.UnknownValues() {
+		s.metrics.add(mUnknownValues, 1, "field", v.Field, "value", v.Value)
+
+		s.unknownLock.Lock()
+		_, seen := s.unknown[v]
+		s.unknown[v] = struct{}{}
+		s.unknownLock.Unlock()
+		if !seen {
+			s.log(LevelWarn, "unknown value, new KSMG version?", "server", l.Server, "field", v.Field, "value", v.Value)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package ksmglog
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEnums(t *testing.T) {
+	assert.True(t, ResultInfected.IsKnown())
+	assert.True(t, Result("infected").IsKnown())
+	assert.False(t, Result("Quarantined").IsKnown())
+	assert.False(t, Result("").IsKnown())
+	assert.Equal(t, "malware found", Result("infected").Description())
+	assert.Equal(t, "Quarantined", Result("Quarantined").Description())
+	assert.Equal(t, "Infected", ResultInfected.String())
+
+	assert.True(t, TypeMail.IsKnown())
+	assert.Equal(t, "mail message", TypeMail.Description())
+	assert.True(t, StatusNotScanned.IsKnown())
+	assert.Equal(t, "banned by content filter", StatusBanned.Description())
+	assert.True(t, ReasonSizeLimit.IsKnown())
+	assert.Equal(t, "message size limit exceeded", NotScannedReason("sizelimit").Description())
+	assert.False(t, NotScannedReason("Quota").IsKnown())
+}
+
+func TestRecord_UnknownValues(t *testing.T) {
+	data := `{"id":1,"type":"mail","result":"Quarantined","details":{"avStatus":"Infected","asStatus":"Greylisted",` +
+		`"asNotScannedReason":"","partResults":[{"avInfo":{"statuses":[{"avStatus":"Clean"},{"avStatus":"Suspicious"}]},` +
+		`"cfInfo":{"statuses":["Banned","Renamed"]}}]}}`
+	var r Record
+	require.NoError(t, json.Unmarshal([]byte(data), &r))
+	assert.Equal(t, StatusInfected, r.Details.AvStatus)
+
+	assert.Equal(t, []UnknownValue{
+		{Field: "result", Value: "Quarantined"},
+		{Field: "details.asStatus", Value: "Greylisted"},
+		{Field: "details.partResults.avInfo.statuses.avStatus", Value: "Suspicious"},
+		{Field: "details.partResults.cfInfo.statuses", Value: "Renamed"},
+	}, r.UnknownValues())
+
+	r = Record{Type: TypeMail, Result: ResultClean}
+	assert.Empty(t, r.UnknownValues())
+}
+
+func TestRecord_EnumsJSON(t *testing.T) {
+	r := Record{ID: 1, Type: TypeMail, Result: ResultSpam}
+	r.Details.AsStatus = StatusSpam
+	r.Details.KtNotScannedReason = ReasonDisabled
+	b, err := json.Marshal(r)
+	require.NoError(t, err)
+	assert.Contains(t, string(b), `"type":"mail","result":"Spam"`)
+	assert.Contains(t, string(b), `"asStatus":"Spam"`)
+	assert.Contains(t, string(b), `"ktNotScannedReason":"Disabled"`)
+
+	res, err := r.Field("details.asStatus")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Spam"}, res)
+}
+
+func TestService_UnknownValues(t *testing.T) {
+	logger := &memLogger{}
+	svc := NewService(Opts{Logger: logger})
+	go func() {
+		for range svc.Channel() {
+		}
+	}()
+
+	r := &Record{ID: 1, Time: int(time.Now().Unix()), Server: "ksmg01", Result: "Quarantined"}
+	r.Details.MessageInfo.To = []string{"a@example.com", "b@example.com"}
+	svc.logsToChannel([]*Record{r})
+	close(svc.newLogCh)
+
+	assert.Equal(t, []UnknownValue{{Field: "result", Value: "Quarantined"}}, svc.UnknownValues())
+	assert.Contains(t, scrape(t, svc.Metrics()), `ksmglog_unknown_values_total{field="result",value="Quarantined"} 1`+"\n")
+	assert.Equal(t, []string{"WARN unknown value, new KSMG version? [server ksmg01 field result value Quarantined]"}, logger.all())
+}
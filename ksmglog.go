@@ -2,15 +2,15 @@ package ksmglog
 
 import (
 	"context"
-	"crypto/tls"
 	"encoding/json"
+	"fmt"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	log "github.com/go-pkgz/lgr"
 	"github.com/pkg/errors"
 )
 
@@ -18,36 +18,75 @@ import (
 type Service struct {
 	Opts
 
-	logMapAll map[string]interface{}
-	newLogCh  chan Record
-	loopTime  time.Time
+	logMapAll   map[string]interface{}
+	dedupLock   sync.Mutex // guards logMapAll, it is changed by delivery reports of sinks
+	newLogCh    chan Record
+	loopTime    time.Time
+	metrics     *Metrics
+	lock        sync.RWMutex // guards Opts and servers changed by Reload
+	servers     []*server
+	serverByURL map[string]*server
+	fallback    map[string]*server // servers of urls not known to service, made on first use
+	unknownLock sync.Mutex
+	unknown     map[UnknownValue]struct{} // unknown values of enumerated fields seen
 }
 
 // Opts collects parameters to initialize Service
 type Opts struct {
 	URL       []string      `long:"urls-paths" env:"URL" description:"urls like https://ksmg01/ksmg/en-US/cgi-bin/klwi split with commas" env-delim:","`
 	User      string        `long:"admin-user" env:"USER" description:"admin user name"`
-	Password  string        `long:"admin-password" env:"PASS" description:"admin password"`
+	Password  string        `long:"admin-password" env:"PASS" description:"admin password, file:path, cmd:command or keystore:name"`
 	SleepTime time.Duration `long:"sleep-time" env:"SLEEP_TIME" default:"1m" description:"sleep time after every run"`
 	Timeout   time.Duration `long:"http-time-out" env:"TIME_OUT" default:"5s" description:"http client timeout"`
+
+	Keystore     string `long:"keystore" env:"KEYSTORE" description:"encrypted keystore file with keystore:name passwords"`
+	KeystorePass string `long:"keystore-pass" env:"KEYSTORE_PASS" description:"keystore passphrase, file:path or cmd:command"`
+
+	// Servers are polled in addition to URL, with own credentials and settings
+	Servers []Server `no-flag:"true"`
+
+	// Logger gets messages of service, they are discarded if not set
+	Logger Logger `no-flag:"true"`
+}
+
+// String hides passwords
+func (o Opts) String() string {
+	return fmt.Sprintf("%+v", plainOpts(o.redacted()))
+}
+
+// GoString hides passwords
+func (o Opts) GoString() string {
+	return "ksmglog.Opts" + strings.TrimPrefix(fmt.Sprintf("%#v", plainOpts(o.redacted())), "ksmglog.plainOpts")
+}
+
+// plainOpts is Opts without String methods
+type plainOpts Opts
+
+func (o Opts) redacted() Opts {
+	o.Password, o.KeystorePass = redact(o.Password), redact(o.KeystorePass)
+	o.Servers = append([]Server{}, o.Servers...)
+	for i := range o.Servers {
+		o.Servers[i] = o.Servers[i].redacted()
+	}
+	return o
 }
 
 const (
 	sleepTime = 10 * time.Second
+
+	// journalFilters selects journal window of polling
+	journalFilters = `{"dateType":8}`
 )
 
 // NewService initializes everything
 func NewService(opts Opts) *Service {
-	res := &Service{
-		Opts: opts,
-	}
-
-	if res.SleepTime.Seconds() < 1 {
-		res.SleepTime = sleepTime
-	}
+	res := &Service{}
 
 	res.newLogCh = make(chan Record)
 	res.logMapAll = make(map[string]interface{})
+	res.unknown = make(map[UnknownValue]struct{})
+	res.metrics = NewMetrics()
+	res.setOpts(opts)
 
 	return res
 }
@@ -57,65 +96,118 @@ func (s *Service) Run(ctx context.Context) {
 	for {
 		select {
 		case <-ctx.Done():
-			log.Printf("[WARN] terminate service")
+			s.log(LevelWarn, "terminate service")
 			close(s.newLogCh)
 			return
 		default:
-			logs, err := s.GetLogs()
+			logs, err := s.getDueLogs(time.Now())
 			if err != nil {
-				log.Printf("[WARN] could not get logs: %v", err)
-				time.Sleep(s.SleepTime)
+				s.log(LevelWarn, "could not get logs", "error", err)
+				time.Sleep(s.sleepTime())
 				continue
 			}
 
 			s.logsToChannel(logs)
 
-			time.Sleep(s.SleepTime)
+			time.Sleep(s.sleepTime())
 		}
 	}
 }
 
-// GetLogs return last audit logs
+// GetLogs return last audit logs. Server which accepted login but returned no session token is failed at login
+// and counted in login failures.
 func (s *Service) GetLogs() (records []*Record, err error) {
 	records = make([]*Record, 0)
-	for _, ksmgURL := range s.URL {
-		_, c2htoken, cookies, err := s.userLogin(ksmgURL)
+	for _, srv := range s.serverList() {
+		recs, err := s.getServerLogs(srv.URL)
 		if err != nil {
-			return nil, errors.Wrap(err, "could not login")
+			return nil, err
 		}
+		records = append(records, recs...)
+	}
 
-		time.Sleep(100 * time.Millisecond)
+	return records, nil
+}
 
-		_, actionID, cookies, err := s.getCurrentTime(ksmgURL, c2htoken, cookies)
+// getDueLogs return last audit logs of servers with passed poll interval
+func (s *Service) getDueLogs(now time.Time) (records []*Record, err error) {
+	records = make([]*Record, 0)
+	for _, srv := range s.dueServers(now) {
+		recs, err := s.getServerLogs(srv.URL)
 		if err != nil {
-			return nil, errors.Wrap(err, "could not get current time")
+			return nil, err
 		}
+		records = append(records, recs...)
+	}
 
-		time.Sleep(300 * time.Millisecond)
+	return records, nil
+}
 
-		cookies, err = s.getCurrentTimeWithActionID(ksmgURL, c2htoken, actionID, cookies)
-		if err != nil {
-			return nil, errors.Wrap(err, "could not get current time for action id")
+// getServerLogs return last audit logs of one server and updates its poll metrics
+func (s *Service) getServerLogs(ksmgURL string) ([]*Record, error) {
+	srv := s.server(ksmgURL)
+	server := srv.Name
+	start := time.Now()
+
+	recs, stage, err := s.journal(ksmgURL, srv.Filters)
+	if err != nil {
+		if stage == "login" {
+			s.metrics.add(mLoginFailures, 1, "server", server)
 		}
+		s.metrics.add(mPollErrors, 1, "server", server, "stage", stage)
+		return nil, err
+	}
 
-		time.Sleep(300 * time.Millisecond)
+	s.metrics.observe(mPollDuration, time.Since(start).Seconds(), "server", server)
+	s.metrics.add(mFetched, float64(len(recs)), "server", server)
+	s.metrics.set(mLastSuccess, float64(time.Now().Unix()), "server", server)
 
-		actionID, err = s.eventLoggerJournalQuery(ksmgURL, c2htoken, cookies)
-		if err != nil {
-			return nil, errors.Wrap(err, "could not get event logger action id")
-		}
+	return recs, nil
+}
 
-		time.Sleep(2500 * time.Millisecond)
+// journal logs in to server and runs journal query with filters json, returns failed stage on error
+func (s *Service) journal(ksmgURL, filters string) (recs []*Record, stage string, err error) {
+	_, c2htoken, cookies, err := s.userLogin(ksmgURL)
+	if err != nil {
+		return nil, "login", errors.Wrap(err, "could not login")
+	}
+	if c2htoken == "" {
+		return nil, "login", errors.New("could not login: no session token returned")
+	}
 
-		recs, err := s.eventLoggerJournalQueryWithActionID(ksmgURL, c2htoken, actionID, cookies)
-		if err != nil {
-			return nil, errors.Wrap(err, "could not get records")
-		}
+	time.Sleep(100 * time.Millisecond)
 
-		records = append(records, recs...)
+	_, actionID, cookies, err := s.getCurrentTime(ksmgURL, c2htoken, cookies)
+	if err != nil {
+		return nil, "current_time", errors.Wrap(err, "could not get current time")
 	}
 
-	return records, nil
+	time.Sleep(300 * time.Millisecond)
+
+	_, _, cookies, err = s.getCurrentTimeWithActionID(ksmgURL, c2htoken, actionID, cookies)
+	if err != nil {
+		return nil, "current_time", errors.Wrap(err, "could not get current time for action id")
+	}
+
+	time.Sleep(300 * time.Millisecond)
+
+	actionID, err = s.eventLoggerJournalQuery(ksmgURL, c2htoken, filters, cookies)
+	if err != nil {
+		return nil, "journal_query", errors.Wrap(err, "could not get event logger action id")
+	}
+
+	time.Sleep(2500 * time.Millisecond)
+
+	recs, err = s.eventLoggerJournalQueryWithActionID(ksmgURL, c2htoken, filters, actionID, cookies)
+	if err != nil {
+		return nil, "journal_result", errors.Wrap(err, "could not get records")
+	}
+
+	server := s.server(ksmgURL).Name
+	for _, r := range recs {
+		r.Server = server
+	}
+	return recs, "", nil
 }
 
 // Channel return channel with new logs
@@ -123,10 +215,58 @@ func (s *Service) Channel() <-chan Record {
 	return s.newLogCh
 }
 
+// Metrics return service metrics, it is http.Handler serving them in prometheus format
+func (s *Service) Metrics() *Metrics {
+	return s.metrics
+}
+
+// String hides passwords
+func (s *Service) String() string {
+	return "Service" + s.Opts.String()
+}
+
+// GoString hides passwords
+func (s *Service) GoString() string {
+	return "&ksmglog.Service{Opts:" + s.Opts.GoString() + "}"
+}
+
+// log sends message to logger of options
+func (s *Service) log(level, msg string, keyvals ...interface{}) {
+	s.lock.RLock()
+	l := s.Logger
+	s.lock.RUnlock()
+	logTo(l, level, msg, keyvals...)
+}
+
+// userLogin logs in with password of server, password is resolved again and login retried once if rejected
 func (s *Service) userLogin(ksmgURL string) (userType int, c2htoken string, cookie []*http.Cookie, err error) {
+	srv := s.server(ksmgURL)
+	password, err := srv.password(false)
+	if err != nil {
+		return -1, "", []*http.Cookie{}, err
+	}
+
+	userType, c2htoken, cookie, err = s.login(ksmgURL, srv.User, password)
+	if err == nil && c2htoken != "" {
+		return userType, c2htoken, cookie, nil
+	}
+
+	fresh, perr := srv.password(true)
+	if perr != nil {
+		s.log(LevelWarn, "could not refresh password", "server", srv.Name, "error", perr)
+		return userType, c2htoken, cookie, err
+	}
+	if fresh == password {
+		return userType, c2htoken, cookie, err
+	}
+	s.log(LevelInfo, "password changed, login again", "server", srv.Name)
+	return s.login(ksmgURL, srv.User, fresh)
+}
+
+func (s *Service) login(ksmgURL, user, password string) (userType int, c2htoken string, cookie []*http.Cookie, err error) {
 	requestBody := url.Values{}
-	requestBody.Set("username", s.User)
-	requestBody.Set("password", s.Password)
+	requestBody.Set("username", user)
+	requestBody.Set("password", password)
 	body := strings.NewReader(requestBody.Encode())
 	req, _ := http.NewRequest("POST", ksmgURL, body)
 	query := req.URL.Query()
@@ -135,13 +275,13 @@ func (s *Service) userLogin(ksmgURL string) (userType int, c2htoken string, cook
 	req.URL.RawQuery = query.Encode()
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	resp, err := s.doRequest(req)
+	resp, err := s.doRequest(ksmgURL, req)
 	if err != nil {
 		return -1, "", []*http.Cookie{}, errors.Wrap(err, "could not request")
 	}
 	defer func() {
 		if err = resp.Body.Close(); err != nil {
-			log.Printf("[WARN] could not close body: %v", err)
+			s.log(LevelWarn, "could not close body", "server", s.server(ksmgURL).Name, "error", err)
 		}
 	}()
 
@@ -157,7 +297,9 @@ func (s *Service) userLogin(ksmgURL string) (userType int, c2htoken string, cook
 		return -1, "", []*http.Cookie{}, errors.Wrap(err, "could not unmarshal body")
 	}
 
-	log.Printf("[DEBUG] result from login: %v", result)
+	secrets.add(password, result.C2htoken)
+	s.log(LevelDebug, "logged in", "server", s.server(ksmgURL).Name, "action", result.Action, "user", user,
+		"user_type", result.UserType, "token_received", result.C2htoken != "")
 
 	return result.UserType, result.C2htoken, resp.Cookies(), nil
 }
@@ -173,13 +315,13 @@ func (s *Service) getCurrentTime(ksmgURL string, c2htoken string, cookies []*htt
 		req.AddCookie(cookie)
 	}
 
-	resp, err := s.doRequest(req)
+	resp, err := s.doRequest(ksmgURL, req)
 	if err != nil {
 		return "", -1, []*http.Cookie{}, errors.Wrap(err, "could not request")
 	}
 	defer func() {
 		if err = resp.Body.Close(); err != nil {
-			log.Printf("[WARN] could not close body: %v", err)
+			s.log(LevelWarn, "could not close body", "server", s.server(ksmgURL).Name, "error", err)
 		}
 	}()
 
@@ -194,12 +336,11 @@ func (s *Service) getCurrentTime(ksmgURL string, c2htoken string, cookies []*htt
 		return "", -1, []*http.Cookie{}, errors.Wrap(err, "could not unmarshal body")
 	}
 
-	log.Printf("[DEBUG] result from getCurrentTime: %v", result)
-
 	return result.Action, result.ActionID, resp.Cookies(), nil
 }
 
-func (s *Service) getCurrentTimeWithActionID(ksmgURL string, c2htoken string, actionID int, cookies []*http.Cookie) ([]*http.Cookie, error) {
+// getCurrentTimeWithActionID returns server time zone and unix time
+func (s *Service) getCurrentTimeWithActionID(ksmgURL string, c2htoken string, actionID int, cookies []*http.Cookie) (tz string, serverTime int, cookie []*http.Cookie, err error) {
 	req, _ := http.NewRequest("POST", ksmgURL, nil)
 	query := req.URL.Query()
 	query.Add("action", "getCurrentTime")
@@ -212,13 +353,13 @@ func (s *Service) getCurrentTimeWithActionID(ksmgURL string, c2htoken string, ac
 		req.AddCookie(cookie)
 	}
 
-	resp, err := s.doRequest(req)
+	resp, err := s.doRequest(ksmgURL, req)
 	if err != nil {
-		return []*http.Cookie{}, errors.Wrap(err, "could not request")
+		return "", 0, []*http.Cookie{}, errors.Wrap(err, "could not request")
 	}
 	defer func() {
 		if err = resp.Body.Close(); err != nil {
-			log.Printf("[WARN] could not close body: %v", err)
+			s.log(LevelWarn, "could not close body", "server", s.server(ksmgURL).Name, "error", err)
 		}
 	}()
 
@@ -233,33 +374,34 @@ func (s *Service) getCurrentTimeWithActionID(ksmgURL string, c2htoken string, ac
 	decoder := json.NewDecoder(resp.Body)
 	err = decoder.Decode(&result)
 	if err != nil {
-		return []*http.Cookie{}, errors.Wrap(err, "could not unmarshal body")
+		return "", 0, []*http.Cookie{}, errors.Wrap(err, "could not unmarshal body")
 	}
 
-	log.Printf("[DEBUG] result from getCurrentTimeWithActionID: %v", result)
+	s.log(LevelDebug, "server time", "server", s.server(ksmgURL).Name, "action", result.Action, "action_id", actionID,
+		"tz", result.Data.Tz, "time", result.Data.Time)
 
-	return resp.Cookies(), nil
+	return result.Data.Tz, result.Data.Time, resp.Cookies(), nil
 }
 
-func (s *Service) eventLoggerJournalQuery(ksmgURL string, c2htoken string, cookies []*http.Cookie) (actionID int, err error) {
+func (s *Service) eventLoggerJournalQuery(ksmgURL string, c2htoken string, filters string, cookies []*http.Cookie) (actionID int, err error) {
 	req, _ := http.NewRequest("POST", ksmgURL, nil)
 	query := req.URL.Query()
 	query.Add("action", "eventLoggerJournalQuery")
 	query.Add("C2HToken", c2htoken)
-	query.Set("data", `{"filters":{"dateType":8}}`)
+	query.Set("data", `{"filters":`+filters+`}`)
 	req.URL.RawQuery = query.Encode()
 
 	for _, cookie := range cookies {
 		req.AddCookie(cookie)
 	}
 
-	resp, err := s.doRequest(req)
+	resp, err := s.doRequest(ksmgURL, req)
 	if err != nil {
 		return -1, err
 	}
 	defer func() {
 		if err = resp.Body.Close(); err != nil {
-			log.Printf("[WARN] could not close body: %v", err)
+			s.log(LevelWarn, "could not close body", "server", s.server(ksmgURL).Name, "error", err)
 		}
 	}()
 
@@ -274,17 +416,15 @@ func (s *Service) eventLoggerJournalQuery(ksmgURL string, c2htoken string, cooki
 		return -1, errors.Wrap(err, "could not unmarshal body")
 	}
 
-	log.Printf("[DEBUG] result from eventLoggerJournalQuery: %v", result)
-
 	return result.ActionID, nil
 }
 
-func (s *Service) eventLoggerJournalQueryWithActionID(ksmgURL string, c2htoken string, actionID int, cookies []*http.Cookie) (res []*Record, err error) {
+func (s *Service) eventLoggerJournalQueryWithActionID(ksmgURL string, c2htoken string, filters string, actionID int, cookies []*http.Cookie) (res []*Record, err error) {
 	req, _ := http.NewRequest("POST", ksmgURL, nil)
 	query := req.URL.Query()
 	query.Add("action", "eventLoggerJournalQuery")
 	query.Add("C2HToken", c2htoken)
-	query.Add("data", `{"filters":{"dateType":8}}`)
+	query.Add("data", `{"filters":`+filters+`}`)
 	query.Add("action_id", strconv.Itoa(actionID))
 	req.URL.RawQuery = query.Encode()
 
@@ -292,13 +432,13 @@ func (s *Service) eventLoggerJournalQueryWithActionID(ksmgURL string, c2htoken s
 		req.AddCookie(cookie)
 	}
 
-	resp, err := s.doRequest(req)
+	resp, err := s.doRequest(ksmgURL, req)
 	if err != nil {
 		return nil, err
 	}
 	defer func() {
 		if err = resp.Body.Close(); err != nil {
-			log.Printf("[WARN] could not close body: %v", err)
+			s.log(LevelWarn, "could not close body", "server", s.server(ksmgURL).Name, "error", err)
 		}
 	}()
 
@@ -323,21 +463,30 @@ func (s *Service) eventLoggerJournalQueryWithActionID(ksmgURL string, c2htoken s
 	return res, nil
 }
 
-func (s *Service) doRequest(r *http.Request) (*http.Response, error) {
-	client := &http.Client{
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true, //nolint:gosec
-			},
-		},
-		Timeout: s.Timeout,
+func (s *Service) doRequest(ksmgURL string, r *http.Request) (*http.Response, error) {
+	srv := s.server(ksmgURL)
+	start := time.Now()
+	resp, err := srv.client.Do(r)
+	fields := []interface{}{"server", srv.Name, "action", r.URL.Query().Get("action")}
+	if id := r.URL.Query().Get("action_id"); id != "" {
+		fields = append(fields, "action_id", id)
 	}
-
-	resp, err := client.Do(r)
+	fields = append(fields, "duration", time.Since(start))
 	if err != nil {
+		s.log(LevelDebug, "request failed", append(fields, "error", err)...)
+		if uerr, ok := err.(*url.Error); ok { // url of request has session token
+			uerr.URL = secrets.redact(uerr.URL)
+		}
 		return nil, errors.Wrap(err, "could not request")
 	}
 
+	for _, c := range resp.Cookies() {
+		if len(c.Value) >= minCookieLen {
+			secrets.add(c.Value)
+		}
+	}
+
+	s.log(LevelDebug, "request done", append(fields, "status", resp.StatusCode)...)
 	if resp.StatusCode != http.StatusOK {
 		return nil, errors.New(resp.Status)
 	}
@@ -347,63 +496,135 @@ func (s *Service) doRequest(r *http.Request) (*http.Response, error) {
 
 func (s *Service) logsToChannel(logs []*Record) {
 	s.loopTime = time.Now().AddDate(0, 0, -1)
+
+	backlog := 0
+	for _, l := range logs {
+		info := l.Details.MessageInfo
+		backlog += len(info.To) + len(info.Cc) + len(info.Bcc)
+	}
+	s.metrics.set(mChannelBacklog, float64(backlog))
+
 	for _, l := range logs {
-		s.extractToRecipient(l)
-		s.extractCcRecipient(l)
-		s.extractBccRecipient(l)
+		sent := s.extractToRecipient(l)
+		sent += s.extractCcRecipient(l)
+		sent += s.extractBccRecipient(l)
+		if sent > 0 {
+			s.countVerdicts(l)
+			s.reportUnknown(l)
+		}
+	}
+
+	s.dedupLock.Lock()
+	s.metrics.set(mDedupEntries, float64(len(s.logMapAll)))
+	s.dedupLock.Unlock()
+}
+
+// Delivered is delivery report of record got from channel, like kafka.Opts.OnDelivery.
+// Failed record is removed from dedup state, so it is sent to channel again if the next poll still returns it.
+func (s *Service) Delivered(r Record, err error) {
+	if err == nil {
+		return
+	}
+	if hashErr := r.Hash(); hashErr != nil {
+		s.log(LevelWarn, "could not create hash string", "server", r.Server, "record", r.ID, "error", hashErr)
+		return
 	}
+	s.dedupLock.Lock()
+	delete(s.logMapAll, r.HashString)
+	s.dedupLock.Unlock()
+	s.log(LevelDebug, "record not delivered, it is sent again on next poll", "server", r.Server, "record", r.ID)
 }
 
-func (s *Service) extractToRecipient(l *Record) {
+func (s *Service) extractToRecipient(l *Record) (sent int) {
 	for _, to := range l.Details.MessageInfo.To {
 		l.Details.MessageInfo.To = []string{to}
 
-		err := s.sendLog(*l)
+		ok, err := s.sendLog(*l)
 		if err != nil {
-			log.Printf("[WARN] could not send log: %v", err)
+			s.log(LevelWarn, "could not send record", "server", l.Server, "error", err)
 			continue
 		}
+		if ok {
+			sent++
+		}
 	}
+	return sent
 }
 
-func (s *Service) extractCcRecipient(l *Record) {
+func (s *Service) extractCcRecipient(l *Record) (sent int) {
 	for _, cc := range l.Details.MessageInfo.Cc {
 		l.Details.MessageInfo.To = []string{cc}
-		err := s.sendLog(*l)
+		ok, err := s.sendLog(*l)
 		if err != nil {
-			log.Printf("[WARN] could not send log: %v", err)
+			s.log(LevelWarn, "could not send record", "server", l.Server, "error", err)
 			continue
 		}
+		if ok {
+			sent++
+		}
 	}
+	return sent
 }
 
-func (s *Service) extractBccRecipient(l *Record) {
+func (s *Service) extractBccRecipient(l *Record) (sent int) {
 	for _, bcc := range l.Details.MessageInfo.Bcc {
 		l.Details.MessageInfo.To = []string{bcc}
-		err := s.sendLog(*l)
+		ok, err := s.sendLog(*l)
 		if err != nil {
-			log.Printf("[WARN] could not send log: %v", err)
+			s.log(LevelWarn, "could not send record", "server", l.Server, "error", err)
+		}
+		if ok {
+			sent++
 		}
 	}
+	return sent
 }
 
-func (s *Service) sendLog(l Record) error {
+// sendLog sends record to channel if it is not seen before, returns true if sent
+func (s *Service) sendLog(l Record) (bool, error) {
+	defer s.metrics.add(mChannelBacklog, -1)
+
 	if err := l.Hash(); err != nil {
-		return errors.Wrap(err, "could not create hash string")
+		return false, errors.Wrap(err, "could not create hash string")
 	}
 
 	lTime := time.Unix(int64(l.Time), 0)
 
 	if lTime.Before(s.loopTime) {
-		// log.Printf("[DEBUG] time %v before %v", lTime, s.loopTime)
+		// s.log(LevelDebug, "record expired", "time", lTime, "loop_time", s.loopTime)
+		s.dedupLock.Lock()
 		delete(s.logMapAll, l.HashString)
-		return nil
+		s.dedupLock.Unlock()
+		s.metrics.add(mExpired, 1, "server", l.Server)
+		return false, nil
 	}
 
-	if _, ok := s.logMapAll[l.HashString]; !ok {
-		s.logMapAll[l.HashString] = nil
+	s.dedupLock.Lock()
+	_, seen := s.logMapAll[l.HashString]
+	s.logMapAll[l.HashString] = nil
+	s.dedupLock.Unlock()
+	if !seen {
 		s.newLogCh <- l
-		return nil
+		s.metrics.add(mEmitted, 1, "server", l.Server)
+		return true, nil
+	}
+	s.metrics.add(mDeduped, 1, "server", l.Server)
+	return false, nil
+}
+
+// countVerdicts updates business metrics for new message
+func (s *Service) countVerdicts(l *Record) {
+	d := l.Details
+	s.metrics.add(mMessages, 1, "result", string(l.Result))
+	if d.AvStatus != "" {
+		s.metrics.add(mScanStatus, 1, "engine", "av", "status", string(d.AvStatus))
+	}
+	if d.AsStatus != "" {
+		s.metrics.add(mScanStatus, 1, "engine", "as", "status", string(d.AsStatus))
+	}
+	for _, p := range d.PartResults {
+		for _, threat := range p.AvInfo.Threats {
+			s.metrics.add(mThreats, 1, "threat", threat)
+		}
 	}
-	return nil
 }
@@ -3,6 +3,7 @@ package ksmglog
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -30,10 +31,41 @@ func TestService_Run(t *testing.T) {
 	for r := range ch {
 		t.Logf("%+v", r)
 		assert.Equal(t, 222, r.ID)
+		assert.Equal(t, "127.0.0.1", r.Server)
 	}
 	cancel()
 }
 
+func TestService_Delivered(t *testing.T) {
+	svc := NewService(Opts{})
+	emitted := make(chan Record, 10)
+	go func() {
+		for r := range svc.Channel() {
+			emitted <- r
+		}
+		close(emitted)
+	}()
+
+	r := Record{ID: 1, Time: int(time.Now().Unix()), Server: "ksmg01"}
+	r.Details.MessageInfo.To = []string{"a@example.com"}
+	poll := func() { l := r; svc.logsToChannel([]*Record{&l}) }
+
+	poll()
+	got := <-emitted
+	poll()
+	svc.Delivered(got, nil)
+	poll()
+	svc.Delivered(got, errors.New("broker is down"))
+	poll()
+	close(svc.newLogCh)
+
+	res := []Record{got}
+	for rec := range emitted {
+		res = append(res, rec)
+	}
+	assert.Equal(t, 2, len(res), "failed record emitted again, delivered one deduped")
+}
+
 func router(t *testing.T) http.Handler {
 	mux := http.NewServeMux()
 
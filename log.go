@@ -0,0 +1,82 @@
+package ksmglog
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+)
+
+// Logger receives messages of package with key/value fields like "server", "ksmg01", "duration", time.Second.
+// Secrets are masked in message and fields before they are passed to logger.
+type Logger interface {
+	Log(level, msg string, keyvals ...interface{})
+}
+
+// Log levels
+const (
+	LevelDebug = "DEBUG"
+	LevelInfo  = "INFO"
+	LevelWarn  = "WARN"
+)
+
+// LoggerFunc is an adapter to use ordinary function as Logger
+type LoggerFunc func(level, msg string, keyvals ...interface{})
+
+// Log calls f(level, msg, keyvals...)
+func (f LoggerFunc) Log(level, msg string, keyvals ...interface{}) { f(level, msg, keyvals...) }
+
+// NopLogger discards messages, it is used if logger is not set
+var NopLogger Logger = LoggerFunc(func(string, string, ...interface{}) {})
+
+// NewLgrLogger makes Logger printing lines like "[WARN] could not get logs server=ksmg01 error=..." to lgr logger,
+// pass lgr.Func(lgr.Printf) to follow the global logger
+func NewLgrLogger(l log.L) Logger {
+	return LoggerFunc(func(level, msg string, keyvals ...interface{}) {
+		b := strings.Builder{}
+		b.WriteString("[" + level + "] " + msg)
+		for i := 0; i < len(keyvals); i += 2 {
+			var v interface{} = "(missing)"
+			if i+1 < len(keyvals) {
+				v = keyvals[i+1]
+			}
+			s := fmt.Sprint(v)
+			if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+				s = strconv.Quote(s)
+			}
+			b.WriteString(fmt.Sprintf(" %v=%s", keyvals[i], s))
+		}
+		l.Logf("%s", b.String())
+	})
+}
+
+// MaskedLogger returns logger passing messages to l with secrets masked as in messages of service,
+// nil l makes logger discarding messages. Sinks and notifiers use it for their Logger option.
+func MaskedLogger(l Logger) Logger {
+	return LoggerFunc(func(level, msg string, keyvals ...interface{}) { logTo(l, level, msg, keyvals...) })
+}
+
+// logTo passes message with secrets masked to logger, nil logger discards it
+func logTo(l Logger, level, msg string, keyvals ...interface{}) {
+	if l == nil {
+		return
+	}
+	res := make([]interface{}, len(keyvals))
+	for i, v := range keyvals {
+		switch val := v.(type) {
+		case time.Duration, time.Time:
+			res[i] = v
+		case string:
+			res[i] = secrets.redact(val)
+		case error:
+			res[i] = secrets.redact(val.Error())
+		case fmt.Stringer:
+			res[i] = secrets.redact(val.String())
+		default:
+			res[i] = v
+		}
+	}
+	l.Log(level, secrets.redact(msg), res...)
+}
@@ -0,0 +1,81 @@
+package ksmglog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// memLogger collects messages as lines with fields
+type memLogger struct {
+	lock  sync.Mutex
+	lines []string
+}
+
+func (m *memLogger) Log(level, msg string, keyvals ...interface{}) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.lines = append(m.lines, fmt.Sprintf("%s %s %v", level, msg, keyvals))
+}
+
+func (m *memLogger) all() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return append([]string{}, m.lines...)
+}
+
+func TestNewLgrLogger(t *testing.T) {
+	var line string
+	l := NewLgrLogger(log.Func(func(format string, args ...interface{}) { line = fmt.Sprintf(format, args...) }))
+
+	l.Log(LevelWarn, "could not get logs", "server", "ksmg01", "duration", 1500*time.Millisecond,
+		"error", errors.New("bad gateway"), "empty", "", "odd")
+	assert.Equal(t, `[WARN] could not get logs server=ksmg01 duration=1.5s error="bad gateway" empty="" odd=(missing)`, line)
+}
+
+func TestLogTo(t *testing.T) {
+	secrets.add("logto-secret-value")
+	var level, msg string
+	var fields []interface{}
+	l := LoggerFunc(func(lv, m string, keyvals ...interface{}) { level, msg, fields = lv, m, keyvals })
+
+	logTo(l, LevelDebug, "request C2HToken=abc", "duration", time.Second, "error", errors.New("logto-secret-value rejected"),
+		"id", 5, "stringer", stringer("logto-secret-value"))
+	assert.Equal(t, LevelDebug, level)
+	assert.Equal(t, "request C2HToken=*****", msg)
+	assert.Equal(t, []interface{}{"duration", time.Second, "error", "***** rejected", "id", 5, "stringer", "*****"}, fields)
+
+	logTo(nil, LevelWarn, "discarded")
+	NopLogger.Log(LevelWarn, "discarded")
+}
+
+func TestMaskedLogger(t *testing.T) {
+	secrets.add("masked-secret-value")
+	logger := &memLogger{}
+	MaskedLogger(logger).Log(LevelWarn, "could not send", "error", errors.New("token=masked-secret-value rejected"))
+	assert.Equal(t, []string{"WARN could not send [error token=***** rejected]"}, logger.all())
+
+	MaskedLogger(nil).Log(LevelWarn, "discarded")
+}
+
+func TestConsume_Logger(t *testing.T) {
+	logger := &memLogger{}
+	ch := make(chan Record, 1)
+	ch <- Record{ID: 1}
+	close(ch)
+	failing := SinkFunc(func(context.Context, []Record) error { return errors.New("down") })
+
+	require.NoError(t, Consume(context.Background(), ch, failing, BatchOpts{Logger: logger}))
+	assert.Equal(t, []string{"WARN could not send records [records 1 error down]"}, logger.all())
+}
+
+type stringer string
+
+func (s stringer) String() string { return string(s) }
@@ -0,0 +1,214 @@
+package ksmglog
+
+import (
+	"bufio"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metrics collects service and mail verdict metrics and serves them in prometheus text format
+type Metrics struct {
+	lock    sync.Mutex
+	metrics map[string]*metric
+}
+
+type metric struct {
+	name    string
+	help    string
+	kind    string // counter, gauge or histogram
+	buckets []float64
+	samples map[string]*sample // by rendered labels
+}
+
+type sample struct {
+	value   float64
+	sum     float64
+	count   uint64
+	buckets []uint64
+}
+
+// metric kinds
+const (
+	counter   = "counter"
+	gauge     = "gauge"
+	histogram = "histogram"
+)
+
+// metric names
+const (
+	mPollDuration    = "ksmglog_poll_duration_seconds"
+	mPollErrors      = "ksmglog_poll_errors_total"
+	mLoginFailures   = "ksmglog_login_failures_total"
+	mLastSuccess     = "ksmglog_last_success_timestamp_seconds"
+	mFetched         = "ksmglog_records_fetched_total"
+	mEmitted         = "ksmglog_records_emitted_total"
+	mDeduped         = "ksmglog_records_deduped_total"
+	mExpired         = "ksmglog_records_expired_total"
+	mDedupEntries    = "ksmglog_dedup_entries"
+	mChannelBacklog  = "ksmglog_channel_backlog"
+	mMessages        = "ksmglog_messages_total"
+	mScanStatus      = "ksmglog_scan_status_total"
+	mThreats         = "ksmglog_threats_total"
+	mUnknownValues   = "ksmglog_unknown_values_total"
+	mRouteMatched    = "ksmglog_route_matched_total"
+	mRouteDropped    = "ksmglog_route_dropped_total"
+	mRouteSent       = "ksmglog_route_sent_total"
+	mRouteErrors     = "ksmglog_route_errors_total"
+	mRouteQueue      = "ksmglog_route_queue_length"
+	metricsMediaType = "text/plain; version=0.0.4; charset=utf-8"
+)
+
+var pollBuckets = []float64{1, 2.5, 5, 10, 20, 30, 60, 120}
+
+// NewMetrics makes Metrics with all service metrics registered
+func NewMetrics() *Metrics {
+	res := &Metrics{metrics: make(map[string]*metric)}
+
+	res.register(mPollDuration, histogram, "Duration of journal poll per server, including pauses between requests.")
+	res.register(mPollErrors, counter, "Failed journal polls per server and stage.")
+	res.register(mLoginFailures, counter, "Failed logins per server.")
+	res.register(mLastSuccess, gauge, "Unix time of last successful poll per server.")
+	res.register(mFetched, counter, "Records fetched from journal per server.")
+	res.register(mEmitted, counter, "Records sent to channel per server, one per recipient.")
+	res.register(mDeduped, counter, "Records skipped as already sent per server.")
+	res.register(mExpired, counter, "Records skipped as older than dedup window per server.")
+	res.register(mDedupEntries, gauge, "Hashes kept for deduplication.")
+	res.register(mChannelBacklog, gauge, "Records of last poll waiting to be sent to channel.")
+	res.register(mMessages, counter, "New messages by result.")
+	res.register(mScanStatus, counter, "New messages by scan engine and status.")
+	res.register(mThreats, counter, "Threats found in new messages by name.")
+	res.register(mUnknownValues, counter, "New messages with values of result, type and scan statuses unknown to ksmglog by field and value.")
+	res.register(mRouteMatched, counter, "Records matched by route.")
+	res.register(mRouteDropped, counter, "Records dropped because route queue is full.")
+	res.register(mRouteSent, counter, "Records delivered by route sink.")
+	res.register(mRouteErrors, counter, "Failed batches of route sink.")
+	res.register(mRouteQueue, gauge, "Records waiting in route queue.")
+
+	return res
+}
+
+// ServeHTTP writes all metrics in prometheus text exposition format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", metricsMediaType)
+	buf := bufio.NewWriter(w)
+	m.write(buf)
+	_ = buf.Flush()
+}
+
+func (m *Metrics) register(name, kind, help string) {
+	mt := &metric{name: name, kind: kind, help: help, samples: make(map[string]*sample)}
+	if kind == histogram {
+		mt.buckets = pollBuckets
+	}
+	m.metrics[name] = mt
+}
+
+// add increases counter or gauge by v
+func (m *Metrics) add(name string, v float64, labels ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.sample(name, labels).value += v
+}
+
+// set sets gauge to v
+func (m *Metrics) set(name string, v float64, labels ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.sample(name, labels).value = v
+}
+
+// observe adds v to histogram
+func (m *Metrics) observe(name string, v float64, labels ...string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	s := m.sample(name, labels)
+	s.sum += v
+	s.count++
+	for i, b := range m.metrics[name].buckets {
+		if v <= b {
+			s.buckets[i]++
+		}
+	}
+}
+
+// sample returns sample of metric for labels given as name, value pairs, creates it if missing
+func (m *Metrics) sample(name string, labels []string) *sample {
+	mt := m.metrics[name]
+	key := renderLabels(labels)
+	s, ok := mt.samples[key]
+	if !ok {
+		s = &sample{buckets: make([]uint64, len(mt.buckets))}
+		mt.samples[key] = s
+	}
+	return s
+}
+
+func (m *Metrics) write(w *bufio.Writer) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	names := make([]string, 0, len(m.metrics))
+	for name := range m.metrics {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		mt := m.metrics[name]
+		_, _ = w.WriteString("# HELP " + name + " " + mt.help + "\n")
+		_, _ = w.WriteString("# TYPE " + name + " " + mt.kind + "\n")
+
+		keys := make([]string, 0, len(mt.samples))
+		for k := range mt.samples {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		for _, k := range keys {
+			s := mt.samples[k]
+			if mt.kind != histogram {
+				writeSample(w, name, k, s.value)
+				continue
+			}
+			for i, b := range mt.buckets {
+				writeSample(w, name+"_bucket", withLabel(k, "le", formatFloat(b)), float64(s.buckets[i]))
+			}
+			writeSample(w, name+"_bucket", withLabel(k, "le", "+Inf"), float64(s.count))
+			writeSample(w, name+"_sum", k, s.sum)
+			writeSample(w, name+"_count", k, float64(s.count))
+		}
+	}
+}
+
+func writeSample(w *bufio.Writer, name, labels string, v float64) {
+	_, _ = w.WriteString(name + labels + " " + formatFloat(v) + "\n")
+}
+
+// renderLabels makes {k1="v1",k2="v2"} from pairs, empty string if no labels
+func renderLabels(pairs []string) string {
+	if len(pairs) < 2 {
+		return ""
+	}
+	parts := make([]string, 0, len(pairs)/2)
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, pairs[i]+"="+strconv.Quote(pairs[i+1]))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+// withLabel appends label to rendered labels
+func withLabel(labels, name, value string) string {
+	l := name + "=" + strconv.Quote(value)
+	if labels == "" {
+		return "{" + l + "}"
+	}
+	return strings.TrimSuffix(labels, "}") + "," + l + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
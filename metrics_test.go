@@ -0,0 +1,87 @@
+package ksmglog
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics_ServeHTTP(t *testing.T) {
+	m := NewMetrics()
+	m.add(mFetched, 2, "server", "ksmg01")
+	m.add(mFetched, 3, "server", "ksmg01")
+	m.set(mDedupEntries, 7)
+	m.observe(mPollDuration, 3, "server", "ksmg01")
+	m.add(mThreats, 1, "threat", `EICAR "test"`)
+
+	body := scrape(t, m)
+	assert.Contains(t, body, "# TYPE ksmglog_records_fetched_total counter\n")
+	assert.Contains(t, body, `ksmglog_records_fetched_total{server="ksmg01"} 5`+"\n")
+	assert.Contains(t, body, "ksmglog_dedup_entries 7\n")
+	assert.Contains(t, body, `ksmglog_poll_duration_seconds_bucket{server="ksmg01",le="2.5"} 0`+"\n")
+	assert.Contains(t, body, `ksmglog_poll_duration_seconds_bucket{server="ksmg01",le="5"} 1`+"\n")
+	assert.Contains(t, body, `ksmglog_poll_duration_seconds_bucket{server="ksmg01",le="+Inf"} 1`+"\n")
+	assert.Contains(t, body, `ksmglog_poll_duration_seconds_sum{server="ksmg01"} 3`+"\n")
+	assert.Contains(t, body, `ksmglog_poll_duration_seconds_count{server="ksmg01"} 1`+"\n")
+	assert.Contains(t, body, `ksmglog_threats_total{threat="EICAR \"test\""} 1`+"\n")
+}
+
+func TestService_Metrics(t *testing.T) {
+	ht := httptest.NewServer(router(t))
+	defer ht.Close()
+
+	svc := NewService(Opts{URL: []string{ht.URL}, Timeout: time.Second})
+	logs, err := svc.GetLogs()
+	require.NoError(t, err)
+
+	r := &Record{ID: 1, Time: int(time.Now().Unix()), Server: "ksmg01", Result: "Infected"}
+	r.Details.MessageInfo.To = []string{"a@example.com", "b@example.com"}
+	r.Details.AvStatus = "infected"
+	logs = append(logs, r)
+
+	go func() {
+		for range svc.Channel() {
+		}
+	}()
+	svc.logsToChannel(logs)
+	r.Details.MessageInfo.To = []string{"a@example.com"}
+	svc.logsToChannel([]*Record{r})
+	close(svc.newLogCh)
+
+	body := scrape(t, svc.Metrics())
+	assert.Contains(t, body, `ksmglog_records_fetched_total{server="127.0.0.1"} 2`+"\n")
+	assert.Contains(t, body, `ksmglog_poll_duration_seconds_count{server="127.0.0.1"} 1`+"\n")
+	assert.Contains(t, body, `ksmglog_last_success_timestamp_seconds{server="127.0.0.1"}`)
+	assert.Contains(t, body, `ksmglog_records_emitted_total{server="ksmg01"} 2`+"\n")
+	assert.Contains(t, body, `ksmglog_records_deduped_total{server="ksmg01"} 1`+"\n")
+	assert.Contains(t, body, "ksmglog_dedup_entries 2\n")
+	assert.Contains(t, body, "ksmglog_channel_backlog 0\n")
+	assert.Contains(t, body, `ksmglog_messages_total{result="Infected"} 1`+"\n")
+	assert.Contains(t, body, `ksmglog_scan_status_total{engine="av",status="infected"} 1`+"\n")
+
+	svc = NewService(Opts{URL: []string{"http://127.0.0.1:1"}, Timeout: 100 * time.Millisecond})
+	_, err = svc.GetLogs()
+	require.Error(t, err)
+	body = scrape(t, svc.Metrics())
+	assert.Contains(t, body, `ksmglog_login_failures_total{server="127.0.0.1"} 1`+"\n")
+	assert.Contains(t, body, `ksmglog_poll_errors_total{server="127.0.0.1",stage="login"} 1`+"\n")
+}
+
+func scrape(t *testing.T, m *Metrics) string {
+	ts := httptest.NewServer(m)
+	defer ts.Close()
+
+	resp, err := ts.Client().Get(ts.URL + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	assert.True(t, strings.HasPrefix(resp.Header.Get("Content-Type"), "text/plain; version=0.0.4"))
+
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	return string(body)
+}
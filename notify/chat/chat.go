@@ -0,0 +1,288 @@
+// Package chat sends alerts about high severity records to Slack, Mattermost or Microsoft Teams incoming webhooks
+package chat
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/zorion79/ksmglog"
+)
+
+// Alerter picks high severity records passed to Send and posts them to chat webhook.
+// Alerts arrived within GroupWait are grouped into one message and messages are sent not more
+// often than MinInterval, alerts accumulate meanwhile.
+type Alerter struct {
+	Opts
+
+	client *http.Client
+
+	lock     sync.Mutex
+	pending  []Alert
+	first    time.Time // arrival of oldest pending alert
+	lastSent time.Time
+}
+
+// Opts collects parameters to initialize Alerter
+type Opts struct {
+	URL                string        `long:"url" env:"URL" description:"incoming webhook url"`
+	Format             string        `long:"format" env:"FORMAT" choice:"slack" choice:"mattermost" choice:"teams" default:"slack" description:"message format"`
+	Channel            string        `long:"channel" env:"CHANNEL" description:"channel override for slack and mattermost"`
+	Username           string        `long:"username" env:"USERNAME" default:"ksmglog" description:"bot name for slack and mattermost"`
+	GroupWait          time.Duration `long:"group-wait" env:"GROUP_WAIT" default:"10s" description:"time to collect burst of alerts into one message"`
+	MinInterval        time.Duration `long:"min-interval" env:"MIN_INTERVAL" default:"1m" description:"min time between messages"`
+	MaxAlerts          int           `long:"max-alerts" env:"MAX_ALERTS" default:"10" description:"max alerts detailed in one message"`
+	DmarcVerdicts      []string      `long:"dmarc-verdict" env:"DMARC_VERDICTS" env-delim:"," default:"reject" description:"dmarc verdicts to alert on"`
+	Timeout            time.Duration `long:"timeout" env:"TIMEOUT" default:"5s" description:"http client timeout"`
+	InsecureSkipVerify bool          `long:"insecure" env:"INSECURE" description:"skip webhook certificate verification"`
+
+	// Logger gets messages of alerter, they are discarded if not set
+	Logger ksmglog.Logger `no-flag:"true"`
+}
+
+// Alert is high severity record with reasons of alerting
+type Alert struct {
+	Record  ksmglog.Record
+	Reasons []string
+}
+
+// Formats
+const (
+	Slack      = "slack"
+	Mattermost = "mattermost"
+	Teams      = "teams"
+)
+
+// Alert reasons
+const (
+	ReasonVirus = "virus found"
+	ReasonMacro = "document with macro"
+	ReasonDmarc = "dmarc"
+)
+
+const (
+	username    = "ksmglog"
+	groupWait   = 10 * time.Second
+	minInterval = time.Minute
+	maxAlerts   = 10
+	timeout     = 5 * time.Second
+)
+
+// NewAlerter initializes everything
+func NewAlerter(opts Opts) *Alerter {
+	res := &Alerter{Opts: opts}
+	res.Logger = ksmglog.MaskedLogger(res.Logger)
+
+	if res.Format == "" {
+		res.Format = Slack
+	}
+	if res.Username == "" {
+		res.Username = username
+	}
+	if res.GroupWait <= 0 {
+		res.GroupWait = groupWait
+	}
+	if res.MinInterval <= 0 {
+		res.MinInterval = minInterval
+	}
+	if res.MaxAlerts <= 0 {
+		res.MaxAlerts = maxAlerts
+	}
+	if len(res.DmarcVerdicts) == 0 {
+		res.DmarcVerdicts = []string{"reject"}
+	}
+	if res.Timeout <= 0 {
+		res.Timeout = timeout
+	}
+
+	res.client = &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: res.InsecureSkipVerify, //nolint:gosec
+			},
+		},
+		Timeout: res.Timeout,
+	}
+
+	return res
+}
+
+// Send queues alerts for high severity records. Service sends copy of record per recipient,
+// copy of pending alert by server and id adds its recipient to the alert instead of raising another one.
+func (a *Alerter) Send(_ context.Context, records []ksmglog.Record) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	for _, r := range records {
+		reasons := a.Reasons(r)
+		if len(reasons) == 0 {
+			continue
+		}
+		if a.merge(r) {
+			continue
+		}
+		if len(a.pending) == 0 {
+			a.first = time.Now()
+		}
+		a.pending = append(a.pending, Alert{Record: r, Reasons: reasons})
+	}
+	return nil
+}
+
+// merge adds recipients of record copy to pending alert of the same record, returns false if there is no such alert
+func (a *Alerter) merge(r ksmglog.Record) bool {
+	for i := range a.pending {
+		rec := &a.pending[i].Record
+		if rec.Server != r.Server || rec.ID != r.ID {
+			continue
+		}
+		have := map[string]bool{}
+		for _, rcpt := range rec.Details.MessageInfo.AllRecipients() {
+			have[strings.ToLower(rcpt)] = true
+		}
+		to := append([]string{}, rec.Details.MessageInfo.To...) // don't touch array of record passed to Send
+		for _, rcpt := range r.Details.MessageInfo.To {
+			if !have[strings.ToLower(rcpt)] {
+				to = append(to, rcpt)
+			}
+		}
+		rec.Details.MessageInfo.To = to
+		return true
+	}
+	return false
+}
+
+// Reasons returns why record should be alerted, empty for ordinary records
+func (a *Alerter) Reasons(r ksmglog.Record) []string {
+	d := r.Details
+	res := []string{}
+
+	virus := strings.EqualFold(string(r.Result), string(ksmglog.ResultInfected)) ||
+		strings.EqualFold(string(d.AvStatus), string(ksmglog.StatusInfected))
+	macro := d.DocWithMacroDetected
+	for _, p := range d.PartResults {
+		virus = virus || p.IsInfected()
+		macro = macro || p.AvInfo.DocWithMacroDetected
+	}
+	if virus {
+		res = append(res, ReasonVirus)
+	}
+	if macro {
+		res = append(res, ReasonMacro)
+	}
+	for _, v := range a.DmarcVerdicts {
+		if d.MaInfo.DmarcVerdict != "" && strings.EqualFold(v, d.MaInfo.DmarcVerdict) {
+			res = append(res, ReasonDmarc+" "+d.MaInfo.DmarcVerdict)
+			break
+		}
+	}
+	return res
+}
+
+// Run posts grouped alerts until ctx done
+func (a *Alerter) Run(ctx context.Context) {
+	tick := a.GroupWait
+	if a.MinInterval < tick {
+		tick = a.MinInterval
+	}
+	ticker := time.NewTicker(tick / 4)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if !a.ready(now) {
+				continue
+			}
+			if err := a.Flush(ctx); err != nil {
+				a.Logger.Log(ksmglog.LevelWarn, "could not send chat alert", "error", err)
+			}
+		}
+	}
+}
+
+// ready checks if burst is collected and rate limit allows to send
+func (a *Alerter) ready(now time.Time) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return len(a.pending) > 0 && now.Sub(a.first) >= a.GroupWait && now.Sub(a.lastSent) >= a.MinInterval
+}
+
+// Flush posts all pending alerts as one message right now, alerts are kept if post failed
+func (a *Alerter) Flush(ctx context.Context) error {
+	a.lock.Lock()
+	alerts := a.pending
+	first := a.first
+	a.pending = nil
+	a.lastSent = time.Now()
+	a.lock.Unlock()
+
+	if len(alerts) == 0 {
+		return nil
+	}
+
+	err := a.post(ctx, alerts)
+	if err != nil {
+		a.lock.Lock()
+		a.pending = append(alerts, a.pending...)
+		a.first = first
+		a.lock.Unlock()
+	}
+	return err
+}
+
+func (a *Alerter) post(ctx context.Context, alerts []Alert) error {
+	payload, err := a.payload(alerts)
+	if err != nil {
+		return errors.Wrap(err, "could not make payload")
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return errors.Wrap(err, "could not marshal payload")
+	}
+
+	req, err := http.NewRequest("POST", a.URL, bytes.NewReader(body))
+	if err != nil {
+		return errors.Wrap(err, "could not make request")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := a.client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "could not request")
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err = resp.Body.Close(); err != nil {
+		a.Logger.Log(ksmglog.LevelWarn, "could not close body", "error", err)
+	}
+
+	if resp.StatusCode/100 != 2 {
+		return errors.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+func (a *Alerter) payload(alerts []Alert) (interface{}, error) {
+	switch a.Format {
+	case Slack:
+		return a.slack(alerts), nil
+	case Mattermost:
+		return a.mattermost(alerts), nil
+	case Teams:
+		return a.teams(alerts), nil
+	default:
+		return nil, errors.Errorf("unknown format %q", a.Format)
+	}
+}
@@ -0,0 +1,161 @@
+package chat
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/zorion79/ksmglog"
+)
+
+func testRecords(t *testing.T) []ksmglog.Record {
+	virus := ksmglog.Record{}
+	require.NoError(t, json.Unmarshal([]byte(`{"id":1,"result":"Infected","details":{
+		"messageInfo":{"from":"bad@evil.com","to":["b@example.com"],"subject":"<invoice>"},
+		"partResults":[{"fileName":"invoice.doc","avInfo":{"threats":["HEUR:Trojan"],"docWithMacroDetected":true}}]}}`), &virus))
+	virus.Server = "ksmg01"
+
+	dmarc := ksmglog.Record{ID: 2, Result: "Rejected"}
+	dmarc.Details.MaInfo.DmarcVerdict = "Reject"
+	return []ksmglog.Record{virus, dmarc, {ID: 3, Result: "Clean"}}
+}
+
+func TestAlerter_Reasons(t *testing.T) {
+	a := NewAlerter(Opts{})
+	recs := testRecords(t)
+	assert.Equal(t, []string{ReasonVirus, ReasonMacro}, a.Reasons(recs[0]))
+	assert.Equal(t, []string{"dmarc Reject"}, a.Reasons(recs[1]))
+	assert.Equal(t, []string{}, a.Reasons(recs[2]))
+
+	r := ksmglog.Record{}
+	r.Details.AvStatus = "Infected"
+	assert.Equal(t, []string{ReasonVirus}, a.Reasons(r))
+	r.Details.AvStatus = "VirusScanFailed"
+	assert.Equal(t, []string{}, a.Reasons(r), "only known infected status")
+	assert.Equal(t, []string{ReasonVirus}, a.Reasons(ksmglog.Record{Result: ksmglog.ResultInfected}))
+}
+
+func TestAlerter_SendCopies(t *testing.T) {
+	a := NewAlerter(Opts{})
+	virus := testRecords(t)[0]
+	virus.Details.MessageInfo.Cc = []string{"c@example.com"}
+	copies := []ksmglog.Record{}
+	for _, to := range []string{"b@example.com", "d@example.com", "c@example.com"} {
+		c := virus
+		c.Details.MessageInfo.To = []string{to}
+		copies = append(copies, c)
+	}
+	other := virus
+	other.Server = "ksmg02"
+	require.NoError(t, a.Send(context.Background(), append(copies, other)))
+
+	require.Equal(t, 2, len(a.pending), "one alert per server and id")
+	assert.Equal(t, []string{"b@example.com", "d@example.com"}, a.pending[0].Record.Details.MessageInfo.To)
+	assert.Equal(t, []string{"b@example.com"}, copies[0].Details.MessageInfo.To)
+	assert.Equal(t, "ksmg02", a.pending[1].Record.Server)
+}
+
+func TestAlerter_Formats(t *testing.T) {
+	alerts := []Alert{}
+	a := NewAlerter(Opts{Channel: "#sec", MaxAlerts: 1})
+	for _, r := range testRecords(t) {
+		if reasons := a.Reasons(r); len(reasons) > 0 {
+			alerts = append(alerts, Alert{Record: r, Reasons: reasons})
+		}
+	}
+
+	slack := marshal(t, a.slack(alerts))
+	assert.Equal(t, "KSMG alerts: 2 high severity messages", slack["text"])
+	assert.Equal(t, "#sec", slack["channel"])
+	blocks := slack["blocks"].([]interface{})
+	require.Equal(t, 4, len(blocks))
+	section := blocks[2].(map[string]interface{})
+	assert.Equal(t, "*virus found, document with macro*", section["text"].(map[string]interface{})["text"])
+	assert.Contains(t, mustJSON(t, section["fields"]), `*Subject*\n\u0026lt;invoice\u0026gt;`)
+	assert.Contains(t, mustJSON(t, section["fields"]), `*Attachment invoice.doc*\nHEUR:Trojan, macro`)
+	assert.Equal(t, "context", blocks[3].(map[string]interface{})["type"])
+
+	mm := marshal(t, a.mattermost(alerts[:1]))
+	assert.Equal(t, "#### KSMG alert: virus found, document with macro", mm["text"])
+	att := mm["attachments"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, alertColor, att["color"])
+	assert.Contains(t, mustJSON(t, att["fields"]), `{"short":true,"title":"From","value":"bad@evil.com"}`)
+
+	teams := marshal(t, a.teams(alerts))
+	assert.Equal(t, "MessageCard", teams["@type"])
+	assert.Equal(t, "d00000", teams["themeColor"])
+	sections := teams["sections"].([]interface{})
+	require.Equal(t, 2, len(sections))
+	assert.Contains(t, mustJSON(t, sections[0]), `{"name":"Server","value":"ksmg01"}`)
+	assert.Equal(t, "... and 1 more", sections[1].(map[string]interface{})["text"])
+}
+
+func TestAlerter_Run(t *testing.T) {
+	var lock sync.Mutex
+	messages := []map[string]interface{}{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		msg := map[string]interface{}{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&msg))
+		lock.Lock()
+		messages = append(messages, msg)
+		lock.Unlock()
+	}))
+	defer ts.Close()
+
+	a := NewAlerter(Opts{URL: ts.URL, Format: Teams, GroupWait: 50 * time.Millisecond, MinInterval: 200 * time.Millisecond})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.Run(ctx)
+
+	recs := testRecords(t)
+	require.NoError(t, a.Send(ctx, recs[:1]))
+	require.NoError(t, a.Send(ctx, recs[1:]))
+	time.Sleep(150 * time.Millisecond)
+
+	lock.Lock()
+	require.Equal(t, 1, len(messages), "burst grouped into one message")
+	assert.Equal(t, 2, len(messages[0]["sections"].([]interface{})))
+	lock.Unlock()
+
+	require.NoError(t, a.Send(ctx, recs[:1]))
+	time.Sleep(50 * time.Millisecond)
+	lock.Lock()
+	assert.Equal(t, 1, len(messages), "rate limited")
+	lock.Unlock()
+
+	time.Sleep(300 * time.Millisecond)
+	lock.Lock()
+	assert.Equal(t, 2, len(messages))
+	lock.Unlock()
+}
+
+func TestAlerter_FlushFailed(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer ts.Close()
+
+	a := NewAlerter(Opts{URL: ts.URL, Format: Mattermost})
+	require.NoError(t, a.Send(context.Background(), testRecords(t)))
+	assert.Error(t, a.Flush(context.Background()))
+	assert.Equal(t, 2, len(a.pending), "alerts kept")
+}
+
+func marshal(t *testing.T, v interface{}) map[string]interface{} {
+	res := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal([]byte(mustJSON(t, v)), &res))
+	return res
+}
+
+func mustJSON(t *testing.T, v interface{}) string {
+	b, err := json.Marshal(v)
+	require.NoError(t, err)
+	return string(b)
+}
@@ -0,0 +1,176 @@
+package chat
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const alertColor = "#d00000"
+
+// line is plain text view of alert shared by all formats
+type line struct {
+	title  string
+	fields [][2]string
+}
+
+func (a *Alerter) title(alerts []Alert) string {
+	if len(alerts) == 1 {
+		return "KSMG alert: " + strings.Join(alerts[0].Reasons, ", ")
+	}
+	return fmt.Sprintf("KSMG alerts: %d high severity messages", len(alerts))
+}
+
+// lines returns details of up to MaxAlerts alerts and number of omitted ones
+func (a *Alerter) lines(alerts []Alert) (res []line, omitted int) {
+	if len(alerts) > a.MaxAlerts {
+		omitted = len(alerts) - a.MaxAlerts
+		alerts = alerts[:a.MaxAlerts]
+	}
+
+	for _, al := range alerts {
+		r := al.Record
+		info := r.Details.MessageInfo
+		l := line{title: strings.Join(al.Reasons, ", ")}
+		l.fields = append(l.fields,
+			[2]string{"Time", time.Unix(int64(r.Time), 0).Format("2006-01-02 15:04:05")},
+			[2]string{"Server", r.Server},
+			[2]string{"Result", string(r.Result)},
+			[2]string{"From", info.From},
+			[2]string{"To", strings.Join(info.AllRecipients(), ", ")},
+			[2]string{"Subject", info.Subject},
+		)
+		for _, p := range r.Details.PartResults {
+			if len(p.AvInfo.Threats) > 0 || p.AvInfo.DocWithMacroDetected {
+				value := strings.Join(p.AvInfo.Threats, ", ")
+				if p.AvInfo.DocWithMacroDetected {
+					value = strings.TrimPrefix(value+", macro", ", ")
+				}
+				l.fields = append(l.fields, [2]string{"Attachment " + p.FileName, value})
+			}
+		}
+		if v := r.Details.MaInfo.DmarcVerdict; v != "" {
+			l.fields = append(l.fields, [2]string{"DMARC", v})
+		}
+		res = append(res, l)
+	}
+	return res, omitted
+}
+
+func omittedText(omitted int) string {
+	return fmt.Sprintf("... and %d more", omitted)
+}
+
+// slack renders message with block kit
+func (a *Alerter) slack(alerts []Alert) map[string]interface{} {
+	title := a.title(alerts)
+	blocks := []map[string]interface{}{
+		{"type": "header", "text": map[string]interface{}{"type": "plain_text", "text": title}},
+	}
+
+	lines, omitted := a.lines(alerts)
+	for _, l := range lines {
+		fields := []map[string]interface{}{}
+		for _, f := range l.fields {
+			if f[1] == "" {
+				continue
+			}
+			fields = append(fields, map[string]interface{}{"type": "mrkdwn", "text": "*" + slackEscape(f[0]) + "*\n" + slackEscape(f[1])})
+		}
+		blocks = append(blocks,
+			map[string]interface{}{"type": "divider"},
+			map[string]interface{}{
+				"type":   "section",
+				"text":   map[string]interface{}{"type": "mrkdwn", "text": "*" + slackEscape(l.title) + "*"},
+				"fields": limit(fields, 10), // slack allows up to 10 fields in section
+			},
+		)
+	}
+	if omitted > 0 {
+		blocks = append(blocks, map[string]interface{}{
+			"type":     "context",
+			"elements": []map[string]interface{}{{"type": "mrkdwn", "text": omittedText(omitted)}},
+		})
+	}
+
+	res := map[string]interface{}{"text": title, "blocks": blocks, "username": a.Username}
+	if a.Channel != "" {
+		res["channel"] = a.Channel
+	}
+	return res
+}
+
+// mattermost renders message with slack compatible attachments
+func (a *Alerter) mattermost(alerts []Alert) map[string]interface{} {
+	title := a.title(alerts)
+	attachments := []map[string]interface{}{}
+
+	lines, omitted := a.lines(alerts)
+	for _, l := range lines {
+		fields := []map[string]interface{}{}
+		for _, f := range l.fields {
+			if f[1] == "" {
+				continue
+			}
+			fields = append(fields, map[string]interface{}{"title": f[0], "value": f[1], "short": len(f[1]) < 40})
+		}
+		attachments = append(attachments, map[string]interface{}{
+			"fallback": l.title,
+			"color":    alertColor,
+			"title":    l.title,
+			"fields":   fields,
+		})
+	}
+
+	text := "#### " + title
+	if omitted > 0 {
+		text += "\n" + omittedText(omitted)
+	}
+	res := map[string]interface{}{"text": text, "attachments": attachments, "username": a.Username}
+	if a.Channel != "" {
+		res["channel"] = a.Channel
+	}
+	return res
+}
+
+// teams renders legacy actionable message card
+func (a *Alerter) teams(alerts []Alert) map[string]interface{} {
+	title := a.title(alerts)
+	sections := []map[string]interface{}{}
+
+	lines, omitted := a.lines(alerts)
+	for _, l := range lines {
+		facts := []map[string]interface{}{}
+		for _, f := range l.fields {
+			if f[1] == "" {
+				continue
+			}
+			facts = append(facts, map[string]interface{}{"name": f[0], "value": f[1]})
+		}
+		sections = append(sections, map[string]interface{}{"activityTitle": l.title, "facts": facts})
+	}
+	if omitted > 0 {
+		sections = append(sections, map[string]interface{}{"text": omittedText(omitted)})
+	}
+
+	return map[string]interface{}{
+		"@type":      "MessageCard",
+		"@context":   "http://schema.org/extensions",
+		"summary":    title,
+		"title":      title,
+		"themeColor": strings.TrimPrefix(alertColor, "#"),
+		"sections":   sections,
+	}
+}
+
+// slackEscape escapes control characters of slack mrkdwn
+func slackEscape(s string) string {
+	return strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace(s)
+}
+
+func limit(fields []map[string]interface{}, max int) []map[string]interface{} {
+	if len(fields) > max {
+		return fields[:max]
+	}
+	return fields
+}
@@ -0,0 +1,482 @@
+// Package digest collects records and periodically emails summary of them via smtp
+package digest
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"fmt"
+	htmltemplate "html/template"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/zorion79/ksmglog"
+)
+
+// Notifier accumulates records passed to Send and emails digest of them every Period.
+// Service sends copy of record per recipient, copies are counted as one message by server and id.
+type Notifier struct {
+	Opts
+
+	lock    sync.Mutex
+	digest  *Digest
+	senders map[string]int
+	results map[string]int
+	seen    map[message]bool // messages of current digest
+}
+
+// message identifies record and its per recipient copies
+type message struct {
+	server string
+	id     int
+}
+
+// Opts collects parameters to initialize Notifier
+type Opts struct {
+	Host               string        `long:"host" env:"HOST" description:"smtp server host"`
+	Port               int           `long:"port" env:"PORT" default:"587" description:"smtp server port"`
+	User               string        `long:"user" env:"USER" description:"smtp auth user, no auth if empty"`
+	Password           string        `long:"password" env:"PASSWORD" description:"smtp auth password"`
+	TLS                bool          `long:"tls" env:"TLS" description:"use implicit tls, usually on port 465"`
+	NoStartTLS         bool          `long:"no-starttls" env:"NO_STARTTLS" description:"don't upgrade connection with STARTTLS"`
+	InsecureSkipVerify bool          `long:"insecure" env:"INSECURE" description:"skip smtp server certificate verification"`
+	Timeout            time.Duration `long:"timeout" env:"TIMEOUT" default:"30s" description:"smtp connection timeout"`
+
+	From    string   `long:"from" env:"FROM" description:"digest sender address"`
+	To      []string `long:"to" env:"TO" env-delim:"," description:"digest recipients"`
+	Subject string   `long:"subject" env:"SUBJECT" default:"KSMG digest" description:"digest subject"`
+
+	Period        time.Duration `long:"period" env:"PERIOD" default:"24h" description:"digest period"`
+	TopSenders    int           `long:"top-senders" env:"TOP_SENDERS" default:"10" description:"number of top blocked senders"`
+	MaxDetections int           `long:"max-detections" env:"MAX_DETECTIONS" default:"100" description:"max malware detections listed"`
+	CleanResults  []string      `long:"clean-result" env:"CLEAN_RESULTS" env-delim:"," default:"Clean" description:"results of not blocked messages"`
+	SkipEmpty     bool          `long:"skip-empty" env:"SKIP_EMPTY" description:"don't send digest without records"`
+
+	// Logger gets messages of notifier, they are discarded if not set
+	Logger ksmglog.Logger `no-flag:"true"`
+}
+
+// Digest is data of one digest email
+type Digest struct {
+	Start      time.Time
+	End        time.Time
+	Total      int
+	Blocked    int
+	ByResult   []Count
+	TopSenders []Count
+	Detections []Detection
+	Truncated  int // detections not listed because of MaxDetections
+}
+
+// Count is number of records with Name
+type Count struct {
+	Name  string
+	Count int
+}
+
+// Detection is malware found in message attachment
+type Detection struct {
+	ID       int
+	Time     time.Time
+	Server   string
+	From     string
+	To       []string
+	Subject  string
+	FileName string
+	Threats  []string
+}
+
+const (
+	port          = 587
+	timeout       = 30 * time.Second
+	subject       = "KSMG digest"
+	period        = 24 * time.Hour
+	topSenders    = 10
+	maxDetections = 100
+)
+
+// NewNotifier initializes everything
+func NewNotifier(opts Opts) *Notifier {
+	res := &Notifier{Opts: opts}
+	res.Logger = ksmglog.MaskedLogger(res.Logger)
+
+	if res.Port <= 0 {
+		res.Port = port
+	}
+	if res.Timeout <= 0 {
+		res.Timeout = timeout
+	}
+	if res.Subject == "" {
+		res.Subject = subject
+	}
+	if res.Period <= 0 {
+		res.Period = period
+	}
+	if res.TopSenders <= 0 {
+		res.TopSenders = topSenders
+	}
+	if res.MaxDetections <= 0 {
+		res.MaxDetections = maxDetections
+	}
+	if len(res.CleanResults) == 0 {
+		res.CleanResults = []string{"Clean"}
+	}
+	res.reset(time.Now())
+
+	return res
+}
+
+// Send adds records to current digest
+func (n *Notifier) Send(_ context.Context, records []ksmglog.Record) error {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	for _, r := range records {
+		n.add(r)
+	}
+	return nil
+}
+
+// Run emails digest every Period until ctx done
+func (n *Notifier) Run(ctx context.Context) {
+	ticker := time.NewTicker(n.Period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := n.Flush(ctx); err != nil {
+				n.Logger.Log(ksmglog.LevelWarn, "could not send digest", "error", err)
+			}
+		}
+	}
+}
+
+// Flush emails digest of records collected so far and starts new one.
+// Collected records are returned to the next digest if email can't be sent.
+func (n *Notifier) Flush(ctx context.Context) error {
+	n.lock.Lock()
+	d := n.current(time.Now())
+	taken, senders, results, seen := n.digest, n.senders, n.results, n.seen
+	n.reset(d.End)
+	n.lock.Unlock()
+
+	if d.Total == 0 && n.SkipEmpty {
+		return nil
+	}
+
+	msg, err := n.message(d)
+	if err == nil {
+		err = n.sendMail(ctx, msg)
+	}
+	if err != nil {
+		n.lock.Lock()
+		n.merge(taken, senders, results, seen)
+		n.lock.Unlock()
+		return errors.Wrap(err, "could not send digest")
+	}
+	return nil
+}
+
+func (n *Notifier) reset(start time.Time) {
+	n.digest = &Digest{Start: start}
+	n.senders = make(map[string]int)
+	n.results = make(map[string]int)
+	n.seen = make(map[message]bool)
+}
+
+// merge adds previously taken digest to current one
+func (n *Notifier) merge(d *Digest, senders, results map[string]int, seen map[message]bool) {
+	cur := n.digest
+	cur.Start = d.Start
+	cur.Total += d.Total
+	cur.Blocked += d.Blocked
+	cur.Truncated += d.Truncated
+	cur.Detections = append(d.Detections, cur.Detections...)
+	if len(cur.Detections) > n.MaxDetections {
+		cur.Truncated += len(cur.Detections) - n.MaxDetections
+		cur.Detections = cur.Detections[:n.MaxDetections]
+	}
+	for k, v := range senders {
+		n.senders[k] += v
+	}
+	for k, v := range results {
+		n.results[k] += v
+	}
+	for k := range seen {
+		n.seen[k] = true
+	}
+}
+
+func (n *Notifier) add(r ksmglog.Record) {
+	d := n.digest
+	info := r.Details.MessageInfo
+	key := message{server: r.Server, id: r.ID}
+	if n.seen[key] {
+		// copy of counted message, only its recipient is added to detections
+		for i := range d.Detections {
+			if det := &d.Detections[i]; det.Server == r.Server && det.ID == r.ID {
+				det.To = appendNew(det.To, info.AllRecipients())
+			}
+		}
+		return
+	}
+	n.seen[key] = true
+
+	d.Total++
+	n.results[string(r.Result)]++
+
+	if !n.clean(string(r.Result)) {
+		d.Blocked++
+		n.senders[strings.ToLower(info.From)]++
+	}
+
+	for _, p := range r.Details.PartResults {
+		if len(p.AvInfo.Threats) == 0 {
+			continue
+		}
+		if len(d.Detections) >= n.MaxDetections {
+			d.Truncated++
+			continue
+		}
+		d.Detections = append(d.Detections, Detection{
+			ID:       r.ID,
+			Time:     time.Unix(int64(r.Time), 0),
+			Server:   r.Server,
+			From:     info.From,
+			To:       info.AllRecipients(),
+			Subject:  info.Subject,
+			FileName: p.FileName,
+			Threats:  p.AvInfo.Threats,
+		})
+	}
+}
+
+// appendNew appends values missing in list
+func appendNew(list, values []string) []string {
+	for _, v := range values {
+		found := false
+		for _, l := range list {
+			if strings.EqualFold(l, v) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func (n *Notifier) clean(result string) bool {
+	for _, c := range n.CleanResults {
+		if strings.EqualFold(c, result) {
+			return true
+		}
+	}
+	return false
+}
+
+// current returns copy of collected digest with sorted counters
+func (n *Notifier) current(end time.Time) Digest {
+	res := *n.digest
+	res.End = end
+	res.Detections = append([]Detection{}, n.digest.Detections...)
+	res.ByResult = sortCounts(n.results, 0)
+	res.TopSenders = sortCounts(n.senders, n.TopSenders)
+	return res
+}
+
+// sortCounts returns counts in descending order, limited to max if max > 0
+func sortCounts(m map[string]int, max int) []Count {
+	res := make([]Count, 0, len(m))
+	for k, v := range m {
+		res = append(res, Count{Name: k, Count: v})
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Count != res[j].Count {
+			return res[i].Count > res[j].Count
+		}
+		return res[i].Name < res[j].Name
+	})
+	if max > 0 && len(res) > max {
+		res = res[:max]
+	}
+	return res
+}
+
+// message renders digest to multipart/alternative email with plain text and html parts
+func (n *Notifier) message(d Digest) ([]byte, error) {
+	text := &bytes.Buffer{}
+	if err := textTmpl.Execute(text, d); err != nil {
+		return nil, errors.Wrap(err, "could not render text")
+	}
+	html := &bytes.Buffer{}
+	if err := htmlTmpl.Execute(html, d); err != nil {
+		return nil, errors.Wrap(err, "could not render html")
+	}
+
+	boundary := randomHex(16)
+	buf := &bytes.Buffer{}
+	headers := [][2]string{
+		{"From", n.From},
+		{"To", strings.Join(n.To, ", ")},
+		{"Subject", mime.QEncoding.Encode("utf-8", fmt.Sprintf("%s %s", n.Subject, d.End.Format("2006-01-02 15:04")))},
+		{"Date", d.End.Format(time.RFC1123Z)},
+		{"Message-ID", "<" + randomHex(16) + "@ksmglog>"},
+		{"MIME-Version", "1.0"},
+		{"Content-Type", `multipart/alternative; boundary="` + boundary + `"`},
+	}
+	for _, h := range headers {
+		buf.WriteString(h[0] + ": " + h[1] + "\r\n")
+	}
+	buf.WriteString("\r\n")
+
+	for _, part := range []struct {
+		contentType string
+		body        []byte
+	}{{"text/plain", text.Bytes()}, {"text/html", html.Bytes()}} {
+		buf.WriteString("--" + boundary + "\r\n")
+		buf.WriteString("Content-Type: " + part.contentType + "; charset=utf-8\r\n")
+		buf.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+		qp := quotedprintable.NewWriter(buf)
+		if _, err := qp.Write(part.body); err != nil {
+			return nil, errors.Wrap(err, "could not encode body")
+		}
+		if err := qp.Close(); err != nil {
+			return nil, errors.Wrap(err, "could not encode body")
+		}
+		buf.WriteString("\r\n")
+	}
+	buf.WriteString("--" + boundary + "--\r\n")
+
+	return buf.Bytes(), nil
+}
+
+// sendMail delivers message with implicit tls or STARTTLS if server supports it, authenticates if User set
+func (n *Notifier) sendMail(ctx context.Context, msg []byte) error {
+	addr := net.JoinHostPort(n.Host, strconv.Itoa(n.Port))
+	tlsConf := &tls.Config{ServerName: n.Host, InsecureSkipVerify: n.InsecureSkipVerify} //nolint:gosec
+
+	dialer := &net.Dialer{Timeout: n.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return errors.Wrapf(err, "could not connect to %s", addr)
+	}
+	if n.TLS {
+		conn = tls.Client(conn, tlsConf)
+	}
+	if err = conn.SetDeadline(time.Now().Add(n.Timeout)); err != nil {
+		_ = conn.Close()
+		return errors.Wrap(err, "could not set deadline")
+	}
+
+	c, err := smtp.NewClient(conn, n.Host)
+	if err != nil {
+		_ = conn.Close()
+		return errors.Wrap(err, "could not start smtp session")
+	}
+	defer c.Close() //nolint:errcheck
+
+	if ok, _ := c.Extension("STARTTLS"); ok && !n.TLS && !n.NoStartTLS {
+		if err = c.StartTLS(tlsConf); err != nil {
+			return errors.Wrap(err, "could not start tls")
+		}
+	}
+
+	if n.User != "" {
+		if err = c.Auth(smtp.PlainAuth("", n.User, n.Password, n.Host)); err != nil {
+			return errors.Wrap(err, "could not authenticate")
+		}
+	}
+
+	if err = c.Mail(n.From); err != nil {
+		return errors.Wrapf(err, "bad sender %s", n.From)
+	}
+	for _, to := range n.To {
+		if err = c.Rcpt(to); err != nil {
+			return errors.Wrapf(err, "bad recipient %s", to)
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return errors.Wrap(err, "could not start data")
+	}
+	if _, err = w.Write(msg); err != nil {
+		return errors.Wrap(err, "could not write data")
+	}
+	if err = w.Close(); err != nil {
+		return errors.Wrap(err, "could not finish data")
+	}
+	return c.Quit()
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return fmt.Sprintf("%x", b)
+}
+
+var funcs = map[string]interface{}{
+	"join": strings.Join,
+	"time": func(t time.Time) string { return t.Format("2006-01-02 15:04:05") },
+}
+
+var textTmpl = template.Must(template.New("text").Funcs(funcs).Parse(`KSMG digest {{time .Start}} - {{time .End}}
+
+Messages: {{.Total}}, blocked: {{.Blocked}}
+
+By result:
+{{range .ByResult}}  {{printf "%-20s" .Name}} {{.Count}}
+{{else}}  none
+{{end}}
+Top blocked senders:
+{{range .TopSenders}}  {{printf "%-40s" .Name}} {{.Count}}
+{{else}}  none
+{{end}}
+Malware detections:
+{{range .Detections}}  {{time .Time}} {{.Server}} {{.From}} -> {{join .To ", "}}
+    {{.FileName}}: {{join .Threats ", "}}
+{{else}}  none
+{{end}}{{if .Truncated}}  ... and {{.Truncated}} more
+{{end}}`))
+
+var htmlTmpl = htmltemplate.Must(htmltemplate.New("html").Funcs(funcs).Parse(`<!DOCTYPE html>
+<html><body style="font-family: sans-serif">
+<h2>KSMG digest {{time .Start}} - {{time .End}}</h2>
+<p>Messages: <b>{{.Total}}</b>, blocked: <b>{{.Blocked}}</b></p>
+<h3>By result</h3>
+<table border="1" cellpadding="4" cellspacing="0">
+<tr><th>Result</th><th>Count</th></tr>
+{{range .ByResult}}<tr><td>{{.Name}}</td><td>{{.Count}}</td></tr>
+{{end}}</table>
+<h3>Top blocked senders</h3>
+<table border="1" cellpadding="4" cellspacing="0">
+<tr><th>Sender</th><th>Count</th></tr>
+{{range .TopSenders}}<tr><td>{{.Name}}</td><td>{{.Count}}</td></tr>
+{{end}}</table>
+<h3>Malware detections</h3>
+<table border="1" cellpadding="4" cellspacing="0">
+<tr><th>Time</th><th>Server</th><th>From</th><th>To</th><th>Subject</th><th>Attachment</th><th>Threats</th></tr>
+{{range .Detections}}<tr><td>{{time .Time}}</td><td>{{.Server}}</td><td>{{.From}}</td><td>{{join .To ", "}}</td><td>{{.Subject}}</td><td>{{.FileName}}</td><td>{{join .Threats ", "}}</td></tr>
+{{end}}</table>
+{{if .Truncated}}<p>... and {{.Truncated}} more</p>{{end}}
+</body></html>
+`))
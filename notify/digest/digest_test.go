@@ -0,0 +1,223 @@
+package digest
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/zorion79/ksmglog"
+)
+
+// fakeSMTP accepts one session, records envelope and data
+type fakeSMTP struct {
+	ln   net.Listener
+	done chan struct{}
+
+	auth string
+	from string
+	rcpt []string
+	data string
+}
+
+func newFakeSMTP(t *testing.T) *fakeSMTP {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	f := &fakeSMTP{ln: ln, done: make(chan struct{})}
+	go f.serve(t)
+	return f
+}
+
+func (f *fakeSMTP) port() int {
+	return f.ln.Addr().(*net.TCPAddr).Port
+}
+
+func (f *fakeSMTP) serve(t *testing.T) {
+	defer close(f.done)
+	conn, err := f.ln.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	reply := func(s string) {
+		_, err := conn.Write([]byte(s + "\r\n"))
+		assert.NoError(t, err)
+	}
+
+	reply("220 fake ESMTP")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		line = strings.TrimRight(line, "\r\n")
+		cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch cmd {
+		case "EHLO":
+			reply("250-fake\r\n250 AUTH PLAIN")
+		case "AUTH":
+			f.auth = strings.TrimPrefix(line, "AUTH PLAIN ")
+			reply("235 ok")
+		case "MAIL":
+			f.from = line
+			reply("250 ok")
+		case "RCPT":
+			f.rcpt = append(f.rcpt, line)
+			reply("250 ok")
+		case "DATA":
+			reply("354 go")
+			data := strings.Builder{}
+			for {
+				l, err := r.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if l == ".\r\n" {
+					break
+				}
+				data.WriteString(strings.TrimPrefix(l, "."))
+			}
+			f.data = data.String()
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 ok")
+		}
+	}
+}
+
+func TestNotifier_Flush(t *testing.T) {
+	srv := newFakeSMTP(t)
+	defer srv.ln.Close()
+
+	n := NewNotifier(Opts{
+		Host: "127.0.0.1", Port: srv.port(), User: "user", Password: "pass",
+		From: "ksmg@example.com", To: []string{"sec@example.com", "admin@example.com"},
+		TopSenders: 1,
+	})
+
+	infected := ksmglog.Record{}
+	require.NoError(t, json.Unmarshal([]byte(`{"id":1,"result":"Infected","details":{
+		"messageInfo":{"from":"Bad@evil.com","to":["b@example.com"],"subject":"invoice"},
+		"partResults":[{"fileName":"invoice.doc","avInfo":{"threats":["HEUR:Trojan.Msoffice"]}},{"fileName":"a.txt"}]}}`), &infected))
+	spam := ksmglog.Record{ID: 2, Result: "Spam"}
+	spam.Details.MessageInfo.From = "bad@evil.com"
+	other := ksmglog.Record{ID: 3, Result: "Spam"}
+	other.Details.MessageInfo.From = "other@spam.com"
+
+	require.NoError(t, n.Send(context.Background(), []ksmglog.Record{infected, spam, other, {ID: 4, Result: "Clean"}}))
+	require.NoError(t, n.Flush(context.Background()))
+	<-srv.done
+
+	auth, err := base64.StdEncoding.DecodeString(srv.auth)
+	require.NoError(t, err)
+	assert.Equal(t, "\x00user\x00pass", string(auth))
+	assert.Equal(t, "MAIL FROM:<ksmg@example.com>", srv.from)
+	assert.Equal(t, []string{"RCPT TO:<sec@example.com>", "RCPT TO:<admin@example.com>"}, srv.rcpt)
+
+	msg, err := mail.ReadMessage(strings.NewReader(srv.data))
+	require.NoError(t, err)
+	subject, err := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(subject, "KSMG digest "), subject)
+
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	require.NoError(t, err)
+	assert.Equal(t, "multipart/alternative", mediaType)
+
+	parts := map[string]string{}
+	mr := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			break
+		}
+		body, err := ioutil.ReadAll(quotedprintable.NewReader(p))
+		require.NoError(t, err)
+		parts[strings.Split(p.Header.Get("Content-Type"), ";")[0]] = string(body)
+	}
+
+	text := parts["text/plain"]
+	assert.Contains(t, text, "Messages: 4, blocked: 3")
+	assert.Contains(t, text, "Spam                 2")
+	assert.Contains(t, text, "bad@evil.com                             2")
+	assert.NotContains(t, text, "other@spam.com", "only top 1 sender")
+	assert.Contains(t, text, "invoice.doc: HEUR:Trojan.Msoffice")
+	assert.NotContains(t, text, "a.txt")
+
+	html := parts["text/html"]
+	assert.Contains(t, html, "<td>invoice.doc</td><td>HEUR:Trojan.Msoffice</td>")
+	assert.Contains(t, html, "<td>bad@evil.com</td><td>"+strconv.Itoa(2)+"</td>")
+
+	// digest is reset after sending
+	n.lock.Lock()
+	assert.Equal(t, 0, n.digest.Total)
+	n.lock.Unlock()
+}
+
+func TestNotifier_SendCopies(t *testing.T) {
+	n := NewNotifier(Opts{TopSenders: 10, MaxDetections: 10})
+
+	// copies made by service per recipient, every one has its recipient in To
+	r := ksmglog.Record{ID: 1, Server: "ksmg01", Result: ksmglog.ResultInfected}
+	r.Details.MessageInfo.From = "bad@evil.com"
+	r.Details.MessageInfo.Cc = []string{"c@example.com"}
+	r.Details.PartResults = []ksmglog.PartResult{{FileName: "a.doc", AvInfo: ksmglog.AvInfo{Threats: []string{"EICAR"}}}}
+	copies := []ksmglog.Record{}
+	for _, to := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+		c := r
+		c.Details.MessageInfo.To = []string{to}
+		copies = append(copies, c)
+	}
+	other := r
+	other.Server = "ksmg02"
+	copies = append(copies, other)
+	require.NoError(t, n.Send(context.Background(), copies))
+
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	d := n.current(time.Now())
+	assert.Equal(t, 2, d.Total, "copies counted once per server and id")
+	assert.Equal(t, 2, d.Blocked)
+	assert.Equal(t, []Count{{Name: "Infected", Count: 2}}, d.ByResult)
+	assert.Equal(t, []Count{{Name: "bad@evil.com", Count: 2}}, d.TopSenders)
+	require.Equal(t, 2, len(d.Detections))
+	assert.Equal(t, []string{"a@example.com", "c@example.com", "b@example.com"}, d.Detections[0].To)
+}
+
+func TestNotifier_FlushFailed(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	port := ln.Addr().(*net.TCPAddr).Port
+	require.NoError(t, ln.Close())
+
+	n := NewNotifier(Opts{Host: "127.0.0.1", Port: port, From: "a@example.com", To: []string{"b@example.com"}})
+	require.NoError(t, n.Send(context.Background(), []ksmglog.Record{{ID: 1}}))
+	assert.Error(t, n.Flush(context.Background()))
+
+	n.lock.Lock()
+	assert.Equal(t, 1, n.digest.Total, "records kept for next digest")
+	n.lock.Unlock()
+}
+
+func TestNotifier_SkipEmpty(t *testing.T) {
+	n := NewNotifier(Opts{Host: "127.0.0.1", Port: 1, SkipEmpty: true})
+	assert.NoError(t, n.Flush(context.Background()))
+}
@@ -0,0 +1,159 @@
+package ksmglog
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Query defines ad-hoc journal search over all servers. Time range, sender, recipient and result are sent
+// to KSMG as journal filters, so records older than polling window are found. Filters json replaces them
+// if set. Returned records are checked against query fields again, they are matched by Match.
+type Query struct {
+	Filters   string    // raw journal filters json like {"dateType":3}, built from other fields if empty
+	From      time.Time // records not older than From, not limited if zero
+	To        time.Time // records older than To, not limited if zero
+	Sender    string    // case insensitive substring of sender address
+	Recipient string    // case insensitive substring of any to, cc or bcc address
+	Result    []string  // record results like Clean or Infected, any if empty
+}
+
+// journal date types of KSMG filters, polling uses 8 for last records
+const (
+	dateTypeAll   = 0 // whole journal
+	dateTypeRange = 7 // records between dateFrom and dateTo
+)
+
+// journalQuery is journal filters json of query, times are unix seconds like Record.Time
+type journalQuery struct {
+	DateType  int      `json:"dateType"`
+	DateFrom  int64    `json:"dateFrom,omitempty"`
+	DateTo    int64    `json:"dateTo,omitempty"`
+	Sender    string   `json:"sender,omitempty"`
+	Recipient string   `json:"recipient,omitempty"`
+	Results   []string `json:"results,omitempty"`
+}
+
+// JournalFilters returns journal filters json sent to KSMG for query: Filters if set, filters built from
+// time range, sender, recipient and result otherwise. Empty string means filters of server.
+func (q Query) JournalFilters() (string, error) {
+	if q.Filters != "" {
+		if !json.Valid([]byte(q.Filters)) {
+			return "", errors.Errorf("invalid filters json %s", q.Filters)
+		}
+		return q.Filters, nil
+	}
+	if q.From.IsZero() && q.To.IsZero() && q.Sender == "" && q.Recipient == "" && len(q.Result) == 0 {
+		return "", nil
+	}
+	if !q.From.IsZero() && !q.To.IsZero() && !q.From.Before(q.To) {
+		return "", errors.Errorf("empty time range %s - %s", q.From.Format(time.RFC3339), q.To.Format(time.RFC3339))
+	}
+
+	jq := journalQuery{DateType: dateTypeAll, Sender: q.Sender, Recipient: q.Recipient, Results: q.Result}
+	if !q.From.IsZero() || !q.To.IsZero() {
+		jq.DateType = dateTypeRange
+		if !q.From.IsZero() {
+			jq.DateFrom = q.From.Unix()
+		}
+		if !q.To.IsZero() {
+			jq.DateTo = q.To.Unix()
+		}
+	}
+	res, err := json.Marshal(jq)
+	return string(res), errors.Wrap(err, "could not marshal filters")
+}
+
+// Query searches journal of all servers in parallel and returns matched records sorted by time.
+// Failed servers are logged and skipped, error returned only if no server answered.
+func (s *Service) Query(q Query) ([]*Record, error) {
+	jf, err := q.JournalFilters()
+	if err != nil {
+		return nil, err
+	}
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	res, failed := []*Record{}, []string{}
+	servers := s.serverList()
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *server) {
+			defer wg.Done()
+			filters := jf
+			if filters == "" {
+				filters = srv.Filters
+			}
+			recs, _, err := s.journal(srv.URL, filters)
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				s.log(LevelWarn, "query failed", "server", srv.Name, "error", err)
+				failed = append(failed, srv.Name)
+				return
+			}
+			for _, r := range recs {
+				if q.Match(*r) {
+					res = append(res, r)
+				}
+			}
+		}(srv)
+	}
+	wg.Wait()
+
+	if len(servers) > 0 && len(failed) == len(servers) {
+		return nil, errors.Errorf("query failed on all servers %s", strings.Join(failed, ", "))
+	}
+
+	sort.SliceStable(res, func(i, j int) bool {
+		if res[i].Time != res[j].Time {
+			return res[i].Time < res[j].Time
+		}
+		return res[i].Server < res[j].Server
+	})
+	return res, nil
+}
+
+// Match checks record against time range, sender, recipient and result of query
+func (q Query) Match(r Record) bool {
+	t := time.Unix(int64(r.Time), 0)
+	if !q.From.IsZero() && t.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && !t.Before(q.To) {
+		return false
+	}
+
+	info := r.Details.MessageInfo
+	if q.Sender != "" && !containsFold(info.From, q.Sender) {
+		return false
+	}
+
+	if q.Recipient != "" {
+		found := false
+		for _, addr := range info.AllRecipients() {
+			found = found || containsFold(addr, q.Recipient)
+		}
+		if !found {
+			return false
+		}
+	}
+
+	if len(q.Result) > 0 {
+		for _, res := range q.Result {
+			if strings.EqualFold(res, string(r.Result)) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
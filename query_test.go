@@ -0,0 +1,149 @@
+package ksmglog
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestService_Query(t *testing.T) {
+	now := time.Now()
+	items := []Record{
+		queryRecord(1, now.Add(-time.Hour), "Clean", "alice@example.com", "bob@corp.local"),
+		queryRecord(2, now.Add(-2*time.Hour), "Infected", "spam@evil.com", "bob@corp.local"),
+		queryRecord(3, now.Add(-3*time.Hour), "Infected", "spam@evil.com", "carol@corp.local"),
+	}
+
+	filters := make(chan string, 2)
+	ht := httptest.NewServer(journalHandler(t, items, filters))
+	defer ht.Close()
+	failed := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failed.Close()
+
+	svc := NewService(Opts{URL: []string{ht.URL, failed.URL}, Timeout: time.Second})
+	recs, err := svc.Query(Query{
+		Filters:   `{"dateType":3}`,
+		From:      now.Add(-150 * time.Minute),
+		Recipient: "BOB@",
+		Result:    []string{"infected"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(recs))
+	assert.Equal(t, 2, recs[0].ID)
+	assert.Equal(t, "127.0.0.1", recs[0].Server)
+	assert.Equal(t, `{"filters":{"dateType":3}}`, <-filters)
+
+	svc = NewService(Opts{URL: []string{failed.URL}, Timeout: time.Second})
+	_, err = svc.Query(Query{})
+	assert.EqualError(t, err, "query failed on all servers 127.0.0.1")
+
+	_, err = svc.Query(Query{Filters: "{bad"})
+	assert.EqualError(t, err, "invalid filters json {bad")
+}
+
+func TestService_QueryJournalFilters(t *testing.T) {
+	now := time.Now()
+	items := []Record{
+		queryRecord(1, now.Add(-48*time.Hour), "Infected", "spam@evil.com", "bob@corp.local"),
+		queryRecord(2, now.Add(-72*time.Hour), "Clean", "alice@example.com", "bob@corp.local"),
+	}
+	filters := make(chan string, 1)
+	ht := httptest.NewServer(journalHandler(t, items, filters))
+	defer ht.Close()
+
+	svc := NewService(Opts{URL: []string{ht.URL}, Timeout: time.Second})
+	from, to := time.Unix(1560000000, 0), time.Unix(1570000000, 0)
+	recs, err := svc.Query(Query{From: now.Add(-50 * time.Hour), Sender: "evil.com"})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(recs), "records older than polling window found")
+	assert.Equal(t, 1, recs[0].ID)
+	assert.Contains(t, <-filters, `"sender":"evil.com"`)
+
+	tbl := []struct {
+		q    Query
+		want string
+		err  string
+	}{
+		{Query{}, "", ""},
+		{Query{Filters: `{"dateType":3}`, Sender: "bob"}, `{"dateType":3}`, ""},
+		{Query{Filters: "{bad"}, "", "invalid filters json {bad"},
+		{Query{From: from, To: to}, `{"dateType":7,"dateFrom":1560000000,"dateTo":1570000000}`, ""},
+		{Query{To: to}, `{"dateType":7,"dateTo":1570000000}`, ""},
+		{Query{Sender: "evil.com", Recipient: "bob@", Result: []string{"Infected"}},
+			`{"dateType":0,"sender":"evil.com","recipient":"bob@","results":["Infected"]}`, ""},
+		{Query{From: to, To: from}, "", "empty time range"},
+	}
+	for i, tt := range tbl {
+		res, err := tt.q.JournalFilters()
+		if tt.err != "" {
+			require.Error(t, err, "case %d", i)
+			assert.Contains(t, err.Error(), tt.err, "case %d", i)
+			continue
+		}
+		require.NoError(t, err, "case %d", i)
+		assert.Equal(t, tt.want, res, "case %d", i)
+	}
+}
+
+func TestQuery_Match(t *testing.T) {
+	now := time.Now()
+	r := queryRecord(1, now, "Clean", "Alice@Example.com", "bob@corp.local")
+	r.Details.MessageInfo.Cc = []string{"carol@corp.local"}
+
+	tbl := []struct {
+		q    Query
+		want bool
+	}{
+		{Query{}, true},
+		{Query{From: now.Add(-time.Minute), To: now.Add(time.Minute)}, true},
+		{Query{From: now.Add(time.Minute)}, false},
+		{Query{To: now.Add(-time.Minute)}, false},
+		{Query{Sender: "alice@example"}, true},
+		{Query{Sender: "bob"}, false},
+		{Query{Recipient: "carol"}, true},
+		{Query{Recipient: "dave"}, false},
+		{Query{Result: []string{"Infected", "clean"}}, true},
+		{Query{Result: []string{"Infected"}}, false},
+	}
+	for i, tt := range tbl {
+		assert.Equal(t, tt.want, tt.q.Match(r), "case %d", i)
+	}
+}
+
+func queryRecord(id int, t time.Time, result Result, from, to string) Record {
+	r := Record{ID: id, Time: int(t.Unix()), Result: result}
+	r.Details.MessageInfo.From = from
+	r.Details.MessageInfo.To = []string{to}
+	return r
+}
+
+// journalHandler imitates ksmg api answering journal query with items, filters of queries are sent to channel if not nil
+func journalHandler(t *testing.T, items []Record, filters chan<- string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		var resp interface{}
+		switch {
+		case q.Get("action") == "userLogin":
+			resp = map[string]interface{}{"action": "userLogin", "userType": 1, "C2HToken": "token"}
+		case q.Get("action") == "getCurrentTime" && q.Get("action_id") == "":
+			resp = map[string]interface{}{"action": "getCurrentTime", "action_id": 2}
+		case q.Get("action") == "getCurrentTime":
+			resp = map[string]interface{}{"action": "getCurrentTime", "data": map[string]interface{}{"tz": "Europe/Moscow", "time": time.Now().Unix()}}
+		case q.Get("action") == "eventLoggerJournalQuery" && q.Get("action_id") == "":
+			if filters != nil {
+				filters <- q.Get("data")
+			}
+			resp = map[string]interface{}{"action": "eventLoggerJournalQuery", "action_id": 3}
+		case q.Get("action") == "eventLoggerJournalQuery":
+			resp = map[string]interface{}{"action": "eventLoggerJournalQuery", "data": map[string]interface{}{"count": len(items), "items": items}}
+		}
+		assert.NoError(t, json.NewEncoder(w).Encode(resp))
+	})
+}
@@ -4,85 +4,130 @@ import (
 	"crypto/md5" //nolint:gosec
 	"encoding/json"
 	"fmt"
+	"strconv"
+	"strings"
 
 	"github.com/pkg/errors"
 )
 
 // Record collects all fields from ksmg json
 type Record struct {
-	ID          int    `json:"id"`
-	Time        int    `json:"time"`
-	Type        string `json:"type"`
-	Result      string `json:"result"`
-	Person      string `json:"person"`
-	Description string `json:"description"`
-	EventName   string `json:"eventName"`
-	Details     struct {
-		MessageInfo struct {
-			MessageID      string   `json:"messageId"`
-			Size           string   `json:"size"`
-			SMTPMessageID  string   `json:"smtpMessageId"`
-			ClientAddress  string   `json:"clientAddress"`
-			ClientHostName string   `json:"clientHostName"`
-			From           string   `json:"from"`
-			To             []string `json:"to"`
-			Cc             []string `json:"cc"`
-			Bcc            []string `json:"bcc"`
-			Subject        string   `json:"subject"`
-		} `json:"messageInfo"`
-		Rules                []int  `json:"rules"`
-		AvStatus             string `json:"avStatus"`
-		DocWithMacroDetected bool   `json:"docWithMacroDetected"`
-		AvNotScannedReason   string `json:"avNotScannedReason"`
-		AsStatus             string `json:"asStatus"`
-		AsNotScannedReason   string `json:"asNotScannedReason"`
-		MaStatus             string `json:"maStatus"`
-		MaNotScannedReason   string `json:"maNotScannedReason"`
-		ApStatus             string `json:"apStatus"`
-		ApNotScannedReason   string `json:"apNotScannedReason"`
-		CfStatus             string `json:"cfStatus"`
-		CfNotScannedReason   string `json:"cfNotScannedReason"`
-		KtStatus             string `json:"ktStatus"`
-		KtNotScannedReason   string `json:"ktNotScannedReason"`
-		KtSkipReason         string `json:"ktSkipReason"`
-		AvMessageSizeLimit   string `json:"avMessageSizeLimit"`
-		AsMessageSizeLimit   string `json:"asMessageSizeLimit"`
-		AsMethod             string `json:"asMethod"`
-		KtProceededBy        string `json:"ktProceededBy"`
-		ApuMethod            string `json:"apuMethod"`
-		WmufMethod           string `json:"wmufMethod"`
-		PartResults          []struct {
-			FileName string `json:"fileName"`
-			FileSize string `json:"fileSize"`
-			AvInfo   struct {
-				Statuses []struct {
-					AvStatus string `json:"avStatus"`
-				} `json:"statuses"`
-				DocWithMacroDetected bool     `json:"docWithMacroDetected"`
-				SkipReason           string   `json:"skipReason"`
-				SkipDescription      string   `json:"skipDescription"`
-				Threats              []string `json:"threats"`
-				DisinfectedObjects   []string `json:"disinfectedObjects"`
-				DeletedObjects       []string `json:"deletedObjects"`
-			} `json:"avInfo"`
-			CfInfo struct {
-				Statuses         []string `json:"statuses"`
-				BannedFileName   string   `json:"bannedFileName"`
-				BannedFileFormat string   `json:"bannedFileFormat"`
-			} `json:"cfInfo"`
-			Action string `json:"action"`
-		} `json:"partResults"`
-		MaInfo struct {
-			DmarcVerdict string   `json:"dmarcVerdict"`
-			SpfVerdict   string   `json:"spfVerdict"`
-			DkimVerdicts []string `json:"dkimVerdicts"`
-		} `json:"maInfo"`
-		Action                       string   `json:"action"`
-		BackupReason                 string   `json:"backupReason"`
-		UnsafeNotificationRecipients []string `json:"unsafeNotificationRecipients"`
-	} `json:"details"`
+	ID          int        `json:"id"`
+	Time        int        `json:"time"`
+	Type        RecordType `json:"type"`
+	Result      Result     `json:"result"`
+	Person      string     `json:"person"`
+	Description string     `json:"description"`
+	EventName   string     `json:"eventName"`
+	Details     Details    `json:"details"`
 
 	HashString string `json:"-"`
+	Server     string `json:"server,omitempty"` // host of ksmg server the record was collected from
+}
+
+// Details of processed message with verdicts of scan engines
+type Details struct {
+	MessageInfo                  MessageInfo      `json:"messageInfo"`
+	Rules                        []int            `json:"rules"`
+	AvStatus                     ScanStatus       `json:"avStatus"`
+	DocWithMacroDetected         bool             `json:"docWithMacroDetected"`
+	AvNotScannedReason           NotScannedReason `json:"avNotScannedReason"`
+	AsStatus                     ScanStatus       `json:"asStatus"`
+	AsNotScannedReason           NotScannedReason `json:"asNotScannedReason"`
+	MaStatus                     ScanStatus       `json:"maStatus"`
+	MaNotScannedReason           NotScannedReason `json:"maNotScannedReason"`
+	ApStatus                     ScanStatus       `json:"apStatus"`
+	ApNotScannedReason           NotScannedReason `json:"apNotScannedReason"`
+	CfStatus                     ScanStatus       `json:"cfStatus"`
+	CfNotScannedReason           NotScannedReason `json:"cfNotScannedReason"`
+	KtStatus                     ScanStatus       `json:"ktStatus"`
+	KtNotScannedReason           NotScannedReason `json:"ktNotScannedReason"`
+	KtSkipReason                 string           `json:"ktSkipReason"`
+	AvMessageSizeLimit           string           `json:"avMessageSizeLimit"`
+	AsMessageSizeLimit           string           `json:"asMessageSizeLimit"`
+	AsMethod                     string           `json:"asMethod"`
+	KtProceededBy                string           `json:"ktProceededBy"`
+	ApuMethod                    string           `json:"apuMethod"`
+	WmufMethod                   string           `json:"wmufMethod"`
+	PartResults                  []PartResult     `json:"partResults"`
+	MaInfo                       MaInfo           `json:"maInfo"`
+	Action                       string           `json:"action"`
+	BackupReason                 string           `json:"backupReason"`
+	UnsafeNotificationRecipients []string         `json:"unsafeNotificationRecipients"`
+}
+
+// MessageInfo is envelope and headers of message
+type MessageInfo struct {
+	MessageID      string   `json:"messageId"`
+	Size           string   `json:"size"`
+	SMTPMessageID  string   `json:"smtpMessageId"`
+	ClientAddress  string   `json:"clientAddress"`
+	ClientHostName string   `json:"clientHostName"`
+	From           string   `json:"from"`
+	To             []string `json:"to"`
+	Cc             []string `json:"cc"`
+	Bcc            []string `json:"bcc"`
+	Subject        string   `json:"subject"`
+}
+
+// AllRecipients returns To, Cc and Bcc recipients in this order
+func (m MessageInfo) AllRecipients() []string {
+	res := make([]string, 0, len(m.To)+len(m.Cc)+len(m.Bcc))
+	res = append(res, m.To...)
+	res = append(res, m.Cc...)
+	return append(res, m.Bcc...)
+}
+
+// PartResult is scan result of message part, like attachment
+type PartResult struct {
+	FileName string `json:"fileName"`
+	FileSize string `json:"fileSize"`
+	AvInfo   AvInfo `json:"avInfo"`
+	CfInfo   CfInfo `json:"cfInfo"`
+	Action   string `json:"action"`
+}
+
+// IsInfected checks if anti-virus found threats in part or reported it infected
+func (p PartResult) IsInfected() bool {
+	if len(p.AvInfo.Threats) > 0 {
+		return true
+	}
+	for _, st := range p.AvInfo.Statuses {
+		if strings.EqualFold(string(st.AvStatus), string(StatusInfected)) {
+			return true
+		}
+	}
+	return false
+}
+
+// AvInfo is anti-virus result of message part
+type AvInfo struct {
+	Statuses             []AvStatus `json:"statuses"`
+	DocWithMacroDetected bool       `json:"docWithMacroDetected"`
+	SkipReason           string     `json:"skipReason"`
+	SkipDescription      string     `json:"skipDescription"`
+	Threats              []string   `json:"threats"`
+	DisinfectedObjects   []string   `json:"disinfectedObjects"`
+	DeletedObjects       []string   `json:"deletedObjects"`
+}
+
+// AvStatus is one of anti-virus statuses of message part
+type AvStatus struct {
+	AvStatus ScanStatus `json:"avStatus"`
+}
+
+// CfInfo is content filtering result of message part
+type CfInfo struct {
+	Statuses         []ScanStatus `json:"statuses"`
+	BannedFileName   string       `json:"bannedFileName"`
+	BannedFileFormat string       `json:"bannedFileFormat"`
+}
+
+// MaInfo is mail authentication verdicts of message
+type MaInfo struct {
+	DmarcVerdict string   `json:"dmarcVerdict"`
+	SpfVerdict   string   `json:"spfVerdict"`
+	DkimVerdicts []string `json:"dkimVerdicts"`
 }
 
 // Hash return hash of record
@@ -95,3 +140,81 @@ func (o *Record) Hash() error {
 	o.HashString = fmt.Sprintf("%x", md5.Sum(jsonBytes)) //nolint:gosec
 	return nil
 }
+
+// Field returns values of record field addressed by dotted json path like details.messageInfo.from.
+// Arrays are walked through, so details.partResults.avInfo.threats returns threats of all parts,
+// numeric path element selects one array item. Server is addressed as "server".
+func (o *Record) Field(path string) ([]string, error) {
+	if path == "server" {
+		return []string{o.Server}, nil
+	}
+	f, err := o.fields()
+	if err != nil {
+		return nil, err
+	}
+	return f.get(path), nil
+}
+
+// recordFields is record decoded once to get many fields of it
+type recordFields struct {
+	server string
+	data   interface{}
+}
+
+// fields decodes record json for field lookup
+func (o *Record) fields() (recordFields, error) {
+	jsonBytes, err := json.Marshal(o)
+	if err != nil {
+		return recordFields{}, errors.Wrap(err, "could not marshal json")
+	}
+	res := recordFields{server: o.Server}
+	decoder := json.NewDecoder(strings.NewReader(string(jsonBytes)))
+	decoder.UseNumber()
+	if err = decoder.Decode(&res.data); err != nil {
+		return recordFields{}, errors.Wrap(err, "could not unmarshal json")
+	}
+	return res, nil
+}
+
+// get returns values of field addressed by path like Record.Field
+func (f recordFields) get(path string) []string {
+	if path == "server" {
+		return []string{f.server}
+	}
+	res := []string{}
+	collectField(f.data, strings.Split(path, "."), &res)
+	return res
+}
+
+func collectField(data interface{}, path []string, res *[]string) {
+	if arr, ok := data.([]interface{}); ok {
+		if len(path) > 0 {
+			if i, err := strconv.Atoi(path[0]); err == nil {
+				if i >= 0 && i < len(arr) {
+					collectField(arr[i], path[1:], res)
+				}
+				return
+			}
+		}
+		for _, item := range arr {
+			collectField(item, path, res)
+		}
+		return
+	}
+
+	if len(path) == 0 {
+		switch v := data.(type) {
+		case nil:
+		case map[string]interface{}:
+			b, _ := json.Marshal(v)
+			*res = append(*res, string(b))
+		default:
+			*res = append(*res, fmt.Sprint(v))
+		}
+		return
+	}
+
+	if m, ok := data.(map[string]interface{}); ok {
+		collectField(m[path[0]], path[1:], res)
+	}
+}
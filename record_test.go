@@ -1,9 +1,11 @@
 package ksmglog
 
 import (
+	"encoding/json"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestRecord_Hash(t *testing.T) {
@@ -15,3 +17,69 @@ func TestRecord_Hash(t *testing.T) {
 	assert.NoError(t, record.Hash())
 	assert.Equal(t, "8d0cdef44129b9ad51cf04d2c9142be7", record.HashString)
 }
+
+func TestRecord_Field(t *testing.T) {
+	record := Record{ID: 111, Server: "ksmg01", Result: "Infected"}
+	assert.NoError(t, json.Unmarshal([]byte(`{"details":{"messageInfo":{"from":"a@example.com","to":["b@example.com","c@example.com"]},
+		"partResults":[{"fileName":"a.doc","avInfo":{"threats":["T1","T2"]}},{"fileName":"b.zip","avInfo":{"threats":["T3"]}}]}}`), &record))
+
+	tbl := []struct {
+		path string
+		res  []string
+	}{
+		{"id", []string{"111"}},
+		{"server", []string{"ksmg01"}},
+		{"result", []string{"Infected"}},
+		{"details.messageInfo.from", []string{"a@example.com"}},
+		{"details.messageInfo.to", []string{"b@example.com", "c@example.com"}},
+		{"details.messageInfo.to.1", []string{"c@example.com"}},
+		{"details.partResults.avInfo.threats", []string{"T1", "T2", "T3"}},
+		{"details.partResults.1.fileName", []string{"b.zip"}},
+		{"details.partResults.5.fileName", []string{}},
+		{"details.docWithMacroDetected", []string{"false"}},
+		{"details.messageInfo.cc", []string{}},
+		{"unknown.field", []string{}},
+	}
+	fields, err := record.fields()
+	require.NoError(t, err)
+	for _, tt := range tbl {
+		res, err := record.Field(tt.path)
+		assert.NoError(t, err)
+		assert.Equal(t, tt.res, res, tt.path)
+		assert.Equal(t, tt.res, fields.get(tt.path), "decoded once, %s", tt.path)
+	}
+}
+
+func TestMessageInfo_AllRecipients(t *testing.T) {
+	info := MessageInfo{To: []string{"a@example.com"}, Cc: []string{"b@example.com", "c@example.com"}, Bcc: []string{"d@example.com"}}
+	assert.Equal(t, []string{"a@example.com", "b@example.com", "c@example.com", "d@example.com"}, info.AllRecipients())
+	assert.Empty(t, MessageInfo{}.AllRecipients())
+}
+
+func TestPartResult_IsInfected(t *testing.T) {
+	assert.False(t, PartResult{FileName: "a.pdf", AvInfo: AvInfo{Statuses: []AvStatus{{AvStatus: StatusClean}}}}.IsInfected())
+	assert.True(t, PartResult{AvInfo: AvInfo{Threats: []string{"EICAR-Test-File"}}}.IsInfected())
+	assert.True(t, PartResult{AvInfo: AvInfo{Statuses: []AvStatus{{AvStatus: StatusClean}, {AvStatus: "infected"}}}}.IsInfected())
+}
+
+func TestRecord_JSON(t *testing.T) {
+	data := `{"id":1,"time":1560000000,"type":"mail","result":"Infected","person":"","description":"","eventName":"",` +
+		`"details":{"messageInfo":{"messageId":"1","size":"10","smtpMessageId":"m@example.com","clientAddress":"10.0.0.1",` +
+		`"clientHostName":"mx","from":"a@example.com","to":["b@example.com"],"cc":null,"bcc":null,"subject":"hi"},` +
+		`"rules":[1],"avStatus":"Infected","docWithMacroDetected":false,"avNotScannedReason":"","asStatus":"Clean",` +
+		`"asNotScannedReason":"","maStatus":"","maNotScannedReason":"","apStatus":"","apNotScannedReason":"","cfStatus":"",` +
+		`"cfNotScannedReason":"","ktStatus":"","ktNotScannedReason":"","ktSkipReason":"","avMessageSizeLimit":"",` +
+		`"asMessageSizeLimit":"","asMethod":"","ktProceededBy":"","apuMethod":"","wmufMethod":"",` +
+		`"partResults":[{"fileName":"a.doc","fileSize":"5","avInfo":{"statuses":[{"avStatus":"Infected"}],` +
+		`"docWithMacroDetected":true,"skipReason":"","skipDescription":"","threats":["EICAR-Test-File"],` +
+		`"disinfectedObjects":null,"deletedObjects":null},"cfInfo":{"statuses":["Banned"],"bannedFileName":"a.doc",` +
+		`"bannedFileFormat":""},"action":"deleted"}],"maInfo":{"dmarcVerdict":"pass","spfVerdict":"pass","dkimVerdicts":["pass"]},` +
+		`"action":"","backupReason":"","unsafeNotificationRecipients":null},"server":"ksmg01"}`
+
+	var r Record
+	require.NoError(t, json.Unmarshal([]byte(data), &r))
+	assert.True(t, r.Details.PartResults[0].IsInfected())
+	res, err := json.Marshal(r)
+	require.NoError(t, err)
+	assert.Equal(t, data, string(res))
+}
@@ -0,0 +1,75 @@
+package ksmglog
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+)
+
+// secrets are session tokens, cookies and passwords seen by service, they are masked in all log messages of package
+var secrets = newRedactor(maxSecrets)
+
+// secretParams matches values of token, cookie and password parameters in urls, forms, json and headers
+var secretParams = regexp.MustCompile(`(?i)\b((?:c2htoken|token|password|passwd|cookie|set-cookie|authorization)"?\s*[=:]\s*"?)[^&"\s,;}]+`)
+
+const (
+	maxSecrets      = 100 // remembered secrets, new token is issued on every login so old ones are forgotten
+	minSecretLen    = 6   // shorter values are too common to be masked everywhere
+	minCookieLen    = 16  // shorter cookies are settings like language, not sessions
+	redactedMessage = "*****"
+)
+
+// redactor masks secrets in messages by value and by parameter name
+type redactor struct {
+	lock     sync.Mutex
+	limit    int
+	values   []string // oldest first
+	replacer *strings.Replacer
+}
+
+func newRedactor(limit int) *redactor {
+	return &redactor{limit: limit}
+}
+
+// add remembers secret values to mask, the oldest ones are forgotten over limit
+func (r *redactor) add(values ...string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, v := range values {
+		if len(v) < minSecretLen || r.has(v) {
+			continue
+		}
+		r.values = append(r.values, v)
+		r.replacer = nil
+	}
+	if len(r.values) > r.limit {
+		r.values = append([]string{}, r.values[len(r.values)-r.limit:]...)
+	}
+}
+
+func (r *redactor) has(v string) bool {
+	for _, s := range r.values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
+
+// redact masks known secrets and values of secret parameters
+func (r *redactor) redact(msg string) string {
+	msg = secretParams.ReplaceAllString(msg, "${1}"+redactedMessage)
+
+	r.lock.Lock()
+	if r.replacer == nil {
+		pairs := make([]string, 0, 2*len(r.values))
+		for _, v := range r.values {
+			pairs = append(pairs, v, redactedMessage)
+		}
+		r.replacer = strings.NewReplacer(pairs...)
+	}
+	replacer := r.replacer
+	r.lock.Unlock()
+
+	return replacer.Replace(msg)
+}
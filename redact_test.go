@@ -0,0 +1,87 @@
+package ksmglog
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	log "github.com/go-pkgz/lgr"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRedactor(t *testing.T) {
+	r := newRedactor(2)
+	r.add("first-secret", "short", "")
+	tbl := []struct{ in, out string }{
+		{`Post "https://ksmg01/klwi?C2HToken=abc123&action=getCurrentTime": EOF`,
+			`Post "https://ksmg01/klwi?C2HToken=*****&action=getCurrentTime": EOF`},
+		{`{"action":"userLogin","C2HToken":"abc123"}`, `{"action":"userLogin","C2HToken":"*****"}`},
+		{`username=admin&password=p%40ss`, `username=admin&password=*****`},
+		{`Cookie: session=abc; lang=en`, `Cookie: *****; lang=en`},
+		{`Authorization: Bearer`, `Authorization: *****`},
+		{`value first-secret in text`, `value ***** in text`},
+		{`short is not masked, password of ksmg01 too`, `short is not masked, password of ksmg01 too`},
+	}
+	for _, tt := range tbl {
+		assert.Equal(t, tt.out, r.redact(tt.in), tt.in)
+	}
+
+	r.add("second-secret", "third-secret")
+	assert.Equal(t, "first-secret ***** *****", r.redact("first-secret second-secret third-secret"), "oldest forgotten")
+}
+
+func TestService_NoSecretsLogged(t *testing.T) {
+	const password, token, cookie = "PASSW0RD-1", "S3SSION-T0KEN", "C00KIE-VALUE-0123456789"
+
+	failTime := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		var resp interface{}
+		switch {
+		case q.Get("action") == "userLogin":
+			http.SetCookie(w, &http.Cookie{Name: "sid", Value: cookie})
+			resp = map[string]interface{}{"action": "userLogin", "userType": 1, "C2HToken": token}
+		case failTime:
+			hj, ok := w.(http.Hijacker)
+			require.True(t, ok)
+			conn, _, err := hj.Hijack()
+			require.NoError(t, err)
+			require.NoError(t, conn.Close())
+			return
+		case q.Get("action") == "getCurrentTime" && q.Get("action_id") == "":
+			resp = map[string]interface{}{"action": "getCurrentTime", "action_id": 2}
+		case q.Get("action") == "getCurrentTime":
+			resp = map[string]interface{}{"action": "getCurrentTime", "data": map[string]interface{}{"tz": "UTC", "time": 1}}
+		case q.Get("action") == "eventLoggerJournalQuery" && q.Get("action_id") == "":
+			resp = map[string]interface{}{"action": "eventLoggerJournalQuery", "action_id": 3}
+		default:
+			resp = map[string]interface{}{"action": "eventLoggerJournalQuery", "data": map[string]interface{}{"items": []Record{}}}
+		}
+		assert.NoError(t, json.NewEncoder(w).Encode(resp))
+	}))
+	defer ts.Close()
+
+	buf := bytes.Buffer{}
+	logger := NewLgrLogger(log.New(log.Debug, log.Out(&buf), log.Err(&buf)))
+	svc := NewService(Opts{URL: []string{ts.URL}, User: "admin", Password: password, Timeout: time.Second, Logger: logger})
+	_, err := svc.GetLogs()
+	require.NoError(t, err)
+
+	failTime = true
+	_, err = svc.GetLogs()
+	require.Error(t, err)
+	svc.log(LevelWarn, "could not get logs", "error", err)
+	svc.log(LevelDebug, "options", "service", svc, "opts", svc.Opts, "servers", svc.Servers())
+
+	out := buf.String()
+	assert.Contains(t, out, "C2HToken=*****")
+	assert.Contains(t, out, "logged in server=127.0.0.1 action=userLogin user=admin user_type=1 token_received=true")
+	for _, secret := range []string{password, token, cookie} {
+		assert.NotContains(t, out, secret)
+		assert.NotContains(t, err.Error(), secret)
+	}
+}
@@ -0,0 +1,350 @@
+package ksmglog
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// Router fans out records to sinks of matched routes.
+// Every route has own queue and consumer, so slow sink doesn't block others,
+// records are dropped for the route if its queue is full unless route blocks.
+type Router struct {
+	Logger Logger // gets messages of router and its routes, they are discarded if not set
+
+	metrics *Metrics
+
+	lock    sync.RWMutex
+	routes  []*route
+	ctx     context.Context // of Run, routes added while running are started with it
+	running bool
+	wg      sync.WaitGroup
+}
+
+// Route defines destination for matched records
+type Route struct {
+	Name      string
+	Sink      Sink
+	Match     []Condition // all conditions must match, empty list matches everything
+	Batch     BatchOpts
+	QueueSize int  // records buffered for sink, 1000 if not set
+	Block     bool // wait for place in full queue instead of dropping record, for sinks like spool which are never slow for long
+}
+
+// Condition checks record field addressed by dotted json path, see Record.Field.
+// Field with many values matches if any of them matches.
+type Condition struct {
+	Field  string
+	Op     string   // one of Op* constants, OpEq by default
+	Value  string   // compared value for all ops except OpIn and OpExists
+	Values []string // values for OpIn
+}
+
+// Condition operators, all string comparisons are case insensitive except OpRegex
+const (
+	OpEq       = "eq"
+	OpNe       = "ne"
+	OpIn       = "in"
+	OpContains = "contains"
+	OpPrefix   = "prefix"
+	OpSuffix   = "suffix"
+	OpRegex    = "regex"
+	OpExists   = "exists"
+)
+
+const queueSize = 1000
+
+type route struct {
+	Route
+	queue chan Record
+	done  chan struct{}    // closed when consumer finished queue
+	re    []*regexp.Regexp // compiled OpRegex values by condition index
+}
+
+// NewRouter validates routes and makes Router, metrics may be shared with Service
+func NewRouter(routes []Route, metrics *Metrics) (*Router, error) {
+	if metrics == nil {
+		metrics = NewMetrics()
+	}
+	res := &Router{metrics: metrics}
+
+	names := make(map[string]bool)
+	for i, r := range routes {
+		if r.Name == "" {
+			return nil, errors.Errorf("route %d has no name", i)
+		}
+		if names[r.Name] {
+			return nil, errors.Errorf("duplicate route %q", r.Name)
+		}
+		names[r.Name] = true
+		rt, err := newRoute(r)
+		if err != nil {
+			return nil, err
+		}
+		res.routes = append(res.routes, rt)
+	}
+
+	return res, nil
+}
+
+// newRoute validates route and compiles its regular expressions
+func newRoute(r Route) (*route, error) {
+	if r.Sink == nil {
+		return nil, errors.Errorf("route %q has no sink", r.Name)
+	}
+	if r.QueueSize <= 0 {
+		r.QueueSize = queueSize
+	}
+
+	rt := &route{Route: r, re: make([]*regexp.Regexp, len(r.Match))}
+	for j, c := range r.Match {
+		switch c.Op {
+		case "", OpEq, OpNe, OpIn, OpContains, OpPrefix, OpSuffix, OpExists:
+		case OpRegex:
+			re, err := regexp.Compile(c.Value)
+			if err != nil {
+				return nil, errors.Wrapf(err, "route %q condition %d", r.Name, j)
+			}
+			rt.re[j] = re
+		default:
+			return nil, errors.Errorf("route %q condition %d has unknown op %q", r.Name, j, c.Op)
+		}
+		if c.Field == "" {
+			return nil, errors.Errorf("route %q condition %d has no field", r.Name, j)
+		}
+	}
+	return rt, nil
+}
+
+// Run reads records from channel and dispatches them to routes until channel closed or ctx done,
+// returns after all route sinks finished their queues
+func (r *Router) Run(ctx context.Context, ch <-chan Record) {
+	r.lock.Lock()
+	r.ctx, r.running = ctx, true
+	for _, rt := range r.routes {
+		r.start(rt)
+	}
+	r.lock.Unlock()
+
+	defer func() {
+		r.lock.Lock()
+		for _, rt := range r.routes {
+			close(rt.queue)
+		}
+		r.running = false
+		r.lock.Unlock()
+		r.wg.Wait()
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case rec, ok := <-ch:
+			if !ok {
+				return
+			}
+			r.dispatch(rec)
+		}
+	}
+}
+
+// AddRoute adds route to router, route added to running router gets records dispatched after the call
+func (r *Router) AddRoute(rt Route) error {
+	if rt.Name == "" {
+		return errors.New("route has no name")
+	}
+	res, err := newRoute(rt)
+	if err != nil {
+		return err
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, existing := range r.routes {
+		if existing.Name == rt.Name {
+			return errors.Errorf("duplicate route %q", rt.Name)
+		}
+	}
+	r.routes = append(r.routes, res)
+	if r.running {
+		r.start(res)
+	}
+	return nil
+}
+
+// RemoveRoute removes route by name. Route of running router stops getting records
+// and RemoveRoute waits until its sink got records already queued, so the sink can be closed after.
+func (r *Router) RemoveRoute(name string) error {
+	r.lock.Lock()
+	var removed *route
+	for i, rt := range r.routes {
+		if rt.Name == name {
+			removed = rt
+			r.routes = append(r.routes[:i:i], r.routes[i+1:]...)
+			break
+		}
+	}
+	running := r.running
+	if removed != nil && running {
+		close(removed.queue)
+	}
+	r.lock.Unlock()
+
+	if removed == nil {
+		return errors.Errorf("no route %q", name)
+	}
+	if running {
+		<-removed.done
+	}
+	return nil
+}
+
+// Routes returns current routes
+func (r *Router) Routes() []Route {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	res := make([]Route, 0, len(r.routes))
+	for _, rt := range r.routes {
+		res = append(res, rt.Route)
+	}
+	return res
+}
+
+// start runs consumer of route queue, called with lock held
+func (r *Router) start(rt *route) {
+	rt.queue, rt.done = make(chan Record, rt.QueueSize), make(chan struct{})
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		defer close(rt.done)
+		batch := rt.Batch
+		if batch.Logger == nil {
+			batch.Logger = r.Logger
+		}
+		if err := Consume(r.ctx, rt.queue, r.instrument(rt), batch); err != nil {
+			logTo(r.Logger, LevelWarn, "route terminated", "route", rt.Name, "error", err)
+		}
+	}()
+}
+
+// Metrics return router metrics
+func (r *Router) Metrics() *Metrics {
+	return r.metrics
+}
+
+func (r *Router) dispatch(rec Record) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	// record is decoded once for conditions of all routes, routes with conditions don't match if it fails
+	var fields *recordFields
+	var fieldsErr error
+	for _, rt := range r.routes {
+		if len(rt.Match) > 0 && fields == nil && fieldsErr == nil {
+			var f recordFields
+			if f, fieldsErr = rec.fields(); fieldsErr != nil {
+				logTo(r.Logger, LevelWarn, "could not get fields", "server", rec.Server, "record", rec.ID, "error", fieldsErr)
+			}
+			fields = &f
+		}
+		if (len(rt.Match) > 0 && fieldsErr != nil) || !rt.match(fields) {
+			continue
+		}
+		r.metrics.add(mRouteMatched, 1, "route", rt.Name)
+
+		if rt.Block {
+			select {
+			case rt.queue <- rec:
+				r.metrics.set(mRouteQueue, float64(len(rt.queue)), "route", rt.Name)
+			case <-r.ctx.Done():
+				r.metrics.add(mRouteDropped, 1, "route", rt.Name)
+				logTo(r.Logger, LevelWarn, "router terminated, record dropped", "route", rt.Name, "server", rec.Server, "record", rec.ID)
+			}
+			continue
+		}
+
+		select {
+		case rt.queue <- rec:
+			r.metrics.set(mRouteQueue, float64(len(rt.queue)), "route", rt.Name)
+		default:
+			r.metrics.add(mRouteDropped, 1, "route", rt.Name)
+			logTo(r.Logger, LevelWarn, "route queue is full, record dropped", "route", rt.Name, "server", rec.Server, "record", rec.ID)
+		}
+	}
+}
+
+// instrument wraps route sink to count delivered records and errors
+func (r *Router) instrument(rt *route) Sink {
+	return SinkFunc(func(ctx context.Context, records []Record) error {
+		r.metrics.set(mRouteQueue, float64(len(rt.queue)), "route", rt.Name)
+		if err := rt.Sink.Send(ctx, records); err != nil {
+			r.metrics.add(mRouteErrors, 1, "route", rt.Name)
+			return errors.Wrapf(err, "route %s", rt.Name)
+		}
+		r.metrics.add(mRouteSent, float64(len(records)), "route", rt.Name)
+		return nil
+	})
+}
+
+// match checks route conditions against fields of record, fields are nil if route has no conditions
+func (rt *route) match(fields *recordFields) bool {
+	for i, c := range rt.Match {
+		if !c.match(fields.get(c.Field), rt.re[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+func (c Condition) match(values []string, re *regexp.Regexp) bool {
+	switch c.Op {
+	case OpExists:
+		for _, v := range values {
+			if v != "" {
+				return true
+			}
+		}
+		return false
+	case OpNe:
+		for _, v := range values {
+			if strings.EqualFold(v, c.Value) {
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, v := range values {
+		if c.matchValue(v, re) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c Condition) matchValue(v string, re *regexp.Regexp) bool {
+	lv, lc := strings.ToLower(v), strings.ToLower(c.Value)
+	switch c.Op {
+	case OpIn:
+		for _, val := range c.Values {
+			if strings.EqualFold(v, val) {
+				return true
+			}
+		}
+		return false
+	case OpContains:
+		return strings.Contains(lv, lc)
+	case OpPrefix:
+		return strings.HasPrefix(lv, lc)
+	case OpSuffix:
+		return strings.HasSuffix(lv, lc)
+	case OpRegex:
+		return re.MatchString(v)
+	default:
+		return strings.EqualFold(v, c.Value)
+	}
+}
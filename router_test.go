@@ -0,0 +1,199 @@
+package ksmglog
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type memSink struct {
+	lock    sync.Mutex
+	records []Record
+}
+
+func (m *memSink) Send(_ context.Context, records []Record) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.records = append(m.records, records...)
+	return nil
+}
+
+func (m *memSink) ids() []int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	res := []int{}
+	for _, r := range m.records {
+		res = append(res, r.ID)
+	}
+	return res
+}
+
+func TestRouter_Run(t *testing.T) {
+	archive, siem, mail := &memSink{}, &memSink{}, &memSink{}
+	release := make(chan struct{})
+	slow := SinkFunc(func(context.Context, []Record) error {
+		<-release
+		return nil
+	})
+
+	router, err := NewRouter([]Route{
+		{Name: "archive", Sink: archive},
+		{Name: "siem", Sink: siem, Match: []Condition{{Field: "result", Op: OpIn, Values: []string{"infected", "phishing"}}}},
+		{Name: "mail", Sink: mail, Match: []Condition{
+			{Field: "details.maInfo.dmarcVerdict", Op: OpRegex, Value: `^(fail|reject)`},
+			{Field: "details.messageInfo.from", Op: OpSuffix, Value: "@example.com"},
+		}},
+		{Name: "slow", Sink: slow, QueueSize: 1, Batch: BatchOpts{Size: 1}},
+	}, nil)
+	require.NoError(t, err)
+
+	r1 := Record{ID: 1, Result: ResultInfected}
+	r2 := Record{ID: 2, Result: ResultClean, Details: Details{
+		MessageInfo: MessageInfo{From: "a@Example.com"}, MaInfo: MaInfo{DmarcVerdict: "reject"},
+	}}
+	r3 := Record{ID: 3, Result: ResultPhishing, Details: Details{
+		MessageInfo: MessageInfo{From: "a@other.com"}, MaInfo: MaInfo{DmarcVerdict: "fail"},
+	}}
+
+	ch := make(chan Record)
+	done := make(chan struct{})
+	go func() {
+		router.Run(context.Background(), ch)
+		close(done)
+	}()
+
+	for _, r := range []Record{r1, r2, r3} {
+		select {
+		case ch <- r:
+		case <-time.After(time.Second):
+			t.Fatal("router blocked by slow sink")
+		}
+	}
+	close(ch)
+	close(release)
+	<-done
+
+	assert.Equal(t, []int{1, 2, 3}, archive.ids())
+	assert.Equal(t, []int{1, 3}, siem.ids())
+	assert.Equal(t, []int{2}, mail.ids())
+
+	body := scrape(t, router.Metrics())
+	assert.Contains(t, body, `ksmglog_route_matched_total{route="archive"} 3`+"\n")
+	assert.Contains(t, body, `ksmglog_route_sent_total{route="siem"} 2`+"\n")
+	assert.Contains(t, body, `ksmglog_route_matched_total{route="slow"} 3`+"\n")
+	assert.Contains(t, body, `ksmglog_route_dropped_total{route="slow"}`)
+}
+
+func TestRouter_RunBlock(t *testing.T) {
+	sink := &memSink{}
+	release := make(chan struct{})
+	slow := SinkFunc(func(ctx context.Context, records []Record) error {
+		<-release
+		return sink.Send(ctx, records)
+	})
+	router, err := NewRouter([]Route{{Name: "spool", Sink: slow, QueueSize: 1, Batch: BatchOpts{Size: 1}, Block: true}}, nil)
+	require.NoError(t, err)
+
+	ch := make(chan Record)
+	done := make(chan struct{})
+	go func() {
+		router.Run(context.Background(), ch)
+		close(done)
+	}()
+
+	sent := make(chan struct{})
+	go func() {
+		for i := 1; i <= 5; i++ {
+			ch <- Record{ID: i}
+		}
+		close(sent)
+	}()
+	select {
+	case <-sent:
+		t.Fatal("full queue of blocking route dropped records")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	<-sent
+	close(ch)
+	<-done
+	assert.Equal(t, []int{1, 2, 3, 4, 5}, sink.ids())
+	assert.NotContains(t, scrape(t, router.Metrics()), `ksmglog_route_dropped_total{route="spool"}`)
+}
+
+func TestRouter_AddRemoveRoute(t *testing.T) {
+	first, second := &memSink{}, &memSink{}
+	router, err := NewRouter([]Route{{Name: "first", Sink: first, Batch: BatchOpts{Size: 100, FlushInterval: time.Hour}}}, nil)
+	require.NoError(t, err)
+
+	ch := make(chan Record)
+	done := make(chan struct{})
+	go func() {
+		router.Run(context.Background(), ch)
+		close(done)
+	}()
+
+	ch <- Record{ID: 1}
+	require.NoError(t, router.AddRoute(Route{Name: "second", Sink: second, Batch: BatchOpts{Size: 1}}))
+	assert.EqualError(t, router.AddRoute(Route{Name: "second", Sink: second}), `duplicate route "second"`)
+	assert.EqualError(t, router.AddRoute(Route{Name: "bad", Sink: second, Match: []Condition{{Op: "like"}}}),
+		`route "bad" condition 0 has unknown op "like"`)
+	ch <- Record{ID: 2}
+	require.Eventually(t, func() bool { return len(second.ids()) == 1 }, time.Second, 10*time.Millisecond)
+
+	require.NoError(t, router.RemoveRoute("first"))
+	assert.Equal(t, []int{1, 2}, first.ids(), "queued records delivered on remove")
+	assert.EqualError(t, router.RemoveRoute("first"), `no route "first"`)
+	ch <- Record{ID: 3}
+
+	routes := router.Routes()
+	require.Equal(t, 1, len(routes))
+	assert.Equal(t, "second", routes[0].Name)
+
+	close(ch)
+	<-done
+	assert.Equal(t, []int{1, 2}, first.ids())
+	assert.Equal(t, []int{2, 3}, second.ids())
+}
+
+func TestCondition_Match(t *testing.T) {
+	tbl := []struct {
+		c      Condition
+		values []string
+		res    bool
+	}{
+		{Condition{Value: "a"}, []string{"A"}, true},
+		{Condition{Op: OpEq, Value: "a"}, []string{"b", "a"}, true},
+		{Condition{Op: OpEq, Value: "a"}, []string{}, false},
+		{Condition{Op: OpNe, Value: "a"}, []string{"b", "a"}, false},
+		{Condition{Op: OpNe, Value: "a"}, []string{}, true},
+		{Condition{Op: OpContains, Value: "troj"}, []string{"HEUR:Trojan"}, true},
+		{Condition{Op: OpPrefix, Value: "heur"}, []string{"HEUR:Trojan"}, true},
+		{Condition{Op: OpExists}, []string{""}, false},
+		{Condition{Op: OpExists}, []string{"x"}, true},
+	}
+	for i, tt := range tbl {
+		assert.Equal(t, tt.res, tt.c.match(tt.values, nil), "case %d", i)
+	}
+}
+
+func TestNewRouter_Errors(t *testing.T) {
+	sink := &memSink{}
+	tbl := [][]Route{
+		{{Sink: sink}},
+		{{Name: "a"}},
+		{{Name: "a", Sink: sink}, {Name: "a", Sink: sink}},
+		{{Name: "a", Sink: sink, Match: []Condition{{Field: "id", Op: "like"}}}},
+		{{Name: "a", Sink: sink, Match: []Condition{{Field: "id", Op: OpRegex, Value: "("}}}},
+		{{Name: "a", Sink: sink, Match: []Condition{{Op: OpEq}}}},
+	}
+	for i, routes := range tbl {
+		_, err := NewRouter(routes, nil)
+		assert.Error(t, err, "case %d", i)
+	}
+}
@@ -0,0 +1,184 @@
+package secret
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Keystore is local file with named secrets encrypted by AES-256-GCM,
+// key is derived from passphrase with PBKDF2-HMAC-SHA256
+type Keystore struct {
+	Path       string
+	Passphrase Provider
+}
+
+// keystoreFile is json content of keystore file
+type keystoreFile struct {
+	Version    int    `json:"version"`
+	Iterations int    `json:"iterations"`
+	Salt       []byte `json:"salt"`
+	Nonce      []byte `json:"nonce"`
+	Data       []byte `json:"data"` // encrypted json object of secrets by name
+}
+
+const (
+	keystoreVersion    = 1
+	keystoreIterations = 200000
+	minIterations      = 100000   // less doesn't stretch passphrase
+	maxIterations      = 10000000 // more takes seconds on start, damaged file
+	keySize            = 32
+)
+
+// Get decrypts keystore and returns secret by name
+func (k Keystore) Get(name string) (string, error) {
+	secrets, err := k.load()
+	if err != nil {
+		return "", err
+	}
+	res, ok := secrets[name]
+	if !ok {
+		return "", errors.Errorf("no secret %q in keystore %s", name, k.Path)
+	}
+	return res, nil
+}
+
+// Names returns names of secrets in keystore
+func (k Keystore) Names() ([]string, error) {
+	secrets, err := k.load()
+	if err != nil {
+		return nil, err
+	}
+	res := make([]string, 0, len(secrets))
+	for name := range secrets {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// Set adds or replaces secret, keystore file is created if not exists
+func (k Keystore) Set(name, value string) error {
+	secrets, err := k.load()
+	if os.IsNotExist(errors.Cause(err)) {
+		secrets, err = map[string]string{}, nil
+	}
+	if err != nil {
+		return err
+	}
+	secrets[name] = value
+	return k.save(secrets)
+}
+
+// Delete removes secret from keystore
+func (k Keystore) Delete(name string) error {
+	secrets, err := k.load()
+	if err != nil {
+		return err
+	}
+	if _, ok := secrets[name]; !ok {
+		return errors.Errorf("no secret %q in keystore %s", name, k.Path)
+	}
+	delete(secrets, name)
+	return k.save(secrets)
+}
+
+func (k Keystore) load() (map[string]string, error) {
+	if k.Path == "" {
+		return nil, errors.New("keystore is not set")
+	}
+	data, err := ioutil.ReadFile(k.Path)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read keystore")
+	}
+	var ksf keystoreFile
+	if err = json.Unmarshal(data, &ksf); err != nil {
+		return nil, errors.Wrap(err, "could not unmarshal keystore")
+	}
+	if ksf.Version != keystoreVersion {
+		return nil, errors.Errorf("unsupported keystore version %d", ksf.Version)
+	}
+
+	gcm, err := k.cipher(ksf.Salt, ksf.Iterations)
+	if err != nil {
+		return nil, err
+	}
+	if len(ksf.Nonce) != gcm.NonceSize() {
+		return nil, errors.New("invalid keystore nonce")
+	}
+	plain, err := gcm.Open(nil, ksf.Nonce, ksf.Data, nil)
+	if err != nil {
+		return nil, errors.New("could not decrypt keystore, wrong passphrase or damaged file")
+	}
+
+	res := map[string]string{}
+	if err = json.Unmarshal(plain, &res); err != nil {
+		return nil, errors.Wrap(err, "could not unmarshal secrets")
+	}
+	return res, nil
+}
+
+// save encrypts secrets with new salt and nonce and replaces keystore file atomically
+func (k Keystore) save(secrets map[string]string) error {
+	ksf := keystoreFile{Version: keystoreVersion, Iterations: keystoreIterations, Salt: make([]byte, 16)}
+	if _, err := io.ReadFull(rand.Reader, ksf.Salt); err != nil {
+		return errors.Wrap(err, "could not make salt")
+	}
+	gcm, err := k.cipher(ksf.Salt, ksf.Iterations)
+	if err != nil {
+		return err
+	}
+	ksf.Nonce = make([]byte, gcm.NonceSize())
+	if _, err = io.ReadFull(rand.Reader, ksf.Nonce); err != nil {
+		return errors.Wrap(err, "could not make nonce")
+	}
+
+	plain, err := json.Marshal(secrets)
+	if err != nil {
+		return errors.Wrap(err, "could not marshal secrets")
+	}
+	ksf.Data = gcm.Seal(nil, ksf.Nonce, plain, nil)
+	data, err := json.MarshalIndent(ksf, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "could not marshal keystore")
+	}
+
+	tmp := filepath.Join(filepath.Dir(k.Path), "."+filepath.Base(k.Path)+".tmp")
+	if err = ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return errors.Wrap(err, "could not write keystore")
+	}
+	return errors.Wrap(os.Rename(tmp, k.Path), "could not save keystore")
+}
+
+// cipher derives key from passphrase and makes AES-GCM with it
+func (k Keystore) cipher(salt []byte, iterations int) (cipher.AEAD, error) {
+	if k.Passphrase == nil {
+		return nil, errors.New("keystore passphrase is not set")
+	}
+	pass, err := k.Passphrase.Secret()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get keystore passphrase")
+	}
+	if pass == "" {
+		return nil, errors.New("keystore passphrase is empty")
+	}
+	if iterations < minIterations || iterations > maxIterations {
+		return nil, errors.Errorf("invalid keystore iterations %d, allowed %d-%d", iterations, minIterations, maxIterations)
+	}
+
+	block, err := aes.NewCipher(pbkdf2.Key([]byte(pass), salt, iterations, keySize, sha256.New))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not make cipher")
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,91 @@
+package secret
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+func TestKeystore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ksmglog-keystore")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ks := Keystore{Path: filepath.Join(dir, "keystore"), Passphrase: Static("master")}
+	_, err = ks.Get("admin")
+	assert.Error(t, err, "no keystore file")
+
+	require.NoError(t, ks.Set("admin", "passw0rd"))
+	require.NoError(t, ks.Set("collector", "other"))
+	require.NoError(t, ks.Set("admin", "rotated"))
+
+	v, err := Entry{Keystore: ks, Name: "admin"}.Secret()
+	require.NoError(t, err)
+	assert.Equal(t, "rotated", v)
+	names, err := ks.Names()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"admin", "collector"}, names)
+
+	data, err := ioutil.ReadFile(ks.Path)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), "rotated")
+	assert.NotContains(t, string(data), "collector")
+	fi, err := os.Stat(ks.Path)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	_, err = ks.Get("nope")
+	assert.EqualError(t, err, `no secret "nope" in keystore `+ks.Path)
+	require.NoError(t, ks.Delete("collector"))
+	assert.Error(t, ks.Delete("collector"))
+
+	wrong := Keystore{Path: ks.Path, Passphrase: Static("guess")}
+	_, err = wrong.Get("admin")
+	assert.EqualError(t, err, "could not decrypt keystore, wrong passphrase or damaged file")
+
+	_, err = Keystore{Path: ks.Path}.Get("admin")
+	assert.EqualError(t, err, "keystore passphrase is not set")
+	_, err = Keystore{}.Get("admin")
+	assert.EqualError(t, err, "keystore is not set")
+}
+
+func TestKeystore_Iterations(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ksmglog-keystore")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	ks := Keystore{Path: filepath.Join(dir, "keystore"), Passphrase: Static("master")}
+	require.NoError(t, ks.Set("admin", "passw0rd"))
+	data, err := ioutil.ReadFile(ks.Path)
+	require.NoError(t, err)
+
+	for _, n := range []int{0, 1, 99999, 10000001, 2000000000} {
+		ksf := keystoreFile{}
+		require.NoError(t, json.Unmarshal(data, &ksf))
+		ksf.Iterations = n
+		damaged, err := json.Marshal(ksf)
+		require.NoError(t, err)
+		require.NoError(t, ioutil.WriteFile(ks.Path, damaged, 0600))
+		_, err = ks.Get("admin")
+		require.Error(t, err, "iterations %d", n)
+		assert.Contains(t, err.Error(), "invalid keystore iterations", "iterations %d", n)
+	}
+}
+
+func TestKeystore_KeyDerivation(t *testing.T) {
+	// test vectors of RFC 7914 section 11, keys of files written before keep decrypting
+	key := pbkdf2.Key([]byte("passwd"), []byte("salt"), 1, 64, sha256.New)
+	assert.Equal(t, "55ac046e56e3089fec1691c22544b605f94185216dde0465e68b9d57c20dacbc"+
+		"49ca9cccf179b645991664b39d77ef317c71b845b1e30bd509112041d3a19783", hex.EncodeToString(key))
+	key = pbkdf2.Key([]byte("Password"), []byte("NaCl"), 80000, 64, sha256.New)
+	assert.Equal(t, "4ddcd8f60b98be21830cee5ef22701f9641a4418d04c0414aeff08876b34ab56"+
+		"a1d425a1225833549adb841b51c9b3176a272bdebba1d078478f62b397f33c8d", hex.EncodeToString(key))
+}
@@ -0,0 +1,125 @@
+// Package secret resolves credentials from files like docker and kubernetes secrets, external commands
+// or encrypted local keystore. Providers are asked again when the value is rejected, so secrets can be rotated.
+package secret
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Provider returns secret value
+type Provider interface {
+	Secret() (string, error)
+}
+
+// Reference prefixes understood by Parse
+const (
+	FilePrefix     = "file:"
+	CommandPrefix  = "cmd:"
+	KeystorePrefix = "keystore:"
+)
+
+const commandTimeout = 10 * time.Second
+
+// Parse makes provider of reference like "file:/run/secrets/ksmg", "cmd:pass show ksmg" or "keystore:admin",
+// other values are literal secrets. Keystore is used for keystore references.
+func Parse(ref string, ks Keystore) Provider {
+	switch {
+	case strings.HasPrefix(ref, FilePrefix):
+		return File(strings.TrimPrefix(ref, FilePrefix))
+	case strings.HasPrefix(ref, CommandPrefix):
+		return Command{Command: strings.TrimPrefix(ref, CommandPrefix)}
+	case strings.HasPrefix(ref, KeystorePrefix):
+		return Entry{Keystore: ks, Name: strings.TrimPrefix(ref, KeystorePrefix)}
+	}
+	return Static(ref)
+}
+
+// IsReference checks if value is reference to secret, not literal one
+func IsReference(ref string) bool {
+	_, ok := Parse(ref, Keystore{}).(Static)
+	return !ok
+}
+
+// Static is literal secret
+type Static string
+
+// Secret returns literal value
+func (s Static) Secret() (string, error) {
+	return string(s), nil
+}
+
+// String hides value
+func (s Static) String() string {
+	return redact(string(s))
+}
+
+// GoString hides value
+func (s Static) GoString() string {
+	return "secret.Static(" + redact(string(s)) + ")"
+}
+
+// File is path of file with secret, trailing new line is trimmed
+type File string
+
+// Secret reads file every time, so rotated secret is picked up
+func (f File) Secret() (string, error) {
+	data, err := ioutil.ReadFile(string(f))
+	if err != nil {
+		return "", errors.Wrap(err, "could not read secret file")
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// Command is shell command printing secret to stdout, like "vault kv get -field=password secret/ksmg"
+type Command struct {
+	Command string
+	Timeout time.Duration // 10s if not set
+}
+
+// Secret runs command and returns first line of its output
+func (c Command) Secret() (string, error) {
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = commandTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "sh", "-c", c.Command) //nolint:gosec
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return "", errors.Wrapf(err, "secret command failed: %s", strings.TrimSpace(stderr.String()))
+	}
+	res := strings.SplitN(stdout.String(), "\n", 2)[0]
+	if res = strings.TrimRight(res, "\r"); res == "" {
+		return "", errors.New("secret command printed nothing")
+	}
+	return res, nil
+}
+
+// Entry is named secret of keystore
+type Entry struct {
+	Keystore Keystore
+	Name     string
+}
+
+// Secret decrypts keystore every time, so updated keystore is picked up
+func (e Entry) Secret() (string, error) {
+	return e.Keystore.Get(e.Name)
+}
+
+// redact hides secret keeping only fact it is set
+func redact(s string) string {
+	if s == "" {
+		return ""
+	}
+	return "*****"
+}
@@ -0,0 +1,81 @@
+package secret
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	ks := Keystore{Path: "/etc/ksmglog/keystore", Passphrase: File("/run/secrets/keystore")}
+	tbl := []struct {
+		ref  string
+		want Provider
+	}{
+		{"secret", Static("secret")},
+		{"", Static("")},
+		{"file:/run/secrets/ksmg", File("/run/secrets/ksmg")},
+		{"cmd:pass show ksmg", Command{Command: "pass show ksmg"}},
+		{"keystore:admin", Entry{Keystore: ks, Name: "admin"}},
+		{"File:/not/prefix", Static("File:/not/prefix")},
+	}
+	for _, tt := range tbl {
+		assert.Equal(t, tt.want, Parse(tt.ref, ks), tt.ref)
+		_, static := tt.want.(Static)
+		assert.Equal(t, !static, IsReference(tt.ref), tt.ref)
+	}
+}
+
+func TestStatic(t *testing.T) {
+	s := Static("passw0rd")
+	v, err := s.Secret()
+	require.NoError(t, err)
+	assert.Equal(t, "passw0rd", v)
+
+	for _, format := range []string{"%v", "%+v", "%s", "%#v"} {
+		assert.NotContains(t, fmt.Sprintf(format, s), "passw0rd", format)
+		assert.NotContains(t, fmt.Sprintf(format, struct{ P Provider }{s}), "passw0rd", format)
+	}
+	assert.Equal(t, "", Static("").String())
+}
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ksmglog-secret")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "pass")
+	require.NoError(t, ioutil.WriteFile(file, []byte("passw0rd\n"), 0600))
+
+	v, err := File(file).Secret()
+	require.NoError(t, err)
+	assert.Equal(t, "passw0rd", v)
+
+	require.NoError(t, ioutil.WriteFile(file, []byte("rotated"), 0600))
+	v, err = File(file).Secret()
+	require.NoError(t, err)
+	assert.Equal(t, "rotated", v)
+
+	_, err = File(filepath.Join(dir, "nope")).Secret()
+	assert.Error(t, err)
+}
+
+func TestCommand(t *testing.T) {
+	v, err := Command{Command: "printf 'passw0rd\\nsecond line'"}.Secret()
+	require.NoError(t, err)
+	assert.Equal(t, "passw0rd", v)
+
+	_, err = Command{Command: "echo denied >&2; exit 3"}.Secret()
+	assert.EqualError(t, err, "secret command failed: denied: exit status 3")
+
+	_, err = Command{Command: "true"}.Secret()
+	assert.EqualError(t, err, "secret command printed nothing")
+
+	_, err = Command{Command: "sleep 1", Timeout: 10 * time.Millisecond}.Secret()
+	assert.Error(t, err)
+}
@@ -0,0 +1,269 @@
+package ksmglog
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/zorion79/ksmglog/secret"
+)
+
+// Server describes one ksmg with own credentials and settings, empty fields are taken from Opts
+type Server struct {
+	Name         string // marks records and metrics, host of URL if empty
+	URL          string
+	User         string
+	Password     string // literal or reference like file:path, cmd:command or keystore:name, see secret.Parse
+	Timeout      time.Duration
+	PollInterval time.Duration // min time between polls, rounded up to SleepTime, every loop if zero
+	Filters      string        // journal filters json, {"dateType":8} if empty
+	TLS          TLSOpts
+}
+
+// TLSOpts defines how server certificate is checked, it is not verified by default
+type TLSOpts struct {
+	Verify     bool   // verify certificate chain and host name
+	CACert     string // PEM file with CA certificates, system roots if empty
+	ServerName string // name to verify instead of URL host
+}
+
+// String hides password
+func (s Server) String() string {
+	return fmt.Sprintf("%+v", plainServer(s.redacted()))
+}
+
+// GoString hides password
+func (s Server) GoString() string {
+	return "ksmglog.Server" + strings.TrimPrefix(fmt.Sprintf("%#v", plainServer(s.redacted())), "ksmglog.plainServer")
+}
+
+// plainServer is Server without String methods
+type plainServer Server
+
+func (s Server) redacted() Server {
+	s.Password = redact(s.Password)
+	return s
+}
+
+// redact hides secret value, references to secrets are kept as is
+func redact(s string) string {
+	if s == "" || secret.IsReference(s) {
+		return s
+	}
+	return "*****"
+}
+
+// server is Server with http client, poll state and resolved password
+type server struct {
+	Server
+	client   *http.Client
+	lastPoll time.Time
+
+	secret   secret.Provider
+	lock     sync.Mutex
+	pass     string
+	resolved bool
+}
+
+// closeIdle closes idle connections of replaced server, requests in flight finish on their connections
+func (srv *server) closeIdle() {
+	srv.client.CloseIdleConnections()
+}
+
+// password returns password of server resolved on first use, refresh resolves it again
+func (srv *server) password(refresh bool) (string, error) {
+	srv.lock.Lock()
+	defer srv.lock.Unlock()
+	if srv.resolved && !refresh {
+		return srv.pass, nil
+	}
+	res, err := srv.secret.Secret()
+	if err != nil {
+		return "", errors.Wrapf(err, "could not get password of %s", srv.Name)
+	}
+	srv.pass, srv.resolved = res, true
+	return res, nil
+}
+
+// Servers returns all polled servers, made of Opts.URL and Opts.Servers with defaults applied
+func (s *Service) Servers() []Server {
+	servers := s.serverList()
+	res := make([]Server, 0, len(servers))
+	for _, srv := range servers {
+		res = append(res, srv.Server)
+	}
+	return res
+}
+
+// Reload applies new options to running service. Servers with unchanged settings keep their http client
+// with open connections and poll state, added servers are polled on the next loop. Dedup of records is kept.
+func (s *Service) Reload(opts Opts) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	prev, prevByURL, prevFallback := s.servers, s.serverByURL, s.fallback
+	s.setOpts(opts)
+
+	for i, srv := range s.servers {
+		old, ok := prevByURL[srv.URL]
+		switch {
+		case !ok:
+			logTo(s.Logger, LevelInfo, "server added", "server", srv.Name)
+		case old.Server == srv.Server && reflect.DeepEqual(old.secret, srv.secret):
+			s.servers[i], s.serverByURL[srv.URL] = old, old
+		default:
+			logTo(s.Logger, LevelInfo, "server changed", "server", srv.Name)
+			old.closeIdle()
+		}
+	}
+	for _, old := range prev {
+		if _, ok := s.serverByURL[old.URL]; !ok {
+			logTo(s.Logger, LevelInfo, "server removed", "server", old.Name)
+			old.closeIdle()
+		}
+	}
+	for _, old := range prevFallback {
+		old.closeIdle()
+	}
+}
+
+// setOpts sets options with defaults and makes servers of them
+func (s *Service) setOpts(opts Opts) {
+	s.Opts = opts
+	if s.SleepTime.Seconds() < 1 {
+		s.SleepTime = sleepTime
+	}
+	s.initServers()
+}
+
+// initServers makes servers of URL and Servers, server with the same url as one of URL replaces it
+func (s *Service) initServers() {
+	s.servers, s.serverByURL, s.fallback = nil, make(map[string]*server), make(map[string]*server)
+	for _, u := range s.URL {
+		s.addServer(Server{URL: u})
+	}
+	for _, srv := range s.Opts.Servers {
+		s.addServer(srv)
+	}
+}
+
+func (s *Service) addServer(srv Server) {
+	res := s.newServer(srv)
+	if prev, ok := s.serverByURL[srv.URL]; ok {
+		for i := range s.servers {
+			if s.servers[i] == prev {
+				s.servers[i] = res
+			}
+		}
+		s.serverByURL[srv.URL] = res
+		return
+	}
+	s.servers = append(s.servers, res)
+	s.serverByURL[srv.URL] = res
+}
+
+// serverList returns current servers, safe to use while Reload replaces them
+func (s *Service) serverList() []*server {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return append([]*server{}, s.servers...)
+}
+
+// dueServers returns servers with passed poll interval and marks them polled at now
+func (s *Service) dueServers(now time.Time) []*server {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	res := []*server{}
+	for _, srv := range s.servers {
+		if now.Sub(srv.lastPoll) < srv.PollInterval {
+			continue
+		}
+		srv.lastPoll = now
+		res = append(res, srv)
+	}
+	return res
+}
+
+func (s *Service) sleepTime() time.Duration {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.SleepTime
+}
+
+// server returns server of url, url not known to service gets default settings and is kept
+// with its http client for the next calls until Reload
+func (s *Service) server(ksmgURL string) *server {
+	s.lock.RLock()
+	srv, ok := s.serverByURL[ksmgURL]
+	if !ok {
+		srv, ok = s.fallback[ksmgURL]
+	}
+	s.lock.RUnlock()
+	if ok {
+		return srv
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if srv, ok = s.serverByURL[ksmgURL]; ok {
+		return srv
+	}
+	if srv, ok = s.fallback[ksmgURL]; ok {
+		return srv
+	}
+	srv = s.newServer(Server{URL: ksmgURL})
+	s.fallback[ksmgURL] = srv
+	return srv
+}
+
+func (s *Service) newServer(srv Server) *server {
+	if srv.Name == "" {
+		srv.Name = serverName(srv.URL)
+	}
+	if srv.User == "" {
+		srv.User, srv.Password = s.User, s.Password
+	}
+	if srv.Timeout <= 0 {
+		srv.Timeout = s.Timeout
+	}
+	if srv.Filters == "" {
+		srv.Filters = journalFilters
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: !srv.TLS.Verify, ServerName: srv.TLS.ServerName} //nolint:gosec
+	if srv.TLS.CACert != "" {
+		pool := x509.NewCertPool()
+		pem, err := ioutil.ReadFile(srv.TLS.CACert)
+		if err != nil || !pool.AppendCertsFromPEM(pem) {
+			logTo(s.Logger, LevelWarn, "could not load ca certificates, system roots used", "server", srv.Name,
+				"file", srv.TLS.CACert, "error", err)
+		} else {
+			tlsConfig.RootCAs = pool
+		}
+	}
+
+	keystore := secret.Keystore{Path: s.Keystore, Passphrase: secret.Parse(s.KeystorePass, secret.Keystore{})}
+	return &server{
+		Server: srv,
+		client: &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}, Timeout: srv.Timeout},
+		secret: secret.Parse(srv.Password, keystore),
+	}
+}
+
+// serverName returns host of ksmg url used to mark records, falls back to url itself
+func serverName(ksmgURL string) string {
+	u, err := url.Parse(ksmgURL)
+	if err != nil || u.Hostname() == "" {
+		return ksmgURL
+	}
+	return u.Hostname()
+}
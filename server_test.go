@@ -0,0 +1,202 @@
+package ksmglog
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestService_Servers(t *testing.T) {
+	svc := NewService(Opts{
+		URL:      []string{"https://ksmg01/klwi", "https://ksmg02/klwi"},
+		User:     "admin",
+		Password: "pass",
+		Timeout:  time.Second,
+		Servers: []Server{
+			{Name: "second", URL: "https://ksmg02/klwi", User: "other", Password: "secret", Timeout: 3 * time.Second},
+			{URL: "https://ksmg03/klwi", PollInterval: time.Minute, Filters: `{"dateType":3}`},
+		},
+	})
+
+	assert.Equal(t, []Server{
+		{Name: "ksmg01", URL: "https://ksmg01/klwi", User: "admin", Password: "pass", Timeout: time.Second, Filters: journalFilters},
+		{Name: "second", URL: "https://ksmg02/klwi", User: "other", Password: "secret", Timeout: 3 * time.Second, Filters: journalFilters},
+		{Name: "ksmg03", URL: "https://ksmg03/klwi", User: "admin", Password: "pass", Timeout: time.Second,
+			PollInterval: time.Minute, Filters: `{"dateType":3}`},
+	}, svc.Servers())
+}
+
+func TestService_ServerSettings(t *testing.T) {
+	users := make(chan string, 10)
+	handler := journalHandler(t, []Record{{ID: 1, Time: int(time.Now().Unix())}}, nil)
+	ht := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("action") == "userLogin" {
+			require.NoError(t, r.ParseForm())
+			users <- r.PostForm.Get("username")
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer ht.Close()
+
+	svc := NewService(Opts{User: "admin", Timeout: time.Second, Servers: []Server{
+		{Name: "ksmg01", URL: ht.URL, User: "collector", PollInterval: time.Hour},
+	}})
+
+	now := time.Now()
+	recs, err := svc.getDueLogs(now)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(recs))
+	assert.Equal(t, "ksmg01", recs[0].Server, "records marked by server name")
+	assert.Equal(t, "collector", <-users)
+
+	recs, err = svc.getDueLogs(now.Add(time.Minute))
+	require.NoError(t, err)
+	assert.Empty(t, recs, "poll interval not passed")
+}
+
+func TestService_ServerFallback(t *testing.T) {
+	svc := NewService(Opts{URL: []string{"https://ksmg01/klwi"}, User: "admin", Timeout: time.Second})
+
+	other := svc.server("https://ksmg09/klwi")
+	assert.Equal(t, "ksmg09", other.Name)
+	assert.Equal(t, "admin", other.User)
+	assert.True(t, other == svc.server("https://ksmg09/klwi"), "server of unknown url kept with its client")
+	assert.Equal(t, 1, len(svc.Servers()), "unknown url not polled")
+
+	svc.Reload(Opts{URL: []string{"https://ksmg01/klwi"}, User: "other"})
+	assert.Equal(t, "other", svc.server("https://ksmg09/klwi").User, "made again with reloaded defaults")
+}
+
+func TestService_Reload(t *testing.T) {
+	svc := NewService(Opts{User: "admin", Servers: []Server{
+		{URL: "https://ksmg01/klwi", PollInterval: time.Minute},
+		{URL: "https://ksmg02/klwi", PollInterval: time.Minute},
+		{URL: "https://ksmg03/klwi"},
+	}})
+	now := time.Now()
+	require.Equal(t, 3, len(svc.dueServers(now)))
+	svc.logMapAll["hash"] = nil
+	first, second := svc.server("https://ksmg01/klwi"), svc.server("https://ksmg02/klwi")
+
+	svc.Reload(Opts{User: "admin", SleepTime: time.Minute, Servers: []Server{
+		{URL: "https://ksmg01/klwi", PollInterval: time.Minute},
+		{URL: "https://ksmg02/klwi", PollInterval: time.Minute, User: "other"},
+		{URL: "https://ksmg04/klwi"},
+	}})
+
+	servers := svc.Servers()
+	require.Equal(t, 3, len(servers))
+	assert.Equal(t, []string{"ksmg01", "ksmg02", "ksmg04"}, []string{servers[0].Name, servers[1].Name, servers[2].Name})
+	assert.True(t, first == svc.server("https://ksmg01/klwi"), "unchanged server kept")
+	assert.False(t, second == svc.server("https://ksmg02/klwi"), "changed server replaced")
+	assert.Equal(t, "other", svc.server("https://ksmg02/klwi").User)
+	assert.Equal(t, time.Minute, svc.sleepTime())
+	assert.Contains(t, svc.logMapAll, "hash", "dedup kept")
+
+	due := svc.dueServers(now.Add(time.Second))
+	require.Equal(t, 2, len(due), "kept server not polled again within poll interval")
+	assert.Equal(t, "ksmg02", due[0].Name)
+	assert.Equal(t, "ksmg04", due[1].Name)
+}
+
+func TestService_ReloadCloseIdle(t *testing.T) {
+	closed := make(chan struct{}, 10)
+	ht := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ht.Config.ConnState = func(_ net.Conn, st http.ConnState) {
+		if st == http.StateClosed {
+			closed <- struct{}{}
+		}
+	}
+	ht.Start()
+	defer ht.Close()
+
+	svc := NewService(Opts{URL: []string{ht.URL}, User: "admin", Timeout: time.Second})
+	for _, u := range []string{ht.URL, ht.URL + "/other"} {
+		resp, err := svc.server(u).client.Get(ht.URL)
+		require.NoError(t, err)
+		require.NoError(t, resp.Body.Close())
+	}
+
+	svc.Reload(Opts{URL: []string{ht.URL}, User: "other", Timeout: time.Second})
+	for i := 0; i < 2; i++ {
+		select {
+		case <-closed:
+		case <-time.After(time.Second):
+			t.Fatal("idle connection of replaced server not closed")
+		}
+	}
+}
+
+func TestService_PasswordRefresh(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ksmglog-server")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	passFile := filepath.Join(dir, "pass")
+	require.NoError(t, ioutil.WriteFile(passFile, []byte("old\n"), 0600))
+
+	logins := 0
+	ht := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, r.ParseForm())
+		logins++
+		if r.PostForm.Get("password") != "new" {
+			_, _ = w.Write([]byte(`{"action":"userLogin"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"action":"userLogin","userType":1,"C2HToken":"token"}`))
+	}))
+	defer ht.Close()
+
+	svc := NewService(Opts{URL: []string{ht.URL}, User: "admin", Password: "file:" + passFile, Timeout: time.Second})
+	_, token, _, err := svc.userLogin(ht.URL)
+	require.NoError(t, err)
+	assert.Equal(t, "", token, "rejected")
+	assert.Equal(t, 1, logins, "not retried with the same password")
+
+	require.NoError(t, ioutil.WriteFile(passFile, []byte("new\n"), 0600))
+	_, token, _, err = svc.userLogin(ht.URL)
+	require.NoError(t, err)
+	assert.Equal(t, "token", token)
+	assert.Equal(t, 3, logins, "retried with refreshed password")
+
+	_, token, _, err = svc.userLogin(ht.URL)
+	require.NoError(t, err)
+	assert.Equal(t, "token", token)
+	assert.Equal(t, 4, logins, "refreshed password cached")
+
+	require.NoError(t, os.Remove(passFile))
+	svc = NewService(Opts{URL: []string{ht.URL}, Password: "file:" + passFile})
+	_, _, _, err = svc.userLogin(ht.URL)
+	assert.Contains(t, err.Error(), "could not get password of 127.0.0.1: could not read secret file")
+}
+
+func TestOpts_String(t *testing.T) {
+	opts := Opts{URL: []string{"https://ksmg01/klwi"}, User: "admin", Password: "passw0rd", KeystorePass: "master",
+		Keystore: "/etc/ksmglog/keystore", Servers: []Server{
+			{URL: "https://ksmg02/klwi", Password: "s3cret"},
+			{URL: "https://ksmg03/klwi", Password: "keystore:ksmg03"},
+		}}
+	svc := NewService(opts)
+
+	for _, v := range []interface{}{opts, &opts, svc, opts.Servers[0], svc.Servers()} {
+		for _, format := range []string{"%v", "%+v", "%s", "%#v"} {
+			s := fmt.Sprintf(format, v)
+			for _, secret := range []string{"passw0rd", "master", "s3cret"} {
+				assert.NotContains(t, s, secret, "%s of %T", format, v)
+			}
+		}
+	}
+	assert.Contains(t, fmt.Sprintf("%+v", opts), "Password:*****")
+	assert.Contains(t, fmt.Sprintf("%+v", opts), "Password:keystore:ksmg03", "reference is not secret")
+	assert.Contains(t, fmt.Sprintf("%#v", opts), `ksmglog.Opts{URL:[]string{"https://ksmg01/klwi"}, User:"admin", Password:"*****"`)
+	assert.Equal(t, "passw0rd", opts.Password, "not changed")
+	assert.Equal(t, "s3cret", opts.Servers[0].Password, "not changed")
+}
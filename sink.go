@@ -0,0 +1,72 @@
+package ksmglog
+
+import (
+	"context"
+	"time"
+)
+
+// Sink delivers batch of records to external destination
+type Sink interface {
+	Send(ctx context.Context, records []Record) error
+}
+
+// BatchOpts defines how Consume groups records before sending them to Sink
+type BatchOpts struct {
+	Size          int           // max records in one batch
+	FlushInterval time.Duration // max time record waits in incomplete batch
+	Logger        Logger        // gets send errors, they are discarded if not set
+}
+
+const (
+	batchSize     = 100
+	flushInterval = 5 * time.Second
+)
+
+// Consume reads records from channel and sends them to sink in batches.
+// Returns nil after channel closed and last batch flushed, or ctx error if ctx done first.
+func Consume(ctx context.Context, ch <-chan Record, sink Sink, opts BatchOpts) error {
+	if opts.Size <= 0 {
+		opts.Size = batchSize
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = flushInterval
+	}
+
+	ticker := time.NewTicker(opts.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]Record, 0, opts.Size)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := sink.Send(ctx, batch); err != nil {
+			logTo(opts.Logger, LevelWarn, "could not send records", "records", len(batch), "error", err)
+		}
+		batch = make([]Record, 0, opts.Size)
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case r, ok := <-ch:
+			if !ok {
+				flush()
+				return nil
+			}
+			batch = append(batch, r)
+			if len(batch) >= opts.Size {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// SinkFunc is an adapter to allow the use of ordinary functions as Sink
+type SinkFunc func(ctx context.Context, records []Record) error
+
+// Send calls f(ctx, records)
+func (f SinkFunc) Send(ctx context.Context, records []Record) error { return f(ctx, records) }
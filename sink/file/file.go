@@ -0,0 +1,349 @@
+// Package file implements ksmglog.Sink writing records as newline-delimited json to local rotated files
+package file
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/zorion79/ksmglog"
+)
+
+// Sink appends records to per server files named by Pattern rendered with current time, not time of record,
+// so records of several servers coming out of order don't switch files. Active file is rotated when it grows
+// over MaxSize, when it is open longer than RotateEvery or when pattern renders new name, e.g. next day started.
+// Rotated files are gzipped and only MaxFiles of them retained.
+type Sink struct {
+	Opts
+
+	lock   sync.Mutex
+	active map[string]*activeFile // by server
+	now    func() time.Time
+}
+
+// Opts collects parameters to initialize Sink
+type Opts struct {
+	Dir      string `long:"dir" env:"DIR" default:"." description:"directory for record files"`
+	Pattern  string `long:"pattern" env:"PATTERN" default:"ksmg-{server}-{date}.ndjson" description:"file name pattern, {server}, {date} and {hour} of writing time replaced"`
+	MaxSize  int64  `long:"max-size" env:"MAX_SIZE" default:"104857600" description:"rotate file bigger than this size in bytes, 0 disables"`
+	MaxFiles int    `long:"max-files" env:"MAX_FILES" default:"0" description:"max rotated files to keep, 0 keeps all"`
+
+	RotateEvery time.Duration `long:"rotate-every" env:"ROTATE_EVERY" description:"rotate file open longer than this, 0 rotates by size and pattern only"`
+	Fsync       string        `long:"fsync" env:"FSYNC" choice:"batch" choice:"rotate" choice:"never" default:"batch" description:"when to fsync written data"`
+	NoGzip      bool          `long:"no-gzip" env:"NO_GZIP" description:"keep rotated files uncompressed"`
+
+	// Logger gets messages of sink, they are discarded if not set
+	Logger ksmglog.Logger `no-flag:"true"`
+}
+
+// Fsync policies
+const (
+	FsyncBatch  = "batch"  // after every Send
+	FsyncRotate = "rotate" // on rotation and Close only
+	FsyncNever  = "never"
+)
+
+const (
+	pattern     = "ksmg-{server}-{date}.ndjson"
+	rotatedTime = "20060102T150405"
+	gzipExt     = ".gz"
+	rotateCheck = 10 * time.Second
+)
+
+type activeFile struct {
+	path   string
+	file   *os.File
+	buf    *bufio.Writer
+	size   int64
+	opened time.Time
+}
+
+// NewSink initializes everything
+func NewSink(opts Opts) *Sink {
+	res := &Sink{Opts: opts, active: make(map[string]*activeFile), now: time.Now}
+	res.Logger = ksmglog.MaskedLogger(res.Logger)
+
+	if res.Dir == "" {
+		res.Dir = "."
+	}
+	if res.Pattern == "" {
+		res.Pattern = pattern
+	}
+	if res.Fsync == "" {
+		res.Fsync = FsyncBatch
+	}
+
+	return res
+}
+
+// Send appends records to their files
+func (s *Sink) Send(_ context.Context, records []ksmglog.Record) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	touched := make(map[*activeFile]bool)
+	for _, r := range records {
+		line, err := json.Marshal(r)
+		if err != nil {
+			return errors.Wrapf(err, "could not marshal record %d", r.ID)
+		}
+		line = append(line, '\n')
+
+		prev := s.active[r.Server]
+		af, err := s.file(r)
+		if err != nil {
+			return err
+		}
+		if prev != nil && prev != af {
+			delete(touched, prev) // rotated, flushed and closed already
+		}
+
+		n, err := af.buf.Write(line)
+		af.size += int64(n)
+		if err != nil {
+			return errors.Wrapf(err, "could not write to %s", af.path)
+		}
+		touched[af] = true
+
+		if s.MaxSize > 0 && af.size >= s.MaxSize {
+			delete(touched, af)
+			if err := s.rotate(r.Server); err != nil {
+				return err
+			}
+		}
+	}
+
+	for af := range touched {
+		if err := af.buf.Flush(); err != nil {
+			return errors.Wrapf(err, "could not flush %s", af.path)
+		}
+		if s.Fsync == FsyncBatch {
+			if err := af.file.Sync(); err != nil {
+				return errors.Wrapf(err, "could not sync %s", af.path)
+			}
+		}
+	}
+	return nil
+}
+
+// Run rotates files by time until ctx done, so file of quiet server is rotated without waiting for its next record
+func (s *Sink) Run(ctx context.Context) {
+	ticker := time.NewTicker(rotateCheck)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.rotateDue(); err != nil {
+				s.Logger.Log(ksmglog.LevelWarn, "could not rotate file", "error", err)
+			}
+		}
+	}
+}
+
+// rotateDue rotates active files open longer than RotateEvery or named by previous time
+func (s *Sink) rotateDue() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := s.now()
+	for server, af := range s.active {
+		if !s.due(af, filepath.Join(s.Dir, s.render(server, now)), now) {
+			continue
+		}
+		if err := s.rotate(server); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close flushes and closes all active files, they are appended again after restart
+func (s *Sink) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var res error
+	for server, af := range s.active {
+		if err := s.closeFile(af); err != nil {
+			res = err
+		}
+		delete(s.active, server)
+	}
+	return res
+}
+
+// file returns active file for record, rotates previous file of the server if it is due
+func (s *Sink) file(r ksmglog.Record) (*activeFile, error) {
+	now := s.now()
+	path := filepath.Join(s.Dir, s.render(r.Server, now))
+
+	af, ok := s.active[r.Server]
+	if ok && !s.due(af, path, now) {
+		return af, nil
+	}
+	if ok {
+		if err := s.rotate(r.Server); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return nil, errors.Wrapf(err, "could not make dir for %s", path)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640) //nolint:gosec
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not open %s", path)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return nil, errors.Wrapf(err, "could not stat %s", path)
+	}
+
+	af = &activeFile{path: path, file: f, buf: bufio.NewWriter(f), size: fi.Size(), opened: now}
+	s.active[r.Server] = af
+	return af, nil
+}
+
+// due checks if active file should be rotated, path is name rendered for now
+func (s *Sink) due(af *activeFile, path string, now time.Time) bool {
+	return af.path != path || (s.RotateEvery > 0 && now.Sub(af.opened) >= s.RotateEvery)
+}
+
+func (s *Sink) render(server string, t time.Time) string {
+	return strings.NewReplacer(
+		"{server}", safeName(server),
+		"{date}", t.Format("2006-01-02"),
+		"{hour}", t.Format("15"),
+	).Replace(s.Pattern)
+}
+
+// rotate closes active file of server, renames it with rotation time suffix, compresses and cleans old files
+func (s *Sink) rotate(server string) error {
+	af, ok := s.active[server]
+	if !ok {
+		return nil
+	}
+	delete(s.active, server)
+
+	if err := s.closeFile(af); err != nil {
+		return err
+	}
+
+	now := s.now()
+	rotated := fmt.Sprintf("%s.%s%09d", af.path, now.Format(rotatedTime), now.Nanosecond())
+	if err := os.Rename(af.path, rotated); err != nil {
+		return errors.Wrapf(err, "could not rename %s", af.path)
+	}
+
+	if !s.NoGzip {
+		if err := s.compress(rotated); err != nil {
+			return err
+		}
+	}
+
+	return s.cleanup()
+}
+
+func (s *Sink) closeFile(af *activeFile) error {
+	if err := af.buf.Flush(); err != nil {
+		_ = af.file.Close()
+		return errors.Wrapf(err, "could not flush %s", af.path)
+	}
+	if s.Fsync != FsyncNever {
+		if err := af.file.Sync(); err != nil {
+			_ = af.file.Close()
+			return errors.Wrapf(err, "could not sync %s", af.path)
+		}
+	}
+	return errors.Wrapf(af.file.Close(), "could not close %s", af.path)
+}
+
+// compress gzips file and removes the original
+func (s *Sink) compress(path string) (err error) {
+	src, err := os.Open(path) //nolint:gosec
+	if err != nil {
+		return errors.Wrapf(err, "could not open %s", path)
+	}
+	defer func() {
+		if e := src.Close(); e != nil {
+			s.Logger.Log(ksmglog.LevelWarn, "could not close file", "file", path, "error", e)
+		}
+	}()
+
+	dst, err := os.OpenFile(path+gzipExt, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640) //nolint:gosec
+	if err != nil {
+		return errors.Wrapf(err, "could not create %s", path+gzipExt)
+	}
+
+	zw := gzip.NewWriter(dst)
+	zw.Name = filepath.Base(path)
+	if _, err = io.Copy(zw, src); err == nil {
+		err = zw.Close()
+	}
+	if err == nil && s.Fsync != FsyncNever {
+		err = dst.Sync()
+	}
+	if e := dst.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		_ = os.Remove(path + gzipExt)
+		return errors.Wrapf(err, "could not compress %s", path)
+	}
+
+	return errors.Wrapf(os.Remove(path), "could not remove %s", path)
+}
+
+// cleanup removes oldest rotated files keeping MaxFiles
+func (s *Sink) cleanup() error {
+	if s.MaxFiles <= 0 {
+		return nil
+	}
+
+	glob := strings.NewReplacer("{server}", "*", "{date}", "*", "{hour}", "*").Replace(s.Pattern) + ".*"
+	files, err := filepath.Glob(filepath.Join(s.Dir, glob))
+	if err != nil {
+		return errors.Wrap(err, "could not list rotated files")
+	}
+	if len(files) <= s.MaxFiles {
+		return nil
+	}
+
+	// rotation suffix sorts by time, compare it first
+	suffix := func(f string) string { return filepath.Ext(strings.TrimSuffix(f, gzipExt)) }
+	sort.Slice(files, func(i, j int) bool {
+		if si, sj := suffix(files[i]), suffix(files[j]); si != sj {
+			return si < sj
+		}
+		return files[i] < files[j]
+	})
+
+	for _, f := range files[:len(files)-s.MaxFiles] {
+		if err := os.Remove(f); err != nil {
+			return errors.Wrapf(err, "could not remove %s", f)
+		}
+	}
+	return nil
+}
+
+// safeName replaces path separators in server name
+func safeName(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return strings.NewReplacer("/", "_", "\\", "_", ":", "_").Replace(s)
+}
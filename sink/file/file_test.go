@@ -0,0 +1,174 @@
+package file
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/zorion79/ksmglog"
+)
+
+func TestSink_Send(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ksmglog-file")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	day := time.Date(2019, 6, 10, 12, 0, 0, 0, time.Local)
+	now := day
+	sink := NewSink(Opts{Dir: dir})
+	sink.now = func() time.Time { return now }
+
+	// files are named by time of writing, late record of previous day doesn't switch file
+	err = sink.Send(context.Background(), []ksmglog.Record{
+		{ID: 1, Time: int(day.Unix()), Server: "ksmg01"},
+		{ID: 2, Time: int(day.Unix()), Server: "ksmg02"},
+		{ID: 3, Time: int(day.AddDate(0, 0, -1).Unix()), Server: "ksmg01"},
+	})
+	require.NoError(t, err)
+
+	assert.Equal(t, []int{1, 3}, readIDs(t, filepath.Join(dir, "ksmg-ksmg01-2019-06-10.ndjson")))
+	assert.Equal(t, []int{2}, readIDs(t, filepath.Join(dir, "ksmg-ksmg02-2019-06-10.ndjson")))
+
+	// next day rotates previous file of the server
+	now = day.AddDate(0, 0, 1)
+	err = sink.Send(context.Background(), []ksmglog.Record{{ID: 4, Time: int(day.Unix()), Server: "ksmg01"}})
+	require.NoError(t, err)
+	require.NoError(t, sink.Close())
+
+	assert.Equal(t, []int{4}, readIDs(t, filepath.Join(dir, "ksmg-ksmg01-2019-06-11.ndjson")))
+	rotated, err := filepath.Glob(filepath.Join(dir, "ksmg-ksmg01-2019-06-10.ndjson.*.gz"))
+	require.NoError(t, err)
+	require.Equal(t, 1, len(rotated))
+	assert.Equal(t, []int{1, 3}, readIDs(t, rotated[0]))
+
+	// reopened sink appends to existing file
+	now = day
+	sink = NewSink(Opts{Dir: dir})
+	sink.now = func() time.Time { return now }
+	err = sink.Send(context.Background(), []ksmglog.Record{{ID: 5, Time: int(day.Unix()), Server: "ksmg02"}})
+	require.NoError(t, err)
+	require.NoError(t, sink.Close())
+	assert.Equal(t, []int{2, 5}, readIDs(t, filepath.Join(dir, "ksmg-ksmg02-2019-06-10.ndjson")))
+}
+
+func TestSink_RotateEvery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ksmglog-file")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2019, 6, 10, 12, 0, 0, 0, time.Local)
+	sink := NewSink(Opts{Dir: dir, Pattern: "{server}.ndjson", RotateEvery: time.Hour})
+	sink.now = func() time.Time { return now }
+
+	require.NoError(t, sink.Send(context.Background(), []ksmglog.Record{{ID: 1, Server: "ksmg01"}}))
+	now = now.Add(30 * time.Minute)
+	require.NoError(t, sink.Send(context.Background(), []ksmglog.Record{{ID: 2, Server: "ksmg01"}}))
+	require.NoError(t, sink.rotateDue())
+	rotated, err := filepath.Glob(filepath.Join(dir, "ksmg01.ndjson.*.gz"))
+	require.NoError(t, err)
+	assert.Empty(t, rotated, "file is not due yet")
+
+	// quiet server file is rotated without new record
+	now = now.Add(30 * time.Minute)
+	require.NoError(t, sink.rotateDue())
+	rotated, err = filepath.Glob(filepath.Join(dir, "ksmg01.ndjson.*.gz"))
+	require.NoError(t, err)
+	require.Equal(t, 1, len(rotated))
+	assert.Equal(t, []int{1, 2}, readIDs(t, rotated[0]))
+
+	require.NoError(t, sink.Send(context.Background(), []ksmglog.Record{{ID: 3, Server: "ksmg01"}}))
+	require.NoError(t, sink.Close())
+	assert.Equal(t, []int{3}, readIDs(t, filepath.Join(dir, "ksmg01.ndjson")))
+}
+
+func TestSink_SendRotateInBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ksmglog-file")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// the hour ends while batch is written
+	times := []time.Time{time.Date(2019, 6, 10, 12, 59, 59, 0, time.Local), time.Date(2019, 6, 10, 13, 0, 0, 0, time.Local)}
+	sink := NewSink(Opts{Dir: dir, Pattern: "{server}-{hour}.ndjson", NoGzip: true})
+	sink.now = func() time.Time {
+		res := times[0]
+		if len(times) > 1 {
+			times = times[1:]
+		}
+		return res
+	}
+
+	require.NoError(t, sink.Send(context.Background(), []ksmglog.Record{{ID: 1, Server: "ksmg01"}, {ID: 2, Server: "ksmg01"}}))
+	require.NoError(t, sink.Close())
+	rotated, err := filepath.Glob(filepath.Join(dir, "ksmg01-12.ndjson.*"))
+	require.NoError(t, err)
+	require.Equal(t, 1, len(rotated))
+	assert.Contains(t, rotated[0], "ksmg01-12.ndjson.20190610T1300", "rotated with time of sink clock")
+	assert.Equal(t, []int{1}, readIDs(t, rotated[0]))
+	assert.Equal(t, []int{2}, readIDs(t, filepath.Join(dir, "ksmg01-13.ndjson")))
+}
+
+func TestSink_SendMaxSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ksmglog-file")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	sink := NewSink(Opts{Dir: dir, Pattern: "{server}/records.ndjson", MaxSize: 1, MaxFiles: 2, Fsync: FsyncNever})
+	for i := 1; i <= 4; i++ {
+		require.NoError(t, sink.Send(context.Background(), []ksmglog.Record{{ID: i, Server: "ksmg:01"}}))
+	}
+	require.NoError(t, sink.Close())
+
+	rotated, err := filepath.Glob(filepath.Join(dir, "ksmg_01", "records.ndjson.*.gz"))
+	require.NoError(t, err)
+	sort.Strings(rotated)
+	require.Equal(t, 2, len(rotated), "oldest rotated files removed")
+	assert.Equal(t, []int{3}, readIDs(t, rotated[0]))
+	assert.Equal(t, []int{4}, readIDs(t, rotated[1]))
+}
+
+func TestSink_NoGzip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ksmglog-file")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	sink := NewSink(Opts{Dir: dir, Pattern: "records-{hour}.ndjson", MaxSize: 1, NoGzip: true})
+	require.NoError(t, sink.Send(context.Background(), []ksmglog.Record{{ID: 1, Server: "ksmg01"}}))
+
+	rotated, err := filepath.Glob(filepath.Join(dir, "records-*.ndjson.*"))
+	require.NoError(t, err)
+	require.Equal(t, 1, len(rotated))
+	assert.NotEqual(t, gzipExt, filepath.Ext(rotated[0]))
+	assert.Equal(t, []int{1}, readIDs(t, rotated[0]))
+}
+
+func readIDs(t *testing.T, path string) []int {
+	f, err := os.Open(path) //nolint:gosec
+	require.NoError(t, err)
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	if filepath.Ext(path) == gzipExt {
+		zr, err := gzip.NewReader(f)
+		require.NoError(t, err)
+		scanner = bufio.NewScanner(zr)
+	}
+
+	res := []int{}
+	for scanner.Scan() {
+		r := ksmglog.Record{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &r))
+		res = append(res, r.ID)
+	}
+	require.NoError(t, scanner.Err())
+	return res
+}
@@ -0,0 +1,29 @@
+// Package retry implements retry settings and waiting shared by sinks
+package retry
+
+import (
+	"context"
+	"time"
+)
+
+// Defaults returns max retries and initial delay with unset values replaced by defaults.
+// Zero max retries is unset, negative one disables retries and is kept, so attempt >= max stops at once.
+func Defaults(maxRetries int, delay time.Duration, defRetries int, defDelay time.Duration) (int, time.Duration) {
+	if maxRetries == 0 {
+		maxRetries = defRetries
+	}
+	if delay <= 0 {
+		delay = defDelay
+	}
+	return maxRetries, delay
+}
+
+// Sleep waits for d, returns ctx error if ctx done first
+func Sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
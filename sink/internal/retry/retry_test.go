@@ -0,0 +1,35 @@
+package retry
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaults(t *testing.T) {
+	tbl := []struct {
+		retries int
+		delay   time.Duration
+		res     int
+		resDur  time.Duration
+	}{
+		{0, 0, 5, time.Second},
+		{2, time.Millisecond, 2, time.Millisecond},
+		{-1, -time.Second, -1, time.Second},
+	}
+	for _, tt := range tbl {
+		retries, delay := Defaults(tt.retries, tt.delay, 5, time.Second)
+		assert.Equal(t, tt.res, retries)
+		assert.Equal(t, tt.resDur, delay)
+	}
+}
+
+func TestSleep(t *testing.T) {
+	assert.NoError(t, Sleep(context.Background(), time.Millisecond))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, Sleep(ctx, time.Hour))
+}
@@ -0,0 +1,215 @@
+// Package kafka implements ksmglog.Sink publishing records as json messages to kafka topic
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/segmentio/kafka-go"
+
+	"github.com/zorion79/ksmglog"
+	"github.com/zorion79/ksmglog/sink/internal/retry"
+)
+
+// Producer writes messages to kafka, implemented by kafka.Writer
+type Producer interface {
+	WriteMessages(ctx context.Context, msgs ...kafka.Message) error
+}
+
+// Sink publishes every record as separate message keyed by sender domain or message id
+type Sink struct {
+	Opts
+
+	producer Producer
+}
+
+// Opts collects parameters to initialize Sink
+type Opts struct {
+	Brokers      []string      `long:"brokers" env:"BROKERS" env-delim:"," description:"kafka brokers like kafka01:9092"`
+	Topic        string        `long:"topic" env:"TOPIC" default:"ksmg" description:"topic to publish records"`
+	Key          string        `long:"key" env:"KEY" choice:"sender-domain" choice:"message-id" default:"message-id" description:"message key"`
+	BatchSize    int           `long:"batch-size" env:"BATCH_SIZE" default:"100" description:"max messages in one produce request"`
+	BatchTimeout time.Duration `long:"batch-timeout" env:"BATCH_TIMEOUT" default:"1s" description:"max time to wait for full batch"`
+	MaxRetries   int           `long:"max-retries" env:"MAX_RETRIES" default:"5" description:"retries of failed messages, -1 disables"`
+	RetryDelay   time.Duration `long:"retry-delay" env:"RETRY_DELAY" default:"1s" description:"initial delay between retries, doubled on every retry"`
+
+	// Producer replaces kafka.Writer made from Brokers, used for in-process stand-ins
+	Producer Producer `no-flag:"true"`
+	// OnDelivery reports final delivery result of every record, nil error means record is stored in kafka.
+	// Service.Delivered fits it, so failed records are polled again.
+	OnDelivery func(r ksmglog.Record, err error) `no-flag:"true"`
+
+	// Logger gets messages of sink, they are discarded if not set
+	Logger ksmglog.Logger `no-flag:"true"`
+}
+
+// Message keys
+const (
+	KeySenderDomain = "sender-domain"
+	KeyMessageID    = "message-id"
+)
+
+// Message headers
+const (
+	HeaderServer = "ksmg-server"
+	HeaderHash   = "ksmg-hash"
+)
+
+const (
+	topic        = "ksmg"
+	batchSize    = 100
+	batchTimeout = time.Second
+	retryDelay   = time.Second
+	maxRetries   = 5
+)
+
+// NewSink initializes everything
+func NewSink(opts Opts) *Sink {
+	res := &Sink{Opts: opts}
+	res.Logger = ksmglog.MaskedLogger(res.Logger)
+
+	if res.Topic == "" {
+		res.Topic = topic
+	}
+	if res.Key == "" {
+		res.Key = KeyMessageID
+	}
+	if res.BatchSize <= 0 {
+		res.BatchSize = batchSize
+	}
+	if res.BatchTimeout <= 0 {
+		res.BatchTimeout = batchTimeout
+	}
+	res.MaxRetries, res.RetryDelay = retry.Defaults(res.MaxRetries, res.RetryDelay, maxRetries, retryDelay)
+
+	res.producer = res.Producer
+	if res.producer == nil {
+		res.producer = &kafka.Writer{
+			Addr:         kafka.TCP(res.Brokers...),
+			Topic:        res.Topic,
+			Balancer:     &kafka.Hash{},
+			BatchSize:    res.BatchSize,
+			BatchTimeout: res.BatchTimeout,
+			RequiredAcks: kafka.RequireAll,
+			MaxAttempts:  1, // retries are made by Send for failed messages only
+		}
+	}
+
+	return res
+}
+
+// Send publishes records and retries failed ones, final result of every record is passed to OnDelivery.
+// Kafka-go has no idempotent producer, so every message carries record hash header
+// letting consumers drop duplicates made by retries.
+func (s *Sink) Send(ctx context.Context, records []ksmglog.Record) error {
+	pending := make([]ksmglog.Record, 0, len(records))
+	msgs := make([]kafka.Message, 0, len(records))
+	for _, r := range records {
+		msg, err := s.message(r)
+		if err != nil {
+			s.report(r, err)
+			continue
+		}
+		pending = append(pending, r)
+		msgs = append(msgs, msg)
+	}
+
+	delay := s.RetryDelay
+	for attempt := 0; len(msgs) > 0; attempt++ {
+		err := s.producer.WriteMessages(ctx, msgs...)
+		if err == nil {
+			for _, r := range pending {
+				s.report(r, nil)
+			}
+			return nil
+		}
+
+		failedRecs, failedMsgs := pending, msgs
+		if writeErrs, ok := err.(kafka.WriteErrors); ok && len(writeErrs) == len(msgs) {
+			failedRecs, failedMsgs = nil, nil
+			for i, e := range writeErrs {
+				if e == nil {
+					s.report(pending[i], nil)
+					continue
+				}
+				failedRecs = append(failedRecs, pending[i])
+				failedMsgs = append(failedMsgs, msgs[i])
+			}
+		}
+		pending, msgs = failedRecs, failedMsgs
+
+		if attempt >= s.MaxRetries || ctx.Err() != nil {
+			for _, r := range pending {
+				s.report(r, err)
+			}
+			return errors.Wrapf(err, "could not publish %d records", len(pending))
+		}
+
+		s.Logger.Log(ksmglog.LevelDebug, "could not publish records, retry", "records", len(msgs), "attempt", attempt+1,
+			"delay", delay, "error", err)
+		_ = retry.Sleep(ctx, delay) // ctx error is reported by next attempt
+		delay *= 2
+	}
+	return nil
+}
+
+// Close flushes and closes underlying producer if it can be closed
+func (s *Sink) Close() error {
+	if c, ok := s.producer.(interface{ Close() error }); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func (s *Sink) message(r ksmglog.Record) (kafka.Message, error) {
+	if err := r.Hash(); err != nil {
+		return kafka.Message{}, errors.Wrap(err, "could not create hash string")
+	}
+
+	value, err := json.Marshal(r)
+	if err != nil {
+		return kafka.Message{}, errors.Wrap(err, "could not marshal record")
+	}
+
+	return kafka.Message{
+		Key:   []byte(s.key(r)),
+		Value: value,
+		Time:  time.Unix(int64(r.Time), 0),
+		Headers: []kafka.Header{
+			{Key: HeaderServer, Value: []byte(r.Server)},
+			{Key: HeaderHash, Value: []byte(r.HashString)},
+		},
+	}, nil
+}
+
+func (s *Sink) key(r ksmglog.Record) string {
+	info := r.Details.MessageInfo
+	if s.Key == KeySenderDomain {
+		if i := strings.LastIndex(info.From, "@"); i >= 0 {
+			return strings.ToLower(strings.Trim(info.From[i+1:], "<> "))
+		}
+		return strings.ToLower(info.From)
+	}
+
+	switch {
+	case info.SMTPMessageID != "":
+		return info.SMTPMessageID
+	case info.MessageID != "":
+		return info.MessageID
+	default:
+		return r.Server + "/" + strconv.Itoa(r.ID)
+	}
+}
+
+func (s *Sink) report(r ksmglog.Record, err error) {
+	if err != nil {
+		s.Logger.Log(ksmglog.LevelWarn, "could not publish record", "server", r.Server, "record", r.ID, "error", err)
+	}
+	if s.OnDelivery != nil {
+		s.OnDelivery(r, err)
+	}
+}
@@ -0,0 +1,114 @@
+package kafka
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/segmentio/kafka-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/zorion79/ksmglog"
+)
+
+// standIn is in-process producer failing messages listed in fail on first write
+type standIn struct {
+	lock   sync.Mutex
+	msgs   []kafka.Message
+	fail   map[string]bool
+	writes int
+}
+
+func (p *standIn) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.writes++
+
+	errs := make(kafka.WriteErrors, len(msgs))
+	failed := false
+	for i, m := range msgs {
+		if p.fail[string(m.Key)] {
+			delete(p.fail, string(m.Key))
+			errs[i] = errors.New("leader not available")
+			failed = true
+			continue
+		}
+		p.msgs = append(p.msgs, m)
+	}
+	if failed {
+		return errs
+	}
+	return nil
+}
+
+func testRecords() []ksmglog.Record {
+	r1 := ksmglog.Record{ID: 1, Time: 1560000000, Server: "ksmg01"}
+	r1.Details.MessageInfo.From = "Alice@Example.COM"
+	r1.Details.MessageInfo.SMTPMessageID = "<m1@example.com>"
+	r2 := ksmglog.Record{ID: 2, Time: 1560000001, Server: "ksmg01"}
+	r2.Details.MessageInfo.From = "bob@mail.org"
+	return []ksmglog.Record{r1, r2}
+}
+
+func TestSink_Send(t *testing.T) {
+	p := &standIn{fail: map[string]bool{"ksmg01/2": true}}
+	delivered := map[int]error{}
+	sink := NewSink(Opts{
+		Producer:   p,
+		RetryDelay: time.Millisecond,
+		OnDelivery: func(r ksmglog.Record, err error) { delivered[r.ID] = err },
+	})
+
+	require.NoError(t, sink.Send(context.Background(), testRecords()))
+	assert.Equal(t, 2, p.writes, "failed message retried")
+	require.Equal(t, 2, len(p.msgs))
+	assert.Equal(t, map[int]error{1: nil, 2: nil}, delivered)
+
+	m := p.msgs[0]
+	assert.Equal(t, "<m1@example.com>", string(m.Key))
+	assert.Equal(t, int64(1560000000), m.Time.Unix())
+	assert.Equal(t, HeaderServer, m.Headers[0].Key)
+	assert.Equal(t, "ksmg01", string(m.Headers[0].Value))
+	assert.Equal(t, HeaderHash, m.Headers[1].Key)
+	assert.Equal(t, 32, len(m.Headers[1].Value))
+
+	r := ksmglog.Record{}
+	require.NoError(t, json.Unmarshal(m.Value, &r))
+	assert.Equal(t, 1, r.ID)
+	assert.Equal(t, "ksmg01/2", string(p.msgs[1].Key))
+}
+
+func TestSink_SendSenderDomain(t *testing.T) {
+	p := &standIn{}
+	sink := NewSink(Opts{Producer: p, Key: KeySenderDomain})
+	require.NoError(t, sink.Send(context.Background(), testRecords()))
+	assert.Equal(t, "example.com", string(p.msgs[0].Key))
+	assert.Equal(t, "mail.org", string(p.msgs[1].Key))
+}
+
+func TestSink_SendFailed(t *testing.T) {
+	failing := producerFunc(func(ctx context.Context, msgs ...kafka.Message) error { return errors.New("broker down") })
+	var reports int
+	sink := NewSink(Opts{
+		Producer:   failing,
+		MaxRetries: 2,
+		RetryDelay: time.Millisecond,
+		OnDelivery: func(r ksmglog.Record, err error) {
+			reports++
+			assert.Error(t, err)
+		},
+	})
+
+	assert.Error(t, sink.Send(context.Background(), testRecords()))
+	assert.Equal(t, 2, reports)
+}
+
+type producerFunc func(ctx context.Context, msgs ...kafka.Message) error
+
+func (f producerFunc) WriteMessages(ctx context.Context, msgs ...kafka.Message) error {
+	return f(ctx, msgs...)
+}
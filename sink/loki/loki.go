@@ -0,0 +1,330 @@
+// Package loki implements ksmglog.Sink pushing records to Grafana Loki
+package loki
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/zorion79/ksmglog"
+	"github.com/zorion79/ksmglog/sink/internal/retry"
+)
+
+// Sink pushes batches of records to /loki/api/v1/push, one stream per label set
+type Sink struct {
+	Opts
+
+	client *http.Client
+
+	lock     sync.Mutex
+	lastTime map[string]int64 // last pushed timestamp per stream
+}
+
+// Opts collects parameters to initialize Sink
+type Opts struct {
+	URL                string            `long:"url" env:"URL" description:"loki base url like http://loki:3100"`
+	TenantID           string            `long:"tenant" env:"TENANT" description:"X-Scope-OrgID header value"`
+	User               string            `long:"user" env:"USER" description:"basic auth user"`
+	Password           string            `long:"password" env:"PASSWORD" description:"basic auth password"`
+	Labels             map[string]string `long:"label" env:"LABELS" env-delim:"," description:"static labels added to every stream"`
+	Format             string            `long:"format" env:"FORMAT" choice:"json" choice:"logfmt" default:"json" description:"log line format"`
+	MaxRetries         int               `long:"max-retries" env:"MAX_RETRIES" default:"5" description:"retries on 429 and 5xx responses, -1 disables"`
+	RetryDelay         time.Duration     `long:"retry-delay" env:"RETRY_DELAY" default:"1s" description:"initial delay between retries, doubled on every retry"`
+	Timeout            time.Duration     `long:"timeout" env:"TIMEOUT" default:"5s" description:"http client timeout"`
+	InsecureSkipVerify bool              `long:"insecure" env:"INSECURE" description:"skip loki certificate verification"`
+
+	// Logger gets messages of sink, they are discarded if not set
+	Logger ksmglog.Logger `no-flag:"true"`
+}
+
+// Line formats
+const (
+	FormatJSON   = "json"
+	FormatLogfmt = "logfmt"
+)
+
+const (
+	pushPath = "/loki/api/v1/push"
+
+	timeout    = 5 * time.Second
+	retryDelay = time.Second
+	maxRetries = 5
+)
+
+type stream struct {
+	Stream map[string]string `json:"stream"`
+	Values [][2]string       `json:"values"`
+}
+
+type entry struct {
+	ts   int64
+	line string
+}
+
+// NewSink initializes everything
+func NewSink(opts Opts) *Sink {
+	res := &Sink{Opts: opts, lastTime: make(map[string]int64)}
+	res.Logger = ksmglog.MaskedLogger(res.Logger)
+
+	if res.Format == "" {
+		res.Format = FormatJSON
+	}
+	if res.Timeout <= 0 {
+		res.Timeout = timeout
+	}
+	res.MaxRetries, res.RetryDelay = retry.Defaults(res.MaxRetries, res.RetryDelay, maxRetries, retryDelay)
+	res.URL = strings.TrimSuffix(res.URL, "/")
+
+	res.client = &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: res.InsecureSkipVerify, //nolint:gosec
+			},
+		},
+		Timeout: res.Timeout,
+	}
+
+	return res
+}
+
+// Send groups records by stream labels and pushes them in one request.
+// Entries of every stream are sent in time order, entries older than already pushed to the stream
+// get timestamp of the last pushed one, so loki never rejects them as out of order.
+func (s *Sink) Send(ctx context.Context, records []ksmglog.Record) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	entries := make(map[string][]entry)
+	labels := make(map[string]map[string]string)
+	for _, r := range records {
+		l := s.labels(r)
+		key := streamKey(l)
+		line, err := s.line(r)
+		if err != nil {
+			return errors.Wrapf(err, "could not format record %d", r.ID)
+		}
+		labels[key] = l
+		entries[key] = append(entries[key], entry{ts: int64(r.Time) * int64(time.Second), line: line})
+	}
+
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	req := struct {
+		Streams []stream `json:"streams"`
+	}{}
+	last := make(map[string]int64, len(keys))
+	for _, key := range keys {
+		es := entries[key]
+		sort.SliceStable(es, func(i, j int) bool { return es[i].ts < es[j].ts })
+
+		st := stream{Stream: labels[key], Values: make([][2]string, 0, len(es))}
+		prev := s.lastTime[key]
+		for _, e := range es {
+			if e.ts < prev {
+				e.ts = prev
+			}
+			prev = e.ts
+			st.Values = append(st.Values, [2]string{strconv.FormatInt(e.ts, 10), e.line})
+		}
+		last[key] = prev
+		req.Streams = append(req.Streams, st)
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return errors.Wrap(err, "could not marshal push request")
+	}
+
+	if err := s.push(ctx, body); err != nil {
+		return errors.Wrapf(err, "could not push %d records", len(records))
+	}
+
+	for key, ts := range last {
+		s.lastTime[key] = ts
+	}
+	return nil
+}
+
+// labels returns bounded label set of record, high-cardinality fields stay in the line
+func (s *Sink) labels(r ksmglog.Record) map[string]string {
+	res := make(map[string]string, len(s.Labels)+3)
+	for k, v := range s.Labels {
+		res[k] = v
+	}
+	res["server"] = r.Server
+	res["type"] = string(r.Type)
+	res["result"] = string(r.Result)
+	return res
+}
+
+func streamKey(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	b := strings.Builder{}
+	b.WriteString("{")
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteString(",")
+		}
+		b.WriteString(k + "=" + strconv.Quote(labels[k]))
+	}
+	b.WriteString("}")
+	return b.String()
+}
+
+func (s *Sink) line(r ksmglog.Record) (string, error) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return "", err
+	}
+	if s.Format != FormatLogfmt {
+		return string(data), nil
+	}
+
+	fields := make(map[string]interface{})
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return "", err
+	}
+	// type and result are labels already
+	delete(fields, "type")
+	delete(fields, "result")
+	return logfmt(fields), nil
+}
+
+// logfmt renders nested json object as key=value pairs with dotted keys, empty values skipped
+func logfmt(fields map[string]interface{}) string {
+	flat := make(map[string]string)
+	flatten("", fields, flat)
+
+	keys := make([]string, 0, len(flat))
+	for k := range flat {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	b := strings.Builder{}
+	for i, k := range keys {
+		if i > 0 {
+			b.WriteString(" ")
+		}
+		v := flat[k]
+		if strings.ContainsAny(v, " =\"\\") || strings.ContainsAny(v, "\n\t\r") {
+			v = strconv.Quote(v)
+		}
+		b.WriteString(k + "=" + v)
+	}
+	return b.String()
+}
+
+func flatten(prefix string, value interface{}, res map[string]string) {
+	key := func(k string) string {
+		if prefix == "" {
+			return k
+		}
+		return prefix + "." + k
+	}
+
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, val := range v {
+			flatten(key(k), val, res)
+		}
+	case []interface{}:
+		scalars := make([]string, 0, len(v))
+		for i, val := range v {
+			switch val.(type) {
+			case map[string]interface{}, []interface{}:
+				flatten(key(strconv.Itoa(i)), val, res)
+			default:
+				scalars = append(scalars, fmt.Sprint(val))
+			}
+		}
+		if len(scalars) > 0 {
+			res[prefix] = strings.Join(scalars, ",")
+		}
+	case nil:
+	case string:
+		if v != "" {
+			res[prefix] = v
+		}
+	case bool:
+		if v {
+			res[prefix] = "true"
+		}
+	case float64:
+		res[prefix] = strconv.FormatFloat(v, 'f', -1, 64)
+	default:
+		res[prefix] = fmt.Sprint(v)
+	}
+}
+
+// push sends body to loki, retries with exponential backoff on 429 and 5xx responses
+func (s *Sink) push(ctx context.Context, body []byte) error {
+	delay := s.RetryDelay
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest("POST", s.URL+pushPath, bytes.NewReader(body))
+		if err != nil {
+			return errors.Wrap(err, "could not make request")
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/json")
+		if s.TenantID != "" {
+			req.Header.Set("X-Scope-OrgID", s.TenantID)
+		}
+		if s.User != "" {
+			req.SetBasicAuth(s.User, s.Password)
+		}
+
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return errors.Wrap(err, "could not request")
+		}
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		if err = resp.Body.Close(); err != nil {
+			s.Logger.Log(ksmglog.LevelWarn, "could not close body", "error", err)
+		}
+
+		if resp.StatusCode/100 == 2 {
+			return nil
+		}
+
+		retryable := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode/100 == 5
+		if !retryable || attempt >= s.MaxRetries {
+			return errors.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+		}
+
+		wait := delay
+		if sec, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && sec > 0 {
+			wait = time.Duration(sec) * time.Second
+		}
+		s.Logger.Log(ksmglog.LevelDebug, "loki busy, retry", "status", resp.Status, "attempt", attempt+1, "delay", wait)
+		if err := retry.Sleep(ctx, wait); err != nil {
+			return err
+		}
+		delay *= 2
+	}
+}
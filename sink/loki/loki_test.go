@@ -0,0 +1,117 @@
+package loki
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/zorion79/ksmglog"
+)
+
+// fakeLoki collects pushed streams and rejects out of order entries like loki does
+type fakeLoki struct {
+	t *testing.T
+
+	lock    sync.Mutex
+	streams map[string][][2]string
+	last    map[string]string
+	fail    int32 // number of requests to reject with 429
+}
+
+func (f *fakeLoki) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	assert.Equal(f.t, pushPath, r.URL.Path)
+	assert.Equal(f.t, "application/json", r.Header.Get("Content-Type"))
+
+	if atomic.AddInt32(&f.fail, -1) >= 0 {
+		w.WriteHeader(http.StatusTooManyRequests)
+		return
+	}
+
+	req := struct {
+		Streams []stream `json:"streams"`
+	}{}
+	require.NoError(f.t, json.NewDecoder(r.Body).Decode(&req))
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	for _, st := range req.Streams {
+		key := streamKey(st.Stream)
+		for _, v := range st.Values {
+			if len(v[0]) < len(f.last[key]) || (len(v[0]) == len(f.last[key]) && v[0] < f.last[key]) {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			f.last[key] = v[0]
+			f.streams[key] = append(f.streams[key], v)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func newFakeLoki(t *testing.T) *fakeLoki {
+	return &fakeLoki{t: t, streams: make(map[string][][2]string), last: make(map[string]string)}
+}
+
+func TestSink_Send(t *testing.T) {
+	fl := newFakeLoki(t)
+	ts := httptest.NewServer(fl)
+	defer ts.Close()
+
+	sink := NewSink(Opts{URL: ts.URL, Labels: map[string]string{"job": "ksmg"}})
+	err := sink.Send(context.Background(), []ksmglog.Record{
+		{ID: 1, Time: 20, Server: "ksmg01", Type: "mail", Result: "clean"},
+		{ID: 2, Time: 10, Server: "ksmg01", Type: "mail", Result: "clean"},
+		{ID: 3, Time: 15, Server: "ksmg01", Type: "mail", Result: "infected"},
+	})
+	require.NoError(t, err)
+
+	clean := `{job="ksmg",result="clean",server="ksmg01",type="mail"}`
+	require.Equal(t, 2, len(fl.streams))
+	require.Equal(t, 2, len(fl.streams[clean]))
+	assert.Equal(t, "10000000000", fl.streams[clean][0][0])
+	assert.Equal(t, "20000000000", fl.streams[clean][1][0])
+
+	r := ksmglog.Record{}
+	require.NoError(t, json.Unmarshal([]byte(fl.streams[clean][0][1]), &r))
+	assert.Equal(t, 2, r.ID)
+
+	// older record pushed later must not break stream order
+	err = sink.Send(context.Background(), []ksmglog.Record{{ID: 4, Time: 5, Server: "ksmg01", Type: "mail", Result: "clean"}})
+	require.NoError(t, err)
+	require.Equal(t, 3, len(fl.streams[clean]))
+	assert.Equal(t, "20000000000", fl.streams[clean][2][0])
+}
+
+func TestSink_SendRetry(t *testing.T) {
+	fl := newFakeLoki(t)
+	fl.fail = 2
+	ts := httptest.NewServer(fl)
+	defer ts.Close()
+
+	sink := NewSink(Opts{URL: ts.URL, RetryDelay: time.Millisecond, MaxRetries: 2})
+	require.NoError(t, sink.Send(context.Background(), []ksmglog.Record{{ID: 1, Time: 1}}))
+	assert.Equal(t, 1, len(fl.streams))
+
+	atomic.StoreInt32(&fl.fail, 5)
+	assert.Error(t, sink.Send(context.Background(), []ksmglog.Record{{ID: 2, Time: 2}}))
+}
+
+func TestSink_Logfmt(t *testing.T) {
+	sink := NewSink(Opts{Format: FormatLogfmt})
+	r := ksmglog.Record{ID: 5, Time: 1, Type: "mail", Result: "clean", Description: "some text"}
+	r.Details.MessageInfo.From = "a@example.com"
+	r.Details.MessageInfo.To = []string{"b@example.com", "c@example.com"}
+
+	line, err := sink.line(r)
+	require.NoError(t, err)
+	assert.Equal(t, `description="some text" details.messageInfo.from=a@example.com `+
+		`details.messageInfo.to=b@example.com,c@example.com id=5 time=1`, line)
+}
@@ -0,0 +1,336 @@
+// Package otlp implements ksmglog.Sink exporting records as OpenTelemetry log records over OTLP/HTTP.
+// Only json encoding is supported, protobuf encoding and OTLP/gRPC are not.
+package otlp
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/zorion79/ksmglog"
+	"github.com/zorion79/ksmglog/sink/internal/retry"
+)
+
+// Sink posts batches of records to OTLP /v1/logs endpoint, one resource per ksmg server
+type Sink struct {
+	Opts
+
+	client *http.Client
+}
+
+// Opts collects parameters to initialize Sink
+type Opts struct {
+	URL                string            `long:"url" env:"URL" description:"collector base url like http://otel-collector:4318"`
+	Headers            map[string]string `long:"header" env:"HEADERS" env-delim:"," description:"extra request headers like authorization"`
+	ServiceName        string            `long:"service-name" env:"SERVICE_NAME" default:"ksmglog" description:"service.name resource attribute"`
+	Severity           map[string]string `long:"severity" env:"SEVERITY" env-delim:"," description:"result to severity text overrides like Infected:ERROR"`
+	MaxRetries         int               `long:"max-retries" env:"MAX_RETRIES" default:"5" description:"retries on 429, 502, 503 and 504 responses, -1 disables"`
+	RetryDelay         time.Duration     `long:"retry-delay" env:"RETRY_DELAY" default:"1s" description:"initial delay between retries, doubled on every retry"`
+	Timeout            time.Duration     `long:"timeout" env:"TIMEOUT" default:"5s" description:"http client timeout"`
+	InsecureSkipVerify bool              `long:"insecure" env:"INSECURE" description:"skip collector certificate verification"`
+
+	// Logger gets messages of sink, they are discarded if not set
+	Logger ksmglog.Logger `no-flag:"true"`
+}
+
+const (
+	logsPath  = "/v1/logs"
+	scopeName = "github.com/zorion79/ksmglog"
+
+	serviceName = "ksmglog"
+	timeout     = 5 * time.Second
+	retryDelay  = time.Second
+	maxRetries  = 5
+)
+
+// severity numbers defined by OpenTelemetry log data model
+var severityNumbers = map[string]int{
+	"TRACE": 1,
+	"DEBUG": 5,
+	"INFO":  9,
+	"WARN":  13,
+	"ERROR": 17,
+	"FATAL": 21,
+}
+
+// resultSeverity is default severity text of known results
+var resultSeverity = map[ksmglog.Result]string{
+	ksmglog.ResultClean:        "INFO",
+	ksmglog.ResultNotScanned:   "INFO",
+	ksmglog.ResultProbableSpam: "WARN",
+	ksmglog.ResultSpam:         "WARN",
+	ksmglog.ResultBlacklisted:  "WARN",
+	ksmglog.ResultRejected:     "WARN",
+	ksmglog.ResultPhishing:     "WARN",
+	ksmglog.ResultInfected:     "WARN",
+	ksmglog.ResultError:        "ERROR",
+}
+
+// NewSink initializes everything
+func NewSink(opts Opts) *Sink {
+	res := &Sink{Opts: opts}
+	res.Logger = ksmglog.MaskedLogger(res.Logger)
+
+	if res.ServiceName == "" {
+		res.ServiceName = serviceName
+	}
+	if res.Timeout <= 0 {
+		res.Timeout = timeout
+	}
+	res.MaxRetries, res.RetryDelay = retry.Defaults(res.MaxRetries, res.RetryDelay, maxRetries, retryDelay)
+	res.URL = strings.TrimSuffix(res.URL, "/")
+
+	res.client = &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: res.InsecureSkipVerify, //nolint:gosec
+			},
+		},
+		Timeout: res.Timeout,
+	}
+
+	return res
+}
+
+// Send exports records in one ExportLogsServiceRequest
+func (s *Sink) Send(ctx context.Context, records []ksmglog.Record) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	req, err := s.makeRequest(records, time.Now())
+	if err != nil {
+		return errors.Wrap(err, "could not make export request")
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return errors.Wrap(err, "could not marshal export request")
+	}
+
+	if err := s.post(ctx, body); err != nil {
+		return errors.Wrapf(err, "could not export %d records", len(records))
+	}
+	return nil
+}
+
+func (s *Sink) makeRequest(records []ksmglog.Record, now time.Time) (exportRequest, error) {
+	byServer := make(map[string][]logRecord)
+	for _, r := range records {
+		lr, err := s.logRecord(r, now)
+		if err != nil {
+			return exportRequest{}, errors.Wrapf(err, "could not convert record %d", r.ID)
+		}
+		byServer[r.Server] = append(byServer[r.Server], lr)
+	}
+
+	servers := make([]string, 0, len(byServer))
+	for server := range byServer {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+
+	res := exportRequest{}
+	for _, server := range servers {
+		res.ResourceLogs = append(res.ResourceLogs, resourceLogs{
+			Resource: resource{Attributes: []keyValue{
+				str("service.name", s.ServiceName),
+				str("host.name", server),
+				str("server.address", server),
+			}},
+			ScopeLogs: []scopeLogs{{
+				Scope:      scope{Name: scopeName},
+				LogRecords: byServer[server],
+			}},
+		})
+	}
+	return res, nil
+}
+
+func (s *Sink) logRecord(r ksmglog.Record, now time.Time) (logRecord, error) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return logRecord{}, err
+	}
+	var raw interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err = decoder.Decode(&raw); err != nil {
+		return logRecord{}, err
+	}
+
+	info := r.Details.MessageInfo
+	attrs := []keyValue{
+		str("event.name", r.EventName),
+		str("ksmg.record.id", strconv.Itoa(r.ID)),
+		str("ksmg.type", string(r.Type)),
+		str("ksmg.result", string(r.Result)),
+		str("email.message_id", info.SMTPMessageID),
+		str("email.local_id", info.MessageID),
+		str("email.from.address", info.From),
+		strs("email.to.address", info.To),
+		strs("email.cc.address", info.Cc),
+		strs("email.bcc.address", info.Bcc),
+		str("email.subject", info.Subject),
+		str("client.address", info.ClientAddress),
+		str("client.hostname", info.ClientHostName),
+	}
+	if size, err := strconv.ParseInt(info.Size, 10, 64); err == nil {
+		attrs = append(attrs, keyValue{Key: "email.size", Value: anyValue{IntValue: strconv.FormatInt(size, 10)}})
+	}
+
+	text := s.severity(r.Result)
+	return logRecord{
+		TimeUnixNano:         strconv.FormatInt(int64(r.Time)*int64(time.Second), 10),
+		ObservedTimeUnixNano: strconv.FormatInt(now.UnixNano(), 10),
+		SeverityNumber:       severityNumbers[text],
+		SeverityText:         text,
+		Body:                 toAnyValue(raw),
+		Attributes:           compact(attrs),
+	}, nil
+}
+
+// severity returns severity text for record result, overrides from Opts.Severity take precedence,
+// unknown results are INFO
+func (s *Sink) severity(result ksmglog.Result) string {
+	for k, v := range s.Severity {
+		if strings.EqualFold(k, string(result)) {
+			if _, ok := severityNumbers[strings.ToUpper(v)]; ok {
+				return strings.ToUpper(v)
+			}
+		}
+	}
+
+	for r, severity := range resultSeverity {
+		if strings.EqualFold(string(r), string(result)) {
+			return severity
+		}
+	}
+	return "INFO"
+}
+
+// post sends body to collector, retries with exponential backoff on retryable responses
+func (s *Sink) post(ctx context.Context, body []byte) error {
+	delay := s.RetryDelay
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest("POST", s.URL+logsPath, bytes.NewReader(body))
+		if err != nil {
+			return errors.Wrap(err, "could not make request")
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/json")
+		for k, v := range s.Headers {
+			req.Header.Set(k, v)
+		}
+
+		resp, err := s.client.Do(req)
+		if err != nil {
+			return errors.Wrap(err, "could not request")
+		}
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		if err = resp.Body.Close(); err != nil {
+			s.Logger.Log(ksmglog.LevelWarn, "could not close body", "error", err)
+		}
+
+		if resp.StatusCode/100 == 2 {
+			return nil
+		}
+
+		switch resp.StatusCode {
+		case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		default:
+			return errors.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+		}
+		if attempt >= s.MaxRetries {
+			return errors.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+		}
+
+		wait := delay
+		if sec, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && sec > 0 {
+			wait = time.Duration(sec) * time.Second
+		}
+		s.Logger.Log(ksmglog.LevelDebug, "collector busy, retry", "status", resp.Status, "attempt", attempt+1, "delay", wait)
+		if err := retry.Sleep(ctx, wait); err != nil {
+			return err
+		}
+		delay *= 2
+	}
+}
+
+// toAnyValue converts decoded json value to OTLP AnyValue
+func toAnyValue(v interface{}) anyValue {
+	switch val := v.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(val))
+		for k := range val {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		kvs := make([]keyValue, 0, len(keys))
+		for _, k := range keys {
+			kvs = append(kvs, keyValue{Key: k, Value: toAnyValue(val[k])})
+		}
+		return anyValue{KvlistValue: &kvList{Values: kvs}}
+	case []interface{}:
+		values := make([]anyValue, 0, len(val))
+		for _, item := range val {
+			values = append(values, toAnyValue(item))
+		}
+		return anyValue{ArrayValue: &arrayValue{Values: values}}
+	case string:
+		return anyValue{StringValue: &val}
+	case bool:
+		return anyValue{BoolValue: &val}
+	case json.Number:
+		if i, err := val.Int64(); err == nil {
+			return anyValue{IntValue: strconv.FormatInt(i, 10)}
+		}
+		f, err := val.Float64()
+		if err != nil || math.IsInf(f, 0) || math.IsNaN(f) {
+			s := val.String()
+			return anyValue{StringValue: &s}
+		}
+		return anyValue{DoubleValue: &f}
+	default:
+		return anyValue{}
+	}
+}
+
+func str(key, value string) keyValue {
+	return keyValue{Key: key, Value: anyValue{StringValue: &value}}
+}
+
+func strs(key string, values []string) keyValue {
+	res := keyValue{Key: key, Value: anyValue{ArrayValue: &arrayValue{}}}
+	for i := range values {
+		res.Value.ArrayValue.Values = append(res.Value.ArrayValue.Values, anyValue{StringValue: &values[i]})
+	}
+	return res
+}
+
+// compact drops attributes with empty values
+func compact(attrs []keyValue) []keyValue {
+	res := attrs[:0]
+	for _, a := range attrs {
+		v := a.Value
+		if v.StringValue != nil && *v.StringValue == "" {
+			continue
+		}
+		if v.ArrayValue != nil && len(v.ArrayValue.Values) == 0 {
+			continue
+		}
+		res = append(res, a)
+	}
+	return res
+}
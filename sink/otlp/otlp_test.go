@@ -0,0 +1,113 @@
+package otlp
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/zorion79/ksmglog"
+)
+
+func TestSink_Send(t *testing.T) {
+	var req exportRequest
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, logsPath, r.URL.Path)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		assert.Equal(t, "Bearer key", r.Header.Get("Authorization"))
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		_, err := w.Write([]byte(`{}`))
+		assert.NoError(t, err)
+	}))
+	defer ts.Close()
+
+	r1 := ksmglog.Record{ID: 1, Time: 1560000000, Server: "ksmg02", Result: "Infected"}
+	r1.Details.MessageInfo.From = "a@example.com"
+	r1.Details.MessageInfo.To = []string{"b@example.com"}
+	r1.Details.MessageInfo.Size = "2048"
+	r1.Details.MessageInfo.ClientAddress = "10.0.0.1"
+	r2 := ksmglog.Record{ID: 2, Time: 1560000001, Server: "ksmg01", Result: "Clean"}
+
+	sink := NewSink(Opts{URL: ts.URL, Headers: map[string]string{"Authorization": "Bearer key"}})
+	require.NoError(t, sink.Send(context.Background(), []ksmglog.Record{r1, r2}))
+
+	require.Equal(t, 2, len(req.ResourceLogs))
+	assert.Equal(t, "ksmg01", *attr(req.ResourceLogs[0].Resource.Attributes, "host.name").StringValue)
+	assert.Equal(t, "ksmglog", *attr(req.ResourceLogs[0].Resource.Attributes, "service.name").StringValue)
+
+	rl := req.ResourceLogs[1]
+	assert.Equal(t, "ksmg02", *attr(rl.Resource.Attributes, "host.name").StringValue)
+	require.Equal(t, 1, len(rl.ScopeLogs))
+	assert.Equal(t, scopeName, rl.ScopeLogs[0].Scope.Name)
+	require.Equal(t, 1, len(rl.ScopeLogs[0].LogRecords))
+
+	lr := rl.ScopeLogs[0].LogRecords[0]
+	assert.Equal(t, "1560000000000000000", lr.TimeUnixNano)
+	assert.Equal(t, "WARN", lr.SeverityText)
+	assert.Equal(t, 13, lr.SeverityNumber)
+	assert.Equal(t, "a@example.com", *attr(lr.Attributes, "email.from.address").StringValue)
+	assert.Equal(t, "b@example.com", *attr(lr.Attributes, "email.to.address").ArrayValue.Values[0].StringValue)
+	assert.Equal(t, "2048", attr(lr.Attributes, "email.size").IntValue)
+	assert.Equal(t, "10.0.0.1", *attr(lr.Attributes, "client.address").StringValue)
+	assert.Nil(t, attr(lr.Attributes, "email.subject"), "empty attributes dropped")
+
+	require.NotNil(t, lr.Body.KvlistValue)
+	assert.Equal(t, "1", attr(lr.Body.KvlistValue.Values, "id").IntValue)
+	assert.Equal(t, "Infected", *attr(lr.Body.KvlistValue.Values, "result").StringValue)
+	details := attr(lr.Body.KvlistValue.Values, "details").KvlistValue
+	require.NotNil(t, details)
+	info := attr(details.Values, "messageInfo").KvlistValue
+	assert.Equal(t, "a@example.com", *attr(info.Values, "from").StringValue)
+}
+
+func TestSink_SendRetry(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer ts.Close()
+
+	sink := NewSink(Opts{URL: ts.URL, RetryDelay: time.Millisecond})
+	assert.Error(t, sink.Send(context.Background(), []ksmglog.Record{{ID: 1}}))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls), "400 is not retried")
+}
+
+func TestSink_Severity(t *testing.T) {
+	sink := NewSink(Opts{Severity: map[string]string{"spam": "error"}})
+	tbl := []struct {
+		result   ksmglog.Result
+		severity string
+	}{
+		{ksmglog.ResultClean, "INFO"},
+		{"", "INFO"},
+		{ksmglog.ResultInfected, "WARN"},
+		{"phishing", "WARN"},
+		{ksmglog.ResultRejected, "WARN"},
+		{ksmglog.ResultSpam, "ERROR"},
+		{ksmglog.ResultError, "ERROR"},
+		{"Quarantined", "INFO"},
+	}
+	for _, tt := range tbl {
+		assert.Equal(t, tt.severity, sink.severity(tt.result), tt.result)
+	}
+}
+
+func attr(attrs []keyValue, key string) *anyValue {
+	for _, a := range attrs {
+		if a.Key == key {
+			v := a.Value
+			return &v
+		}
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+// Package parquet implements ksmglog.Sink writing records to parquet files partitioned by server and hour
+package parquet
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+
+	"github.com/zorion79/ksmglog"
+)
+
+// Sink writes records to Dir/server=<server>/date=<YYYY-MM-DD>/hour=<HH>/part-<time>.parquet.
+// Partition file is written under temporary name and renamed when it's closed, that is when record of
+// another hour arrives for the server, CloseDelay after the hour ended or on Close, so ingestion never sees
+// incomplete file. Records of the hour arriving later are written to the next file of the partition.
+type Sink struct {
+	Opts
+
+	lock   sync.Mutex
+	active map[string]*partition // by server
+	now    func() time.Time
+}
+
+// Opts collects parameters to initialize Sink
+type Opts struct {
+	Dir         string `long:"dir" env:"DIR" default:"." description:"root directory of partitions"`
+	Compression string `long:"compression" env:"COMPRESSION" choice:"snappy" choice:"gzip" choice:"none" default:"snappy" description:"column compression"`
+	UTC         bool   `long:"utc" env:"UTC" description:"partition by UTC time instead of local"`
+	// CloseDelay waits for late records of the hour before partition file is finished
+	CloseDelay time.Duration `long:"close-delay" env:"CLOSE_DELAY" default:"5m" description:"finish partition file this long after its hour ended"`
+
+	// Logger gets messages of sink, they are discarded if not set
+	Logger ksmglog.Logger `no-flag:"true"`
+}
+
+const (
+	tmpExt     = ".tmp"
+	fileExt    = ".parquet"
+	closeDelay = 5 * time.Minute
+	closeCheck = 10 * time.Second
+)
+
+type partition struct {
+	dir  string
+	path string
+	end  time.Time // end of partition hour
+	file *os.File
+	pw   *writer.ParquetWriter
+	rows int
+}
+
+// NewSink initializes everything
+func NewSink(opts Opts) *Sink {
+	res := &Sink{Opts: opts, active: make(map[string]*partition), now: time.Now}
+	res.Logger = ksmglog.MaskedLogger(res.Logger)
+	if res.Dir == "" {
+		res.Dir = "."
+	}
+	if res.CloseDelay <= 0 {
+		res.CloseDelay = closeDelay
+	}
+	return res
+}
+
+// Run finishes partition files CloseDelay after their hour ended until ctx done,
+// so the last hour of quiet server is available without waiting for its next record
+func (s *Sink) Run(ctx context.Context) {
+	ticker := time.NewTicker(closeCheck)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.closeDue(); err != nil {
+				s.Logger.Log(ksmglog.LevelWarn, "could not finish parquet file", "error", err)
+			}
+		}
+	}
+}
+
+// Send writes records to partitions of their server and hour
+func (s *Sink) Send(_ context.Context, records []ksmglog.Record) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, r := range records {
+		p, err := s.partition(r)
+		if err != nil {
+			return err
+		}
+		if err = p.pw.Write(NewRow(r)); err != nil {
+			return errors.Wrapf(err, "could not write record %d", r.ID)
+		}
+		p.rows++
+	}
+	return nil
+}
+
+// Close finishes all partition files
+func (s *Sink) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var res error
+	for server, p := range s.active {
+		if err := s.finish(p); err != nil {
+			res = err
+		}
+		delete(s.active, server)
+	}
+	return res
+}
+
+// closeDue finishes partitions with hour ended more than CloseDelay ago
+func (s *Sink) closeDue() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var res error
+	now := s.now()
+	for server, p := range s.active {
+		if now.Before(p.end.Add(s.CloseDelay)) {
+			continue
+		}
+		delete(s.active, server)
+		if err := s.finish(p); err != nil {
+			res = err
+		}
+	}
+	return res
+}
+
+// partition returns open partition for record, closes previous partition of the server if hour changed
+func (s *Sink) partition(r ksmglog.Record) (*partition, error) {
+	t := time.Unix(int64(r.Time), 0)
+	if s.UTC {
+		t = t.UTC()
+	}
+	dir := filepath.Join(s.Dir, "server="+safeName(r.Server), "date="+t.Format("2006-01-02"), "hour="+t.Format("15"))
+
+	p, ok := s.active[r.Server]
+	if ok && p.dir == dir {
+		return p, nil
+	}
+	if ok {
+		delete(s.active, r.Server)
+		if err := s.finish(p); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := os.MkdirAll(dir, 0750); err != nil {
+		return nil, errors.Wrapf(err, "could not make partition %s", dir)
+	}
+
+	now := s.now()
+	path := filepath.Join(dir, fmt.Sprintf("part-%s%09d%s", now.Format("20060102T150405"), now.Nanosecond(), fileExt))
+	f, err := os.OpenFile(path+tmpExt, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0640) //nolint:gosec
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not create %s", path)
+	}
+
+	pw, err := writer.NewParquetWriterFromWriter(f, new(Row), 1)
+	if err != nil {
+		_ = f.Close()
+		_ = os.Remove(path + tmpExt)
+		return nil, errors.Wrap(err, "could not make parquet writer")
+	}
+	switch s.Compression {
+	case "gzip":
+		pw.CompressionType = parquet.CompressionCodec_GZIP
+	case "none":
+		pw.CompressionType = parquet.CompressionCodec_UNCOMPRESSED
+	default:
+		pw.CompressionType = parquet.CompressionCodec_SNAPPY
+	}
+
+	end := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location()).Add(time.Hour)
+	p = &partition{dir: dir, path: path, end: end, file: f, pw: pw}
+	s.active[r.Server] = p
+	return p, nil
+}
+
+// finish writes parquet footer of partition and renames file to final name
+func (s *Sink) finish(p *partition) error {
+	if err := p.pw.WriteStop(); err != nil {
+		_ = p.file.Close()
+		return errors.Wrapf(err, "could not finish %s", p.path)
+	}
+	if err := p.file.Sync(); err != nil {
+		_ = p.file.Close()
+		return errors.Wrapf(err, "could not sync %s", p.path)
+	}
+	if err := p.file.Close(); err != nil {
+		return errors.Wrapf(err, "could not close %s", p.path)
+	}
+	if err := os.Rename(p.path+tmpExt, p.path); err != nil {
+		return errors.Wrapf(err, "could not rename %s", p.path)
+	}
+	s.Logger.Log(ksmglog.LevelDebug, "parquet file written", "file", p.path, "rows", p.rows)
+	return nil
+}
+
+// safeName replaces path separators in server name
+func safeName(s string) string {
+	if s == "" {
+		return "unknown"
+	}
+	return strings.NewReplacer("/", "_", "\\", "_", ":", "_", "=", "_").Replace(s)
+}
@@ -0,0 +1,127 @@
+package parquet
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/xitongsys/parquet-go-source/local"
+	"github.com/xitongsys/parquet-go/reader"
+
+	"github.com/zorion79/ksmglog"
+)
+
+func TestSink_Send(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ksmglog-parquet")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	hour := time.Date(2019, 6, 10, 12, 0, 0, 0, time.UTC)
+	r1 := ksmglog.Record{}
+	require.NoError(t, json.Unmarshal([]byte(`{"id":1,"result":"Infected","details":{
+		"messageInfo":{"from":"a@example.com","to":["b@example.com","c@example.com"],"subject":"hi"},
+		"avStatus":"infected","maInfo":{"dmarcVerdict":"pass","dkimVerdicts":["pass"]},
+		"partResults":[{"fileName":"a.doc","avInfo":{"threats":["T1","T2"]}},{"fileName":"b.txt"}]}}`), &r1))
+	r1.Time = int(hour.Unix())
+	r1.Server = "ksmg01"
+
+	sink := NewSink(Opts{Dir: dir, UTC: true})
+	err = sink.Send(context.Background(), []ksmglog.Record{
+		r1,
+		{ID: 2, Time: int(hour.Unix()) + 60, Server: "ksmg01"},
+		{ID: 3, Time: int(hour.Unix()), Server: "ksmg02"},
+	})
+	require.NoError(t, err)
+
+	tmp, err := filepath.Glob(filepath.Join(dir, "*", "*", "*", "*"+tmpExt))
+	require.NoError(t, err)
+	assert.Equal(t, 2, len(tmp), "open partitions have temporary names")
+
+	// next hour closes partition of ksmg01
+	require.NoError(t, sink.Send(context.Background(), []ksmglog.Record{{ID: 4, Time: int(hour.Unix()) + 3600, Server: "ksmg01"}}))
+	files := partFiles(t, filepath.Join(dir, "server=ksmg01", "date=2019-06-10", "hour=12"))
+	require.Equal(t, 1, len(files))
+
+	require.NoError(t, sink.Close())
+
+	rows := readRows(t, files[0])
+	require.Equal(t, 2, len(rows))
+	row := rows[0]
+	assert.Equal(t, int64(1), row.ID)
+	assert.Equal(t, hour.Unix()*1000, row.Time)
+	assert.Equal(t, "ksmg01", row.Server)
+	assert.Equal(t, "Infected", row.Result)
+	assert.Equal(t, "a@example.com", row.From)
+	assert.Equal(t, []string{"b@example.com", "c@example.com"}, row.To)
+	assert.Equal(t, "infected", row.AvStatus)
+	assert.Equal(t, "pass", row.DmarcVerdict)
+	assert.Equal(t, []string{"pass"}, row.DkimVerdicts)
+	require.Equal(t, 2, len(row.Attachments))
+	assert.Equal(t, "a.doc", row.Attachments[0].FileName)
+	assert.Equal(t, []string{"T1", "T2"}, row.Attachments[0].Threats)
+	assert.Equal(t, "b.txt", row.Attachments[1].FileName)
+	assert.Equal(t, int64(2), rows[1].ID)
+
+	files = partFiles(t, filepath.Join(dir, "server=ksmg01", "date=2019-06-10", "hour=13"))
+	require.Equal(t, 1, len(files))
+	assert.Equal(t, int64(4), readRows(t, files[0])[0].ID)
+
+	files = partFiles(t, filepath.Join(dir, "server=ksmg02", "date=2019-06-10", "hour=12"))
+	require.Equal(t, 1, len(files))
+	assert.Equal(t, int64(3), readRows(t, files[0])[0].ID)
+}
+
+func TestSink_CloseDue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ksmglog-parquet")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	hour := time.Date(2019, 6, 10, 12, 0, 0, 0, time.UTC)
+	now := hour.Add(30 * time.Minute)
+	sink := NewSink(Opts{Dir: dir, UTC: true, CloseDelay: 5 * time.Minute})
+	sink.now = func() time.Time { return now }
+	partDir := filepath.Join(dir, "server=ksmg01", "date=2019-06-10", "hour=12")
+
+	require.NoError(t, sink.Send(context.Background(), []ksmglog.Record{{ID: 1, Time: int(now.Unix()), Server: "ksmg01"}}))
+	now = hour.Add(64 * time.Minute)
+	require.NoError(t, sink.closeDue())
+	assert.Empty(t, partFiles(t, partDir), "partition waits for late records")
+
+	// quiet server partition is finished without record of the next hour
+	now = hour.Add(65 * time.Minute)
+	require.NoError(t, sink.closeDue())
+	files := partFiles(t, partDir)
+	require.Equal(t, 1, len(files))
+	assert.Equal(t, int64(1), readRows(t, files[0])[0].ID)
+
+	// late record goes to the next file of partition
+	require.NoError(t, sink.Send(context.Background(), []ksmglog.Record{{ID: 2, Time: int(hour.Unix()), Server: "ksmg01"}}))
+	require.NoError(t, sink.Close())
+	assert.Equal(t, 2, len(partFiles(t, partDir)))
+}
+
+func partFiles(t *testing.T, dir string) []string {
+	files, err := filepath.Glob(filepath.Join(dir, "part-*"+fileExt))
+	require.NoError(t, err)
+	return files
+}
+
+func readRows(t *testing.T, path string) []Row {
+	f, err := local.NewLocalFileReader(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	pr, err := reader.NewParquetReader(f, new(Row), 1)
+	require.NoError(t, err)
+	defer pr.ReadStop()
+
+	rows := make([]Row, pr.GetNumRows())
+	require.NoError(t, pr.Read(&rows))
+	return rows
+}
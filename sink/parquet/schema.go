@@ -0,0 +1,107 @@
+package parquet
+
+import (
+	"github.com/zorion79/ksmglog"
+)
+
+// Row is parquet schema of record, one row per record
+type Row struct {
+	Server         string   `parquet:"name=server, type=BYTE_ARRAY, convertedtype=UTF8"`
+	ID             int64    `parquet:"name=id, type=INT64"`
+	Time           int64    `parquet:"name=time, type=INT64, convertedtype=TIMESTAMP_MILLIS"`
+	Type           string   `parquet:"name=type, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Result         string   `parquet:"name=result, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Person         string   `parquet:"name=person, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Description    string   `parquet:"name=description, type=BYTE_ARRAY, convertedtype=UTF8"`
+	EventName      string   `parquet:"name=event_name, type=BYTE_ARRAY, convertedtype=UTF8"`
+	MessageID      string   `parquet:"name=message_id, type=BYTE_ARRAY, convertedtype=UTF8"`
+	SMTPMessageID  string   `parquet:"name=smtp_message_id, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Size           string   `parquet:"name=size, type=BYTE_ARRAY, convertedtype=UTF8"`
+	ClientAddress  string   `parquet:"name=client_address, type=BYTE_ARRAY, convertedtype=UTF8"`
+	ClientHostName string   `parquet:"name=client_host_name, type=BYTE_ARRAY, convertedtype=UTF8"`
+	From           string   `parquet:"name=from, type=BYTE_ARRAY, convertedtype=UTF8"`
+	To             []string `parquet:"name=to, type=LIST, valuetype=BYTE_ARRAY, valueconvertedtype=UTF8"`
+	Cc             []string `parquet:"name=cc, type=LIST, valuetype=BYTE_ARRAY, valueconvertedtype=UTF8"`
+	Bcc            []string `parquet:"name=bcc, type=LIST, valuetype=BYTE_ARRAY, valueconvertedtype=UTF8"`
+	Subject        string   `parquet:"name=subject, type=BYTE_ARRAY, convertedtype=UTF8"`
+
+	AvStatus     string `parquet:"name=av_status, type=BYTE_ARRAY, convertedtype=UTF8"`
+	AsStatus     string `parquet:"name=as_status, type=BYTE_ARRAY, convertedtype=UTF8"`
+	MaStatus     string `parquet:"name=ma_status, type=BYTE_ARRAY, convertedtype=UTF8"`
+	ApStatus     string `parquet:"name=ap_status, type=BYTE_ARRAY, convertedtype=UTF8"`
+	CfStatus     string `parquet:"name=cf_status, type=BYTE_ARRAY, convertedtype=UTF8"`
+	KtStatus     string `parquet:"name=kt_status, type=BYTE_ARRAY, convertedtype=UTF8"`
+	DocWithMacro bool   `parquet:"name=doc_with_macro, type=BOOLEAN"`
+	Action       string `parquet:"name=action, type=BYTE_ARRAY, convertedtype=UTF8"`
+	BackupReason string `parquet:"name=backup_reason, type=BYTE_ARRAY, convertedtype=UTF8"`
+
+	DmarcVerdict string   `parquet:"name=dmarc_verdict, type=BYTE_ARRAY, convertedtype=UTF8"`
+	SpfVerdict   string   `parquet:"name=spf_verdict, type=BYTE_ARRAY, convertedtype=UTF8"`
+	DkimVerdicts []string `parquet:"name=dkim_verdicts, type=LIST, valuetype=BYTE_ARRAY, valueconvertedtype=UTF8"`
+
+	Attachments []Attachment `parquet:"name=attachments, type=LIST"`
+}
+
+// Attachment is parquet schema of record part result
+type Attachment struct {
+	FileName         string   `parquet:"name=file_name, type=BYTE_ARRAY, convertedtype=UTF8"`
+	FileSize         string   `parquet:"name=file_size, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Action           string   `parquet:"name=action, type=BYTE_ARRAY, convertedtype=UTF8"`
+	DocWithMacro     bool     `parquet:"name=doc_with_macro, type=BOOLEAN"`
+	SkipReason       string   `parquet:"name=skip_reason, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Threats          []string `parquet:"name=threats, type=LIST, valuetype=BYTE_ARRAY, valueconvertedtype=UTF8"`
+	BannedFileName   string   `parquet:"name=banned_file_name, type=BYTE_ARRAY, convertedtype=UTF8"`
+	BannedFileFormat string   `parquet:"name=banned_file_format, type=BYTE_ARRAY, convertedtype=UTF8"`
+}
+
+// NewRow converts record to Row
+func NewRow(r ksmglog.Record) Row {
+	d := r.Details
+	info := d.MessageInfo
+	res := Row{
+		Server:         r.Server,
+		ID:             int64(r.ID),
+		Time:           int64(r.Time) * 1000,
+		Type:           string(r.Type),
+		Result:         string(r.Result),
+		Person:         r.Person,
+		Description:    r.Description,
+		EventName:      r.EventName,
+		MessageID:      info.MessageID,
+		SMTPMessageID:  info.SMTPMessageID,
+		Size:           info.Size,
+		ClientAddress:  info.ClientAddress,
+		ClientHostName: info.ClientHostName,
+		From:           info.From,
+		To:             info.To,
+		Cc:             info.Cc,
+		Bcc:            info.Bcc,
+		Subject:        info.Subject,
+		AvStatus:       string(d.AvStatus),
+		AsStatus:       string(d.AsStatus),
+		MaStatus:       string(d.MaStatus),
+		ApStatus:       string(d.ApStatus),
+		CfStatus:       string(d.CfStatus),
+		KtStatus:       string(d.KtStatus),
+		DocWithMacro:   d.DocWithMacroDetected,
+		Action:         d.Action,
+		BackupReason:   d.BackupReason,
+		DmarcVerdict:   d.MaInfo.DmarcVerdict,
+		SpfVerdict:     d.MaInfo.SpfVerdict,
+		DkimVerdicts:   d.MaInfo.DkimVerdicts,
+	}
+
+	for _, p := range d.PartResults {
+		res.Attachments = append(res.Attachments, Attachment{
+			FileName:         p.FileName,
+			FileSize:         p.FileSize,
+			Action:           p.Action,
+			DocWithMacro:     p.AvInfo.DocWithMacroDetected,
+			SkipReason:       p.AvInfo.SkipReason,
+			Threats:          p.AvInfo.Threats,
+			BannedFileName:   p.CfInfo.BannedFileName,
+			BannedFileFormat: p.CfInfo.BannedFileFormat,
+		})
+	}
+	return res
+}
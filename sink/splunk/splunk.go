@@ -0,0 +1,288 @@
+// Package splunk implements ksmglog.Sink sending records to Splunk HTTP Event Collector (HEC)
+package splunk
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/zorion79/ksmglog"
+	"github.com/zorion79/ksmglog/sink/internal/retry"
+)
+
+// Sink sends batches of records to HEC /services/collector/event
+type Sink struct {
+	Opts
+
+	client *http.Client
+}
+
+// Opts collects parameters to initialize Sink
+type Opts struct {
+	URL                string            `long:"url" env:"URL" description:"HEC base url like https://splunk:8088"`
+	Token              string            `long:"token" env:"TOKEN" description:"HEC token"`
+	Source             string            `long:"source" env:"SOURCE" default:"ksmglog" description:"event source"`
+	SourceType         string            `long:"sourcetype" env:"SOURCETYPE" default:"ksmg:journal" description:"event sourcetype"`
+	Index              string            `long:"index" env:"INDEX" description:"event index, HEC token default if empty"`
+	Servers            map[string]Target `no-flag:"true"`
+	Ack                bool              `long:"ack" env:"ACK" description:"wait for indexer acknowledgement"`
+	Channel            string            `long:"channel" env:"CHANNEL" description:"request channel GUID, random if empty"`
+	AckTimeout         time.Duration     `long:"ack-timeout" env:"ACK_TIMEOUT" default:"1m" description:"max time to wait for acknowledgement"`
+	AckInterval        time.Duration     `long:"ack-interval" env:"ACK_INTERVAL" default:"1s" description:"acknowledgement poll interval"`
+	MaxRetries         int               `long:"max-retries" env:"MAX_RETRIES" default:"5" description:"retries on 503 response, -1 disables"`
+	RetryDelay         time.Duration     `long:"retry-delay" env:"RETRY_DELAY" default:"1s" description:"initial delay between retries, doubled on every retry"`
+	Timeout            time.Duration     `long:"timeout" env:"TIMEOUT" default:"5s" description:"http client timeout"`
+	InsecureSkipVerify bool              `long:"insecure" env:"INSECURE" description:"skip HEC certificate verification"`
+
+	// Logger gets messages of sink, they are discarded if not set
+	Logger ksmglog.Logger `no-flag:"true"`
+}
+
+// Target overrides event metadata for records of one ksmg server, empty fields use Opts values
+type Target struct {
+	Host       string
+	SourceType string
+	Index      string
+}
+
+// event is a single HEC event envelope
+type event struct {
+	Time       int64          `json:"time"`
+	Host       string         `json:"host,omitempty"`
+	Source     string         `json:"source,omitempty"`
+	SourceType string         `json:"sourcetype,omitempty"`
+	Index      string         `json:"index,omitempty"`
+	Event      ksmglog.Record `json:"event"`
+}
+
+const (
+	eventPath = "/services/collector/event"
+	ackPath   = "/services/collector/ack"
+
+	timeout     = 5 * time.Second
+	retryDelay  = time.Second
+	maxRetries  = 5
+	ackTimeout  = time.Minute
+	ackInterval = time.Second
+)
+
+// NewSink initializes everything
+func NewSink(opts Opts) *Sink {
+	res := &Sink{Opts: opts}
+	res.Logger = ksmglog.MaskedLogger(res.Logger)
+
+	if res.Timeout <= 0 {
+		res.Timeout = timeout
+	}
+	res.MaxRetries, res.RetryDelay = retry.Defaults(res.MaxRetries, res.RetryDelay, maxRetries, retryDelay)
+	if res.AckTimeout <= 0 {
+		res.AckTimeout = ackTimeout
+	}
+	if res.AckInterval <= 0 {
+		res.AckInterval = ackInterval
+	}
+	if res.Channel == "" {
+		res.Channel = newGUID()
+	}
+	res.URL = strings.TrimSuffix(res.URL, "/")
+
+	res.client = &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: res.InsecureSkipVerify, //nolint:gosec
+			},
+		},
+		Timeout: res.Timeout,
+	}
+
+	return res
+}
+
+// Send posts records as one HEC request and waits for acknowledgement if enabled
+func (s *Sink) Send(ctx context.Context, records []ksmglog.Record) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	body := &bytes.Buffer{}
+	encoder := json.NewEncoder(body)
+	for _, r := range records {
+		if err := encoder.Encode(s.makeEvent(r)); err != nil {
+			return errors.Wrapf(err, "could not marshal record %d", r.ID)
+		}
+	}
+
+	resp := struct {
+		Text  string `json:"text"`
+		Code  int    `json:"code"`
+		AckID *int64 `json:"ackId"`
+	}{}
+	if err := s.post(ctx, eventPath, body.Bytes(), &resp); err != nil {
+		return errors.Wrap(err, "could not send events")
+	}
+	if resp.Code != 0 {
+		return errors.Errorf("hec error %d: %s", resp.Code, resp.Text)
+	}
+
+	if !s.Ack {
+		return nil
+	}
+	if resp.AckID == nil {
+		return errors.New("indexer acknowledgement is not enabled for token")
+	}
+
+	return s.waitAck(ctx, *resp.AckID)
+}
+
+func (s *Sink) makeEvent(r ksmglog.Record) event {
+	res := event{
+		Time:       int64(r.Time),
+		Host:       r.Server,
+		Source:     s.Source,
+		SourceType: s.SourceType,
+		Index:      s.Index,
+		Event:      r,
+	}
+
+	t, ok := s.Servers[r.Server]
+	if !ok {
+		return res
+	}
+	if t.Host != "" {
+		res.Host = t.Host
+	}
+	if t.SourceType != "" {
+		res.SourceType = t.SourceType
+	}
+	if t.Index != "" {
+		res.Index = t.Index
+	}
+	return res
+}
+
+// waitAck polls ack endpoint until ackID reported as indexed
+func (s *Sink) waitAck(ctx context.Context, ackID int64) error {
+	ctx, cancel := context.WithTimeout(ctx, s.AckTimeout)
+	defer cancel()
+
+	body, err := json.Marshal(map[string][]int64{"acks": {ackID}})
+	if err != nil {
+		return errors.Wrap(err, "could not marshal ack request")
+	}
+
+	for {
+		resp := struct {
+			Acks map[string]bool `json:"acks"`
+		}{}
+		if err := s.post(ctx, ackPath, body, &resp); err != nil {
+			return errors.Wrapf(err, "could not check ack %d", ackID)
+		}
+		if resp.Acks[strconv.FormatInt(ackID, 10)] {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "ack %d not received", ackID)
+		case <-time.After(s.AckInterval):
+		}
+	}
+}
+
+// post sends body to HEC path, retries with exponential backoff while server responds 503
+func (s *Sink) post(ctx context.Context, path string, body []byte, result interface{}) error {
+	delay := s.RetryDelay
+	for attempt := 0; ; attempt++ {
+		resp, err := s.doRequest(ctx, path, body)
+		if err != nil {
+			return err
+		}
+
+		if resp.StatusCode == http.StatusServiceUnavailable && attempt < s.MaxRetries {
+			wait := retryAfter(resp, delay)
+			s.drain(resp.Body)
+			s.Logger.Log(ksmglog.LevelDebug, "hec busy, retry", "attempt", attempt+1, "delay", wait)
+			if err := retry.Sleep(ctx, wait); err != nil {
+				return err
+			}
+			delay *= 2
+			continue
+		}
+
+		err = decode(resp, result)
+		s.drain(resp.Body)
+		return err
+	}
+}
+
+func (s *Sink) doRequest(ctx context.Context, path string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequest("POST", s.URL+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not make request")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Authorization", "Splunk "+s.Token)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Splunk-Request-Channel", s.Channel)
+	if path == ackPath {
+		query := req.URL.Query()
+		query.Set("channel", s.Channel)
+		req.URL.RawQuery = query.Encode()
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not request")
+	}
+	return resp, nil
+}
+
+func decode(resp *http.Response, result interface{}) error {
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return errors.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return errors.Wrap(err, "could not unmarshal body")
+	}
+	return nil
+}
+
+// retryAfter returns delay from Retry-After header in seconds or def
+func retryAfter(resp *http.Response, def time.Duration) time.Duration {
+	sec, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || sec <= 0 {
+		return def
+	}
+	return time.Duration(sec) * time.Second
+}
+
+func (s *Sink) drain(body io.ReadCloser) {
+	_, _ = io.Copy(ioutil.Discard, body)
+	if err := body.Close(); err != nil {
+		s.Logger.Log(ksmglog.LevelWarn, "could not close body", "error", err)
+	}
+}
+
+// newGUID returns random v4 uuid used as request channel
+func newGUID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "00000000-0000-4000-8000-000000000000"
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,129 @@
+package splunk
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/zorion79/ksmglog"
+)
+
+func TestSink_Send(t *testing.T) {
+	var events []event
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, eventPath, r.URL.Path)
+		assert.Equal(t, "Splunk secret", r.Header.Get("Authorization"))
+		assert.NotEmpty(t, r.Header.Get("X-Splunk-Request-Channel"))
+
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			e := event{}
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &e))
+			events = append(events, e)
+		}
+		_, err := w.Write([]byte(`{"text":"Success","code":0}`))
+		assert.NoError(t, err)
+	}))
+	defer ts.Close()
+
+	sink := NewSink(Opts{
+		URL:        ts.URL + "/",
+		Token:      "secret",
+		SourceType: "ksmg",
+		Index:      "mail",
+		Servers:    map[string]Target{"ksmg02": {Host: "gw2", Index: "mail2"}},
+	})
+
+	err := sink.Send(context.Background(), []ksmglog.Record{
+		{ID: 1, Time: 1560000000, Server: "ksmg01"},
+		{ID: 2, Time: 1560000001, Server: "ksmg02"},
+	})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(events))
+
+	assert.Equal(t, int64(1560000000), events[0].Time)
+	assert.Equal(t, "ksmg01", events[0].Host)
+	assert.Equal(t, "mail", events[0].Index)
+	assert.Equal(t, "ksmg", events[0].SourceType)
+	assert.Equal(t, 1, events[0].Event.ID)
+
+	assert.Equal(t, "gw2", events[1].Host)
+	assert.Equal(t, "mail2", events[1].Index)
+	assert.Equal(t, "ksmg", events[1].SourceType)
+}
+
+func TestSink_SendRetry(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, err := w.Write([]byte(`{"text":"Success","code":0}`))
+		assert.NoError(t, err)
+	}))
+	defer ts.Close()
+
+	sink := NewSink(Opts{URL: ts.URL, RetryDelay: time.Millisecond, MaxRetries: 3})
+	assert.NoError(t, sink.Send(context.Background(), []ksmglog.Record{{ID: 1}}))
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+	atomic.StoreInt32(&calls, 0)
+	sink = NewSink(Opts{URL: ts.URL, RetryDelay: time.Millisecond, MaxRetries: 1})
+	assert.Error(t, sink.Send(context.Background(), []ksmglog.Record{{ID: 1}}))
+
+	atomic.StoreInt32(&calls, 0)
+	sink = NewSink(Opts{URL: ts.URL, RetryDelay: time.Millisecond, MaxRetries: -1})
+	assert.Error(t, sink.Send(context.Background(), []ksmglog.Record{{ID: 1}}))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls), "no retries")
+}
+
+func TestSink_SendAck(t *testing.T) {
+	var polls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case eventPath:
+			_, err := w.Write([]byte(`{"text":"Success","code":0,"ackId":7}`))
+			assert.NoError(t, err)
+		case ackPath:
+			assert.Equal(t, "chan", r.URL.Query().Get("channel"))
+			req := struct {
+				Acks []int64 `json:"acks"`
+			}{}
+			assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			assert.Equal(t, []int64{7}, req.Acks)
+			done := atomic.AddInt32(&polls, 1) > 1
+			assert.NoError(t, json.NewEncoder(w).Encode(map[string]map[string]bool{"acks": {"7": done}}))
+		}
+	}))
+	defer ts.Close()
+
+	sink := NewSink(Opts{URL: ts.URL, Ack: true, Channel: "chan", AckInterval: time.Millisecond})
+	assert.NoError(t, sink.Send(context.Background(), []ksmglog.Record{{ID: 1}}))
+	assert.Equal(t, int32(2), atomic.LoadInt32(&polls))
+}
+
+func TestSink_SendError(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		_, err := w.Write([]byte(`{"text":"Invalid token","code":4}`))
+		assert.NoError(t, err)
+	}))
+	defer ts.Close()
+
+	err := NewSink(Opts{URL: ts.URL}).Send(context.Background(), []ksmglog.Record{{ID: 1}})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Invalid token")
+}
+
+func TestNewGUID(t *testing.T) {
+	assert.Regexp(t, `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`, newGUID())
+}
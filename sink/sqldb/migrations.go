@@ -0,0 +1,75 @@
+package sqldb
+
+// migrations are applied in order, index+1 is the schema version.
+// Statements use types and syntax common for SQLite and PostgreSQL, so both share the same schema.
+var migrations = [][]string{
+	{
+		`CREATE TABLE messages (
+			server TEXT NOT NULL,
+			id BIGINT NOT NULL,
+			time BIGINT NOT NULL,
+			type TEXT NOT NULL,
+			result TEXT NOT NULL,
+			person TEXT NOT NULL,
+			description TEXT NOT NULL,
+			event_name TEXT NOT NULL,
+			message_id TEXT NOT NULL,
+			smtp_message_id TEXT NOT NULL,
+			size TEXT NOT NULL,
+			client_address TEXT NOT NULL,
+			client_host_name TEXT NOT NULL,
+			sender TEXT NOT NULL,
+			subject TEXT NOT NULL,
+			av_status TEXT NOT NULL,
+			as_status TEXT NOT NULL,
+			ma_status TEXT NOT NULL,
+			ap_status TEXT NOT NULL,
+			cf_status TEXT NOT NULL,
+			kt_status TEXT NOT NULL,
+			doc_with_macro BOOLEAN NOT NULL,
+			action TEXT NOT NULL,
+			backup_reason TEXT NOT NULL,
+			raw TEXT NOT NULL,
+			PRIMARY KEY (server, id)
+		)`,
+		`CREATE INDEX messages_time ON messages (time)`,
+		`CREATE INDEX messages_sender ON messages (sender)`,
+		`CREATE TABLE recipients (
+			server TEXT NOT NULL,
+			record_id BIGINT NOT NULL,
+			kind TEXT NOT NULL,
+			address TEXT NOT NULL,
+			PRIMARY KEY (server, record_id, kind, address)
+		)`,
+		`CREATE INDEX recipients_address ON recipients (address)`,
+		`CREATE TABLE attachments (
+			server TEXT NOT NULL,
+			record_id BIGINT NOT NULL,
+			part INTEGER NOT NULL,
+			file_name TEXT NOT NULL,
+			file_size TEXT NOT NULL,
+			action TEXT NOT NULL,
+			doc_with_macro BOOLEAN NOT NULL,
+			skip_reason TEXT NOT NULL,
+			banned_file_name TEXT NOT NULL,
+			banned_file_format TEXT NOT NULL,
+			PRIMARY KEY (server, record_id, part)
+		)`,
+		`CREATE TABLE threats (
+			server TEXT NOT NULL,
+			record_id BIGINT NOT NULL,
+			part INTEGER NOT NULL,
+			threat TEXT NOT NULL,
+			PRIMARY KEY (server, record_id, part, threat)
+		)`,
+		`CREATE INDEX threats_threat ON threats (threat)`,
+		`CREATE TABLE auth_verdicts (
+			server TEXT NOT NULL,
+			record_id BIGINT NOT NULL,
+			method TEXT NOT NULL,
+			seq INTEGER NOT NULL,
+			verdict TEXT NOT NULL,
+			PRIMARY KEY (server, record_id, method, seq)
+		)`,
+	},
+}
@@ -0,0 +1,302 @@
+// Package sqldb implements ksmglog.Sink persisting records into relational database via database/sql.
+// SQLite and PostgreSQL are supported, the binary has to import driver package itself.
+package sqldb
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/zorion79/ksmglog"
+)
+
+// Sink upserts records by server and id into normalized tables, one transaction per batch.
+// Service sends copy of record per recipient with it in To, recipients of copies are merged into one message.
+type Sink struct {
+	Opts
+
+	db      *sql.DB
+	dialect string
+}
+
+// Opts collects parameters to initialize Sink
+type Opts struct {
+	Driver string `long:"driver" env:"DRIVER" default:"sqlite" description:"database/sql driver name like sqlite or postgres"`
+	DSN    string `long:"dsn" env:"DSN" description:"data source name"`
+
+	// Logger gets messages of sink, they are discarded if not set
+	Logger ksmglog.Logger `no-flag:"true"`
+}
+
+// Dialects
+const (
+	SQLite   = "sqlite"
+	Postgres = "postgres"
+)
+
+// child tables rewritten on every upsert of a record, recipients are merged
+var children = []string{"attachments", "threats", "auth_verdicts"}
+
+// NewSink opens database and applies pending migrations
+func NewSink(ctx context.Context, opts Opts) (*Sink, error) {
+	db, err := sql.Open(opts.Driver, opts.DSN)
+	if err != nil {
+		return nil, errors.Wrapf(err, "could not open %s database", opts.Driver)
+	}
+
+	res := &Sink{Opts: opts, db: db, dialect: DialectOf(opts.Driver)}
+	res.Logger = ksmglog.MaskedLogger(res.Logger)
+	if err = migrate(ctx, db, res.dialect, res.Logger); err != nil {
+		_ = db.Close()
+		return nil, errors.Wrap(err, "could not migrate")
+	}
+	return res, nil
+}
+
+// DialectOf returns dialect for driver name
+func DialectOf(driver string) string {
+	switch driver {
+	case "postgres", "pgx", "cloudsqlpostgres":
+		return Postgres
+	default:
+		return SQLite
+	}
+}
+
+// DB returns underlying database
+func (s *Sink) DB() *sql.DB {
+	return s.db
+}
+
+// Close closes database
+func (s *Sink) Close() error {
+	return s.db.Close()
+}
+
+// Send upserts records in one transaction
+func (s *Sink) Send(ctx context.Context, records []ksmglog.Record) (err error) {
+	if len(records) == 0 {
+		return nil
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "could not begin transaction")
+	}
+	defer func() {
+		if err == nil {
+			err = errors.Wrap(tx.Commit(), "could not commit")
+			return
+		}
+		if rbErr := tx.Rollback(); rbErr != nil {
+			s.Logger.Log(ksmglog.LevelWarn, "could not rollback", "error", rbErr)
+		}
+	}()
+
+	for _, r := range records {
+		if err = s.upsert(ctx, tx, r); err != nil {
+			return errors.Wrapf(err, "could not store record %s/%d", r.Server, r.ID)
+		}
+	}
+	return nil
+}
+
+func (s *Sink) upsert(ctx context.Context, tx *sql.Tx, r ksmglog.Record) error {
+	raw, err := json.Marshal(r)
+	if err != nil {
+		return errors.Wrap(err, "could not marshal record")
+	}
+
+	d := r.Details
+	info := d.MessageInfo
+	columns := []string{
+		"server", "id", "time", "type", "result", "person", "description", "event_name",
+		"message_id", "smtp_message_id", "size", "client_address", "client_host_name", "sender", "subject",
+		"av_status", "as_status", "ma_status", "ap_status", "cf_status", "kt_status", "doc_with_macro",
+		"action", "backup_reason", "raw",
+	}
+	values := []interface{}{
+		r.Server, r.ID, r.Time, r.Type, r.Result, r.Person, r.Description, r.EventName,
+		info.MessageID, info.SMTPMessageID, info.Size, info.ClientAddress, info.ClientHostName, info.From, info.Subject,
+		d.AvStatus, d.AsStatus, d.MaStatus, d.ApStatus, d.CfStatus, d.KtStatus, d.DocWithMacroDetected,
+		d.Action, d.BackupReason, string(raw),
+	}
+
+	updates := make([]string, 0, len(columns)-2)
+	for _, c := range columns[2:] {
+		updates = append(updates, c+" = excluded."+c)
+	}
+	query := "INSERT INTO messages (" + strings.Join(columns, ", ") + ") VALUES (" + placeholders(len(columns)) + ")" +
+		" ON CONFLICT (server, id) DO UPDATE SET " + strings.Join(updates, ", ")
+	if _, err = tx.ExecContext(ctx, s.rebind(query), values...); err != nil {
+		return errors.Wrap(err, "could not upsert message")
+	}
+
+	for _, table := range children {
+		if _, err = tx.ExecContext(ctx, s.rebind("DELETE FROM "+table+" WHERE server = ? AND record_id = ?"), r.Server, r.ID); err != nil {
+			return errors.Wrapf(err, "could not clean %s", table)
+		}
+	}
+
+	insert := func(table string, columns string, values ...interface{}) error {
+		n := len(strings.Split(columns, ","))
+		query := "INSERT INTO " + table + " (server, record_id, " + columns + ") VALUES (" + placeholders(n+2) + ")"
+		_, err := tx.ExecContext(ctx, s.rebind(query), append([]interface{}{r.Server, r.ID}, values...)...)
+		return errors.Wrapf(err, "could not insert into %s", table)
+	}
+
+	if err = s.mergeRecipients(ctx, tx, r); err != nil {
+		return err
+	}
+
+	for i, p := range d.PartResults {
+		err = insert("attachments", "part, file_name, file_size, action, doc_with_macro, skip_reason, banned_file_name, banned_file_format",
+			i, p.FileName, p.FileSize, p.Action, p.AvInfo.DocWithMacroDetected, p.AvInfo.SkipReason,
+			p.CfInfo.BannedFileName, p.CfInfo.BannedFileFormat)
+		if err != nil {
+			return err
+		}
+		for _, threat := range unique(p.AvInfo.Threats) {
+			if err = insert("threats", "part, threat", i, threat); err != nil {
+				return err
+			}
+		}
+	}
+
+	verdicts := map[string][]string{"dmarc": {d.MaInfo.DmarcVerdict}, "spf": {d.MaInfo.SpfVerdict}, "dkim": d.MaInfo.DkimVerdicts}
+	for method, vv := range verdicts {
+		for seq, v := range vv {
+			if v == "" {
+				continue
+			}
+			if err = insert("auth_verdicts", "method, seq, verdict", method, seq, v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// mergeRecipients adds To recipients of record to ones stored by other copies of it, Cc and Bcc are
+// complete in every copy and replaced. Copy made for cc or bcc recipient has it in To, it is stored with its kind.
+func (s *Sink) mergeRecipients(ctx context.Context, tx *sql.Tx, r ksmglog.Record) error {
+	info := r.Details.MessageInfo
+	query := "DELETE FROM recipients WHERE server = ? AND record_id = ? AND kind IN ('cc', 'bcc')"
+	if _, err := tx.ExecContext(ctx, s.rebind(query), r.Server, r.ID); err != nil {
+		return errors.Wrap(err, "could not clean recipients")
+	}
+
+	kinds := map[string]string{}
+	for _, addr := range info.To {
+		kinds[addr] = "to"
+	}
+	for kind, addrs := range map[string][]string{"cc": info.Cc, "bcc": info.Bcc} {
+		for _, addr := range addrs {
+			kinds[addr] = kind
+		}
+	}
+
+	query = s.rebind("INSERT INTO recipients (server, record_id, kind, address) VALUES (?, ?, ?, ?)" +
+		" ON CONFLICT (server, record_id, kind, address) DO NOTHING")
+	for _, addr := range unique(info.AllRecipients()) {
+		if _, err := tx.ExecContext(ctx, query, r.Server, r.ID, kinds[addr], addr); err != nil {
+			return errors.Wrap(err, "could not insert into recipients")
+		}
+	}
+	return nil
+}
+
+// Migrate applies pending migrations, every one in own transaction
+func Migrate(ctx context.Context, db *sql.DB, dialect string) error {
+	return migrate(ctx, db, dialect, ksmglog.NopLogger)
+}
+
+// migrate applies pending migrations and reports applied ones to l
+func migrate(ctx context.Context, db *sql.DB, dialect string, l ksmglog.Logger) error {
+	if _, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version INTEGER PRIMARY KEY,
+		applied_at BIGINT NOT NULL
+	)`); err != nil {
+		return errors.Wrap(err, "could not create schema_migrations")
+	}
+
+	var current sql.NullInt64
+	if err := db.QueryRowContext(ctx, "SELECT MAX(version) FROM schema_migrations").Scan(&current); err != nil {
+		return errors.Wrap(err, "could not get schema version")
+	}
+
+	for i := int(current.Int64); i < len(migrations); i++ {
+		version := i + 1
+		if err := apply(ctx, db, dialect, version, migrations[i]); err != nil {
+			return errors.Wrapf(err, "could not apply migration %d", version)
+		}
+		l.Log(ksmglog.LevelInfo, "applied migration", "version", version)
+	}
+	return nil
+}
+
+func apply(ctx context.Context, db *sql.DB, dialect string, version int, statements []string) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return errors.Wrap(err, "could not begin transaction")
+	}
+
+	for _, stmt := range statements {
+		if _, err = tx.ExecContext(ctx, stmt); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+
+	query := rebind(dialect, "INSERT INTO schema_migrations (version, applied_at) VALUES (?, ?)")
+	if _, err = tx.ExecContext(ctx, query, version, time.Now().Unix()); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *Sink) rebind(query string) string {
+	return rebind(s.dialect, query)
+}
+
+// rebind replaces ? placeholders with $n for postgres
+func rebind(dialect, query string) string {
+	if dialect != Postgres {
+		return query
+	}
+
+	b := strings.Builder{}
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+func unique(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	res := make([]string, 0, len(values))
+	for _, v := range values {
+		if v == "" || seen[v] {
+			continue
+		}
+		seen[v] = true
+		res = append(res, v)
+	}
+	return res
+}
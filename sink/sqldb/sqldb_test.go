@@ -0,0 +1,122 @@
+package sqldb
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	_ "modernc.org/sqlite"
+
+	"github.com/zorion79/ksmglog"
+)
+
+func TestSink_Send(t *testing.T) {
+	sink, teardown := prepSink(t)
+	defer teardown()
+
+	r := ksmglog.Record{}
+	require.NoError(t, json.Unmarshal([]byte(`{"id":10,"time":1560000000,"result":"Infected","details":{
+		"messageInfo":{"from":"a@example.com","to":["b@example.com","b@example.com"],"cc":["c@example.com"]},
+		"partResults":[{"fileName":"invoice.doc","avInfo":{"threats":["HEUR:Trojan.Script.Generic"]}}],
+		"maInfo":{"spfVerdict":"pass","dkimVerdicts":["pass","fail"]}}}`), &r))
+	r.Server = "ksmg01"
+
+	ctx := context.Background()
+	require.NoError(t, sink.Send(ctx, []ksmglog.Record{r, {ID: 11, Server: "ksmg01"}, {ID: 10, Server: "ksmg02"}}))
+
+	assert.Equal(t, 3, count(t, sink, "SELECT COUNT(*) FROM messages"))
+	assert.Equal(t, 2, count(t, sink, "SELECT COUNT(*) FROM recipients WHERE server = 'ksmg01' AND record_id = 10"))
+	assert.Equal(t, 1, count(t, sink, "SELECT COUNT(*) FROM attachments WHERE file_name = 'invoice.doc'"))
+	assert.Equal(t, 1, count(t, sink, "SELECT COUNT(*) FROM threats WHERE threat = 'HEUR:Trojan.Script.Generic'"))
+	assert.Equal(t, 3, count(t, sink, "SELECT COUNT(*) FROM auth_verdicts"))
+
+	// upsert replaces message and its children
+	r.Result = "Clean"
+	r.Details.MessageInfo.Cc = nil
+	r.Details.PartResults = nil
+	require.NoError(t, sink.Send(ctx, []ksmglog.Record{r}))
+
+	assert.Equal(t, 3, count(t, sink, "SELECT COUNT(*) FROM messages"))
+	var result, sender string
+	require.NoError(t, sink.DB().QueryRow("SELECT result, sender FROM messages WHERE server = 'ksmg01' AND id = 10").Scan(&result, &sender))
+	assert.Equal(t, "Clean", result)
+	assert.Equal(t, "a@example.com", sender)
+	assert.Equal(t, 1, count(t, sink, "SELECT COUNT(*) FROM recipients"))
+	assert.Equal(t, 0, count(t, sink, "SELECT COUNT(*) FROM attachments"))
+	assert.Equal(t, 0, count(t, sink, "SELECT COUNT(*) FROM threats"))
+}
+
+func TestSink_SendCopies(t *testing.T) {
+	sink, teardown := prepSink(t)
+	defer teardown()
+
+	// copies of one record made by service per recipient, every one has its recipient in To
+	r := ksmglog.Record{ID: 10, Server: "ksmg01", Result: ksmglog.ResultSpam}
+	r.Details.MessageInfo.Cc = []string{"c@example.com"}
+	r.Details.MessageInfo.Bcc = []string{"d@example.com"}
+	copies := []ksmglog.Record{}
+	for _, to := range []string{"a@example.com", "b@example.com", "c@example.com", "d@example.com"} {
+		c := r
+		c.Details.MessageInfo.To = []string{to}
+		copies = append(copies, c)
+	}
+
+	ctx := context.Background()
+	require.NoError(t, sink.Send(ctx, copies[:2]))
+	require.NoError(t, sink.Send(ctx, copies[2:]))
+
+	assert.Equal(t, 1, count(t, sink, "SELECT COUNT(*) FROM messages"))
+	rows, err := sink.DB().Query("SELECT kind, address FROM recipients WHERE server = 'ksmg01' AND record_id = 10 ORDER BY address")
+	require.NoError(t, err)
+	defer rows.Close()
+	res := []string{}
+	for rows.Next() {
+		var kind, addr string
+		require.NoError(t, rows.Scan(&kind, &addr))
+		res = append(res, kind+":"+addr)
+	}
+	require.NoError(t, rows.Err())
+	assert.Equal(t, []string{"to:a@example.com", "to:b@example.com", "cc:c@example.com", "bcc:d@example.com"}, res)
+}
+
+func TestMigrate(t *testing.T) {
+	sink, teardown := prepSink(t)
+	defer teardown()
+
+	// second run is no-op
+	require.NoError(t, Migrate(context.Background(), sink.DB(), SQLite))
+	assert.Equal(t, len(migrations), count(t, sink, "SELECT MAX(version) FROM schema_migrations"))
+	assert.Equal(t, len(migrations), count(t, sink, "SELECT COUNT(*) FROM schema_migrations"))
+}
+
+func TestRebind(t *testing.T) {
+	assert.Equal(t, "a = $1 AND b = $2", rebind(Postgres, "a = ? AND b = ?"))
+	assert.Equal(t, "a = ? AND b = ?", rebind(SQLite, "a = ? AND b = ?"))
+	assert.Equal(t, Postgres, DialectOf("pgx"))
+	assert.Equal(t, SQLite, DialectOf("sqlite3"))
+	assert.Equal(t, SQLite, DialectOf("sqlite"))
+}
+
+func prepSink(t *testing.T) (sink *Sink, teardown func()) {
+	dir, err := ioutil.TempDir("", "ksmglog-sqldb")
+	require.NoError(t, err)
+
+	sink, err = NewSink(context.Background(), Opts{Driver: "sqlite", DSN: filepath.Join(dir, "ksmg.db")})
+	require.NoError(t, err)
+
+	return sink, func() {
+		assert.NoError(t, sink.Close())
+		assert.NoError(t, os.RemoveAll(dir))
+	}
+}
+
+func count(t *testing.T, sink *Sink, query string) int {
+	var res int
+	require.NoError(t, sink.DB().QueryRow(query).Scan(&res))
+	return res
+}
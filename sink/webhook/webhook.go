@@ -0,0 +1,291 @@
+// Package webhook implements ksmglog.Sink posting records rendered by text/template to http endpoint
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/zorion79/ksmglog"
+	"github.com/zorion79/ksmglog/sink/internal/retry"
+)
+
+// Sink posts every matched record, or all matched records of a batch, to URL
+type Sink struct {
+	Opts
+
+	client *http.Client
+	body   *template.Template
+	filter *template.Template
+
+	lock sync.Mutex // protects dead letter file
+}
+
+// Opts collects parameters to initialize Sink
+type Opts struct {
+	URL         string            `long:"url" env:"URL" description:"webhook url"`
+	Method      string            `long:"method" env:"METHOD" default:"POST" description:"http method"`
+	Headers     map[string]string `long:"header" env:"HEADERS" env-delim:"," description:"extra request headers"`
+	ContentType string            `long:"content-type" env:"CONTENT_TYPE" default:"application/json" description:"request content type"`
+	// Template renders request body, Record is passed for single requests and []Record in Batch mode, json of data if empty
+	Template string `long:"template" env:"TEMPLATE" description:"text/template of request body"`
+	// Filter is text/template executed with Record, record is sent only if it renders "true"
+	Filter             string        `long:"filter" env:"FILTER" description:"text/template filter expression like {{eq .Result \"Infected\"}}"`
+	Secret             string        `long:"secret" env:"SECRET" description:"HMAC-SHA256 signing secret"`
+	SignatureHeader    string        `long:"signature-header" env:"SIGNATURE_HEADER" default:"X-Signature-256" description:"header with body signature"`
+	Batch              bool          `long:"batch" env:"BATCH" description:"send all matched records of a batch in one request"`
+	MaxRetries         int           `long:"max-retries" env:"MAX_RETRIES" default:"3" description:"retries on network errors, 429 and 5xx responses, -1 disables"`
+	RetryDelay         time.Duration `long:"retry-delay" env:"RETRY_DELAY" default:"1s" description:"initial delay between retries, doubled on every retry"`
+	DeadLetter         string        `long:"dead-letter" env:"DEAD_LETTER" description:"file to append requests failed after all retries"`
+	Timeout            time.Duration `long:"timeout" env:"TIMEOUT" default:"5s" description:"http client timeout"`
+	InsecureSkipVerify bool          `long:"insecure" env:"INSECURE" description:"skip webhook certificate verification"`
+
+	// Logger gets messages of sink, they are discarded if not set
+	Logger ksmglog.Logger `no-flag:"true"`
+}
+
+// DeadLetter is a line of dead letter file
+type DeadLetter struct {
+	Time  time.Time `json:"time"`
+	URL   string    `json:"url"`
+	Body  string    `json:"body"`
+	Error string    `json:"error"`
+}
+
+const (
+	method          = "POST"
+	contentType     = "application/json"
+	signatureHeader = "X-Signature-256"
+	timeout         = 5 * time.Second
+	retryDelay      = time.Second
+	maxRetries      = 3
+)
+
+// funcs available in Template and Filter
+var funcs = template.FuncMap{
+	"json": func(v interface{}) (string, error) {
+		b, err := json.Marshal(v)
+		return string(b), err
+	},
+	"join":     strings.Join,
+	"lower":    strings.ToLower,
+	"upper":    strings.ToUpper,
+	"contains": strings.Contains,
+	"time": func(sec int, layout string) string {
+		return time.Unix(int64(sec), 0).Format(layout)
+	},
+}
+
+// NewSink makes sink with parsed templates
+func NewSink(opts Opts) (*Sink, error) {
+	res := &Sink{Opts: opts}
+	res.Logger = ksmglog.MaskedLogger(res.Logger)
+
+	if res.Method == "" {
+		res.Method = method
+	}
+	if res.ContentType == "" {
+		res.ContentType = contentType
+	}
+	if res.SignatureHeader == "" {
+		res.SignatureHeader = signatureHeader
+	}
+	if res.Timeout <= 0 {
+		res.Timeout = timeout
+	}
+	res.MaxRetries, res.RetryDelay = retry.Defaults(res.MaxRetries, res.RetryDelay, maxRetries, retryDelay)
+
+	body := res.Template
+	if body == "" {
+		body = "{{json .}}"
+	}
+	var err error
+	if res.body, err = template.New("body").Funcs(funcs).Parse(body); err != nil {
+		return nil, errors.Wrap(err, "could not parse template")
+	}
+	if res.Filter != "" {
+		if res.filter, err = template.New("filter").Funcs(funcs).Parse(res.Filter); err != nil {
+			return nil, errors.Wrap(err, "could not parse filter")
+		}
+	}
+
+	res.client = &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{
+				InsecureSkipVerify: res.InsecureSkipVerify, //nolint:gosec
+			},
+		},
+		Timeout: res.Timeout,
+	}
+
+	return res, nil
+}
+
+// Send posts matched records. Requests failed after retries are written to dead letter file and count as
+// delivered, so retry of the batch by caller doesn't post and dead letter them again. Without dead letter
+// error is returned, per record requests only if no record was posted, so delivered ones are not repeated.
+func (s *Sink) Send(ctx context.Context, records []ksmglog.Record) error {
+	matched := make([]ksmglog.Record, 0, len(records))
+	for _, r := range records {
+		ok, err := s.Match(r)
+		if err != nil {
+			return errors.Wrapf(err, "could not filter record %d", r.ID)
+		}
+		if ok {
+			matched = append(matched, r)
+		}
+	}
+	if len(matched) == 0 {
+		return nil
+	}
+
+	if s.Batch {
+		return s.post(ctx, matched)
+	}
+
+	failed := []int{}
+	var lastErr error
+	for _, r := range matched {
+		if err := s.post(ctx, r); err != nil {
+			failed = append(failed, r.ID)
+			lastErr = err
+		}
+	}
+	if len(failed) == len(matched) {
+		return errors.Wrapf(lastErr, "could not send %d records", len(matched))
+	}
+	if len(failed) > 0 {
+		// batch is not failed, otherwise records already posted would be sent again on retry
+		s.Logger.Log(ksmglog.LevelWarn, "could not send records", "records", failed, "batch", len(matched), "error", lastErr)
+	}
+	return nil
+}
+
+// Match checks if record passes filter
+func (s *Sink) Match(r ksmglog.Record) (bool, error) {
+	if s.filter == nil {
+		return true, nil
+	}
+	buf := &bytes.Buffer{}
+	if err := s.filter.Execute(buf, r); err != nil {
+		return false, err
+	}
+	return strings.TrimSpace(buf.String()) == "true", nil
+}
+
+// Sign returns signature header value of body
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	_, _ = mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// post renders data and sends it with retries, request failed after retries is written to dead letter
+// and not reported as error if dead letter is set
+func (s *Sink) post(ctx context.Context, data interface{}) error {
+	buf := &bytes.Buffer{}
+	if err := s.body.Execute(buf, data); err != nil {
+		return errors.Wrap(err, "could not render template")
+	}
+	body := buf.Bytes()
+
+	err := s.send(ctx, body)
+	if err == nil || s.DeadLetter == "" {
+		return err
+	}
+
+	if dlErr := s.deadLetter(body, err); dlErr != nil {
+		s.Logger.Log(ksmglog.LevelWarn, "could not write dead letter", "error", dlErr)
+		return err
+	}
+	s.Logger.Log(ksmglog.LevelWarn, "request failed, written to dead letter", "file", s.DeadLetter, "error", err)
+	return nil
+}
+
+func (s *Sink) send(ctx context.Context, body []byte) error {
+	delay := s.RetryDelay
+	for attempt := 0; ; attempt++ {
+		retryable, err := s.request(ctx, body)
+		if err == nil {
+			return nil
+		}
+		if !retryable || attempt >= s.MaxRetries {
+			return err
+		}
+
+		s.Logger.Log(ksmglog.LevelDebug, "webhook failed, retry", "attempt", attempt+1, "delay", delay, "error", err)
+		if err := retry.Sleep(ctx, delay); err != nil {
+			return err
+		}
+		delay *= 2
+	}
+}
+
+func (s *Sink) request(ctx context.Context, body []byte) (retryable bool, err error) {
+	req, err := http.NewRequest(s.Method, s.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, errors.Wrap(err, "could not make request")
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", s.ContentType)
+	for k, v := range s.Headers {
+		req.Header.Set(k, v)
+	}
+	if s.Secret != "" {
+		req.Header.Set(s.SignatureHeader, Sign(s.Secret, body))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, errors.Wrap(err, "could not request")
+	}
+	msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	if err = resp.Body.Close(); err != nil {
+		s.Logger.Log(ksmglog.LevelWarn, "could not close body", "error", err)
+	}
+
+	if resp.StatusCode/100 == 2 {
+		return false, nil
+	}
+	retryable = resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode/100 == 5
+	return retryable, errors.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(msg)))
+}
+
+// deadLetter appends failed request to DeadLetter file as json line
+func (s *Sink) deadLetter(body []byte, reqErr error) error {
+	if s.DeadLetter == "" {
+		return nil
+	}
+
+	line, err := json.Marshal(DeadLetter{Time: time.Now(), URL: s.URL, Body: string(body), Error: reqErr.Error()})
+	if err != nil {
+		return errors.Wrap(err, "could not marshal dead letter")
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	f, err := os.OpenFile(s.DeadLetter, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "could not open %s", s.DeadLetter)
+	}
+	if _, err = f.Write(append(line, '\n')); err != nil {
+		_ = f.Close()
+		return errors.Wrapf(err, "could not write %s", s.DeadLetter)
+	}
+	return f.Close()
+}
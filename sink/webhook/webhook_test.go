@@ -0,0 +1,155 @@
+package webhook
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/zorion79/ksmglog"
+)
+
+func TestSink_Send(t *testing.T) {
+	var lock sync.Mutex
+	bodies := []string{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.Equal(t, Sign("key", body), r.Header.Get("X-Signature-256"))
+		assert.Equal(t, "ksmg", r.Header.Get("X-Source"))
+		assert.Equal(t, "text/plain", r.Header.Get("Content-Type"))
+
+		lock.Lock()
+		bodies = append(bodies, string(body))
+		lock.Unlock()
+	}))
+	defer ts.Close()
+
+	sink, err := NewSink(Opts{
+		URL:         ts.URL,
+		Headers:     map[string]string{"X-Source": "ksmg"},
+		ContentType: "text/plain",
+		Template:    `{{.ID}} {{.Result}} from {{.Details.MessageInfo.From}} to {{join .Details.MessageInfo.To ","}}`,
+		Filter:      `{{ne .Result "Clean"}}`,
+		Secret:      "key",
+	})
+	require.NoError(t, err)
+
+	r1 := ksmglog.Record{ID: 1, Result: "Infected"}
+	r1.Details.MessageInfo.From = "a@example.com"
+	r1.Details.MessageInfo.To = []string{"b@example.com", "c@example.com"}
+	r2 := ksmglog.Record{ID: 2, Result: "Clean"}
+
+	require.NoError(t, sink.Send(context.Background(), []ksmglog.Record{r1, r2}))
+	assert.Equal(t, []string{"1 Infected from a@example.com to b@example.com,c@example.com"}, bodies)
+}
+
+func TestSink_SendBatch(t *testing.T) {
+	var records []ksmglog.Record
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&records))
+	}))
+	defer ts.Close()
+
+	sink, err := NewSink(Opts{URL: ts.URL, Batch: true})
+	require.NoError(t, err)
+	require.NoError(t, sink.Send(context.Background(), []ksmglog.Record{{ID: 1}, {ID: 2}}))
+	require.Equal(t, 2, len(records))
+	assert.Equal(t, 2, records[1].ID)
+}
+
+func TestSink_SendDeadLetter(t *testing.T) {
+	var calls int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer ts.Close()
+
+	dir, err := ioutil.TempDir("", "ksmglog-webhook")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	dl := filepath.Join(dir, "dead.ndjson")
+
+	sink, err := NewSink(Opts{URL: ts.URL, MaxRetries: 2, RetryDelay: time.Millisecond, DeadLetter: dl})
+	require.NoError(t, err)
+	assert.NoError(t, sink.Send(context.Background(), []ksmglog.Record{{ID: 7}}), "dead lettered request is not retried by caller")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+	data, err := ioutil.ReadFile(dl) //nolint:gosec
+	require.NoError(t, err)
+	letter := DeadLetter{}
+	require.NoError(t, json.Unmarshal(data, &letter))
+	assert.Equal(t, ts.URL, letter.URL)
+	assert.Contains(t, letter.Error, "502")
+	assert.Contains(t, letter.Body, `"id":7`)
+
+	batch, err := NewSink(Opts{URL: ts.URL, MaxRetries: -1, Batch: true, DeadLetter: dl})
+	require.NoError(t, err)
+	assert.NoError(t, batch.Send(context.Background(), []ksmglog.Record{{ID: 8}, {ID: 9}}))
+	data, err = ioutil.ReadFile(dl) //nolint:gosec
+	require.NoError(t, err)
+	assert.Equal(t, 2, strings.Count(string(data), "\n"), "every failed request dead lettered once")
+
+	// without dead letter caller gets error and retries
+	noDL, err := NewSink(Opts{URL: ts.URL, MaxRetries: -1, Batch: true})
+	require.NoError(t, err)
+	assert.Error(t, noDL.Send(context.Background(), []ksmglog.Record{{ID: 8}}))
+}
+
+func TestSink_SendPartial(t *testing.T) {
+	var lock sync.Mutex
+	bodies := []string{}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		require.NoError(t, err)
+		if string(body) == "2" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		lock.Lock()
+		bodies = append(bodies, string(body))
+		lock.Unlock()
+	}))
+	defer ts.Close()
+
+	var warned []interface{}
+	logger := ksmglog.LoggerFunc(func(level, msg string, keyvals ...interface{}) {
+		if level == ksmglog.LevelWarn {
+			warned = keyvals
+		}
+	})
+	sink, err := NewSink(Opts{URL: ts.URL, Template: "{{.ID}}", Logger: logger})
+	require.NoError(t, err)
+	require.NoError(t, sink.Send(context.Background(), []ksmglog.Record{{ID: 1}, {ID: 2}, {ID: 3}}),
+		"batch with posted records is not failed")
+	assert.Equal(t, []string{"1", "3"}, bodies)
+	require.True(t, len(warned) > 1, "failed records logged")
+	assert.Equal(t, []interface{}{"records", []int{2}}, warned[:2])
+
+	bodies = []string{}
+	assert.Error(t, sink.Send(context.Background(), []ksmglog.Record{{ID: 2}}), "nothing posted")
+}
+
+func TestNewSink_BadTemplate(t *testing.T) {
+	_, err := NewSink(Opts{Template: "{{.ID"})
+	assert.Error(t, err)
+	_, err = NewSink(Opts{Filter: "{{eq .Result}"})
+	assert.Error(t, err)
+}
+
+func TestSign(t *testing.T) {
+	assert.Equal(t, "sha256=f7bc83f430538424b13298e6aa6fb143ef4d59a14946175997479dbc2d1a3cd8",
+		Sign("key", []byte("The quick brown fox jumps over the lazy dog")))
+}
@@ -0,0 +1,69 @@
+package ksmglog
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsume(t *testing.T) {
+	var mu sync.Mutex
+	batches := [][]Record{}
+	sink := SinkFunc(func(ctx context.Context, records []Record) error {
+		mu.Lock()
+		defer mu.Unlock()
+		batches = append(batches, records)
+		return nil
+	})
+
+	ch := make(chan Record)
+	go func() {
+		for i := 1; i <= 5; i++ {
+			ch <- Record{ID: i}
+		}
+		close(ch)
+	}()
+
+	err := Consume(context.Background(), ch, sink, BatchOpts{Size: 2, FlushInterval: time.Minute})
+	assert.NoError(t, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 3, len(batches))
+	assert.Equal(t, 2, len(batches[0]))
+	assert.Equal(t, 1, len(batches[2]))
+	assert.Equal(t, 5, batches[2][0].ID)
+}
+
+func TestConsume_FlushInterval(t *testing.T) {
+	sent := make(chan []Record, 1)
+	sink := SinkFunc(func(ctx context.Context, records []Record) error {
+		sent <- records
+		return nil
+	})
+
+	ch := make(chan Record)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = Consume(ctx, ch, sink, BatchOpts{Size: 10, FlushInterval: 10 * time.Millisecond})
+	}()
+
+	ch <- Record{ID: 1}
+	select {
+	case records := <-sent:
+		assert.Equal(t, 1, len(records))
+	case <-time.After(time.Second):
+		t.Fatal("batch not flushed")
+	}
+}
+
+func TestConsume_ContextDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := Consume(ctx, make(chan Record), SinkFunc(func(context.Context, []Record) error { return nil }), BatchOpts{})
+	assert.Equal(t, context.Canceled, err)
+}
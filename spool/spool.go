@@ -0,0 +1,513 @@
+// Package spool implements durable on-disk queue of records between Service and sinks.
+// Records are appended to segment files as length and crc32c prefixed json entries,
+// consumer position is kept in cursor file, so records survive outages and restarts
+// and are delivered in order when destination recovers.
+package spool
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/zorion79/ksmglog"
+)
+
+// Spool is segmented append-only log of records, it is ksmglog.Sink appending records
+type Spool struct {
+	Opts
+
+	lock     sync.Mutex
+	segments []uint64 // existing segment sequences, ascending, last one is active
+	sizes    map[uint64]int64
+	active   *os.File
+	cursor   Position
+	notify   chan struct{}
+	closed   bool
+}
+
+// Opts collects parameters to initialize Spool
+type Opts struct {
+	Dir         string `long:"dir" env:"DIR" description:"spool directory"`
+	SegmentSize int64  `long:"segment-size" env:"SEGMENT_SIZE" default:"16777216" description:"max segment file size in bytes"`
+	MaxSize     int64  `long:"max-size" env:"MAX_SIZE" default:"1073741824" description:"max spool size in bytes, oldest segments evicted"`
+	NoSync      bool   `long:"no-sync" env:"NO_SYNC" description:"don't fsync appended records"`
+
+	// Logger gets messages of spool, they are discarded if not set
+	Logger ksmglog.Logger `no-flag:"true"`
+}
+
+// DrainOpts defines how Drain delivers records
+type DrainOpts struct {
+	BatchSize     int
+	RetryDelay    time.Duration // initial delay after failed send, doubled up to MaxRetryDelay
+	MaxRetryDelay time.Duration
+	PollInterval  time.Duration // check for new records if no append notification received
+}
+
+// Position addresses entry in spool
+type Position struct {
+	Seq    uint64 `json:"seq"`
+	Offset int64  `json:"offset"`
+}
+
+const (
+	segmentExt = ".seg"
+	cursorFile = "cursor"
+	headerSize = 8 // entry length and crc32c
+
+	segmentSize   = 16 * 1024 * 1024
+	maxSize       = 1024 * 1024 * 1024
+	batchSize     = 100
+	retryDelay    = time.Second
+	maxRetryDelay = time.Minute
+	pollInterval  = time.Second
+	maxEntrySize  = 64 * 1024 * 1024
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// New opens spool in Dir, repairs torn tail of the last segment left by crash
+func New(opts Opts) (*Spool, error) {
+	res := &Spool{Opts: opts, sizes: make(map[uint64]int64), notify: make(chan struct{}, 1)}
+	res.Logger = ksmglog.MaskedLogger(res.Logger)
+	if res.SegmentSize <= 0 {
+		res.SegmentSize = segmentSize
+	}
+	if res.MaxSize <= 0 {
+		res.MaxSize = maxSize
+	}
+
+	if err := os.MkdirAll(res.Dir, 0750); err != nil {
+		return nil, errors.Wrapf(err, "could not make spool dir %s", res.Dir)
+	}
+
+	files, err := filepath.Glob(filepath.Join(res.Dir, "*"+segmentExt))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not list segments")
+	}
+	for _, f := range files {
+		seq, err := strconv.ParseUint(strings.TrimSuffix(filepath.Base(f), segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+		fi, err := os.Stat(f)
+		if err != nil {
+			return nil, errors.Wrapf(err, "could not stat %s", f)
+		}
+		res.segments = append(res.segments, seq)
+		res.sizes[seq] = fi.Size()
+	}
+	sort.Slice(res.segments, func(i, j int) bool { return res.segments[i] < res.segments[j] })
+
+	if err = res.loadCursor(); err != nil {
+		return nil, err
+	}
+
+	if len(res.segments) == 0 {
+		if err = res.newSegment(1); err != nil {
+			return nil, err
+		}
+	} else if err = res.openActive(); err != nil {
+		return nil, err
+	}
+
+	if len(res.segments) > 0 && res.cursor.Seq < res.segments[0] {
+		res.cursor = Position{Seq: res.segments[0]}
+	}
+	return res, nil
+}
+
+// Send appends records, makes Spool usable with ksmglog.Consume
+func (s *Spool) Send(_ context.Context, records []ksmglog.Record) error {
+	return s.Append(records)
+}
+
+// Append writes records to active segment, rotates it if full and evicts oldest segments over MaxSize
+func (s *Spool) Append(records []ksmglog.Record) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	buf := make([]byte, 0, 4096)
+	for _, r := range records {
+		payload, err := json.Marshal(r)
+		if err != nil {
+			return errors.Wrapf(err, "could not marshal record %d", r.ID)
+		}
+		header := make([]byte, headerSize)
+		binary.BigEndian.PutUint32(header[:4], uint32(len(payload)))
+		binary.BigEndian.PutUint32(header[4:], crc32.Checksum(payload, crcTable))
+		buf = append(append(buf, header...), payload...)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return errors.New("spool closed")
+	}
+
+	seq := s.activeSeq()
+	if s.sizes[seq] > 0 && s.sizes[seq]+int64(len(buf)) > s.SegmentSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+		seq = s.activeSeq()
+	}
+
+	n, err := s.active.Write(buf)
+	s.sizes[seq] += int64(n)
+	if err != nil {
+		return errors.Wrap(err, "could not write segment")
+	}
+	if !s.NoSync {
+		if err = s.active.Sync(); err != nil {
+			return errors.Wrap(err, "could not sync segment")
+		}
+	}
+
+	s.evict()
+
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Read returns up to max records starting from cursor and position after them, cursor is not moved
+func (s *Spool) Read(max int) ([]ksmglog.Record, Position, error) {
+	s.lock.Lock()
+	pos := s.cursor
+	segments := append([]uint64{}, s.segments...)
+	activeSize := s.sizes[s.activeSeq()]
+	s.lock.Unlock()
+
+	res := []ksmglog.Record{}
+	for i := 0; i < len(segments) && len(res) < max; i++ {
+		seq := segments[i]
+		if seq < pos.Seq {
+			continue
+		}
+		if seq > pos.Seq {
+			pos = Position{Seq: seq}
+		}
+
+		limit := int64(-1) // read whole sealed segment
+		if i == len(segments)-1 {
+			limit = activeSize
+		}
+
+		recs, next, err := s.readSegment(pos, limit, max-len(res))
+		res = append(res, recs...)
+		pos = next
+		if err != nil {
+			if os.IsNotExist(errors.Cause(err)) {
+				continue // evicted meanwhile
+			}
+			if i == len(segments)-1 {
+				return res, pos, err
+			}
+			s.Logger.Log(ksmglog.LevelWarn, "skip rest of segment", "segment", seq, "error", err)
+			continue
+		}
+		if len(res) >= max {
+			break
+		}
+		if i < len(segments)-1 {
+			pos = Position{Seq: segments[i+1]}
+		}
+	}
+	return res, pos, nil
+}
+
+// Commit moves cursor to pos and removes fully consumed segments
+func (s *Spool) Commit(pos Position) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if pos.Seq < s.cursor.Seq || (pos.Seq == s.cursor.Seq && pos.Offset < s.cursor.Offset) {
+		return nil // cursor moved by eviction already
+	}
+	s.cursor = pos
+	if err := s.saveCursor(); err != nil {
+		return err
+	}
+
+	for len(s.segments) > 1 && s.segments[0] < s.cursor.Seq {
+		if err := s.removeSegment(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Pending returns bytes of not consumed records
+func (s *Spool) Pending() int64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var res int64
+	for _, seq := range s.segments {
+		switch {
+		case seq == s.cursor.Seq:
+			res += s.sizes[seq] - s.cursor.Offset
+		case seq > s.cursor.Seq:
+			res += s.sizes[seq]
+		}
+	}
+	return res
+}
+
+// Drain sends records to sink in order until ctx done, failed batch is retried with backoff
+// and cursor moved only after successful send
+func (s *Spool) Drain(ctx context.Context, sink ksmglog.Sink, opts DrainOpts) error {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = batchSize
+	}
+	if opts.RetryDelay <= 0 {
+		opts.RetryDelay = retryDelay
+	}
+	if opts.MaxRetryDelay <= 0 {
+		opts.MaxRetryDelay = maxRetryDelay
+	}
+	if opts.PollInterval <= 0 {
+		opts.PollInterval = pollInterval
+	}
+
+	delay := opts.RetryDelay
+	for {
+		records, next, err := s.Read(opts.BatchSize)
+		if err != nil {
+			s.Logger.Log(ksmglog.LevelWarn, "could not read spool", "error", err)
+		}
+
+		if len(records) == 0 {
+			if err == nil && next != s.Cursor() {
+				if err = s.Commit(next); err != nil {
+					return err
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-s.notify:
+			case <-time.After(opts.PollInterval):
+			}
+			continue
+		}
+
+		if err = sink.Send(ctx, records); err != nil {
+			s.Logger.Log(ksmglog.LevelWarn, "could not send spooled records, retry", "records", len(records), "delay", delay, "error", err)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(delay):
+			}
+			if delay *= 2; delay > opts.MaxRetryDelay {
+				delay = opts.MaxRetryDelay
+			}
+			continue
+		}
+
+		delay = opts.RetryDelay
+		if err = s.Commit(next); err != nil {
+			return err
+		}
+	}
+}
+
+// Cursor returns position of the next record to read
+func (s *Spool) Cursor() Position {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.cursor
+}
+
+// Close closes active segment
+func (s *Spool) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return errors.Wrap(s.active.Close(), "could not close segment")
+}
+
+func (s *Spool) activeSeq() uint64 {
+	return s.segments[len(s.segments)-1]
+}
+
+func (s *Spool) segmentPath(seq uint64) string {
+	return filepath.Join(s.Dir, fmt.Sprintf("%020d%s", seq, segmentExt))
+}
+
+func (s *Spool) newSegment(seq uint64) error {
+	f, err := os.OpenFile(s.segmentPath(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return errors.Wrapf(err, "could not create segment %d", seq)
+	}
+	s.active = f
+	s.segments = append(s.segments, seq)
+	s.sizes[seq] = 0
+	return nil
+}
+
+// openActive opens last segment for append, cutting entries broken by crash
+func (s *Spool) openActive() error {
+	seq := s.activeSeq()
+	_, valid, err := s.readSegment(Position{Seq: seq}, -1, -1)
+	if err != nil {
+		s.Logger.Log(ksmglog.LevelWarn, "segment has broken tail, truncated", "segment", seq, "size", valid.Offset, "error", err)
+		if err = os.Truncate(s.segmentPath(seq), valid.Offset); err != nil {
+			return errors.Wrapf(err, "could not truncate segment %d", seq)
+		}
+		s.sizes[seq] = valid.Offset
+	}
+
+	f, err := os.OpenFile(s.segmentPath(seq), os.O_WRONLY|os.O_APPEND, 0640)
+	if err != nil {
+		return errors.Wrapf(err, "could not open segment %d", seq)
+	}
+	s.active = f
+	return nil
+}
+
+func (s *Spool) rotate() error {
+	if err := s.active.Close(); err != nil {
+		return errors.Wrap(err, "could not close segment")
+	}
+	return s.newSegment(s.activeSeq() + 1)
+}
+
+// evict removes oldest segments while spool is over MaxSize, active segment is never removed
+func (s *Spool) evict() {
+	var total int64
+	for _, size := range s.sizes {
+		total += size
+	}
+
+	evicted := 0
+	for total > s.MaxSize && len(s.segments) > 1 {
+		seq := s.segments[0]
+		total -= s.sizes[seq]
+		if err := s.removeSegment(); err != nil {
+			s.Logger.Log(ksmglog.LevelWarn, "could not evict segment", "segment", seq, "error", err)
+			return
+		}
+		evicted++
+		if s.cursor.Seq <= seq {
+			s.cursor = Position{Seq: s.segments[0]}
+			if err := s.saveCursor(); err != nil {
+				s.Logger.Log(ksmglog.LevelWarn, "could not move cursor past evicted segment", "error", err)
+			}
+		}
+	}
+	if evicted > 0 {
+		s.Logger.Log(ksmglog.LevelWarn, "spool is over max size, oldest segments evicted", "max_size", s.MaxSize, "segments", evicted)
+	}
+}
+
+func (s *Spool) removeSegment() error {
+	seq := s.segments[0]
+	if err := os.Remove(s.segmentPath(seq)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrapf(err, "could not remove segment %d", seq)
+	}
+	s.segments = s.segments[1:]
+	delete(s.sizes, seq)
+	return nil
+}
+
+// readSegment reads up to max entries (all if max < 0) from pos until limit offset (segment end if limit < 0),
+// returns position after the last valid entry
+func (s *Spool) readSegment(pos Position, limit int64, max int) ([]ksmglog.Record, Position, error) {
+	f, err := os.Open(s.segmentPath(pos.Seq))
+	if err != nil {
+		return nil, pos, errors.Wrapf(err, "could not open segment %d", pos.Seq)
+	}
+	defer f.Close() //nolint:errcheck
+
+	if _, err = f.Seek(pos.Offset, io.SeekStart); err != nil {
+		return nil, pos, errors.Wrapf(err, "could not seek segment %d", pos.Seq)
+	}
+
+	res := []ksmglog.Record{}
+	r := bufio.NewReader(f)
+	header := make([]byte, headerSize)
+	for max < 0 || len(res) < max {
+		if limit >= 0 && pos.Offset >= limit {
+			break
+		}
+
+		if _, err = io.ReadFull(r, header); err == io.EOF {
+			break
+		}
+		if err != nil {
+			return res, pos, errors.Wrapf(err, "could not read entry header at %d", pos.Offset)
+		}
+
+		size := binary.BigEndian.Uint32(header[:4])
+		if size > maxEntrySize {
+			return res, pos, errors.Errorf("entry at %d has invalid size %d", pos.Offset, size)
+		}
+		payload := make([]byte, size)
+		if _, err = io.ReadFull(r, payload); err != nil {
+			return res, pos, errors.Wrapf(err, "could not read entry at %d", pos.Offset)
+		}
+		if crc32.Checksum(payload, crcTable) != binary.BigEndian.Uint32(header[4:]) {
+			return res, pos, errors.Errorf("entry at %d has invalid checksum", pos.Offset)
+		}
+
+		rec := ksmglog.Record{}
+		if err = json.Unmarshal(payload, &rec); err != nil {
+			return res, pos, errors.Wrapf(err, "could not unmarshal entry at %d", pos.Offset)
+		}
+		res = append(res, rec)
+		pos.Offset += int64(headerSize + len(payload))
+	}
+	return res, pos, nil
+}
+
+func (s *Spool) loadCursor() error {
+	data, err := ioutil.ReadFile(filepath.Join(s.Dir, cursorFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return errors.Wrap(err, "could not read cursor")
+	}
+	if err = json.Unmarshal(data, &s.cursor); err != nil {
+		s.Logger.Log(ksmglog.LevelWarn, "broken cursor file, start from the oldest record", "error", err)
+		s.cursor = Position{}
+	}
+	return nil
+}
+
+// saveCursor writes cursor to temporary file and renames it, so cursor is never half written
+func (s *Spool) saveCursor() error {
+	data, err := json.Marshal(s.cursor)
+	if err != nil {
+		return errors.Wrap(err, "could not marshal cursor")
+	}
+
+	tmp := filepath.Join(s.Dir, cursorFile+".tmp")
+	if err = ioutil.WriteFile(tmp, data, 0640); err != nil {
+		return errors.Wrap(err, "could not write cursor")
+	}
+	return errors.Wrap(os.Rename(tmp, filepath.Join(s.Dir, cursorFile)), "could not save cursor")
+}
@@ -0,0 +1,207 @@
+package spool
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/zorion79/ksmglog"
+)
+
+func TestSpool_AppendRead(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := New(Opts{Dir: dir, SegmentSize: 200})
+	require.NoError(t, err)
+	for i := 1; i <= 10; i++ {
+		require.NoError(t, s.Append([]ksmglog.Record{{ID: i, Server: "ksmg01"}}))
+	}
+	assert.True(t, len(segmentFiles(t, dir)) > 1, "small segments rotated")
+
+	records, next, err := s.Read(4)
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 2, 3, 4}, ids(records))
+	assert.Equal(t, "ksmg01", records[0].Server)
+
+	records, _, err = s.Read(4)
+	require.NoError(t, err)
+	assert.Equal(t, []int{1, 2, 3, 4}, ids(records), "read doesn't move cursor")
+
+	require.NoError(t, s.Commit(next))
+	records, next, err = s.Read(100)
+	require.NoError(t, err)
+	assert.Equal(t, []int{5, 6, 7, 8, 9, 10}, ids(records))
+
+	require.NoError(t, s.Commit(next))
+	assert.Equal(t, int64(0), s.Pending())
+	assert.Equal(t, 1, len(segmentFiles(t, dir)), "consumed segments removed")
+	require.NoError(t, s.Close())
+}
+
+func TestSpool_Restart(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := New(Opts{Dir: dir, SegmentSize: 200})
+	require.NoError(t, err)
+	require.NoError(t, s.Append([]ksmglog.Record{{ID: 1}, {ID: 2}, {ID: 3}}))
+	_, next, err := s.Read(1)
+	require.NoError(t, err)
+	require.NoError(t, s.Commit(next))
+	require.NoError(t, s.Close())
+
+	// torn write after crash
+	segs := segmentFiles(t, dir)
+	f, err := os.OpenFile(segs[len(segs)-1], os.O_WRONLY|os.O_APPEND, 0640)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 0, 0, 50, 1, 2})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	s, err = New(Opts{Dir: dir, SegmentSize: 200})
+	require.NoError(t, err)
+	require.NoError(t, s.Append([]ksmglog.Record{{ID: 4}}))
+	records, _, err := s.Read(100)
+	require.NoError(t, err)
+	assert.Equal(t, []int{2, 3, 4}, ids(records))
+	require.NoError(t, s.Close())
+}
+
+func TestSpool_Corrupted(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := New(Opts{Dir: dir, SegmentSize: 100})
+	require.NoError(t, err)
+	for i := 1; i <= 4; i++ {
+		require.NoError(t, s.Append([]ksmglog.Record{{ID: i}}))
+	}
+
+	// flip payload byte of the first sealed segment
+	segs := segmentFiles(t, dir)
+	require.True(t, len(segs) > 1)
+	data, err := ioutil.ReadFile(segs[0])
+	require.NoError(t, err)
+	data[headerSize+1] ^= 0xff
+	require.NoError(t, ioutil.WriteFile(segs[0], data, 0640))
+
+	records, _, err := s.Read(100)
+	require.NoError(t, err)
+	assert.NotContains(t, ids(records), 1)
+	assert.Contains(t, ids(records), 4)
+	require.NoError(t, s.Close())
+}
+
+func TestSpool_Evict(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	evicted := 0
+	logger := ksmglog.LoggerFunc(func(_, msg string, _ ...interface{}) {
+		if strings.Contains(msg, "evicted") {
+			evicted++
+		}
+	})
+	s, err := New(Opts{Dir: dir, SegmentSize: 1000, MaxSize: 3000, Logger: logger})
+	require.NoError(t, err)
+	for i := 1; i <= 20; i++ {
+		require.NoError(t, s.Append([]ksmglog.Record{{ID: i}}))
+	}
+
+	var total int64
+	for _, f := range segmentFiles(t, dir) {
+		fi, err := os.Stat(f)
+		require.NoError(t, err)
+		total += fi.Size()
+	}
+	assert.True(t, total <= 3000, "spool size %d limited", total)
+
+	records, _, err := s.Read(100)
+	require.NoError(t, err)
+	require.True(t, len(records) > 0)
+	assert.NotEqual(t, 1, records[0].ID, "oldest records evicted")
+	assert.Equal(t, 20, records[len(records)-1].ID)
+	assert.True(t, evicted > 0, "eviction logged")
+	require.NoError(t, s.Close())
+}
+
+func TestSpool_Drain(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	s, err := New(Opts{Dir: dir, SegmentSize: 200, NoSync: true})
+	require.NoError(t, err)
+	defer s.Close() //nolint:errcheck
+
+	var lock sync.Mutex
+	received, fails := []int{}, 2
+	sink := ksmglog.SinkFunc(func(_ context.Context, records []ksmglog.Record) error {
+		lock.Lock()
+		defer lock.Unlock()
+		if fails > 0 {
+			fails--
+			return errors.New("sink is down")
+		}
+		received = append(received, ids(records)...)
+		return nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error)
+	go func() {
+		done <- s.Drain(ctx, sink, DrainOpts{BatchSize: 3, RetryDelay: time.Millisecond, PollInterval: 10 * time.Millisecond})
+	}()
+
+	ch := make(chan ksmglog.Record)
+	go func() {
+		for i := 1; i <= 10; i++ {
+			ch <- ksmglog.Record{ID: i}
+		}
+	}()
+	go ksmglog.Consume(ctx, ch, s, ksmglog.BatchOpts{Size: 2, FlushInterval: 10 * time.Millisecond}) //nolint:errcheck
+
+	assert.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(received) == 10
+	}, 4*time.Second, 10*time.Millisecond)
+
+	lock.Lock()
+	assert.Equal(t, []int{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}, received, "delivered in order after failures")
+	lock.Unlock()
+	assert.Eventually(t, func() bool { return s.Pending() == 0 }, time.Second, 10*time.Millisecond)
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "ksmglog-spool")
+	require.NoError(t, err)
+	return dir
+}
+
+func segmentFiles(t *testing.T, dir string) []string {
+	res, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	require.NoError(t, err)
+	return res
+}
+
+func ids(records []ksmglog.Record) []int {
+	res := []int{}
+	for _, r := range records {
+		res = append(res, r.ID)
+	}
+	return res
+}